@@ -2,41 +2,37 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"strings"
 
+	"github.com/bonovoxly/mark/pkg/confluence"
 	"github.com/reconquest/karma-go"
 )
 
 type Credentials struct {
-	Username string
-	Password string
-	BaseURL  string
-	PageID   string
+	Username   string
+	Password   string
+	BaseURL    string
+	PageIDs    []string
+	AuthMethod string
 }
 
 func GetCredentials(
 	flags Flags,
 	config *Config,
 ) (*Credentials, error) {
-	var err error
-
 	var (
-		username  = flags.Username
-		password  = flags.Password
-		targetURL = flags.TargetURL
+		username   = flags.Username
+		password   = flags.Password
+		targetURL  = flags.TargetURL
+		authMethod = flags.AuthMethod
 	)
 
 	if username == "" {
 		username = config.Username
-		if username == "" {
-			return nil, errors.New(
-				"Confluence username should be specified using -u " +
-					"flag or be stored in configuration file",
-			)
-		}
 	}
 
 	if password == "" {
@@ -49,7 +45,47 @@ func GetCredentials(
 		}
 	}
 
+	if authMethod == "" {
+		authMethod = config.AuthMethod
+	}
+
+	// token without username can be used only as bearer token
+	if authMethod == "" {
+		if username == "" {
+			authMethod = confluence.AuthMethodBearer
+		} else {
+			authMethod = confluence.AuthMethodBasic
+		}
+	}
+
+	switch authMethod {
+	case confluence.AuthMethodBasic:
+		if username == "" {
+			return nil, errors.New(
+				"Confluence username should be specified using -u " +
+					"flag or be stored in configuration file",
+			)
+		}
+
+	case confluence.AuthMethodBearer:
+		username = ""
+
+	default:
+		return nil, fmt.Errorf(
+			"unknown auth method %q, expected %s or %s",
+			authMethod,
+			confluence.AuthMethodBasic,
+			confluence.AuthMethodBearer,
+		)
+	}
+
 	if password == "-" {
+		if flags.NonInteractive && isTerminal(os.Stdin) {
+			return nil, errors.New(
+				"password can't be read from terminal in non-interactive mode",
+			)
+		}
+
 		stdin, err := ioutil.ReadAll(os.Stdin)
 		if err != nil {
 			return nil, karma.Format(
@@ -61,17 +97,47 @@ func GetCredentials(
 		password = string(stdin)
 	}
 
-	url, err := url.Parse(targetURL)
-	if err != nil {
-		return nil, karma.Format(
-			err,
-			"unable to parse %q as url", targetURL,
-		)
-	}
+	var (
+		baseURL string
+		pageIDs []string
+	)
 
-	baseURL := url.Scheme + "://" + url.Host
+	// several target URLs can be specified separated by comma, all of them
+	// should point to the same Confluence instance
+	for _, targetURL := range strings.Split(targetURL, ",") {
+		targetURL = strings.TrimSpace(targetURL)
+		if targetURL == "" {
+			continue
+		}
 
-	if url.Host == "" {
+		url, err := url.Parse(targetURL)
+		if err != nil {
+			return nil, karma.Format(
+				err,
+				"unable to parse %q as url", targetURL,
+			)
+		}
+
+		if url.Host != "" {
+			targetBaseURL := url.Scheme + "://" + url.Host
+			if baseURL != "" && baseURL != targetBaseURL {
+				return nil, fmt.Errorf(
+					"all URLs specified using -l flag should point to "+
+						"the same Confluence, but %q and %q are found",
+					baseURL,
+					targetBaseURL,
+				)
+			}
+
+			baseURL = targetBaseURL
+		}
+
+		if pageID := url.Query().Get("pageId"); pageID != "" {
+			pageIDs = append(pageIDs, pageID)
+		}
+	}
+
+	if baseURL == "" {
 		baseURL = flags.BaseURL
 		if baseURL == "" {
 			baseURL = config.BaseURL
@@ -87,13 +153,27 @@ func GetCredentials(
 
 	baseURL = strings.TrimRight(baseURL, `/`)
 
-	pageID := url.Query().Get("pageId")
+	if flags.PageID != "" {
+		if len(pageIDs) > 0 {
+			return nil, errors.New(
+				"page should be specified either using --page-id flag " +
+					"or using pageId GET-parameter of -l URL, not both",
+			)
+		}
+
+		for _, pageID := range strings.Split(flags.PageID, ",") {
+			if pageID = strings.TrimSpace(pageID); pageID != "" {
+				pageIDs = append(pageIDs, pageID)
+			}
+		}
+	}
 
 	creds := &Credentials{
-		Username: username,
-		Password: password,
-		BaseURL:  baseURL,
-		PageID:   pageID,
+		Username:   username,
+		Password:   password,
+		BaseURL:    baseURL,
+		PageIDs:    pageIDs,
+		AuthMethod: authMethod,
 	}
 
 	return creds, nil
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/reconquest/karma-go"
+)
+
+// FilterChanged returns files which are changed since given git ref and/or
+// modified after given time, along with files which are not. Empty ref and
+// zero time disable corresponding filter.
+func FilterChanged(
+	files []string,
+	ref string,
+	since time.Time,
+) ([]string, []string, error) {
+	var changed map[string]bool
+
+	if ref != "" {
+		var err error
+
+		changed, err = getGitChanges(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var matched, skipped []string
+
+	for _, file := range files {
+		if changed != nil && !changed[filepath.Clean(file)] {
+			skipped = append(skipped, file)
+
+			continue
+		}
+
+		if !since.IsZero() {
+			info, err := os.Stat(file)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if !info.ModTime().After(since) {
+				skipped = append(skipped, file)
+
+				continue
+			}
+		}
+
+		matched = append(matched, file)
+	}
+
+	return matched, skipped, nil
+}
+
+// getGitChanges returns files changed in working tree since given ref,
+// including untracked ones. Paths are relative to the current directory.
+func getGitChanges(ref string) (map[string]bool, error) {
+	changed := map[string]bool{}
+
+	for _, args := range [][]string{
+		{"diff", "--name-only", "--relative", ref, "--"},
+		{"ls-files", "--others", "--exclude-standard"},
+	} {
+		var stderr bytes.Buffer
+
+		cmd := exec.Command("git", args...)
+		cmd.Stderr = &stderr
+
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, karma.
+				Describe("stderr", strings.TrimSpace(stderr.String())).
+				Format(
+					err,
+					"unable to list files changed since %q: git %s",
+					ref,
+					strings.Join(args, " "),
+				)
+		}
+
+		for _, line := range strings.Split(string(output), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				changed[filepath.Clean(line)] = true
+			}
+		}
+	}
+
+	return changed, nil
+}
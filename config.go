@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/kovetskiy/ko"
 )
@@ -10,6 +13,95 @@ type Config struct {
 	Username string `env:"MARK_USERNAME" toml:"username"`
 	Password string `env:"MARK_PASSWORD" toml:"password"`
 	BaseURL  string `env:"MARK_BASE_URL" toml:"base_url"`
+
+	AuthMethod string `env:"MARK_AUTH_METHOD" toml:"auth_method"`
+
+	ProxyURL      string `env:"MARK_PROXY_URL" toml:"proxy_url"`
+	ProxyUsername string `env:"MARK_PROXY_USERNAME" toml:"proxy_username"`
+	ProxyPassword string `env:"MARK_PROXY_PASSWORD" toml:"proxy_password"`
+
+	CACert string `env:"MARK_CA_CERT" toml:"ca_cert"`
+
+	CompressRequests bool `env:"MARK_COMPRESS_REQUESTS" toml:"compress_requests"`
+
+	UserAgent       string `env:"MARK_USER_AGENT" toml:"user_agent"`
+	RequestIDPrefix string `env:"MARK_REQUEST_ID_PREFIX" toml:"request_id_prefix"`
+
+	Math string `env:"MARK_MATH" toml:"math"`
+
+	MathImageURL string `env:"MARK_MATH_IMAGE_URL" toml:"math_image_url"`
+
+	Layout string `env:"MARK_LAYOUT" toml:"layout"`
+
+	UserScheme string `env:"MARK_USER_SCHEME" toml:"user_scheme"`
+
+	TemplatesDir string `env:"MARK_TEMPLATES_DIR" toml:"templates_dir"`
+
+	IndexFiles string `env:"MARK_INDEX_FILES" toml:"index_files"`
+
+	Profiles map[string]Profile `toml:"profiles"`
+}
+
+// Profile contains settings of Confluence instance which override top-level
+// settings of the config when the profile is selected.
+type Profile struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	BaseURL  string `toml:"base_url"`
+
+	AuthMethod string `toml:"auth_method"`
+
+	ProxyURL      string `toml:"proxy_url"`
+	ProxyUsername string `toml:"proxy_username"`
+	ProxyPassword string `toml:"proxy_password"`
+
+	CACert string `toml:"ca_cert"`
+}
+
+// UseProfile overrides settings of the config with non-empty settings of the
+// profile with given name. Top-level credentials are dropped if the profile
+// points to another Confluence instance, so they are never sent to it.
+func (config *Config) UseProfile(name string) error {
+	profile, ok := config.Profiles[name]
+	if !ok {
+		names := []string{}
+		for name := range config.Profiles {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		return fmt.Errorf(
+			"profile %q is not found in config, available profiles: %s",
+			name,
+			strings.Join(names, ", "),
+		)
+	}
+
+	if profile.BaseURL != "" && profile.BaseURL != config.BaseURL {
+		config.Username = ""
+		config.Password = ""
+	}
+
+	for _, field := range []struct {
+		target *string
+		value  string
+	}{
+		{&config.Username, profile.Username},
+		{&config.Password, profile.Password},
+		{&config.BaseURL, profile.BaseURL},
+		{&config.AuthMethod, profile.AuthMethod},
+		{&config.ProxyURL, profile.ProxyURL},
+		{&config.ProxyUsername, profile.ProxyUsername},
+		{&config.ProxyPassword, profile.ProxyPassword},
+		{&config.CACert, profile.CACert},
+	} {
+		if field.value != "" {
+			*field.target = field.value
+		}
+	}
+
+	return nil
 }
 
 func LoadConfig(path string) (*Config, error) {
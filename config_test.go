@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUseProfile(t *testing.T) {
+	test := assert.New(t)
+
+	config := &Config{
+		Username: "smith",
+		Password: "matrixishere",
+		BaseURL:  "http://confluence.local",
+		Profiles: map[string]Profile{
+			"cloud": {BaseURL: "https://example.atlassian.net/wiki"},
+			"proxy": {ProxyURL: "http://proxy.local"},
+		},
+	}
+
+	test.NoError(config.UseProfile("proxy"))
+	test.Equal("smith", config.Username)
+	test.Equal("matrixishere", config.Password)
+	test.Equal("http://proxy.local", config.ProxyURL)
+
+	// credentials of the top-level instance are not sent to another one
+	test.NoError(config.UseProfile("cloud"))
+	test.Equal("https://example.atlassian.net/wiki", config.BaseURL)
+	test.Equal("", config.Username)
+	test.Equal("", config.Password)
+
+	test.Error(config.UseProfile("unknown"))
+}
+
+func TestUseProfileCredentials(t *testing.T) {
+	test := assert.New(t)
+
+	config := &Config{
+		Username: "smith",
+		Password: "matrixishere",
+		BaseURL:  "http://confluence.local",
+		Profiles: map[string]Profile{
+			"cloud": {
+				BaseURL:  "https://example.atlassian.net/wiki",
+				Username: "smith@example.com",
+				Password: "cloudtoken",
+			},
+		},
+	}
+
+	test.NoError(config.UseProfile("cloud"))
+	test.Equal("smith@example.com", config.Username)
+	test.Equal("cloudtoken", config.Password)
+}
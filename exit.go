@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/bonovoxly/mark/pkg/mark"
+	"github.com/kovetskiy/lorg"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+)
+
+// Exit codes which allow scripts to distinguish classes of errors, e.g.
+// retry on network errors only.
+const (
+	ExitGeneric  = 1
+	ExitAuth     = 2
+	ExitNotFound = 3
+	ExitNetwork  = 4
+	ExitDiff     = 5
+	ExitWarnings = 6
+)
+
+// warnings is a number of warnings logged during the run, see
+// --fail-on-warning.
+var warnings int64
+
+// countWarnings makes logger count every logged warning, warnings are logged
+// from concurrent uploads as well.
+func countWarnings() {
+	log.GetLogger().SetSender(
+		func(level lorg.Level, _ karma.Hierarchical) error {
+			if level == lorg.LevelWarning {
+				atomic.AddInt64(&warnings, 1)
+			}
+
+			return nil
+		},
+	)
+}
+
+// exit exits with given code, successful run is turned into failure if any
+// warnings have been logged and --fail-on-warning is specified.
+func exit(flags Flags, code int) {
+	count := atomic.LoadInt64(&warnings)
+
+	if code == 0 && flags.FailOnWarning && count > 0 {
+		log.Errorf(
+			nil,
+			"%d warnings logged, failing due to --fail-on-warning",
+			count,
+		)
+
+		code = ExitWarnings
+	}
+
+	os.Exit(code)
+}
+
+// exitCode returns exit code corresponding to class of the error.
+func exitCode(err error) int {
+	switch {
+	case confluence.IsAuthError(err):
+		return ExitAuth
+	case mark.IsResolveError(err):
+		return ExitNotFound
+	case confluence.IsNetworkError(err):
+		return ExitNetwork
+	default:
+		return ExitGeneric
+	}
+}
+
+// fatal logs error and exits with code corresponding to class of the error.
+func fatal(err error) {
+	log.Error(err)
+	os.Exit(exitCode(err))
+}
+
+// fatalf logs error with message and exits with code corresponding to class
+// of the error.
+func fatalf(err error, format string, args ...interface{}) {
+	log.Errorf(err, format, args...)
+	os.Exit(exitCode(err))
+}
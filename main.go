@@ -1,37 +1,104 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/docopt/docopt-go"
 	"github.com/kovetskiy/lorg"
 	"github.com/bonovoxly/mark/pkg/confluence"
 	"github.com/bonovoxly/mark/pkg/mark"
-	"github.com/bonovoxly/mark/pkg/mark/includes"
-	"github.com/bonovoxly/mark/pkg/mark/macro"
 	"github.com/bonovoxly/mark/pkg/mark/stdlib"
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
 )
 
 type Flags struct {
-	FileGlobPatten string `docopt:"-f"`
-	CompileOnly    bool   `docopt:"--compile-only"`
-	DryRun         bool   `docopt:"--dry-run"`
-	EditLock       bool   `docopt:"-k"`
-	DropH1         bool   `docopt:"--drop-h1"`
-	MinorEdit      bool   `docopt:"--minor-edit"`
-	Color          string `docopt:"--color"`
-	Debug          bool   `docopt:"--debug"`
-	Trace          bool   `docopt:"--trace"`
-	Username       string `docopt:"-u"`
-	Password       string `docopt:"-p"`
-	TargetURL      string `docopt:"-l"`
-	BaseURL        string `docopt:"--base-url"`
+	Files          []string `docopt:"-f"`
+	ChangedSince   string   `docopt:"--changed-since"`
+	ModifiedSince  string   `docopt:"--modified-since"`
+	CompileOnly    bool     `docopt:"--compile-only"`
+	Format         string   `docopt:"--format"`
+	Serve          bool     `docopt:"--serve"`
+	Listen         string   `docopt:"--listen"`
+	DumpMeta       bool     `docopt:"--dump-meta"`
+	DryRun         bool     `docopt:"--dry-run"`
+	Validate       bool     `docopt:"--validate"`
+	Diff           bool     `docopt:"--diff"`
+	EditLock       bool     `docopt:"-k"`
+	PruneAttach    bool     `docopt:"--prune-attachments"`
+	AttachJobs     string   `docopt:"--attachment-jobs"`
+	SizeWarning    string   `docopt:"--size-warning"`
+	DropH1         bool     `docopt:"--drop-h1"`
+	StripHeading   string   `docopt:"--strip-leading-heading"`
+	DemoteHeading  string   `docopt:"--demote-leading-heading"`
+	TitleFromH1    bool     `docopt:"--title-from-h1"`
+	H1Title        string   `docopt:"--h1-title"`
+	HeadingAnchors string   `docopt:"--heading-anchors"`
+	Math           string   `docopt:"--math"`
+	MathImageURL   string   `docopt:"--math-image-url"`
+	DetectLanguage bool     `docopt:"--detect-language"`
+	HTML           string   `docopt:"--html"`
+	SoftBreaks     string   `docopt:"--soft-breaks"`
+	RawStorage     bool     `docopt:"--raw-storage"`
+	CollapseCode   bool     `docopt:"--collapse-code"`
+	EnvSubst       bool     `docopt:"--env-subst"`
+	StrictMacros   bool     `docopt:"--strict-macros"`
+	TemplatesDir   string   `docopt:"--templates-dir"`
+	BaseDir        string   `docopt:"--base-dir"`
+	IndexFiles     string   `docopt:"--index-files"`
+	MirrorTree     string   `docopt:"--mirror-tree"`
+	Space          string   `docopt:"--space"`
+	Title          string   `docopt:"--title"`
+	OnMultiple     string   `docopt:"--on-multiple"`
+	MinorEdit      bool     `docopt:"--minor-edit"`
+	Delete         bool     `docopt:"--delete"`
+	Force          bool     `docopt:"--force"`
+	NoSkip         bool     `docopt:"--no-skip"`
+	AssumeYes      bool     `docopt:"--assume-yes"`
+	NonInteractive bool     `docopt:"--non-interactive"`
+	NoOverwrite    bool     `docopt:"--no-overwrite"`
+	OverwriteNewer bool     `docopt:"--overwrite-newer"`
+	LabelsOnly     bool     `docopt:"--labels-only"`
+	EmbedSource    bool     `docopt:"--embed-source"`
+	CopyFrom       string   `docopt:"--copy-from"`
+	ExtractSource  bool     `docopt:"--extract-source"`
+	Message        string   `docopt:"--message"`
+	Editor         string   `docopt:"--editor"`
+	Layout         string   `docopt:"--layout"`
+	UserScheme     string   `docopt:"--user-scheme"`
+	Labels         []string `docopt:"--label"`
+	RemoveLabels   []string `docopt:"--remove-label"`
+	Profile        string   `docopt:"--profile"`
+	Report         string   `docopt:"--report"`
+	Color          string   `docopt:"--color"`
+	NoColor        bool     `docopt:"--no-color"`
+	Debug          bool     `docopt:"--debug"`
+	Trace          bool     `docopt:"--trace"`
+	VersionCheck   bool     `docopt:"--version-check"`
+	FailOnWarning  bool     `docopt:"--fail-on-warning"`
+	Username       string   `docopt:"-u"`
+	Password       string   `docopt:"-p"`
+	AuthMethod     string   `docopt:"--auth-method"`
+	TargetURL      string   `docopt:"-l"`
+	PageID         string   `docopt:"--page-id"`
+	BaseURL        string   `docopt:"--base-url"`
+	Proxy          string   `docopt:"--proxy"`
+	Insecure       bool     `docopt:"--insecure"`
+	CACert         string   `docopt:"--ca-cert"`
+	Timeout        string   `docopt:"--timeout"`
+	RateLimit      string   `docopt:"--rate-limit"`
 }
 
 const (
@@ -41,8 +108,11 @@ const (
 Docs: https://github.com/bonovoxly/mark
 
 Usage:
-  mark [options] [-u <username>] [-p <token>] [-k] [-l <url>] -f <file>
-  mark [options] [-u <username>] [-p <password>] [-k] [-b <url>] -f <file>
+  mark [options] [-u <username>] [-p <token>] [-k] [-l <url>] [--label <name>]... [--remove-label <name>]... (-f <file>)...
+  mark [options] [-u <username>] [-p <password>] [-k] [-b <url>] [--label <name>]... [--remove-label <name>]... (-f <file>)...
+  mark [options] [-u <username>] [-p <password>] [-b <url>] --page-id <id> [--label <name>]... [--remove-label <name>]... (-f <file>)...
+  mark [options] [-u <username>] [-p <password>] --delete (-l <url> | -b <url> --page-id <id>)
+  mark [options] [-u <username>] [-p <password>] --extract-source (-l <url> | -b <url> --page-id <id>)
   mark -v | --version
   mark -h | --help
 
@@ -50,24 +120,196 @@ Options:
   -u <username>        Use specified username for updating Confluence page.
   -p <token>           Use specified token for updating Confluence page.
                         Specify - as password to read password from stdin.
+  --auth-method <method>  Use specified authentication method: basic, bearer.
+                        If not specified, bearer is used when username is
+                        not set. Alternative option for auth_method config
+                        field.
   -l <url>             Edit specified Confluence page.
                         If -l is not specified, file should contain metadata (see
-                        above).
+                        above). Multiple URLs can be separated by comma.
+  --page-id <id>       Edit Confluence page with specified id. Alternative
+                        option for -l with pageId GET-parameter. Multiple ids
+                        can be separated by comma.
   -b --base-url <url>  Base URL for Confluence.
                         Alternative option for base_url config field.
+  --proxy <url>        Use specified proxy for connecting to Confluence.
+                        Alternative option for proxy_url config field.
+  --insecure           Skip TLS certificate verification.
+  --ca-cert <path>     Trust CA certificates from specified PEM file(s),
+                        multiple files can be separated by comma.
+                        Alternative option for ca_cert config field.
+  --timeout <duration> Abort if Confluence API calls aren't complete within
+                        specified duration, e.g. 30s or 5m.
+  --rate-limit <rps>   Send no more than specified number of requests per
+                        second to Confluence, requests over the limit are
+                        delayed. Specify 0 to disable the limit. Defaults to
+                        10 on Confluence Cloud and no limit otherwise.
   -f <file>            Use specified markdown file(s) for converting to html. Supports file globbing patterns (needs to be quoted).
+                        Can be specified several times, every matched file
+                        is processed once.
+                        Specify - to read markdown from stdin, relative
+                        paths are resolved against --base-dir or current
+                        directory then.
+  --changed-since <ref>  Process only files matched by -f which are changed
+                        since specified git ref, e.g. origin/master.
+  --modified-since <time>  Process only files matched by -f which are
+                        modified after specified time in RFC3339 format.
   -k                   Lock page editing to current user only to prevent accidental
                         manual edits over Confluence Web UI.
+  --prune-attachments  Delete attachments uploaded by mark which are not
+                        referenced by the file anymore.
+  --attachment-jobs <n>  Number of attachments uploaded concurrently.
+                        [default: 4]
+  --size-warning <bytes>  Warn if storage format of page is larger than
+                        specified size, Confluence rejects pages larger than
+                        5242880 bytes by default. [default: 4194304]
   --drop-h1            Don't include H1 headings in Confluence output.
+                        Shorthand for --strip-leading-heading 1.
+  --strip-leading-heading <level>  Don't include heading of specified level
+                        (1-6) in Confluence output if document starts with it.
+  --demote-leading-heading <level>  Demote heading of specified level (1-6)
+                        by one level if document starts with it, e.g. H1
+                        becomes H2.
+  --math <strategy>    Render $...$ and $$...$$ math using specified strategy:
+                        macro, image. Alternative option for math config field.
+  --math-image-url <url>  URL of service rendering math into images, formula
+                        is appended to it, e.g.
+                        https://latex.codecogs.com/png.latex? Required by
+                        --math image. Alternative option for math_image_url
+                        config field.
+  --base-dir <dir>     Resolve relative links and attachments against
+                        specified directory instead of directory of the file.
+  --templates-dir <dir>  Load custom templates and macros from specified
+                        directory. Alternative option for templates_dir
+                        config field.
+  --index-files <names>  Comma-separated names of files which links to
+                        directories are resolved to, the first existing one
+                        is used, README.md,index.md by default. Alternative
+                        option for index_files config field.
+  --space <key>        Space of the page for files without metadata, page is
+                        updated if it exists or created otherwise. Title of
+                        the page is specified by --title.
+  --title <title>      Title of the page for files without metadata, space
+                        of the page is specified by --space.
+  --on-multiple <strategy>  Action to take when several pages with specified
+                        space and title are found: error, newest.
+                        [default: error]
+  --mirror-tree <dir>  Publish pages as a tree mirroring structure of
+                        specified directory: every subdirectory becomes a
+                        parent page named after its index file, parents
+                        specified in metadata are ignored.
+  --detect-language    Guess language of code blocks which don't specify it.
+  --html <policy>      Action to take on raw HTML tags which are not valid in
+                        Confluence storage format: warn, strip, keep.
+                        [default: warn]
+  --soft-breaks <mode>  Render line breaks inside of paragraphs as is (keep),
+                        as spaces like GitHub does for files (space) or as
+                        <br /> like GitHub comments (break). [default: keep]
+  --collapse-code      Collapse code blocks which don't specify it, unless
+                        CollapseCode metadata field is set to false.
+  --raw-storage        Pass contents of code blocks with confluence language
+                        through as raw Confluence storage format.
+  --env-subst          Replace ${VAR} and ${VAR:-default} placeholders outside
+                        of code blocks with environment variables, use $$
+                        for literal $.
+  --strict-macros      Fail if file contains directives which look like macros
+                        but aren't recognized, e.g. due to a typo.
+  --title-from-h1      Use leading H1 heading as page title if metadata
+                        doesn't specify it.
+  --h1-title <mode>    Action to take when heading dropped by --drop-h1 or by
+                        the --strip-leading-heading differs from page title:
+                        warn, error, ignore.
+                        [default: warn]
+  --heading-anchors <style>  Emit anchor macro for every heading using
+                        specified naming style: github, confluence, ascii.
+                        HeadingAnchors metadata field takes precedence.
   --dry-run            Resolve page and ancestry, show resulting HTML and exit.
+                        All include, macro and template errors are reported
+                        at once, exit code is non-zero if there are any.
+  --validate           Check that relative links and attachments of the file
+                        can be resolved without updating Confluence page,
+                        exit with non-zero code if they can't.
+  --diff               Show word-level diff between live page and resulting
+                        HTML without updating Confluence page, exit with
+                        code 5 if they differ.
   --compile-only       Show resulting HTML and don't update Confluence page content.
+  --format <format>    Representation of HTML shown by --compile-only or by
+                        the --dry-run: storage, view. View representation is
+                        converted by Confluence.
+                        [default: storage]
+  --serve              Serve preview of resulting HTML over HTTP, page is
+                        reloaded when file is changed. Confluence is not
+                        accessed.
+  --listen <address>   Address to serve preview at. [default: localhost:8080]
+  --dump-meta          Show parsed metadata as JSON and exit.
   --minor-edit         Don't send notifications while updating Confluence page.
+  --message <text>     Use specified text as a version message for the update.
+  --editor <version>   Set editor the page is opened in: v2, v1. Editor is
+                        left unchanged if not specified.
+  --layout <layout>    Layout of pages which metadata doesn't specify it, e.g.
+                        article. Alternative option for layout config field.
+  --user-scheme <scheme>  Link mentioned users by account-id (Cloud),
+                        username or userkey (Server/Data Center). Chosen by
+                        flavor detected by --version-check or by found users
+                        if not specified. Alternative option for user_scheme
+                        config field.
+  --label <name>       Add label to every published page in addition to labels
+                        specified in metadata. Can be specified several times.
+  --remove-label <name>  Remove label from every published page, both from
+                        labels specified by metadata and by --label and from
+                        labels the page already has. Can be specified several
+                        times.
+  --labels-only        Update only labels, properties and restrictions of
+                        existing pages without updating their contents, so
+                        no new page version is created. Labels are only
+                        added, use --remove-label to remove them.
+  --delete             Delete Confluence page specified by -l or by file
+                        metadata instead of updating it.
+  --copy-from <id>     Copy attachments of the page with specified id to pages
+                        which don't exist yet when they are created.
+  --embed-source       Store markdown source of the file in the mark-source
+                        content property of the page, so it can be recovered
+                        later.
+  --extract-source     Show markdown source embedded into Confluence page
+                        specified by -l by --embed-source.
+  --force              Don't ask for confirmation before deleting page and
+                        update page even if its contents are not changed.
+  --no-skip            Update page even if its contents are not changed since
+                        it was published by mark last time, but still ask for
+                        confirmation before deleting page.
+  --assume-yes         Answer yes to every confirmation instead of asking.
+  --non-interactive    Never wait for user input: confirmations are denied
+                        unless --force or --assume-yes is specified, reading
+                        password or markdown from stdin fails if stdin is a
+                        terminal.
+  --no-overwrite       Abort if page is changed by someone else while being
+                        updated instead of overwriting their changes.
+  --overwrite-newer    Update page even if it's newer than MinVersion metadata
+                        field and the version published by mark last time.
+  --report <path>      Write summary of published pages to specified file as
+                        JSON, or as CSV if file has .csv extension.
+  --version-check      Detect whether Confluence is Cloud or Server/Data Center
+                        and warn about features which don't work there.
+  --fail-on-warning    Exit with non-zero code if any warnings are logged,
+                        e.g. about ignored metadata or unresolved links.
+  --profile <name>     Use Confluence instance settings and credentials from
+                        specified profile of the config.
   --debug              Enable debug logs.
   --trace              Enable trace logs.
   --color <when>       Display logs in color. Possible values: auto, never.
-                        [default: auto]
+                        If not specified, auto is used unless --no-color is
+                        specified or NO_COLOR environment variable is set.
+  --no-color           Alias for --color never.
   -h --help            Show this screen and call 911.
   -v --version         Show version.
+
+Exit codes:
+  1  Generic error.
+  2  Authentication failed or permission denied.
+  3  Page or its parents can't be found or resolved.
+  4  Network error, e.g. connection failure or timeout.
+  5  Page differs from the file, see --diff.
+  6  Warnings are logged and --fail-on-warning is specified.
 `
 )
 
@@ -80,7 +322,7 @@ func main() {
 	var flags Flags
 	err = cmd.Bind(&flags)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
 	if flags.Debug {
@@ -91,7 +333,7 @@ func main() {
 		log.SetLevel(lorg.LevelTrace)
 	}
 
-	if flags.Color == "never" {
+	if getColor(flags) == "never" {
 		log.GetLogger().SetFormat(
 			lorg.NewFormat(
 				`${time:2006-01-02 15:04:05.000} ${level:%s:left:true} ${prefix}%s`,
@@ -100,237 +342,2748 @@ func main() {
 		log.GetLogger().SetOutput(os.Stderr)
 	}
 
-	config, err := LoadConfig(filepath.Join(os.Getenv("HOME"), ".config/mark"))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	creds, err := GetCredentials(flags, config)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	api := confluence.NewAPI(creds.BaseURL, creds.Username, creds.Password)
+	countWarnings()
 
-	files, err := filepath.Glob(flags.FileGlobPatten)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if len(files) == 0 {
-		log.Fatal("No files matched")
+	if flags.HeadingAnchors != "" {
+		_, err := mark.Slugify("", flags.HeadingAnchors)
+		if err != nil {
+			fatal(err)
+		}
 	}
 
-	// Loop through files matched by glob pattern
-	for _, file := range files {
-		log.Infof(
+	switch flags.H1Title {
+	case "warn", "error", "ignore":
+	default:
+		log.Fatalf(
 			nil,
-			"processing %s",
-			file,
+			"invalid --h1-title value %q, expected warn, error or ignore",
+			flags.H1Title,
 		)
+	}
 
-		target := processFile(file, api, flags, creds.PageID, creds.Username)
-
-		log.Infof(
+	switch flags.Format {
+	case "storage":
+	case "view":
+		if !flags.CompileOnly && !flags.DryRun {
+			log.Fatal(
+				"--format can be used only with --compile-only or --dry-run",
+			)
+		}
+	case "wiki":
+		log.Fatal(
+			"--format wiki is not supported: Confluence converts wiki " +
+				"markup into storage format, but not storage format back " +
+				"into wiki markup",
+		)
+	default:
+		log.Fatalf(
 			nil,
-			"page successfully updated: %s",
-			creds.BaseURL+target.Links.Full,
+			"invalid --format value %q, expected storage or view",
+			flags.Format,
 		)
+	}
 
-		fmt.Println(creds.BaseURL + target.Links.Full)
+	_, err = getLeadingHeading(flags)
+	if err != nil {
+		log.Fatal(err)
 	}
-}
 
-func processFile(
-	file string,
-	api *confluence.API,
-	flags Flags,
-	pageID string,
-	username string,
-) *confluence.PageInfo {
-	markdown, err := ioutil.ReadFile(file)
+	_, err = getAttachmentJobs(flags)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	meta, markdown, err := mark.ExtractMeta(markdown)
+	_, err = getSizeWarning(flags)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	stdlib, err := stdlib.New(api)
+	_, err = getRateLimit(flags, "")
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	templates := stdlib.Templates
+	if flags.Editor != "" {
+		err := mark.ValidateEditor(flags.Editor)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	if (flags.Space == "") != (flags.Title == "") {
+		log.Fatal("--space and --title must be specified together")
+	}
 
-	var recurse bool
+	err = mark.ValidateMultipleMatches(flags.OnMultiple)
+	if err != nil {
+		fatal(err)
+	}
 
-	for {
-		templates, markdown, recurse, err = includes.ProcessIncludes(
-			markdown,
-			templates,
+	if flags.NonInteractive && isStdin(flags) && isTerminal(os.Stdin) {
+		log.Fatal(
+			"markdown can't be read from terminal in non-interactive mode",
 		)
+	}
+
+	if flags.MirrorTree != "" && isStdin(flags) {
+		log.Fatal("--mirror-tree can't be used with stdin")
+	}
+
+	if flags.BaseDir != "" {
+		info, err := os.Stat(flags.BaseDir)
 		if err != nil {
-			log.Fatal(err)
+			fatalf(err, "invalid base directory")
 		}
 
-		if !recurse {
-			break
+		if !info.IsDir() {
+			log.Fatalf(nil, "base directory %q is not a directory", flags.BaseDir)
 		}
 	}
 
-	macros, markdown, err := macro.ExtractMacros(markdown, templates)
+	config, err := LoadConfig(filepath.Join(os.Getenv("HOME"), ".config/mark"))
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+
+	if flags.Profile != "" {
+		err := config.UseProfile(flags.Profile)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	if flags.Math == "" {
+		flags.Math = config.Math
+	}
+
+	if flags.MathImageURL == "" {
+		flags.MathImageURL = config.MathImageURL
+	}
+
+	if flags.TemplatesDir == "" {
+		flags.TemplatesDir = config.TemplatesDir
 	}
 
-	macros = append(macros, stdlib.Macros...)
+	if flags.IndexFiles == "" {
+		flags.IndexFiles = config.IndexFiles
+	}
+
+	if flags.Layout == "" {
+		flags.Layout = config.Layout
+	}
+
+	if flags.Layout != "" {
+		err := mark.ValidateLayout(flags.Layout)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	if flags.UserScheme == "" {
+		flags.UserScheme = config.UserScheme
+	}
 
-	for _, macro := range macros {
-		markdown, err = macro.Apply(markdown)
+	if flags.UserScheme != "" {
+		err := mark.ValidateUserScheme(flags.UserScheme)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	}
 
-	links, err := mark.ResolveRelativeLinks(api, meta, markdown, ".")
+	// metadata is dumped with defaults from config applied
+	if flags.DumpMeta {
+		dumpMeta(flags)
+		exit(flags, 0)
+	}
+
+	err = mark.ValidateMath(flags.Math, flags.MathImageURL)
 	if err != nil {
-		log.Fatalf(err, "unable to resolve relative links")
+		fatal(err)
 	}
 
-	markdown = mark.SubstituteLinks(markdown, links)
+	err = mark.ValidateHTML(flags.HTML)
+	if err != nil {
+		fatal(err)
+	}
 
-	if flags.DryRun {
-		flags.CompileOnly = true
+	err = mark.ValidateSoftBreaks(flags.SoftBreaks)
+	if err != nil {
+		fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		_, _, err := mark.ResolvePage(flags.DryRun, api, meta)
+	if flags.Timeout != "" {
+		timeout, err := time.ParseDuration(flags.Timeout)
 		if err != nil {
-			log.Fatalf(err, "unable to resolve page location")
+			fatalf(err, "invalid timeout: %q", flags.Timeout)
 		}
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	if flags.CompileOnly {
-		fmt.Println(mark.CompileMarkdown(markdown, stdlib))
+	go func() {
+		interrupts := make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt)
+
+		<-interrupts
+
+		// next Ctrl-C terminates mark immediately in case cancellation
+		// hangs
+		signal.Stop(interrupts)
+
+		log.Warning("interrupted, cancelling pending requests")
+
+		cancel()
+	}()
+
+	if flags.Serve {
+		if isStdin(flags) {
+			log.Fatal("preview of stdin is not supported")
+		}
+
+		files, err := listFiles(flags.Files)
+		if err != nil {
+			fatal(err)
+		}
+
+		if len(files) == 0 {
+			log.Fatal("No files matched")
+		}
+
+		serve(ctx, files, flags)
 		os.Exit(0)
 	}
 
-	if pageID != "" && meta != nil {
+	creds, err := GetCredentials(flags, config)
+	if err != nil {
+		fatal(err)
+	}
+
+	proxy := flags.Proxy
+	if proxy == "" {
+		proxy = config.ProxyURL
+	}
+
+	if flags.Insecure {
 		log.Warning(
-			`specified file contains metadata, ` +
-				`but it will be ignored due specified command line URL`,
+			"TLS certificate verification is disabled, " +
+				"connection to Confluence is not secure",
 		)
+	}
 
-		meta = nil
+	caCert := flags.CACert
+	if caCert == "" {
+		caCert = config.CACert
 	}
 
-	if pageID == "" && meta == nil {
-		log.Fatal(
-			`specified file doesn't contain metadata ` +
-				`and URL is not specified via command line ` +
-				`or doesn't contain pageId GET-parameter`,
-		)
+	var caCerts []string
+	for _, path := range strings.Split(caCert, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			caCerts = append(caCerts, path)
+		}
 	}
 
-	var target *confluence.PageInfo
+	var token string
+	if creds.AuthMethod == confluence.AuthMethodBearer {
+		token = creds.Password
+	}
 
-	if meta != nil {
-		parent, page, err := mark.ResolvePage(flags.DryRun, api, meta)
-		if err != nil {
-			log.Fatalf(
-				karma.Describe("title", meta.Title).Reason(err),
-				"unable to resolve %s",
-				meta.Type,
-			)
+	rateLimit, _ := getRateLimit(flags, creds.BaseURL)
+
+	client, err := confluence.NewClient(confluence.ClientOptions{
+		Token:         token,
+		ProxyURL:      proxy,
+		ProxyUsername: config.ProxyUsername,
+		ProxyPassword: config.ProxyPassword,
+		Insecure:      flags.Insecure,
+		CACerts:       caCerts,
+
+		CompressRequests: config.CompressRequests,
+
+		UserAgent:       getUserAgent(config),
+		RequestIDPrefix: config.RequestIDPrefix,
+
+		RateLimit: rateLimit,
+	})
+	if err != nil {
+		fatal(err)
+	}
+
+	api := confluence.NewAPI(
+		creds.BaseURL,
+		creds.Username,
+		creds.Password,
+		client,
+	)
+
+	if flags.VersionCheck {
+		checkServer(ctx, api, flags)
+	}
+
+	if flags.Delete && len(flags.Files) == 0 {
+		for _, pageID := range creds.PageIDs {
+			deletePage(ctx, api, flags, pageID)
 		}
 
-		if page == nil {
-			page, err = api.CreatePage(
-				meta.Space,
-				meta.Type,
-				parent,
-				meta.Title,
-				``,
-			)
+		exit(flags, 0)
+	}
+
+	if flags.ExtractSource {
+		for _, pageID := range creds.PageIDs {
+			extractSource(ctx, api, pageID)
+		}
+
+		exit(flags, 0)
+	}
+
+	files, err := listFiles(flags.Files)
+	if err != nil {
+		fatal(err)
+	}
+	if len(files) == 0 {
+		log.Fatal("No files matched")
+	}
+
+	if !isStdin(flags) &&
+		(flags.ChangedSince != "" || flags.ModifiedSince != "") {
+		var since time.Time
+		if flags.ModifiedSince != "" {
+			since, err = time.Parse(time.RFC3339, flags.ModifiedSince)
 			if err != nil {
-				log.Fatalf(
-					err,
-					"can't create %s %q",
-					meta.Type,
-					meta.Title,
-				)
+				fatalf(err, "invalid time: %q", flags.ModifiedSince)
 			}
 		}
 
-		target = page
-	} else {
-		if pageID == "" {
-			log.Fatalf(nil, "URL should provide 'pageId' GET-parameter")
+		var skipped []string
+
+		files, skipped, err = FilterChanged(files, flags.ChangedSince, since)
+		if err != nil {
+			fatal(err)
+		}
+
+		if len(skipped) > 0 {
+			log.Infof(
+				nil,
+				"skipped %d unchanged files: %s",
+				len(skipped),
+				strings.Join(skipped, ", "),
+			)
+		}
+
+		if len(files) == 0 {
+			log.Info("no changed files, nothing to do")
+
+			exit(flags, 0)
+		}
+	}
+
+	var (
+		problems    int
+		differences int
+		results     []PageResult
+
+		// pages included into documents are fetched once per run
+		pages = mark.NewPageCache()
+
+		// parent pages shared by documents are fetched once per run
+		parents = mark.NewAncestryCache()
+	)
+
+	// Loop through files matched by glob pattern
+	for _, file := range files {
+		log.Infof(
+			nil,
+			"processing %s",
+			file,
+		)
+
+		if flags.Validate {
+			problems += validateFile(ctx, file, api, flags)
+
+			continue
+		}
+
+		if flags.Diff {
+			differences += diffFile(ctx, file, api, pages, flags, creds.PageIDs)
+
+			continue
+		}
+
+		if flags.Delete {
+			deleteFile(ctx, file, api, flags, creds.PageIDs)
+
+			continue
+		}
+
+		published, err := processFile(
+			ctx,
+			file,
+			api,
+			pages,
+			parents,
+			flags,
+			creds.PageIDs,
+		)
+
+		results = append(results, published...)
+
+		for _, result := range published {
+			if result.Status == StatusFailed {
+				continue
+			}
+
+			log.Infof(nil, "page successfully %s: %s", result.Status, result.URL)
+
+			fmt.Println(result.URL)
 		}
 
-		page, err := api.GetPageByID(pageID)
 		if err != nil {
-			log.Fatalf(err, "unable to retrieve page by id")
+			// report is written anyway, so it's known which pages are
+			// published before the failure
+			if err := saveReport(flags, results); err != nil {
+				log.Error(err)
+			}
+
+			fatal(err)
 		}
+	}
 
-		target = page
+	if err := saveReport(flags, results); err != nil {
+		fatal(err)
 	}
 
-	attaches, err := mark.ResolveAttachments(api, target, ".", meta.Attachments)
-	if err != nil {
-		log.Fatalf(err, "unable to create/update attachments")
+	if problems > 0 {
+		log.Fatalf(nil, "validation failed: %d problems found", problems)
 	}
 
-	markdown = mark.CompileAttachmentLinks(markdown, attaches)
+	if differences > 0 {
+		log.Infof(nil, "pages differing from files: %d", differences)
 
-	if flags.DropH1 {
-		log.Info(
-			"the leading H1 heading will be excluded from the Confluence output",
-		)
-		markdown = mark.DropDocumentLeadingH1(markdown)
+		exit(flags, ExitDiff)
 	}
 
-	html := mark.CompileMarkdown(markdown, stdlib)
+	exit(flags, 0)
+}
 
-	{
-		var buffer bytes.Buffer
+// validateFile reports every unresolved link and missing attachment of the
+// file and returns number of problems found. No changes are made in
+// Confluence.
+func validateFile(
+	ctx context.Context,
+	file string,
+	api *confluence.API,
+	flags Flags,
+) int {
+	source, err := readFile(file)
+	if err != nil {
+		fatal(err)
+	}
 
-		err := stdlib.Templates.ExecuteTemplate(
-			&buffer,
-			"ac:layout",
-			struct {
-				Layout string
-				Body   string
-			}{
-				Layout: meta.Layout,
-				Body:   html,
+	base := getBaseDir(flags, file)
+
+	var count int
+
+	for _, section := range mark.SplitPages(source) {
+		// links are not resolved during preparation, they are checked below
+		document, err := mark.Prepare(
+			ctx,
+			section,
+			mark.Options{
+				Base:          base,
+				File:          file,
+				TitleFromH1:   flags.TitleFromH1,
+				TemplatesDir:  flags.TemplatesDir,
+				IndexFiles:    getIndexFiles(flags),
+				EnvSubst:      flags.EnvSubst,
+				StrictMacros:  flags.StrictMacros,
+				CollectErrors: true,
 			},
 		)
 		if err != nil {
-			log.Fatal(err)
+			log.Errorf(err, "%s: unable to prepare document", file)
+
+			count++
+
+			continue
 		}
 
-		html = buffer.String()
+		problems, err := mark.Validate(
+			ctx,
+			api,
+			document.Meta,
+			document.Markdown,
+			base,
+			getIndexFiles(flags),
+		)
+		if err != nil {
+			fatal(err)
+		}
+
+		for _, problem := range problems {
+			log.Errorf(nil, "%s: %s", file, problem)
+		}
+
+		count += len(problems)
 	}
 
-	err = api.UpdatePage(target, html, flags.MinorEdit, meta.Labels)
+	return count
+}
+
+// diffFile prints differences between storage format of every page of the
+// file and the live page and returns number of pages which differ. No changes
+// are made in Confluence.
+func diffFile(
+	ctx context.Context,
+	file string,
+	api *confluence.API,
+	pages *mark.PageCache,
+	flags Flags,
+	pageIDs []string,
+) int {
+	source, err := readFile(file)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 
-	if flags.EditLock {
-		log.Infof(
-			nil,
-			`edit locked on page %q by user %q to prevent manual edits`,
-			target.Title,
-			username,
+	base := getBaseDir(flags, file)
+
+	var count int
+
+	for _, section := range mark.SplitPages(source) {
+		options := mark.CompileOptions{
+			AnchorStyle:    flags.HeadingAnchors,
+			Math:           flags.Math,
+			MathImageURL:   flags.MathImageURL,
+			DetectLanguage: flags.DetectLanguage,
+			HTML:           flags.HTML,
+			SoftBreaks:     flags.SoftBreaks,
+			RawStorage:     flags.RawStorage,
+			CollapseCode:   flags.CollapseCode,
+		}
+
+		document, err := mark.Prepare(
+			ctx,
+			section,
+			mark.Options{
+				CompileOptions: options,
+				API:            api,
+				Base:           base,
+				File:           file,
+				TitleFromH1:    flags.TitleFromH1,
+				TemplatesDir:   flags.TemplatesDir,
+				IndexFiles:     getIndexFiles(flags),
+				EnvSubst:       flags.EnvSubst,
+				PageCache:      pages,
+				StrictMacros:   flags.StrictMacros,
+				UserScheme:     confluence.UserScheme(flags.UserScheme),
+			},
 		)
+		if err != nil {
+			fatalf(err, "unable to prepare %q", file)
+		}
 
-		err := api.RestrictPageUpdates(target, username)
+		meta := document.Meta
+
+		err = applyMirrorTree(flags, file, meta)
 		if err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
-	}
 
-	return target
+		options = document.Options
+
+		ids := pageIDs
+		if len(ids) > 0 {
+			meta = nil
+		}
+
+		if len(ids) == 0 && meta == nil && flags.Title != "" {
+			meta, ids, err = upsertTarget(ctx, api, flags)
+			if err != nil {
+				fatal(err)
+			}
+		}
+
+		if len(ids) == 0 && meta == nil {
+			log.Fatalf(
+				nil,
+				"%s: file doesn't contain metadata and page is not specified",
+				file,
+			)
+		}
+
+		targets := []target{}
+		for _, pageID := range ids {
+			targets = append(targets, target{pageID: pageID})
+		}
+
+		if meta != nil {
+			targets = append(targets, target{meta: meta})
+
+			for _, space := range meta.Mirrors {
+				mirror := *meta
+				mirror.Space = space
+
+				targets = append(targets, target{meta: &mirror})
+			}
+		}
+
+		for _, target := range targets {
+			changed, err := diffPage(
+				ctx,
+				api,
+				document,
+				flags,
+				options,
+				target,
+				base,
+			)
+			if err != nil {
+				fatal(err)
+			}
+
+			if changed {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// diffPage prints differences between the page and its live version and
+// returns true if they differ. Page which doesn't exist yet is compared
+// against empty page.
+func diffPage(
+	ctx context.Context,
+	api *confluence.API,
+	document *mark.Document,
+	flags Flags,
+	options mark.CompileOptions,
+	target target,
+	base string,
+) (bool, error) {
+	var (
+		page *confluence.PageInfo
+		name string
+		err  error
+	)
+
+	if target.meta != nil {
+		name = target.meta.Space + ": " + target.meta.Title
+
+		page, err = api.FindPage(
+			ctx,
+			target.meta.Space,
+			target.meta.Title,
+			target.meta.Type,
+		)
+		if err != nil {
+			return false, karma.Format(err, "unable to find page %q", name)
+		}
+	} else {
+		name = target.pageID
+
+		page, err = api.GetPageByID(ctx, target.pageID)
+		if err != nil {
+			return false, karma.Format(err, "unable to retrieve page by id")
+		}
+	}
+
+	html, err := compilePage(
+		ctx,
+		api,
+		page,
+		document.Stdlib,
+		document.Pages,
+		flags,
+		options,
+		target.meta,
+		document.Markdown,
+		base,
+		true,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	var live string
+	if page == nil {
+		log.Infof(nil, "page %q doesn't exist yet", name)
+	} else {
+		name = api.BaseURL + page.Links.Full
+
+		// checksum of the page matches only if it's published by mark with
+		// the same contents, title, parent, labels and properties
+		property, err := api.GetPageProperty(
+			ctx,
+			page.ID,
+			mark.PageChecksumProperty,
+		)
+		if err != nil {
+			return false, karma.Format(err, "unable to retrieve page checksum")
+		}
+
+		properties := getProperties(flags, target.meta)
+
+		embedSource(flags, page, properties, document.Source)
+
+		checksum := mark.GetPageChecksum(
+			page,
+			html,
+			getLabels(flags, target.meta),
+			properties,
+		)
+		if property != nil && property.Value == checksum {
+			log.Infof(nil, "no changes in page %q", page.Title)
+
+			return false, nil
+		}
+
+		live, err = api.GetPageBody(ctx, page.ID)
+		if err != nil {
+			return false, karma.Format(err, "unable to retrieve page body")
+		}
+	}
+
+	diff := mark.DiffStorage(live, html)
+	if !diff.Changed() {
+		log.Infof(
+			nil,
+			"contents of page %q are not changed, but it would be "+
+				"updated since its title, parent, labels, properties or "+
+				"checksum differ",
+			name,
+		)
+
+		return true, nil
+	}
+
+	fmt.Printf("--- %s\n%s\n", name, diff.Render(isDiffColored(flags)))
+
+	return true, nil
+}
+
+// isDiffColored returns true if diff should be highlighted using terminal
+// colors, which is done only if stdout is a terminal.
+func isDiffColored(flags Flags) bool {
+	return getColor(flags) != "never" && isTerminal(os.Stdout)
+}
+
+// isTerminal returns true if file is a terminal, e.g. stdin which reading
+// from waits for user input.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// target is a page where the file is published to, it's located either by
+// metadata or by page id.
+type target struct {
+	meta   *mark.Meta
+	pageID string
+}
+
+func processFile(
+	ctx context.Context,
+	file string,
+	api *confluence.API,
+	pages *mark.PageCache,
+	parents *mark.AncestryCache,
+	flags Flags,
+	pageIDs []string,
+) ([]PageResult, error) {
+	source, err := readFile(file)
+	if err != nil {
+		fatal(err)
+	}
+
+	sections := mark.SplitPages(source)
+
+	// pages created beforehand are reported as created, not updated
+	created := map[string]bool{}
+
+	if len(sections) > 1 {
+		if len(pageIDs) > 0 {
+			log.Fatal(
+				`specified file contains multiple pages, ` +
+					`they can't be published to command line URL or page id`,
+			)
+		}
+
+		// every page is created beforehand, so links between pages of the
+		// file are resolved regardless of their order
+		if !flags.DryRun && !flags.CompileOnly && !flags.LabelsOnly {
+			created, err = createPages(ctx, file, api, parents, flags, sections)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var (
+		results = []PageResult{}
+		failed  []karma.Reason
+	)
+
+	for _, section := range sections {
+		published, err := processPage(
+			ctx,
+			file,
+			section,
+			api,
+			pages,
+			parents,
+			flags,
+			pageIDs,
+		)
+
+		for i, result := range published {
+			if result.Status == StatusUpdated && created[result.ID] {
+				published[i].Status = StatusCreated
+			}
+		}
+
+		// page may fail before it's known where it should be published
+		if err != nil && len(published) == 0 {
+			published = append(published, PageResult{
+				File:   file,
+				Status: StatusFailed,
+				Error:  err.Error(),
+			})
+		}
+
+		results = append(results, published...)
+
+		if err != nil {
+			if len(sections) == 1 {
+				return results, err
+			}
+
+			failed = append(failed, err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return results, karma.Push(
+			fmt.Sprintf(
+				"unable to publish %d of %d pages of %q",
+				len(failed),
+				len(sections),
+				file,
+			),
+			failed...,
+		)
+	}
+
+	if flags.CompileOnly || flags.DryRun {
+		exit(flags, 0)
+	}
+
+	return results, nil
+}
+
+// createPages creates pages of multi-page file which don't exist yet and
+// returns ids of created pages.
+func createPages(
+	ctx context.Context,
+	file string,
+	api *confluence.API,
+	parents *mark.AncestryCache,
+	flags Flags,
+	sections [][]byte,
+) (map[string]bool, error) {
+	created := map[string]bool{}
+
+	for i, section := range sections {
+		if flags.EnvSubst {
+			var err error
+
+			section, err = mark.SubstituteEnv(section)
+			if err != nil {
+				return nil, karma.Format(err, "unable to substitute variables")
+			}
+		}
+
+		meta, _, err := mark.ExtractFileMeta(
+			section,
+			file,
+			flags.TitleFromH1,
+		)
+		if err != nil {
+			return nil, karma.Format(err, "unable to extract metadata")
+		}
+
+		if meta == nil {
+			return nil, fmt.Errorf(
+				"page #%d of %q doesn't contain metadata",
+				i+1,
+				file,
+			)
+		}
+
+		err = applyMirrorTree(flags, file, meta)
+		if err != nil {
+			return nil, err
+		}
+
+		page, isNew, err := ensurePage(ctx, api, parents, flags, meta)
+		if err != nil {
+			return nil, err
+		}
+
+		if isNew {
+			created[page.ID] = true
+		}
+	}
+
+	return created, nil
+}
+
+// processPage publishes single page of the file to every target.
+func processPage(
+	ctx context.Context,
+	file string,
+	source []byte,
+	api *confluence.API,
+	pages *mark.PageCache,
+	parents *mark.AncestryCache,
+	flags Flags,
+	pageIDs []string,
+) ([]PageResult, error) {
+	// relative links and attachments are resolved against directory of the
+	// file by default, so mark can be run from any directory
+	base := getBaseDir(flags, file)
+
+	options := mark.CompileOptions{
+		AnchorStyle:    flags.HeadingAnchors,
+		Math:           flags.Math,
+		MathImageURL:   flags.MathImageURL,
+		DetectLanguage: flags.DetectLanguage,
+		HTML:           flags.HTML,
+		SoftBreaks:     flags.SoftBreaks,
+		RawStorage:     flags.RawStorage,
+		CollapseCode:   flags.CollapseCode,
+	}
+
+	document, err := mark.Prepare(
+		ctx,
+		source,
+		mark.Options{
+			CompileOptions: options,
+			API:            api,
+			Base:           base,
+			File:           file,
+			TitleFromH1:    flags.TitleFromH1,
+			TemplatesDir:   flags.TemplatesDir,
+			IndexFiles:     getIndexFiles(flags),
+			EnvSubst:       flags.EnvSubst,
+			PageCache:      pages,
+			StrictMacros:   flags.StrictMacros,
+			UserScheme:     confluence.UserScheme(flags.UserScheme),
+			CollectErrors:  flags.DryRun,
+		},
+	)
+	if err != nil {
+		return nil, karma.Format(err, "unable to prepare %q", file)
+	}
+
+	var (
+		meta     = document.Meta
+		markdown = document.Markdown
+		stdlib   = document.Stdlib
+	)
+
+	err = applyMirrorTree(flags, file, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	options = document.Options
+
+	checkEmoji(api, file, meta)
+
+	if flags.DryRun {
+		flags.CompileOnly = true
+
+		parent, page, err := mark.ResolvePage(
+			ctx,
+			flags.DryRun,
+			api,
+			parents,
+			meta,
+		)
+		if err != nil {
+			fatalf(err, "unable to resolve page location")
+		}
+
+		fmt.Println(mark.GetPageTree(meta, parent, page))
+	}
+
+	if flags.CompileOnly {
+		html := mark.SubstituteConfluenceIncludes(
+			mark.CompileMarkdown(markdown, stdlib, options),
+			document.Pages,
+		)
+
+		if flags.Format != "storage" {
+			html, err = api.ConvertBody(ctx, html, "storage", flags.Format)
+			if err != nil {
+				fatalf(
+					err,
+					"unable to convert page to %s representation",
+					flags.Format,
+				)
+			}
+		}
+
+		fmt.Println(html)
+
+		return nil, nil
+	}
+
+	if len(pageIDs) > 0 && meta != nil {
+		log.Warning(
+			`specified file contains metadata, ` +
+				`but it will be ignored due specified command line URL ` +
+				`or page id`,
+		)
+
+		meta = nil
+	}
+
+	if len(pageIDs) == 0 && meta == nil && flags.Title != "" {
+		meta, pageIDs, err = upsertTarget(ctx, api, flags)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(pageIDs) == 0 && meta == nil {
+		log.Fatal(
+			`specified file doesn't contain metadata ` +
+				`and neither page id is specified via --page-id ` +
+				`nor URL is specified via command line ` +
+				`or doesn't contain pageId GET-parameter`,
+		)
+	}
+
+	leading, _ := getLeadingHeading(flags)
+
+	if leading.Action == mark.LeadingHeadingDrop &&
+		meta != nil &&
+		flags.H1Title != "ignore" {
+		heading := mark.ExtractLeadingHeading(markdown, leading.Level)
+		if heading != "" && heading != meta.Title {
+			err := fmt.Errorf(
+				"H%d heading %q differs from page title %q, "+
+					"metadata or heading may be outdated",
+				leading.Level,
+				heading,
+				meta.Title,
+			)
+
+			if flags.H1Title == "error" {
+				fatal(err)
+			}
+
+			log.Warning(err)
+		}
+	}
+
+	targets := []target{}
+
+	for _, pageID := range pageIDs {
+		targets = append(targets, target{pageID: pageID})
+	}
+
+	if meta != nil {
+		targets = append(targets, target{meta: meta})
+
+		for _, space := range meta.Mirrors {
+			mirror := *meta
+			mirror.Space = space
+
+			targets = append(targets, target{meta: &mirror})
+		}
+	}
+
+	var (
+		results = []PageResult{}
+		failed  = []karma.Reason{}
+	)
+
+	// every target is processed even if some of them failed, so one broken
+	// target doesn't prevent updating others
+	for _, target := range targets {
+		var (
+			page   *confluence.PageInfo
+			status string
+		)
+
+		if flags.LabelsOnly {
+			page, status, err = updateMeta(ctx, api, flags, target)
+		} else {
+			page, status, err = publish(
+				ctx,
+				api,
+				parents,
+				stdlib,
+				document.Pages,
+				flags,
+				options,
+				target,
+				markdown,
+				document.Source,
+				base,
+			)
+		}
+		if err != nil {
+			name := target.pageID
+			if target.meta != nil {
+				name = target.meta.Space + ": " + target.meta.Title
+			}
+
+			err = karma.Format(err, "unable to publish page %q", name)
+
+			result := PageResult{
+				File:   file,
+				ID:     target.pageID,
+				Status: StatusFailed,
+				Error:  err.Error(),
+			}
+
+			if target.meta != nil {
+				result.Space = target.meta.Space
+				result.Title = target.meta.Title
+			}
+
+			results = append(results, result)
+
+			if len(targets) == 1 {
+				return results, err
+			}
+
+			failed = append(failed, err)
+
+			continue
+		}
+
+		results = append(results, PageResult{
+			File:    file,
+			Space:   page.Space.Key,
+			Title:   page.Title,
+			ID:      page.ID,
+			URL:     api.BaseURL + page.Links.Full,
+			Version: page.Version.Number,
+			Status:  status,
+		})
+	}
+
+	if len(failed) > 0 {
+		return results, karma.Push(
+			fmt.Sprintf(
+				"unable to publish %d of %d pages",
+				len(failed),
+				len(targets),
+			),
+			failed...,
+		)
+	}
+
+	return results, nil
+}
+
+func publish(
+	ctx context.Context,
+	api *confluence.API,
+	parents *mark.AncestryCache,
+	stdlib *stdlib.Lib,
+	included map[string]string,
+	flags Flags,
+	options mark.CompileOptions,
+	target target,
+	markdown []byte,
+	source []byte,
+	base string,
+) (*confluence.PageInfo, string, error) {
+	meta := target.meta
+
+	var (
+		page   *confluence.PageInfo
+		status = StatusUpdated
+	)
+
+	if meta != nil {
+		found, created, err := ensurePage(ctx, api, parents, flags, meta)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if created {
+			status = StatusCreated
+		}
+
+		page = found
+	} else {
+		found, err := api.GetPageByID(ctx, target.pageID)
+		if err != nil {
+			return nil, "", karma.Format(err, "unable to retrieve page by id")
+		}
+
+		page = found
+	}
+
+	// restrictions are set before attachments and contents are uploaded, so
+	// restricted contents are never visible to others
+	err := restrictPage(ctx, api, flags, meta, page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	html, err := compilePage(
+		ctx,
+		api,
+		page,
+		stdlib,
+		included,
+		flags,
+		options,
+		meta,
+		markdown,
+		base,
+		false,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	checkPageSize(flags, page, html)
+
+	labels := getLabels(flags, meta)
+
+	minorEdit := flags.MinorEdit
+	if meta != nil && meta.MinorEdit != nil {
+		minorEdit = *meta.MinorEdit
+
+		log.Infof(nil, "minor edit is set to %t by metadata", minorEdit)
+	} else {
+		log.Infof(nil, "minor edit is set to %t by command line", minorEdit)
+	}
+
+	message := flags.Message
+	if message == "" && meta != nil {
+		message = meta.Message
+	}
+
+	// content properties which are set along with the update
+	properties := getProperties(flags, meta)
+
+	embedSource(flags, page, properties, source)
+
+	checksum := mark.GetPageChecksum(page, html, labels, properties)
+
+	property, err := api.GetPageProperty(
+		ctx,
+		page.ID,
+		mark.PageChecksumProperty,
+	)
+	if err != nil {
+		return nil, "", karma.Format(err, "unable to retrieve page checksum")
+	}
+
+	if property != nil && property.Value == checksum &&
+		!flags.Force && !flags.NoSkip {
+		log.Infof(nil, "no changes, skipping update of page %q", page.Title)
+
+		status = StatusSkipped
+	} else {
+		err = checkMinVersion(ctx, api, flags, meta, page)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(labels) > 0 {
+			log.Infof(
+				nil,
+				"page %q is labeled: %s",
+				page.Title,
+				strings.Join(labels, ", "),
+			)
+		}
+
+		err = api.UpdatePage(
+			ctx,
+			page,
+			html,
+			minorEdit,
+			message,
+			labels,
+			properties,
+		)
+		if err == confluence.ErrVersionConflict {
+			if flags.NoOverwrite {
+				return nil, "", karma.Format(
+					err,
+					"page %q was changed while being updated",
+					page.Title,
+				)
+			}
+
+			log.Warningf(
+				nil,
+				"page %q was changed while being updated, "+
+					"overwriting with the new version",
+				page.Title,
+			)
+
+			page, err = mark.RefreshPage(ctx, api, meta, page)
+			if err != nil {
+				return nil, "", err
+			}
+
+			err = checkMinVersion(ctx, api, flags, meta, page)
+			if err != nil {
+				return nil, "", err
+			}
+
+			err = api.UpdatePage(
+				ctx,
+				page,
+				html,
+				minorEdit,
+				message,
+				labels,
+				properties,
+			)
+		}
+
+		if confluence.IsTooLargeError(err) {
+			return nil, "", karma.Format(
+				err,
+				"page %q is rejected by Confluence as too large: "+
+					"storage format is %d bytes, split the page into "+
+					"several pages or collapse large code blocks "+
+					"using --collapse-code",
+				page.Title,
+				len(html),
+			)
+		}
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		// page info is retrieved before the update
+		page.Version.Number++
+
+		err = api.SetPageProperty(
+			ctx,
+			page.ID,
+			property,
+			mark.PageChecksumProperty,
+			checksum,
+		)
+		if err != nil {
+			return nil, "", karma.Format(err, "unable to store page checksum")
+		}
+
+		err = storePublishedVersion(ctx, api, meta, page)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	_, err = removeLabels(ctx, api, flags, page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return page, status, nil
+}
+
+// updateMeta updates labels, content properties and restrictions of the
+// existing page without updating its body, see --labels-only.
+func updateMeta(
+	ctx context.Context,
+	api *confluence.API,
+	flags Flags,
+	target target,
+) (*confluence.PageInfo, string, error) {
+	meta := target.meta
+
+	var (
+		page *confluence.PageInfo
+		err  error
+	)
+
+	if meta != nil {
+		page, err = api.FindPage(ctx, meta.Space, meta.Title, meta.Type)
+		if err != nil {
+			return nil, "", karma.Format(err, "error while finding page")
+		}
+
+		if page == nil {
+			return nil, "", &mark.ResolveError{
+				Err: fmt.Errorf(
+					"%s %q is not found in space %q, "+
+						"it should be published before updating its labels",
+					meta.Type,
+					meta.Title,
+					meta.Space,
+				),
+			}
+		}
+	} else {
+		page, err = api.GetPageByID(ctx, target.pageID)
+		if err != nil {
+			return nil, "", karma.Format(err, "unable to retrieve page by id")
+		}
+	}
+
+	labels := getLabels(flags, meta)
+
+	log.Infof(
+		nil,
+		"updating labels of page %q: %s",
+		page.Title,
+		strings.Join(labels, ", "),
+	)
+
+	changed, err := api.UpdatePageMeta(
+		ctx,
+		page,
+		labels,
+		getProperties(flags, meta),
+	)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = restrictPage(ctx, api, flags, meta, page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	removed, err := removeLabels(ctx, api, flags, page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !changed && !removed {
+		log.Infof(nil, "no changes in labels of page %q", page.Title)
+
+		return page, StatusSkipped, nil
+	}
+
+	err = resetChecksum(ctx, api, page)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return page, StatusUpdated, nil
+}
+
+// resetChecksum clears checksum of the page contents after its labels or
+// properties are changed without updating contents, so the next run doesn't
+// skip the page as unchanged while its labels differ from the file.
+func resetChecksum(
+	ctx context.Context,
+	api *confluence.API,
+	page *confluence.PageInfo,
+) error {
+	property, err := api.GetPageProperty(
+		ctx,
+		page.ID,
+		mark.PageChecksumProperty,
+	)
+	if err != nil {
+		return karma.Format(err, "unable to retrieve page checksum")
+	}
+
+	if property == nil || property.Value == "" {
+		return nil
+	}
+
+	err = api.SetPageProperty(
+		ctx,
+		page.ID,
+		property,
+		mark.PageChecksumProperty,
+		"",
+	)
+	if err != nil {
+		return karma.Format(err, "unable to reset page checksum")
+	}
+
+	return nil
+}
+
+// getProperties returns content properties of the page which are set along
+// with its contents.
+func getProperties(flags Flags, meta *mark.Meta) map[string]string {
+	properties := map[string]string{}
+
+	editor := flags.Editor
+	if editor == "" && meta != nil {
+		editor = meta.Editor
+	}
+
+	if editor != "" {
+		properties["editor"] = editor
+	}
+
+	if meta != nil && meta.Emoji != "" {
+		// shortname is validated along with metadata
+		properties[mark.PageEmojiProperty], _ = mark.GetEmojiCode(meta.Emoji)
+	}
+
+	return properties
+}
+
+// restrictPage sets restrictions of the page specified by metadata and locks
+// page editing to the user if -k is specified.
+func restrictPage(
+	ctx context.Context,
+	api *confluence.API,
+	flags Flags,
+	meta *mark.Meta,
+	page *confluence.PageInfo,
+) error {
+	var user *confluence.User
+
+	if flags.EditLock {
+		var err error
+
+		// user is identified by credentials, since -u may differ from the
+		// account restrictions are set for, e.g. email on Confluence Cloud
+		user, err = api.CurrentUser(ctx)
+		if err != nil {
+			return karma.Format(err, "unable to retrieve current user")
+		}
+	}
+
+	managed, err := setRestrictions(ctx, api, meta, page, user)
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return nil
+	}
+
+	// user is added to restrictions set by metadata instead of replacing them
+	if !managed {
+		err = api.RestrictPageUpdates(ctx, page, user)
+		if err != nil {
+			return karma.Format(err, "unable to lock page %q", page.Title)
+		}
+	}
+
+	log.Infof(
+		nil,
+		`edit locked on page %q by user %q to prevent manual edits`,
+		page.Title,
+		user,
+	)
+
+	return nil
+}
+
+// setRestrictions replaces restrictions of the page with ones specified by
+// metadata along with the user editing is locked for if it's not nil.
+// Restrictions previously set by mark are cleared if metadata doesn't specify
+// them anymore. Returns false if restrictions are not managed by metadata.
+func setRestrictions(
+	ctx context.Context,
+	api *confluence.API,
+	meta *mark.Meta,
+	page *confluence.PageInfo,
+	user *confluence.User,
+) (bool, error) {
+	if meta == nil {
+		return false, nil
+	}
+
+	property, err := api.GetPageProperty(
+		ctx,
+		page.ID,
+		mark.PageRestrictionsProperty,
+	)
+	if err != nil {
+		return false, karma.Format(err, "unable to retrieve page restrictions")
+	}
+
+	restrictions := mark.GetRestrictions(meta.Restrictions)
+
+	operations := []string{}
+	restricted := map[string]bool{}
+	for _, restriction := range restrictions {
+		operations = append(operations, restriction.Operation)
+		restricted[restriction.Operation] = true
+	}
+
+	// operations restricted by mark before are cleared once they are removed
+	// from metadata, restrictions set manually are not touched
+	if property != nil && property.Value != "" {
+		for _, operation := range strings.Split(property.Value, ",") {
+			if !restricted[operation] {
+				restrictions = append(
+					restrictions,
+					confluence.Restriction{Operation: operation},
+				)
+			}
+		}
+	}
+
+	if len(restrictions) == 0 {
+		return false, nil
+	}
+
+	log.Infof(nil, "setting restrictions of page %q", page.Title)
+
+	if user != nil {
+		restrictions = mark.LockRestrictions(
+			restrictions,
+			api.UserIdentifier(user),
+		)
+	}
+
+	err = api.SetRestrictions(ctx, page, restrictions)
+	if err != nil {
+		return false, karma.Format(err, "unable to set page restrictions")
+	}
+
+	err = api.SetPageProperty(
+		ctx,
+		page.ID,
+		property,
+		mark.PageRestrictionsProperty,
+		strings.Join(operations, ","),
+	)
+	if err != nil {
+		return false, karma.Format(err, "unable to store page restrictions")
+	}
+
+	return true, nil
+}
+
+// compilePage compiles markdown into storage format of the page exactly as it
+// is published. Attachments are uploaded to the page unless preview is set,
+// links to attachments which are not uploaded yet are left as is then. Page
+// may be nil in preview mode if it doesn't exist yet.
+func compilePage(
+	ctx context.Context,
+	api *confluence.API,
+	page *confluence.PageInfo,
+	stdlib *stdlib.Lib,
+	included map[string]string,
+	flags Flags,
+	options mark.CompileOptions,
+	meta *mark.Meta,
+	markdown []byte,
+	base string,
+	preview bool,
+) (string, error) {
+	attachments := map[string]string{}
+	if meta != nil {
+		for replace, name := range meta.Attachments {
+			attachments[replace] = name
+		}
+	}
+
+	for _, link := range mark.ExtractAttachmentLinks(markdown, base) {
+		if _, ok := attachments[link]; !ok {
+			attachments[link] = filepath.ToSlash(filepath.Clean(link))
+		}
+	}
+
+	var comments map[string]string
+	if meta != nil {
+		comments = meta.AttachmentComments
+	}
+
+	jobs, _ := getAttachmentJobs(flags)
+
+	var (
+		attaches []mark.Attachment
+		err      error
+	)
+
+	if preview {
+		attaches, err = mark.PreviewAttachments(
+			ctx,
+			api,
+			page,
+			base,
+			attachments,
+			comments,
+		)
+		if err != nil {
+			return "", karma.Format(err, "unable to resolve attachments")
+		}
+	} else {
+		attaches, err = mark.ResolveAttachments(
+			ctx,
+			api,
+			page,
+			base,
+			attachments,
+			comments,
+			jobs,
+		)
+		if err != nil {
+			return "", karma.Format(err, "unable to create/update attachments")
+		}
+
+		if flags.PruneAttach {
+			err = mark.PruneAttachments(ctx, api, page, attaches)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	markdown = mark.CompileAttachmentLinks(markdown, attaches)
+
+	leading, _ := getLeadingHeading(flags)
+
+	switch leading.Action {
+	case mark.LeadingHeadingDrop:
+		log.Infof(
+			nil,
+			"the leading H%d heading will be excluded from the Confluence output",
+			leading.Level,
+		)
+	case mark.LeadingHeadingDemote:
+		log.Infof(
+			nil,
+			"the leading H%d heading will be demoted in the Confluence output",
+			leading.Level,
+		)
+	}
+
+	markdown = mark.TransformLeadingHeading(markdown, leading)
+
+	html := mark.CompileMarkdown(markdown, stdlib, options)
+	html = mark.SubstituteConfluenceIncludes(html, included)
+
+	layout := flags.Layout
+	if meta != nil && meta.Layout != "" {
+		layout = meta.Layout
+	}
+
+	{
+		var buffer bytes.Buffer
+
+		err := stdlib.Templates.ExecuteTemplate(
+			&buffer,
+			"ac:layout",
+			struct {
+				Layout string
+				Body   string
+			}{
+				Layout: layout,
+				Body:   html,
+			},
+		)
+		if err != nil {
+			return "", err
+		}
+
+		html = buffer.String()
+	}
+
+	return html, nil
+}
+
+// embedSource adds markdown source to content properties of the page if
+// --embed-source is specified and the source isn't too large.
+func embedSource(
+	flags Flags,
+	page *confluence.PageInfo,
+	properties map[string]string,
+	source []byte,
+) {
+	if !flags.EmbedSource {
+		return
+	}
+
+	if !mark.EmbedSource(properties, source) {
+		log.Warningf(
+			nil,
+			"source of page %q is not embedded, "+
+				"it exceeds %d bytes allowed for content property",
+			page.Title,
+			mark.MaxSourceSize,
+		)
+	}
+}
+
+// extractSource shows markdown source embedded into the page by
+// --embed-source.
+func extractSource(ctx context.Context, api *confluence.API, pageID string) {
+	if pageID == "" {
+		log.Fatalf(
+			nil,
+			"page id should be specified using --page-id flag "+
+				"or 'pageId' GET-parameter of URL",
+		)
+	}
+
+	property, err := api.GetPageProperty(
+		ctx,
+		pageID,
+		mark.PageSourceProperty,
+	)
+	if err != nil {
+		fatalf(err, "unable to retrieve page source")
+	}
+
+	if property == nil {
+		fatal(&mark.ResolveError{
+			Err: fmt.Errorf(
+				"page %s has no embedded source, "+
+					"it's not published with --embed-source",
+				pageID,
+			),
+		})
+	}
+
+	os.Stdout.Write([]byte(property.Value))
+}
+
+// checkServer detects flavor of Confluence and warns about features which
+// don't work on it. Detected flavor is used for the rest of the run.
+func checkServer(ctx context.Context, api *confluence.API, flags Flags) {
+	server, err := api.DetectServer(ctx)
+	if err != nil {
+		fatalf(err, "unable to detect Confluence flavor")
+	}
+
+	if server.Flavor == confluence.FlavorCloud {
+		log.Infof(nil, "detected Confluence Cloud at %s", api.BaseURL)
+
+		return
+	}
+
+	version := server.Version
+	if version == "" {
+		version = "of unknown version"
+	}
+
+	log.Infof(
+		nil,
+		"detected Confluence Server/Data Center %s at %s",
+		version,
+		api.BaseURL,
+	)
+
+	if flags.UserScheme == string(confluence.UserAccountID) {
+		log.Warning(
+			"user mentions and profiles won't work if used: they are linked " +
+				"by account id, which Confluence Server/Data Center " +
+				"doesn't support, use --user-scheme username instead",
+		)
+	}
+
+	if flags.Editor != "" {
+		log.Warningf(
+			nil,
+			"--editor %s has no effect on Confluence Server/Data Center",
+			flags.Editor,
+		)
+	}
+}
+
+// checkEmoji warns if the page sets Emoji metadata field while Confluence is
+// detected as Server/Data Center, which doesn't support page emoji.
+func checkEmoji(api *confluence.API, file string, meta *mark.Meta) {
+	if meta == nil || meta.Emoji == "" {
+		return
+	}
+
+	server := api.Server()
+	if server == nil || server.Flavor == confluence.FlavorCloud {
+		return
+	}
+
+	log.Warningf(
+		nil,
+		"%s metadata field of %q has no effect: page emoji is supported by "+
+			"Confluence Cloud only",
+		mark.HeaderEmoji,
+		file,
+	)
+}
+
+// checkMinVersion returns error if the page is newer than MinVersion metadata
+// field and the version published by mark last time allow, the check is
+// skipped with --overwrite-newer.
+func checkMinVersion(
+	ctx context.Context,
+	api *confluence.API,
+	flags Flags,
+	meta *mark.Meta,
+	page *confluence.PageInfo,
+) error {
+	if meta == nil || meta.MinVersion == 0 {
+		return nil
+	}
+
+	published, err := getPublishedVersion(ctx, api, page)
+	if err != nil {
+		return err
+	}
+
+	err = mark.CheckMinVersion(meta, page, published)
+	if err == nil {
+		return nil
+	}
+
+	if flags.OverwriteNewer {
+		log.Warningf(
+			err,
+			"overwriting page %q due to --overwrite-newer",
+			page.Title,
+		)
+
+		return nil
+	}
+
+	return karma.Format(
+		err,
+		"refusing to update page, use --overwrite-newer to overwrite",
+	)
+}
+
+// getPublishedVersion returns version of the page published by mark last
+// time or zero if it's not known.
+func getPublishedVersion(
+	ctx context.Context,
+	api *confluence.API,
+	page *confluence.PageInfo,
+) (int64, error) {
+	property, err := api.GetPageProperty(
+		ctx,
+		page.ID,
+		mark.PageVersionProperty,
+	)
+	if err != nil {
+		return 0, karma.Format(err, "unable to retrieve published page version")
+	}
+
+	if property == nil {
+		return 0, nil
+	}
+
+	version, err := strconv.ParseInt(property.Value, 10, 64)
+	if err != nil {
+		log.Warningf(
+			err,
+			"ignoring invalid %s property of page %q",
+			mark.PageVersionProperty,
+			page.Title,
+		)
+
+		return 0, nil
+	}
+
+	return version, nil
+}
+
+// storePublishedVersion stores version of the page published by mark, so the
+// page isn't considered newer than MinVersion metadata field allows due to
+// versions created by mark itself.
+func storePublishedVersion(
+	ctx context.Context,
+	api *confluence.API,
+	meta *mark.Meta,
+	page *confluence.PageInfo,
+) error {
+	if meta == nil || meta.MinVersion == 0 {
+		return nil
+	}
+
+	property, err := api.GetPageProperty(
+		ctx,
+		page.ID,
+		mark.PageVersionProperty,
+	)
+	if err != nil {
+		return karma.Format(err, "unable to retrieve published page version")
+	}
+
+	err = api.SetPageProperty(
+		ctx,
+		page.ID,
+		property,
+		mark.PageVersionProperty,
+		strconv.FormatInt(page.Version.Number, 10),
+	)
+	if err != nil {
+		return karma.Format(err, "unable to store published page version")
+	}
+
+	return nil
+}
+
+// getUserAgent returns User-Agent which mark identifies itself with, it can be
+// overridden by user_agent config field.
+func getUserAgent(config *Config) string {
+	if config.UserAgent != "" {
+		return config.UserAgent
+	}
+
+	return "mark/" + version + " (+https://github.com/bonovoxly/mark)"
+}
+
+// getBaseDir returns directory which relative links and attachments of the
+// file are resolved against: --base-dir if specified or directory of the file,
+// current directory is used for stdin.
+func getBaseDir(flags Flags, file string) string {
+	if flags.BaseDir != "" {
+		return flags.BaseDir
+	}
+
+	if file == "-" {
+		return "."
+	}
+
+	return filepath.Dir(file)
+}
+
+// getIndexFiles returns names of index files specified by --index-files flag,
+// nil is returned if flag is not set, so default names are used.
+func getIndexFiles(flags Flags) []string {
+	var names []string
+
+	for _, name := range strings.Split(flags.IndexFiles, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// getLabels returns labels of the page specified by metadata along with
+// labels specified by --label, see mark.NormalizeLabels.
+func getLabels(flags Flags, meta *mark.Meta) []string {
+	labels := mark.NormalizeLabels(flags.Labels)
+	if meta != nil {
+		labels = mark.NormalizeLabels(meta.Labels, flags.Labels)
+	}
+
+	return mark.ExcludeLabels(labels, flags.RemoveLabels)
+}
+
+// removeLabels removes labels specified by --remove-label from the page, so
+// labels added manually or by previous runs are removed too.
+func removeLabels(
+	ctx context.Context,
+	api *confluence.API,
+	flags Flags,
+	page *confluence.PageInfo,
+) (bool, error) {
+	var removed bool
+
+	for _, label := range mark.NormalizeLabels(flags.RemoveLabels) {
+		ok, err := api.RemoveLabel(ctx, page.ID, label)
+		if err != nil {
+			return false, karma.Format(
+				err,
+				"unable to remove label %q from page %q",
+				label,
+				page.Title,
+			)
+		}
+
+		if !ok {
+			log.Debugf(nil, "page %q has no label %q", page.Title, label)
+
+			continue
+		}
+
+		log.Infof(nil, "removed label %q from page %q", label, page.Title)
+
+		removed = true
+	}
+
+	return removed, nil
+}
+
+// getColor returns color mode of logs, --color flag takes precedence over
+// --no-color flag, which takes precedence over NO_COLOR environment variable.
+func getColor(flags Flags) string {
+	switch {
+	case flags.Color != "":
+		return flags.Color
+	case flags.NoColor:
+		return "never"
+	}
+
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return "never"
+	}
+
+	return "auto"
+}
+
+// upsertTarget returns id of the page specified by --space and --title if it
+// exists, otherwise metadata for creating the page is returned.
+func upsertTarget(
+	ctx context.Context,
+	api *confluence.API,
+	flags Flags,
+) (*mark.Meta, []string, error) {
+	page, err := mark.FindPageByCQL(
+		ctx,
+		api,
+		flags.Space,
+		flags.Title,
+		flags.OnMultiple,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if page != nil {
+		log.Debugf(nil, "page %q found: %s", flags.Title, page.Links.Full)
+
+		return nil, []string{page.ID}, nil
+	}
+
+	log.Infof(
+		nil,
+		"page %q is not found in space %q, it will be created",
+		flags.Title,
+		flags.Space,
+	)
+
+	return &mark.Meta{
+		Space:       flags.Space,
+		Type:        "page",
+		Title:       flags.Title,
+		Attachments: map[string]string{},
+	}, nil, nil
+}
+
+// applyMirrorTree replaces parents of the page with ancestry mirroring
+// directory structure if --mirror-tree is specified.
+func applyMirrorTree(flags Flags, file string, meta *mark.Meta) error {
+	if flags.MirrorTree == "" || meta == nil {
+		return nil
+	}
+
+	parents, err := mark.MirrorTree(
+		flags.MirrorTree,
+		file,
+		getIndexFiles(flags),
+	)
+	if err != nil {
+		return karma.Format(err, "unable to mirror directory tree")
+	}
+
+	if len(meta.Parents) > 0 {
+		log.Debugf(
+			nil,
+			"parents of %q specified in %q are ignored due to --mirror-tree",
+			meta.Title,
+			file,
+		)
+	}
+
+	meta.Parents = parents
+	meta.ParentSpace = ""
+
+	return nil
+}
+
+// getAttachmentJobs returns number of attachments uploaded concurrently.
+func getAttachmentJobs(flags Flags) (int, error) {
+	if flags.AttachJobs == "" {
+		return mark.DefaultAttachmentJobs, nil
+	}
+
+	jobs, err := strconv.Atoi(flags.AttachJobs)
+	if err != nil || jobs < 1 {
+		return 0, fmt.Errorf(
+			"invalid number of attachment jobs %q, expected positive number",
+			flags.AttachJobs,
+		)
+	}
+
+	return jobs, nil
+}
+
+// getSizeWarning returns size of storage format in bytes which pages are
+// reported to be close to the size limit at.
+func getSizeWarning(flags Flags) (int, error) {
+	if flags.SizeWarning == "" {
+		return mark.DefaultStorageSizeWarning, nil
+	}
+
+	size, err := strconv.Atoi(flags.SizeWarning)
+	if err != nil || size < 1 {
+		return 0, fmt.Errorf(
+			"invalid size warning threshold %q, expected positive number "+
+				"of bytes",
+			flags.SizeWarning,
+		)
+	}
+
+	return size, nil
+}
+
+// getRateLimit returns maximum number of requests per second which are sent
+// to Confluence at given URL, zero means no limit, see --rate-limit. Requests
+// are limited by default only on Confluence Cloud.
+func getRateLimit(flags Flags, baseURL string) (float64, error) {
+	if flags.RateLimit == "" {
+		if confluence.IsCloudURL(baseURL) {
+			return confluence.DefaultRateLimit, nil
+		}
+
+		return 0, nil
+	}
+
+	rate, err := strconv.ParseFloat(flags.RateLimit, 64)
+	if err != nil || rate < 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return 0, fmt.Errorf(
+			"invalid rate limit %q, expected non-negative number of "+
+				"requests per second",
+			flags.RateLimit,
+		)
+	}
+
+	return rate, nil
+}
+
+// checkPageSize warns if storage format of the page approaches or exceeds
+// size limit of Confluence, see --size-warning.
+func checkPageSize(flags Flags, page *confluence.PageInfo, html string) {
+	threshold, _ := getSizeWarning(flags)
+
+	switch {
+	case len(html) > mark.MaxStorageSize:
+		log.Warningf(
+			nil,
+			"page %q is %d bytes, which exceeds default limit of %d bytes, "+
+				"it's likely to be rejected by Confluence",
+			page.Title,
+			len(html),
+			mark.MaxStorageSize,
+		)
+	case len(html) > threshold:
+		log.Warningf(
+			nil,
+			"page %q is %d bytes, which is close to default limit of %d bytes",
+			page.Title,
+			len(html),
+			mark.MaxStorageSize,
+		)
+	}
+}
+
+// getLeadingHeading returns transformation of the leading heading requested
+// by command line flags.
+func getLeadingHeading(flags Flags) (mark.LeadingHeading, error) {
+	heading := mark.LeadingHeading{
+		Action: mark.LeadingHeadingKeep,
+		Level:  1,
+	}
+
+	var (
+		level string
+		count int
+	)
+
+	if flags.DropH1 {
+		heading.Action = mark.LeadingHeadingDrop
+		count++
+	}
+
+	if flags.StripHeading != "" {
+		heading.Action, level = mark.LeadingHeadingDrop, flags.StripHeading
+		count++
+	}
+
+	if flags.DemoteHeading != "" {
+		heading.Action, level = mark.LeadingHeadingDemote, flags.DemoteHeading
+		count++
+	}
+
+	if count > 1 {
+		return heading, fmt.Errorf(
+			"--drop-h1, --strip-leading-heading and " +
+				"--demote-leading-heading can't be used together",
+		)
+	}
+
+	if level != "" {
+		var err error
+
+		heading.Level, err = strconv.Atoi(level)
+		if err != nil {
+			return heading, fmt.Errorf(
+				"invalid heading level %q, expected 1 to 6",
+				level,
+			)
+		}
+	}
+
+	return heading, mark.ValidateLeadingHeading(heading)
+}
+
+// ensurePage returns page described by metadata, page is created if it
+// doesn't exist, in which case true is returned.
+func ensurePage(
+	ctx context.Context,
+	api *confluence.API,
+	parents *mark.AncestryCache,
+	flags Flags,
+	meta *mark.Meta,
+) (*confluence.PageInfo, bool, error) {
+	parent, page, err := mark.ResolvePage(
+		ctx,
+		flags.DryRun,
+		api,
+		parents,
+		meta,
+	)
+	if err != nil {
+		return nil, false, karma.Describe("title", meta.Title).Format(
+			err,
+			"unable to resolve %s",
+			meta.Type,
+		)
+	}
+
+	if page != nil {
+		return page, false, nil
+	}
+
+	if flags.CopyFrom != "" && meta.Type == "page" {
+		page, err = copyPage(ctx, api, flags, meta, parent)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return page, true, nil
+	}
+
+	page, err = api.CreatePage(
+		ctx,
+		meta.Space,
+		meta.Type,
+		parent,
+		meta.Title,
+		``,
+	)
+	if err != nil {
+		return nil, false, karma.Format(
+			err,
+			"can't create %s %q",
+			meta.Type,
+			meta.Title,
+		)
+	}
+
+	return page, true, nil
+}
+
+// copyPage creates page described by metadata with attachments of the page
+// specified by --copy-from. Body of that page is not copied since the page is
+// updated with the file right away.
+func copyPage(
+	ctx context.Context,
+	api *confluence.API,
+	flags Flags,
+	meta *mark.Meta,
+	parent *confluence.PageInfo,
+) (*confluence.PageInfo, error) {
+	page, err := api.CreatePage(
+		ctx,
+		meta.Space,
+		meta.Type,
+		parent,
+		meta.Title,
+		``,
+	)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"can't create %s %q",
+			meta.Type,
+			meta.Title,
+		)
+	}
+
+	attachments, err := mark.CopyAttachments(
+		ctx,
+		api,
+		flags.CopyFrom,
+		page.ID,
+	)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"can't copy attachments of page %q to page %q",
+			flags.CopyFrom,
+			meta.Title,
+		)
+	}
+
+	log.Infof(
+		nil,
+		"%d attachments are copied from page %q to page %q",
+		len(attachments),
+		flags.CopyFrom,
+		meta.Title,
+	)
+
+	return page, nil
+}
+
+// dumpMeta prints metadata of every file with command line overrides applied.
+// No Confluence API calls are made.
+func dumpMeta(flags Flags) {
+	files, err := listFiles(flags.Files)
+	if err != nil {
+		fatal(err)
+	}
+
+	if len(files) == 0 {
+		log.Fatal("No files matched")
+	}
+
+	for _, file := range files {
+		markdown, err := readFile(file)
+		if err != nil {
+			fatal(err)
+		}
+
+		if flags.EnvSubst {
+			markdown, err = mark.SubstituteEnv(markdown)
+			if err != nil {
+				fatalf(err, "unable to substitute variables in %q", file)
+			}
+		}
+
+		for _, section := range mark.SplitPages(markdown) {
+			meta, _, err := mark.ExtractFileMeta(
+				section,
+				file,
+				flags.TitleFromH1,
+			)
+			if err != nil {
+				fatalf(err, "unable to extract metadata from %q", file)
+			}
+
+			if meta != nil {
+				if meta.MinorEdit == nil {
+					meta.MinorEdit = &flags.MinorEdit
+				}
+
+				if flags.Message != "" {
+					meta.Message = flags.Message
+				}
+
+				if flags.Editor != "" {
+					meta.Editor = flags.Editor
+				}
+
+				if meta.Layout == "" {
+					meta.Layout = flags.Layout
+				}
+
+				if meta.CollapseCode == nil {
+					meta.CollapseCode = &flags.CollapseCode
+				}
+
+				if meta.UserScheme == "" {
+					meta.UserScheme = flags.UserScheme
+				}
+
+				if meta.HeadingAnchors == "" {
+					meta.HeadingAnchors = flags.HeadingAnchors
+				}
+
+				err := applyMirrorTree(flags, file, meta)
+				if err != nil {
+					fatal(err)
+				}
+			}
+
+			dump, err := json.MarshalIndent(
+				struct {
+					File string     `json:"file"`
+					Meta *mark.Meta `json:"meta"`
+				}{
+					File: file,
+					Meta: meta,
+				},
+				"",
+				"  ",
+			)
+			if err != nil {
+				fatal(err)
+			}
+
+			fmt.Println(string(dump))
+		}
+	}
+}
+
+func deleteFile(
+	ctx context.Context,
+	file string,
+	api *confluence.API,
+	flags Flags,
+	pageIDs []string,
+) {
+	markdown, err := readFile(file)
+	if err != nil {
+		fatal(err)
+	}
+
+	if flags.EnvSubst {
+		markdown, err = mark.SubstituteEnv(markdown)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	if len(pageIDs) > 0 {
+		for _, pageID := range pageIDs {
+			deletePage(ctx, api, flags, pageID)
+		}
+
+		return
+	}
+
+	for _, section := range mark.SplitPages(markdown) {
+		meta, _, err := mark.ExtractFileMeta(
+			section,
+			file,
+			flags.TitleFromH1,
+		)
+		if err != nil {
+			fatal(err)
+		}
+
+		if meta == nil {
+			deletePage(ctx, api, flags, "")
+
+			continue
+		}
+
+		deleteMeta(ctx, api, flags, meta)
+	}
+}
+
+// deleteMeta deletes page described by metadata along with its mirrors.
+func deleteMeta(
+	ctx context.Context,
+	api *confluence.API,
+	flags Flags,
+	meta *mark.Meta,
+) {
+	for _, space := range append([]string{meta.Space}, meta.Mirrors...) {
+		page, err := api.FindPage(ctx, space, meta.Title, meta.Type)
+		if err != nil {
+			fatalf(
+				karma.Describe("title", meta.Title).Reason(err),
+				"unable to find %s",
+				meta.Type,
+			)
+		}
+
+		if page == nil {
+			log.Warningf(
+				nil,
+				"%s %q is not found in space %q, nothing to delete",
+				meta.Type,
+				meta.Title,
+				space,
+			)
+
+			continue
+		}
+
+		deletePage(ctx, api, flags, page.ID)
+	}
+}
+
+func deletePage(
+	ctx context.Context,
+	api *confluence.API,
+	flags Flags,
+	pageID string,
+) {
+	if pageID == "" {
+		log.Fatalf(
+			nil,
+			"page id should be specified using --page-id flag "+
+				"or 'pageId' GET-parameter of URL",
+		)
+	}
+
+	page, err := api.GetPageByID(ctx, pageID)
+	if err != nil {
+		fatalf(err, "unable to retrieve page by id")
+	}
+
+	if !flags.Force && !confirm(
+		flags,
+		fmt.Sprintf(
+			"delete %s %q (%s)?",
+			page.Type,
+			page.Title,
+			api.BaseURL+page.Links.Full,
+		),
+	) {
+		log.Infof(nil, "deletion of %q is cancelled", page.Title)
+
+		return
+	}
+
+	err = api.DeletePage(ctx, page.ID)
+	if err != nil {
+		fatalf(err, "unable to delete %s %q", page.Type, page.Title)
+	}
+
+	log.Infof(nil, "page successfully deleted: %s", page.Title)
+}
+
+// isStdin returns true if markdown is read from stdin.
+func isStdin(flags Flags) bool {
+	return len(flags.Files) == 1 && flags.Files[0] == "-"
+}
+
+// listFiles returns files matched by any of given patterns in order of
+// patterns, every file is listed once. Single - pattern stands for stdin.
+func listFiles(patterns []string) ([]string, error) {
+	if len(patterns) == 1 && patterns[0] == "-" {
+		return patterns, nil
+	}
+
+	var (
+		files []string
+		seen  = map[string]bool{}
+	)
+
+	for _, pattern := range patterns {
+		if pattern == "-" {
+			return nil, fmt.Errorf("stdin (-f -) can't be combined with files")
+		}
+
+		matched, err := listPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range matched {
+			if seen[filepath.Clean(file)] {
+				continue
+			}
+
+			seen[filepath.Clean(file)] = true
+
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// listPattern returns files matched by given glob pattern, directory is
+// matched as all markdown files in it.
+func listPattern(pattern string) ([]string, error) {
+	// directory is walked recursively, so entire docs tree can be published
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		files := []string{}
+
+		err := filepath.Walk(
+			pattern,
+			func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				if !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".md") {
+					files = append(files, path)
+				}
+
+				return nil
+			},
+		)
+		if err != nil {
+			return nil, karma.Format(err, "unable to list files in %q", pattern)
+		}
+
+		return files, nil
+	}
+
+	return filepath.Glob(pattern)
+}
+
+// readFile reads markdown source from the file or from stdin if file is -,
+// source is normalized, so BOM and CRLF line endings don't break parsing.
+func readFile(file string) ([]byte, error) {
+	var (
+		source []byte
+		err    error
+	)
+
+	if file == "-" {
+		source, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		source, err = ioutil.ReadFile(file)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mark.NormalizeSource(source), nil
+}
+
+// confirm asks user to confirm the action unless --assume-yes or
+// --non-interactive is specified.
+func confirm(flags Flags, question string) bool {
+	if flags.AssumeYes {
+		log.Infof(nil, "%s yes, --assume-yes is specified", question)
+
+		return true
+	}
+
+	if flags.NonInteractive {
+		log.Warningf(
+			nil,
+			"%s no, confirmation is required in non-interactive mode, "+
+				"specify --assume-yes or --force to proceed",
+			question,
+		)
+
+		return false
+	}
+
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
 }
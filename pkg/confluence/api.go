@@ -2,14 +2,17 @@ package confluence
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/kovetskiy/gopencils"
 	"github.com/kovetskiy/lorg"
@@ -17,8 +20,67 @@ import (
 	"github.com/reconquest/pkg/log"
 )
 
+// ErrVersionConflict is returned by UpdatePage if the page was changed since
+// its version has been retrieved.
+var ErrVersionConflict = errors.New(
+	"Confluence API returned unexpected status: 409 (Conflict), " +
+		"page version is outdated",
+)
+
 type User struct {
 	AccountID string `json:"accountId"`
+
+	// Username and UserKey identify users of Confluence Server/Data Center,
+	// they are empty on Confluence Cloud.
+	Username string `json:"username"`
+	UserKey  string `json:"userKey"`
+
+	DisplayName string `json:"displayName"`
+
+	// Email is returned only if it's visible to the current user.
+	Email string `json:"email"`
+}
+
+// String returns display name of the user, or its identifier if display name
+// is not known.
+func (user *User) String() string {
+	for _, name := range []string{
+		user.DisplayName,
+		user.Username,
+		user.AccountID,
+		user.UserKey,
+	} {
+		if name != "" {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// UserScheme is an attribute which users are identified by in storage format,
+// e.g. ri:account-id of <ri:user/>.
+type UserScheme string
+
+const (
+	// UserAccountID is supported by Confluence Cloud only.
+	UserAccountID UserScheme = "account-id"
+
+	// UserName and UserKey are supported by Confluence Server/Data Center.
+	UserName UserScheme = "username"
+	UserKey  UserScheme = "userkey"
+)
+
+// Identifier returns identifier of the user according to given scheme.
+func (user *User) Identifier(scheme UserScheme) string {
+	switch scheme {
+	case UserName:
+		return user.Username
+	case UserKey:
+		return user.UserKey
+	default:
+		return user.AccountID
+	}
 }
 
 type API struct {
@@ -26,29 +88,183 @@ type API struct {
 
 	// it's deprecated accordingly to Atlassian documentation,
 	// but it's only way to set permissions
-	json    *gopencils.Resource
+	json *gopencils.Resource
+
+	// restrictions can be set via REST API of Confluence Server only using
+	// experimental endpoint
+	experimental *gopencils.Resource
+
+	// applinks describes Confluence Server/Data Center instance, including
+	// its version
+	applinks *gopencils.Resource
+
+	// server is detected once per run, see DetectServer
+	server      *ServerInfo
+	serverMutex sync.Mutex
+
+	// user is retrieved once per run, see CurrentUser
+	user      *User
+	userMutex sync.Mutex
+
 	BaseURL string
 }
 
+// Flavor is a kind of Confluence deployment, REST APIs of Confluence Cloud
+// and Confluence Server/Data Center differ.
+type Flavor string
+
+const (
+	FlavorCloud  Flavor = "cloud"
+	FlavorServer Flavor = "server"
+)
+
+// ServerInfo describes Confluence instance detected by DetectServer.
+type ServerInfo struct {
+	Flavor Flavor
+
+	// Version is a version of Confluence Server/Data Center, it's empty for
+	// Confluence Cloud and if version can't be retrieved.
+	Version string
+}
+
+// UserScheme returns scheme which users are identified by on the instance.
+func (server *ServerInfo) UserScheme() UserScheme {
+	if server.Flavor == FlavorCloud {
+		return UserAccountID
+	}
+
+	return UserName
+}
+
+// Restriction lists users and groups which are allowed to perform the
+// operation on the page, operation is either "read" or "update".
+type Restriction struct {
+	Operation string
+	Users     []string
+	Groups    []string
+}
+
+type PageAncestor struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+}
+
 type PageInfo struct {
 	ID    string `json:"id"`
 	Title string `json:"title"`
 	Type  string `json:"type"`
 
+	Space struct {
+		Key string `json:"key"`
+	} `json:"space"`
+
 	Version struct {
-		Number int64 `json:"number"`
+		Number int64  `json:"number"`
+		When   string `json:"when"`
 	} `json:"version"`
 
-	Ancestors []struct {
-		Id    string `json:"id"`
-		Title string `json:"title"`
-	} `json:"ancestors"`
+	Ancestors []PageAncestor `json:"ancestors"`
+
+	// Body, Metadata and Restrictions are filled only if requested by
+	// ExpandBody, ExpandLabels and ExpandRestrictions of GetPageByID.
+	Body struct {
+		Storage struct {
+			Value string `json:"value"`
+		} `json:"storage"`
+	} `json:"body"`
+
+	Metadata struct {
+		Labels struct {
+			Results []struct {
+				Name string `json:"name"`
+			} `json:"results"`
+		} `json:"labels"`
+	} `json:"metadata"`
+
+	Restrictions map[string]struct {
+		Restrictions struct {
+			User struct {
+				Results []User `json:"results"`
+			} `json:"user"`
+			Group struct {
+				Results []struct {
+					Name string `json:"name"`
+				} `json:"results"`
+			} `json:"group"`
+		} `json:"restrictions"`
+	} `json:"restrictions"`
 
 	Links struct {
 		Full string `json:"webui"`
 	} `json:"_links"`
 }
 
+// Fields of the page which can be requested by GetPageByID in addition to
+// ancestors, version and space, which are always fetched.
+const (
+	ExpandBody   = "body.storage"
+	ExpandLabels = "metadata.labels"
+
+	ExpandRestrictions = "restrictions.read.restrictions.user," +
+		"restrictions.read.restrictions.group," +
+		"restrictions.update.restrictions.user," +
+		"restrictions.update.restrictions.group"
+)
+
+// defaultPageExpand is a list of fields which GetPageByID always fetches.
+var defaultPageExpand = []string{"ancestors", "version", "space"}
+
+// GetLabels returns names of labels of the page fetched with ExpandLabels.
+// Only first 200 labels are returned by Confluence, use GetPageLabels to get
+// all of them.
+func (page *PageInfo) GetLabels() []string {
+	labels := []string{}
+	for _, label := range page.Metadata.Labels.Results {
+		labels = append(labels, label.Name)
+	}
+
+	return labels
+}
+
+// GetRestrictions returns restrictions of the page fetched with
+// ExpandRestrictions, users are identified the same way as in
+// SetRestrictions. Operations without restrictions are omitted.
+func (page *PageInfo) GetRestrictions() []Restriction {
+	restrictions := []Restriction{}
+
+	for _, operation := range []string{"read", "update"} {
+		restriction := Restriction{Operation: operation}
+
+		expanded := page.Restrictions[operation].Restrictions
+		for _, user := range expanded.User.Results {
+			if user.AccountID != "" {
+				restriction.Users = append(restriction.Users, user.AccountID)
+			} else {
+				restriction.Users = append(restriction.Users, user.Username)
+			}
+		}
+
+		for _, group := range expanded.Group.Results {
+			restriction.Groups = append(restriction.Groups, group.Name)
+		}
+
+		if len(restriction.Users) > 0 || len(restriction.Groups) > 0 {
+			restrictions = append(restrictions, restriction)
+		}
+	}
+
+	return restrictions
+}
+
+type PageProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+
+	Version struct {
+		Number int64 `json:"number"`
+	} `json:"version"`
+}
+
 type AttachmentInfo struct {
 	Filename string `json:"title"`
 	ID       string `json:"id"`
@@ -70,33 +286,61 @@ type tracer struct {
 	prefix string
 }
 
+// traceMutex serializes tracing of concurrent requests, since logger is not
+// safe for concurrent use.
+var traceMutex sync.Mutex
+
 func (tracer *tracer) Printf(format string, args ...interface{}) {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+
 	log.Tracef(nil, tracer.prefix+" "+format, args...)
 }
 
-func NewAPI(baseURL string, username string, password string) *API {
-	auth := &gopencils.BasicAuth{username, password}
+func NewAPI(
+	baseURL string,
+	username string,
+	password string,
+	client *http.Client,
+) *API {
+	// basic auth is not used if username is not specified, e.g. when bearer
+	// token is set up in the client
+	var auth *gopencils.BasicAuth
+	if username != "" {
+		auth = &gopencils.BasicAuth{Username: username, Password: password}
+	}
 
-	rest := gopencils.Api(baseURL+"/rest/api", auth)
+	rest := gopencils.Api(baseURL+"/rest/api", auth, client)
 	json := gopencils.Api(
 		baseURL+"/rpc/json-rpc/confluenceservice-v2",
 		auth,
+		client,
 	)
 
+	experimental := gopencils.Api(baseURL+"/rest/experimental", auth, client)
+	applinks := gopencils.Api(baseURL+"/rest/applinks/1.0", auth, client)
+
 	if log.GetLevel() == lorg.LevelTrace {
 		rest.Logger = &tracer{"rest:"}
 		json.Logger = &tracer{"json-rpc:"}
+		experimental.Logger = &tracer{"rest:"}
+		applinks.Logger = &tracer{"rest:"}
 	}
 
 	return &API{
-		rest:    rest,
-		json:    json,
-		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		rest:         rest,
+		json:         json,
+		experimental: experimental,
+		applinks:     applinks,
+		BaseURL:      strings.TrimSuffix(baseURL, "/"),
 	}
 }
 
-func (api *API) FindRootPage(space string) (*PageInfo, error) {
-	page, err := api.FindPage(space, ``, "page")
+func (api *API) FindRootPage(
+	ctx context.Context,
+	space string,
+) (*PageInfo, error) {
+	page, err := api.FindPage(ctx, space, ``, "page")
 	if err != nil {
 		return nil, karma.Format(
 			err,
@@ -122,14 +366,19 @@ func (api *API) FindRootPage(space string) (*PageInfo, error) {
 	}, nil
 }
 
-func (api *API) FindPage(space string, title string, pageType string) (*PageInfo, error) {
+func (api *API) FindPage(
+	ctx context.Context,
+	space string,
+	title string,
+	pageType string,
+) (*PageInfo, error) {
 	result := struct {
 		Results []PageInfo `json:"results"`
 	}{}
 
 	payload := map[string]string{
 		"spaceKey": space,
-		"expand":   "ancestors,version",
+		"expand":   "ancestors,version,space",
 		"type":     pageType,
 	}
 
@@ -137,7 +386,7 @@ func (api *API) FindPage(space string, title string, pageType string) (*PageInfo
 		payload["title"] = title
 	}
 
-	request, err := api.rest.Res(
+	request, err := withContext(ctx, api.rest).Res(
 		"content/", &result,
 	).Get(payload)
 	if err != nil {
@@ -157,7 +406,53 @@ func (api *API) FindPage(space string, title string, pageType string) (*PageInfo
 	return &result.Results[0], nil
 }
 
+// SearchByCQL returns every content matching given CQL query, results of all
+// pages of the response are collected.
+func (api *API) SearchByCQL(
+	ctx context.Context,
+	cql string,
+) ([]PageInfo, error) {
+	pages := []PageInfo{}
+
+	resource := "content/search"
+	query := map[string]string{
+		"cql":    cql,
+		"expand": "ancestors,version,space",
+		"limit":  "100",
+	}
+
+	for {
+		result := struct {
+			Links   pageLinks  `json:"_links"`
+			Results []PageInfo `json:"results"`
+		}{}
+
+		request, err := withContext(ctx, api.rest).Res(
+			resource, &result,
+		).Get(query)
+		if err != nil {
+			return nil, err
+		}
+
+		if request.Raw.StatusCode != 200 {
+			return nil, newErrorStatusNotOK(request)
+		}
+
+		pages = append(pages, result.Results...)
+
+		if result.Links.Next == "" {
+			return pages, nil
+		}
+
+		resource, query, err = parseNextLink(result.Links.Next)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
 func (api *API) CreateAttachment(
+	ctx context.Context,
 	pageID string,
 	name string,
 	comment string,
@@ -177,7 +472,7 @@ func (api *API) CreateAttachment(
 		Results []AttachmentInfo `json:"results"`
 	}
 
-	resource := api.rest.Res(
+	resource := withContext(ctx, api.rest).Res(
 		"content/"+pageID+"/child/attachment", &result,
 	)
 
@@ -217,6 +512,7 @@ func (api *API) CreateAttachment(
 }
 
 func (api *API) UpdateAttachment(
+	ctx context.Context,
 	pageID string,
 	attachID string,
 	name string,
@@ -237,7 +533,7 @@ func (api *API) UpdateAttachment(
 		Results []AttachmentInfo `json:"results"`
 	}
 
-	resource := api.rest.Res(
+	resource := withContext(ctx, api.rest).Res(
 		"content/"+pageID+"/child/attachment/"+attachID+"/data", &result,
 	)
 
@@ -339,21 +635,70 @@ func getAttachmentPayload(name, comment, path string) (*form, error) {
 	}, nil
 }
 
-func (api *API) GetAttachments(pageID string) ([]AttachmentInfo, error) {
-	result := struct {
-		Links struct {
-			Context string `json:"context"`
-		} `json:"_links"`
-		Results []AttachmentInfo `json:"results"`
-	}{}
+// GetAttachments returns every attachment of the page, results of all pages
+// of the response are collected, so attachments of pages with many of them
+// are not missed.
+func (api *API) GetAttachments(
+	ctx context.Context,
+	pageID string,
+) ([]AttachmentInfo, error) {
+	attachments := []AttachmentInfo{}
 
-	payload := map[string]string{
+	resource := "content/" + pageID + "/child/attachment"
+	query := map[string]string{
 		"expand": "version,container",
+		"limit":  "100",
 	}
 
-	request, err := api.rest.Res(
-		"content/"+pageID+"/child/attachment", &result,
-	).Get(payload)
+	for {
+		result := struct {
+			Links   pageLinks        `json:"_links"`
+			Results []AttachmentInfo `json:"results"`
+		}{}
+
+		request, err := withContext(ctx, api.rest).Res(
+			resource, &result,
+		).Get(query)
+		if err != nil {
+			return nil, err
+		}
+
+		if request.Raw.StatusCode != 200 {
+			return nil, newErrorStatusNotOK(request)
+		}
+
+		for _, info := range result.Results {
+			if info.Links.Context == "" {
+				info.Links.Context = result.Links.Context
+			}
+
+			attachments = append(attachments, info)
+		}
+
+		if result.Links.Next == "" {
+			return attachments, nil
+		}
+
+		resource, query, err = parseNextLink(result.Links.Next)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// GetPageByID returns the page with its ancestors, version and space, other
+// fields are fetched only if requested, e.g. ExpandBody, so they don't take
+// separate requests.
+func (api *API) GetPageByID(
+	ctx context.Context,
+	pageID string,
+	expand ...string,
+) (*PageInfo, error) {
+	expand = append(append([]string{}, defaultPageExpand...), expand...)
+
+	request, err := withContext(ctx, api.rest).Res(
+		"content/"+pageID, &PageInfo{},
+	).Get(map[string]string{"expand": strings.Join(expand, ",")})
 	if err != nil {
 		return nil, err
 	}
@@ -362,33 +707,100 @@ func (api *API) GetAttachments(pageID string) ([]AttachmentInfo, error) {
 		return nil, newErrorStatusNotOK(request)
 	}
 
-	for i, info := range result.Results {
-		if info.Links.Context == "" {
-			info.Links.Context = result.Links.Context
+	return request.Response.(*PageInfo), nil
+}
+
+// GetPageChildren returns child pages of the page, results of all pages of
+// the response are collected.
+func (api *API) GetPageChildren(
+	ctx context.Context,
+	pageID string,
+) ([]PageInfo, error) {
+	pages := []PageInfo{}
+
+	resource := "content/" + pageID + "/child/page"
+	query := map[string]string{
+		"expand": "ancestors,version,space",
+		"limit":  "100",
+	}
+
+	for {
+		result := struct {
+			Links   pageLinks  `json:"_links"`
+			Results []PageInfo `json:"results"`
+		}{}
+
+		request, err := withContext(ctx, api.rest).Res(
+			resource, &result,
+		).Get(query)
+		if err != nil {
+			return nil, err
 		}
 
-		result.Results[i] = info
+		if request.Raw.StatusCode != 200 {
+			return nil, newErrorStatusNotOK(request)
+		}
+
+		pages = append(pages, result.Results...)
+
+		if result.Links.Next == "" {
+			return pages, nil
+		}
+
+		resource, query, err = parseNextLink(result.Links.Next)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// GetPageBody returns body of the page in storage format.
+func (api *API) GetPageBody(
+	ctx context.Context,
+	pageID string,
+) (string, error) {
+	page, err := api.GetPageByID(ctx, pageID, ExpandBody)
+	if err != nil {
+		return "", err
 	}
 
-	return result.Results, nil
+	return page.Body.Storage.Value, nil
 }
 
-func (api *API) GetPageByID(pageID string) (*PageInfo, error) {
-	request, err := api.rest.Res(
-		"content/"+pageID, &PageInfo{},
-	).Get(map[string]string{"expand": "ancestors,version"})
+// ConvertBody converts page body from one representation to another using
+// Confluence, e.g. from storage to view representation, which is HTML shown
+// to readers.
+func (api *API) ConvertBody(
+	ctx context.Context,
+	body string,
+	from string,
+	to string,
+) (string, error) {
+	payload := map[string]interface{}{
+		"value":          body,
+		"representation": from,
+	}
+
+	result := struct {
+		Value string `json:"value"`
+	}{}
+
+	request, err := withContext(ctx, api.rest).Res(
+		"contentbody/convert/"+to, &result,
+	).Post(payload)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	if request.Raw.StatusCode != 200 {
-		return nil, newErrorStatusNotOK(request)
+		return "", newErrorStatusNotOK(request)
 	}
 
-	return request.Response.(*PageInfo), nil
+	return result.Value, nil
 }
 
 func (api *API) CreatePage(
+	ctx context.Context,
 	space string,
 	pageType string,
 	parent *PageInfo,
@@ -422,7 +834,7 @@ func (api *API) CreatePage(
 		}
 	}
 
-	request, err := api.rest.Res(
+	request, err := withContext(ctx, api.rest).Res(
 		"content/", &PageInfo{},
 	).Post(payload)
 	if err != nil {
@@ -436,8 +848,89 @@ func (api *API) CreatePage(
 	return request.Response.(*PageInfo), nil
 }
 
+// CopyAttachment uploads attachment of another page to the target page with
+// the same name and given comment. Attachment is downloaded into temporary
+// file first.
+func (api *API) CopyAttachment(
+	ctx context.Context,
+	attachment AttachmentInfo,
+	targetID string,
+	comment string,
+) (AttachmentInfo, error) {
+	file, err := ioutil.TempFile("", "mark-attachment-")
+	if err != nil {
+		return AttachmentInfo{}, karma.Format(
+			err,
+			"unable to create temporary file",
+		)
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	err = api.downloadAttachment(ctx, attachment, file)
+	if err != nil {
+		return AttachmentInfo{}, err
+	}
+
+	return api.CreateAttachment(
+		ctx,
+		targetID,
+		attachment.Filename,
+		comment,
+		file.Name(),
+	)
+}
+
+// downloadAttachment writes contents of the attachment into given writer.
+func (api *API) downloadAttachment(
+	ctx context.Context,
+	attachment AttachmentInfo,
+	writer io.Writer,
+) error {
+	request, err := http.NewRequest(
+		http.MethodGet,
+		api.BaseURL+attachment.Links.Download,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+
+	if auth := api.rest.Api.BasicAuth; auth != nil {
+		request.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	response, err := api.rest.Api.Client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return &StatusError{
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+		}
+	}
+
+	_, err = io.Copy(writer, response.Body)
+	if err != nil {
+		return karma.Format(err, "unable to download attachment")
+	}
+
+	return nil
+}
+
 func (api *API) UpdatePage(
-	page *PageInfo, newContent string, minorEdit bool, newLabels []string,
+	ctx context.Context,
+	page *PageInfo,
+	newContent string,
+	minorEdit bool,
+	versionMessage string,
+	newLabels []string,
+	properties map[string]string,
 ) error {
 	nextPageVersion := page.Version.Number + 1
 	oldAncestors := []map[string]interface{}{}
@@ -467,14 +960,36 @@ func (api *API) UpdatePage(
 		}
 	}
 
+	version := map[string]interface{}{
+		"number":    nextPageVersion,
+		"minorEdit": minorEdit,
+	}
+
+	if versionMessage != "" {
+		version["message"] = versionMessage
+	}
+
+	metadata := map[string]interface{}{
+		"labels": labels,
+	}
+
+	if len(properties) > 0 {
+		values := map[string]interface{}{}
+		for key, value := range properties {
+			values[key] = map[string]interface{}{
+				"key":   key,
+				"value": value,
+			}
+		}
+
+		metadata["properties"] = values
+	}
+
 	payload := map[string]interface{}{
-		"id":    page.ID,
-		"type":  page.Type,
-		"title": page.Title,
-		"version": map[string]interface{}{
-			"number":    nextPageVersion,
-			"minorEdit": minorEdit,
-		},
+		"id":        page.ID,
+		"type":      page.Type,
+		"title":     page.Title,
+		"version":   version,
 		"ancestors": oldAncestors,
 		"body": map[string]interface{}{
 			"storage": map[string]interface{}{
@@ -482,18 +997,20 @@ func (api *API) UpdatePage(
 				"representation": "storage",
 			},
 		},
-		"metadata": map[string]interface{}{
-			"labels": labels,
-		},
+		"metadata": metadata,
 	}
 
-	request, err := api.rest.Res(
+	request, err := withContext(ctx, api.rest).Res(
 		"content/"+page.ID, &map[string]interface{}{},
 	).Put(payload)
 	if err != nil {
 		return err
 	}
 
+	if request.Raw.StatusCode == 409 {
+		return ErrVersionConflict
+	}
+
 	if request.Raw.StatusCode != 200 {
 		return newErrorStatusNotOK(request)
 	}
@@ -501,62 +1018,456 @@ func (api *API) UpdatePage(
 	return nil
 }
 
-func (api *API) GetUserByName(name string) (*User, error) {
-	var response struct {
-		Results []struct {
-			User User
-		}
-	}
-
-	_, err := api.rest.
-		Res("search").
-		Res("user", &response).
-		Get(map[string]string{
-			"cql": fmt.Sprintf("user.fullname~%q", name),
-		})
+func (api *API) GetPageProperty(
+	ctx context.Context,
+	pageID string,
+	key string,
+) (*PageProperty, error) {
+	request, err := withContext(ctx, api.rest).Res(
+		"content/"+pageID+"/property/"+key, &PageProperty{},
+	).Get()
 	if err != nil {
 		return nil, err
 	}
 
-	if len(response.Results) == 0 {
-		return nil, karma.
-			Describe("name", name).
-			Reason(
-				"user with given name is not found",
-			)
+	// allow 404 because it's fine if property is not set,
+	// the function will return nil, nil
+	if request.Raw.StatusCode == 404 {
+		return nil, nil
 	}
 
-	return &response.Results[0].User, nil
-}
-
-func (api *API) GetCurrentUser() (*User, error) {
-	var user User
-
-	_, err := api.rest.
-		Res("user").
-		Res("current", &user).
-		Get()
-	if err != nil {
-		return nil, err
+	if request.Raw.StatusCode != 200 {
+		return nil, newErrorStatusNotOK(request)
 	}
 
-	return &user, nil
+	return request.Response.(*PageProperty), nil
 }
 
-func (api *API) RestrictPageUpdatesCloud(
-	page *PageInfo,
-	allowedUser string,
+// SetPageProperty creates page property if given property is nil or updates
+// it otherwise.
+func (api *API) SetPageProperty(
+	ctx context.Context,
+	pageID string,
+	property *PageProperty,
+	key string,
+	value string,
 ) error {
-	user, err := api.GetCurrentUser()
+	var (
+		request *gopencils.Resource
+		err     error
+	)
+
+	if property == nil {
+		request, err = withContext(ctx, api.rest).Res(
+			"content/"+pageID+"/property", &PageProperty{},
+		).Post(map[string]interface{}{
+			"key":   key,
+			"value": value,
+		})
+	} else {
+		request, err = withContext(ctx, api.rest).Res(
+			"content/"+pageID+"/property/"+key, &PageProperty{},
+		).Put(map[string]interface{}{
+			"key":   key,
+			"value": value,
+			"version": map[string]interface{}{
+				"number": property.Version.Number + 1,
+			},
+		})
+	}
 	if err != nil {
 		return err
 	}
 
-	var result interface{}
+	if request.Raw.StatusCode != 200 {
+		return newErrorStatusNotOK(request)
+	}
 
-	request, err := api.rest.
-		Res("content").
-		Id(page.ID).
+	return nil
+}
+
+// GetPageLabels returns names of labels of the page, results of all pages of
+// the response are collected.
+func (api *API) GetPageLabels(
+	ctx context.Context,
+	pageID string,
+) ([]string, error) {
+	labels := []string{}
+
+	resource := "content/" + pageID + "/label"
+	query := map[string]string{
+		"limit": "200",
+	}
+
+	for {
+		result := struct {
+			Links   pageLinks `json:"_links"`
+			Results []struct {
+				Name string `json:"name"`
+			} `json:"results"`
+		}{}
+
+		request, err := withContext(ctx, api.rest).Res(
+			resource, &result,
+		).Get(query)
+		if err != nil {
+			return nil, err
+		}
+
+		if request.Raw.StatusCode != 200 {
+			return nil, newErrorStatusNotOK(request)
+		}
+
+		for _, label := range result.Results {
+			labels = append(labels, label.Name)
+		}
+
+		if result.Links.Next == "" {
+			return labels, nil
+		}
+
+		resource, query, err = parseNextLink(result.Links.Next)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// AddPageLabels adds labels to the page, labels which the page already has
+// are left as is.
+func (api *API) AddPageLabels(
+	ctx context.Context,
+	pageID string,
+	labels []string,
+) error {
+	payload := []map[string]interface{}{}
+	for _, label := range labels {
+		payload = append(payload, map[string]interface{}{
+			"prefix": "global",
+			"name":   label,
+		})
+	}
+
+	request, err := withContext(ctx, api.rest).Res(
+		"content/"+pageID+"/label", &map[string]interface{}{},
+	).Post(payload)
+	if err != nil {
+		return err
+	}
+
+	if request.Raw.StatusCode != 200 {
+		return newErrorStatusNotOK(request)
+	}
+
+	return nil
+}
+
+// DeletePageLabel removes label from the page.
+func (api *API) DeletePageLabel(
+	ctx context.Context,
+	pageID string,
+	label string,
+) error {
+	request, err := withContext(ctx, api.rest).Res(
+		"content/"+pageID+"/label", &map[string]interface{}{},
+	).Delete(map[string]string{"name": label})
+	// confluence responds with empty body on successful deletion,
+	// so io.EOF is expected while decoding it
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if request.Raw.StatusCode != 204 && request.Raw.StatusCode != 200 {
+		return newErrorStatusNotOK(request)
+	}
+
+	return nil
+}
+
+// RemoveLabel removes label from the page if the page has it. Returns true if
+// the label has been removed and false if the page has no such label.
+func (api *API) RemoveLabel(
+	ctx context.Context,
+	pageID string,
+	label string,
+) (bool, error) {
+	labels, err := api.GetPageLabels(ctx, pageID)
+	if err != nil {
+		return false, karma.Format(err, "unable to retrieve page labels")
+	}
+
+	for _, name := range labels {
+		if name != label {
+			continue
+		}
+
+		err := api.DeletePageLabel(ctx, pageID, label)
+		if err != nil {
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// UpdatePageMeta adds labels to the page and sets its content properties
+// without updating the body, so no new version of the page is created.
+// Labels which the page already has are kept. Returns true if anything has
+// been changed.
+func (api *API) UpdatePageMeta(
+	ctx context.Context,
+	page *PageInfo,
+	labels []string,
+	properties map[string]string,
+) (bool, error) {
+	current, err := api.GetPageLabels(ctx, page.ID)
+	if err != nil {
+		return false, karma.Format(err, "unable to retrieve page labels")
+	}
+
+	var (
+		changed bool
+		have    = map[string]bool{}
+		adding  = []string{}
+	)
+
+	for _, label := range current {
+		have[label] = true
+	}
+
+	for _, label := range labels {
+		if label == "" {
+			continue
+		}
+
+		if !have[label] {
+			adding = append(adding, label)
+		}
+	}
+
+	if len(adding) > 0 {
+		err := api.AddPageLabels(ctx, page.ID, adding)
+		if err != nil {
+			return false, karma.Format(err, "unable to add page labels")
+		}
+
+		changed = true
+	}
+
+	for key, value := range properties {
+		property, err := api.GetPageProperty(ctx, page.ID, key)
+		if err != nil {
+			return false, karma.Format(
+				err,
+				"unable to retrieve page property %q",
+				key,
+			)
+		}
+
+		if property != nil && property.Value == value {
+			continue
+		}
+
+		err = api.SetPageProperty(ctx, page.ID, property, key, value)
+		if err != nil {
+			return false, karma.Format(
+				err,
+				"unable to set page property %q",
+				key,
+			)
+		}
+
+		changed = true
+	}
+
+	return changed, nil
+}
+
+func (api *API) DeletePage(ctx context.Context, pageID string) error {
+	return api.deleteContent(ctx, pageID)
+}
+
+func (api *API) DeleteAttachment(
+	ctx context.Context,
+	attachmentID string,
+) error {
+	return api.deleteContent(ctx, attachmentID)
+}
+
+func (api *API) deleteContent(ctx context.Context, contentID string) error {
+	request, err := withContext(ctx, api.rest).Res(
+		"content/"+contentID, &map[string]interface{}{},
+	).Delete()
+	// confluence responds with empty body on successful deletion,
+	// so io.EOF is expected while decoding it
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if request.Raw.StatusCode != 204 && request.Raw.StatusCode != 200 {
+		return newErrorStatusNotOK(request)
+	}
+
+	return nil
+}
+
+func (api *API) GetUserByName(ctx context.Context, name string) (*User, error) {
+	user, err := api.searchUser(ctx, fmt.Sprintf("user.fullname~%q", name))
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, karma.
+			Describe("name", name).
+			Reason(
+				"user with given name is not found",
+			)
+	}
+
+	return user, nil
+}
+
+// GetUserByEmail finds user by email using user search, which matches users
+// by email as well as by name. Found users are matched by email if it's
+// visible, otherwise the user is returned only if it's the only one found.
+func (api *API) GetUserByEmail(
+	ctx context.Context,
+	email string,
+) (*User, error) {
+	users, err := api.searchUsers(ctx, fmt.Sprintf("user.fullname~%q", email))
+	if err != nil {
+		return nil, err
+	}
+
+	var user *User
+	for i := range users {
+		if strings.EqualFold(users[i].Email, email) {
+			user = &users[i]
+			break
+		}
+	}
+
+	if user == nil && len(users) == 1 && users[0].Email == "" {
+		user = &users[0]
+	}
+
+	if user == nil {
+		return nil, karma.
+			Describe("email", email).
+			Reason(
+				"user with given email is not found",
+			)
+	}
+
+	return user, nil
+}
+
+// searchUser returns first user matching given CQL query or nil if there is
+// no such user.
+func (api *API) searchUser(ctx context.Context, cql string) (*User, error) {
+	users, err := api.searchUsers(ctx, cql)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	return &users[0], nil
+}
+
+// searchUsers returns users matching given CQL query using user search,
+// only user fields like user.fullname are supported by the query.
+func (api *API) searchUsers(ctx context.Context, cql string) ([]User, error) {
+	var response struct {
+		Results []struct {
+			User User
+		}
+	}
+
+	_, err := withContext(ctx, api.rest).
+		Res("search").
+		Res("user", &response).
+		Get(map[string]string{
+			"cql": cql,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	for _, result := range response.Results {
+		users = append(users, result.User)
+	}
+
+	return users, nil
+}
+
+func (api *API) GetCurrentUser(ctx context.Context) (*User, error) {
+	var user User
+
+	request, err := withContext(ctx, api.rest).
+		Res("user").
+		Res("current", &user).
+		Get()
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Raw.StatusCode != 200 {
+		return nil, newErrorStatusNotOK(request)
+	}
+
+	return &user, nil
+}
+
+// CurrentUser returns the user which requests are authenticated as, it's
+// retrieved once per run. Error is returned if the user can't be identified,
+// e.g. if requests are anonymous, so nothing is done on behalf of a wrong
+// user.
+func (api *API) CurrentUser(ctx context.Context) (*User, error) {
+	api.userMutex.Lock()
+	defer api.userMutex.Unlock()
+
+	if api.user != nil {
+		return api.user, nil
+	}
+
+	user, err := api.GetCurrentUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.AccountID == "" && user.Username == "" {
+		return nil, errors.New(
+			"current user has neither account id nor username, " +
+				"requests are probably anonymous",
+		)
+	}
+
+	api.user = user
+
+	return user, nil
+}
+
+func (api *API) RestrictPageUpdatesCloud(
+	ctx context.Context,
+	page *PageInfo,
+	user *User,
+) error {
+	if user.AccountID == "" {
+		return fmt.Errorf("user %q has no account id", user)
+	}
+
+	var result interface{}
+
+	request, err := withContext(ctx, api.rest).
+		Res("content").
+		Id(page.ID).
 		Res("restriction", &result).
 		Post([]map[string]interface{}{
 			{
@@ -583,22 +1494,27 @@ func (api *API) RestrictPageUpdatesCloud(
 }
 
 func (api *API) RestrictPageUpdatesServer(
+	ctx context.Context,
 	page *PageInfo,
-	allowedUser string,
+	user *User,
 ) error {
+	if user.Username == "" {
+		return fmt.Errorf("user %q has no username", user)
+	}
+
 	var (
 		err    error
 		result interface{}
 	)
 
-	request, err := api.json.Res(
+	request, err := withContext(ctx, api.json).Res(
 		"setContentPermissions", &result,
 	).Post([]interface{}{
 		page.ID,
 		"Edit",
 		[]map[string]interface{}{
 			{
-				"userName": allowedUser,
+				"userName": user.Username,
 			},
 		},
 	})
@@ -620,40 +1536,275 @@ func (api *API) RestrictPageUpdatesServer(
 	return nil
 }
 
+// SetRestrictions replaces restrictions of the page with given ones. Users
+// are identified by account ids in Confluence Cloud and by user names in
+// Confluence Server, see UserIdentifier. Restrictions of the operation are
+// cleared if it has neither users nor groups.
+func (api *API) SetRestrictions(
+	ctx context.Context,
+	page *PageInfo,
+	restrictions []Restriction,
+) error {
+	var (
+		cloud    = api.isCloud()
+		payload  = []map[string]interface{}{}
+		resource = api.experimental
+	)
+
+	if cloud {
+		resource = api.rest
+	}
+
+	for _, restriction := range restrictions {
+		users := []map[string]interface{}{}
+		for _, user := range restriction.Users {
+			if cloud {
+				users = append(users, map[string]interface{}{
+					"type":      "known",
+					"accountId": user,
+				})
+			} else {
+				users = append(users, map[string]interface{}{
+					"type":     "known",
+					"username": user,
+				})
+			}
+		}
+
+		groups := []map[string]interface{}{}
+		for _, group := range restriction.Groups {
+			groups = append(groups, map[string]interface{}{
+				"type": "group",
+				"name": group,
+			})
+		}
+
+		payload = append(payload, map[string]interface{}{
+			"operation": restriction.Operation,
+			"restrictions": map[string]interface{}{
+				"user":  users,
+				"group": groups,
+			},
+		})
+	}
+
+	var result interface{}
+
+	request, err := withContext(ctx, resource).
+		Res("content").
+		Id(page.ID).
+		Res("restriction", &result).
+		Put(payload)
+	if err != nil {
+		return err
+	}
+
+	if request.Raw.StatusCode != 200 {
+		return newErrorStatusNotOK(request)
+	}
+
+	return nil
+}
+
+// DetectServer probes Confluence instance to find out whether it's Confluence
+// Cloud or Confluence Server/Data Center. Instance is probed once, following
+// calls return the same result. Once detected, flavor is used instead of
+// guessing it by host name, e.g. for setting restrictions.
+func (api *API) DetectServer(ctx context.Context) (*ServerInfo, error) {
+	api.serverMutex.Lock()
+	defer api.serverMutex.Unlock()
+
+	if api.server != nil {
+		return api.server, nil
+	}
+
+	// system info is provided only by Confluence Cloud
+	result := struct {
+		CloudID string `json:"cloudId"`
+	}{}
+
+	request, err := withContext(ctx, api.rest).Res(
+		"settings/systemInfo", &result,
+	).Get()
+	// response which can't be decoded doesn't come from Confluence Cloud,
+	// only errors of sending the request are reported
+	if err != nil && request.Raw == nil {
+		return nil, err
+	}
+
+	switch request.Raw.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, newErrorStatusNotOK(request)
+	}
+
+	if err == nil &&
+		request.Raw.StatusCode == http.StatusOK &&
+		result.CloudID != "" {
+		api.server = &ServerInfo{Flavor: FlavorCloud}
+
+		return api.server, nil
+	}
+
+	server := &ServerInfo{Flavor: FlavorServer}
+
+	manifest := struct {
+		Version string `json:"version"`
+	}{}
+
+	// version is optional, so errors are not reported
+	request, err = withContext(ctx, api.applinks).Res(
+		"manifest", &manifest,
+	).Get()
+	if err == nil && request.Raw.StatusCode == http.StatusOK {
+		server.Version = manifest.Version
+	}
+
+	api.server = server
+
+	return api.server, nil
+}
+
+// Server returns Confluence instance detected by DetectServer or nil if it's
+// not detected yet.
+func (api *API) Server() *ServerInfo {
+	api.serverMutex.Lock()
+	defer api.serverMutex.Unlock()
+
+	return api.server
+}
+
+func (api *API) isCloud() bool {
+	api.serverMutex.Lock()
+	defer api.serverMutex.Unlock()
+
+	if api.server != nil {
+		return api.server.Flavor == FlavorCloud
+	}
+
+	return isCloudHost(api.rest.Api.BaseUrl.Host)
+}
+
+// IsCloudURL returns true if given URL points to Confluence Cloud, it's
+// guessed by atlassian.net host name before flavor is detected.
+func IsCloudURL(baseURL string) bool {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return false
+	}
+
+	return isCloudHost(parsed.Host)
+}
+
+func isCloudHost(host string) bool {
+	return strings.HasSuffix(host, "atlassian.net")
+}
+
+// UserIdentifier returns identifier of the user which is used in page
+// restrictions: account id in Confluence Cloud and user name in Confluence
+// Server.
+func (api *API) UserIdentifier(user *User) string {
+	if api.isCloud() {
+		return user.AccountID
+	}
+
+	return user.Username
+}
+
+// RestrictPageUpdates allows only given user to edit the page. Restrictions
+// are read back afterwards, so error is returned if the user is not the one
+// the page is locked for, e.g. due to mismatching user identifiers.
 func (api *API) RestrictPageUpdates(
+	ctx context.Context,
 	page *PageInfo,
-	allowedUser string,
+	user *User,
 ) error {
 	var err error
 
-	if strings.HasSuffix(api.rest.Api.BaseUrl.Host, "atlassian.net") {
-		err = api.RestrictPageUpdatesCloud(page, allowedUser)
+	if api.isCloud() {
+		err = api.RestrictPageUpdatesCloud(ctx, page, user)
 	} else {
-		err = api.RestrictPageUpdatesServer(page, allowedUser)
+		err = api.RestrictPageUpdatesServer(ctx, page, user)
 	}
 
-	return err
+	if err != nil {
+		return err
+	}
+
+	identifier := api.UserIdentifier(user)
+
+	restricted, err := api.GetPageByID(ctx, page.ID, ExpandRestrictions)
+	if err != nil {
+		return karma.Format(err, "unable to retrieve page restrictions")
+	}
+
+	for _, restriction := range restricted.GetRestrictions() {
+		if restriction.Operation != "update" {
+			continue
+		}
+
+		for _, allowed := range restriction.Users {
+			if allowed == identifier {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf(
+		"page is not locked for user %q after setting restrictions, "+
+			"expected identifier: %s",
+		user,
+		identifier,
+	)
 }
 
-func newErrorStatusNotOK(request *gopencils.Resource) error {
-	if request.Raw.StatusCode == 401 {
-		return errors.New(
-			"Confluence API returned unexpected status: 401 (Unauthorized)",
-		)
+// restPrefix is a path prefix of REST API resources in links returned by
+// Confluence.
+const restPrefix = "/rest/api/"
+
+// pageLinks are links of the paginated response, Next is set only if there
+// are more results. Confluence Cloud paginates some responses by cursor, so
+// the next page should be requested by the link instead of incrementing start.
+type pageLinks struct {
+	Context string `json:"context"`
+	Next    string `json:"next"`
+}
+
+// parseNextLink returns resource and query of the next page of paginated
+// response specified by _links.next, e.g.
+// /rest/api/content/search?cql=...&cursor=... becomes content/search.
+func parseNextLink(next string) (string, map[string]string, error) {
+	link, err := url.Parse(next)
+	if err != nil {
+		return "", nil, karma.Format(err, "unable to parse next link %q", next)
 	}
 
-	if request.Raw.StatusCode == 404 {
-		return errors.New(
-			"Confluence API returned unexpected status: 404 (Not Found)",
+	index := strings.Index(link.Path, restPrefix)
+	if index < 0 {
+		return "", nil, fmt.Errorf(
+			"next link %q doesn't point to REST API",
+			next,
 		)
 	}
 
-	output, _ := ioutil.ReadAll(request.Raw.Body)
-	defer request.Raw.Body.Close()
+	query := map[string]string{}
+	for key, values := range link.Query() {
+		query[key] = values[0]
+	}
 
-	return fmt.Errorf(
-		"Confluence API returned unexpected status: %v, "+
-			"output: %q",
-		request.Raw.Status, output,
-	)
+	return link.Path[index+len(restPrefix):], query, nil
+}
+
+func newErrorStatusNotOK(request *gopencils.Resource) error {
+	err := &StatusError{
+		StatusCode: request.Raw.StatusCode,
+		Status:     request.Raw.Status,
+	}
+
+	if err.StatusCode != http.StatusUnauthorized &&
+		err.StatusCode != http.StatusNotFound {
+		err.Output, _ = ioutil.ReadAll(request.Raw.Body)
+		defer request.Raw.Body.Close()
+	}
+
+	return err
 }
@@ -0,0 +1,190 @@
+package confluence
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchByCQLFollowsNextLink(t *testing.T) {
+	test := assert.New(t)
+
+	cursors := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			test.Equal("/rest/api/content/search", request.URL.Path)
+			test.Equal("type=page", request.URL.Query().Get("cql"))
+
+			cursor := request.URL.Query().Get("cursor")
+			cursors = append(cursors, cursor)
+
+			if cursor == "" {
+				writer.Write([]byte(`{"results":[{"id":"1"},{"id":"2"}],` +
+					`"_links":{"next":"/rest/api/content/search` +
+					`?cql=type%3Dpage&cursor=abc&limit=2"}}`))
+			} else {
+				writer.Write([]byte(`{"results":[{"id":"3"}],"_links":{}}`))
+			}
+		},
+	))
+	defer server.Close()
+
+	api := NewAPI(server.URL, "", "", nil)
+
+	pages, err := api.SearchByCQL(context.Background(), "type=page")
+	test.NoError(err)
+
+	ids := []string{}
+	for _, page := range pages {
+		ids = append(ids, page.ID)
+	}
+
+	test.Equal([]string{"1", "2", "3"}, ids)
+	test.Equal([]string{"", "abc"}, cursors)
+}
+
+func TestParseNextLink(t *testing.T) {
+	test := assert.New(t)
+
+	resource, query, err := parseNextLink(
+		"/wiki/rest/api/content/1/child/attachment?start=100&limit=100",
+	)
+	test.NoError(err)
+	test.Equal("content/1/child/attachment", resource)
+	test.Equal(map[string]string{"start": "100", "limit": "100"}, query)
+
+	_, _, err = parseNextLink("/download/attachments/1")
+	test.Error(err)
+}
+
+func TestGetAttachmentsFollowsNextLink(t *testing.T) {
+	test := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			test.Equal("/rest/api/content/1/child/attachment", request.URL.Path)
+
+			if request.URL.Query().Get("start") == "" {
+				writer.Write([]byte(`{"results":[{"id":"a","title":"a.png"}],` +
+					`"_links":{"context":"/wiki","next":` +
+					`"/rest/api/content/1/child/attachment?start=1&limit=1"}}`))
+			} else {
+				writer.Write([]byte(`{"results":[{"id":"b","title":"b.png"}],` +
+					`"_links":{"context":"/wiki"}}`))
+			}
+		},
+	))
+	defer server.Close()
+
+	api := NewAPI(server.URL, "", "", nil)
+
+	attachments, err := api.GetAttachments(context.Background(), "1")
+	test.NoError(err)
+	test.Len(attachments, 2)
+	test.Equal("a.png", attachments[0].Filename)
+	test.Equal("b.png", attachments[1].Filename)
+	test.Equal("/wiki", attachments[1].Links.Context)
+}
+
+func TestGetPageChildrenFollowsNextLink(t *testing.T) {
+	test := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			test.Equal("/rest/api/content/1/child/page", request.URL.Path)
+
+			if request.URL.Query().Get("start") == "" {
+				writer.Write([]byte(`{"results":[{"id":"2"}],"_links":{"next":` +
+					`"/rest/api/content/1/child/page?start=1&limit=1"}}`))
+			} else {
+				writer.Write([]byte(`{"results":[{"id":"3"}],"_links":{}}`))
+			}
+		},
+	))
+	defer server.Close()
+
+	api := NewAPI(server.URL, "", "", nil)
+
+	pages, err := api.GetPageChildren(context.Background(), "1")
+	test.NoError(err)
+	test.Len(pages, 2)
+	test.Equal("3", pages[1].ID)
+}
+
+func TestGetPageLabelsFollowsNextLink(t *testing.T) {
+	test := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			test.Equal("/rest/api/content/1/label", request.URL.Path)
+
+			// confluence may return less results than requested limit
+			// even if there are more labels
+			if request.URL.Query().Get("start") == "" {
+				writer.Write([]byte(`{"results":[{"name":"a"}],"_links":{"next":` +
+					`"/rest/api/content/1/label?start=1&limit=200"}}`))
+			} else {
+				writer.Write([]byte(`{"results":[{"name":"b"}],"_links":{}}`))
+			}
+		},
+	))
+	defer server.Close()
+
+	api := NewAPI(server.URL, "", "", nil)
+
+	labels, err := api.GetPageLabels(context.Background(), "1")
+	test.NoError(err)
+	test.Equal([]string{"a", "b"}, labels)
+}
+
+func TestUpdatePageMetaKeepsLabels(t *testing.T) {
+	test := assert.New(t)
+
+	added := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			test.Equal("/rest/api/content/1/label", request.URL.Path)
+
+			switch request.Method {
+			case http.MethodGet:
+				writer.Write([]byte(`{"results":[{"name":"manual"},` +
+					`{"name":"docs"}],"_links":{}}`))
+
+			case http.MethodPost:
+				labels := []struct {
+					Name string `json:"name"`
+				}{}
+
+				test.NoError(json.NewDecoder(request.Body).Decode(&labels))
+
+				for _, label := range labels {
+					added = append(added, label.Name)
+				}
+
+				writer.Write([]byte(`{}`))
+
+			default:
+				t.Errorf("unexpected request: %s", request.Method)
+			}
+		},
+	))
+	defer server.Close()
+
+	api := NewAPI(server.URL, "", "", nil)
+
+	changed, err := api.UpdatePageMeta(
+		context.Background(),
+		&PageInfo{ID: "1"},
+		[]string{"docs", "release"},
+		nil,
+	)
+	test.NoError(err)
+	test.True(changed)
+	test.Equal([]string{"release"}, added)
+}
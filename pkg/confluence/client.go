@@ -0,0 +1,557 @@
+package confluence
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kovetskiy/gopencils"
+	"github.com/reconquest/karma-go"
+)
+
+const (
+	AuthMethodBasic  = `basic`
+	AuthMethodBearer = `bearer`
+)
+
+// CompressionThreshold is a size of JSON request body in bytes, bodies larger
+// than that are sent compressed with gzip if compression is enabled.
+const CompressionThreshold = 32 * 1024
+
+// DefaultRateLimit is a number of requests per second which are sent to
+// Confluence Cloud by default, it's low enough to stay within its rate limits
+// even when several instances of mark are run at once.
+const DefaultRateLimit = 10
+
+// DefaultRetries is a number of times request rejected with 429 Too Many
+// Requests is resent before the response is returned as is.
+const DefaultRetries = 5
+
+// maxRetryDelay limits delay before request rejected with 429 Too Many
+// Requests is resent, whether it's requested by Retry-After header or not.
+const maxRetryDelay = time.Minute
+
+type ClientOptions struct {
+	// Token is sent in Authorization header as bearer token if specified,
+	// e.g. Confluence Personal Access Token.
+	Token string
+
+	// ProxyURL is used for all requests if specified, otherwise proxy is
+	// taken from HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	ProxyURL      string
+	ProxyUsername string
+	ProxyPassword string
+
+	// Insecure disables TLS certificate verification.
+	Insecure bool
+
+	// CACerts is a list of PEM files with additional CA certificates which
+	// are trusted along with system ones.
+	CACerts []string
+
+	// CompressRequests enables gzip compression of large request bodies,
+	// which is not supported by every Confluence instance and proxy.
+	// Compressed responses are accepted regardless of it.
+	CompressRequests bool
+
+	// UserAgent is sent in User-Agent header of every request.
+	UserAgent string
+
+	// RequestIDPrefix enables X-Request-Id header, which is unique for every
+	// request and consists of the prefix, random id of the client and number
+	// of the request, e.g. mark-5f2a9c1e-7.
+	RequestIDPrefix string
+
+	// RateLimit is a maximum number of requests per second, requests over the
+	// limit are delayed instead of being sent at once. Zero means no limit,
+	// requests rejected with 429 Too Many Requests are retried regardless.
+	RateLimit float64
+}
+
+func NewClient(options ClientOptions) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+
+	if options.ProxyURL != "" {
+		proxyURL, err := url.Parse(options.ProxyURL)
+		if err != nil {
+			return nil, karma.Format(
+				err,
+				"unable to parse proxy url %q",
+				options.ProxyURL,
+			)
+		}
+
+		if options.ProxyUsername != "" {
+			proxyURL.User = url.UserPassword(
+				options.ProxyUsername,
+				options.ProxyPassword,
+			)
+		}
+
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, karma.Format(err, "unable to create cookie jar")
+	}
+
+	roots, err := loadCACerts(options.CACerts)
+	if err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: proxy,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: options.Insecure,
+			RootCAs:            roots,
+		},
+	}
+
+	if options.CompressRequests {
+		transport = &gzipTransport{
+			threshold: CompressionThreshold,
+			transport: transport,
+		}
+	}
+
+	if options.UserAgent != "" || options.RequestIDPrefix != "" {
+		headers := &headerTransport{
+			userAgent: options.UserAgent,
+			transport: transport,
+		}
+
+		if options.RequestIDPrefix != "" {
+			id := make([]byte, 4)
+
+			_, err := rand.Read(id)
+			if err != nil {
+				return nil, karma.Format(err, "unable to generate client id")
+			}
+
+			headers.requestID = options.RequestIDPrefix + "-" +
+				hex.EncodeToString(id)
+		}
+
+		transport = headers
+	}
+
+	transport = newRateTransport(options.RateLimit, transport)
+
+	if options.Token != "" {
+		transport = &bearerTransport{
+			token:     options.Token,
+			transport: transport,
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Jar:       jar,
+	}, nil
+}
+
+type bearerTransport struct {
+	token     string
+	transport http.RoundTripper
+}
+
+func (bearer *bearerTransport) RoundTrip(
+	request *http.Request,
+) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.Header.Set("Authorization", "Bearer "+bearer.token)
+
+	return bearer.transport.RoundTrip(request)
+}
+
+// headerTransport sets User-Agent and X-Request-Id headers of requests.
+type headerTransport struct {
+	// requests is accessed atomically, so it's the first field to be 64-bit
+	// aligned on 32-bit platforms
+	requests int64
+
+	userAgent string
+	requestID string
+	transport http.RoundTripper
+}
+
+func (headers *headerTransport) RoundTrip(
+	request *http.Request,
+) (*http.Response, error) {
+	request = request.Clone(request.Context())
+
+	if headers.userAgent != "" {
+		request.Header.Set("User-Agent", headers.userAgent)
+	}
+
+	if headers.requestID != "" {
+		request.Header.Set(
+			"X-Request-Id",
+			headers.requestID+"-"+strconv.FormatInt(
+				atomic.AddInt64(&headers.requests, 1),
+				10,
+			),
+		)
+	}
+
+	return headers.transport.RoundTrip(request)
+}
+
+// rateTransport delays requests to send no more than rate requests per second
+// using token bucket, so bursts of requests, e.g. attachments of several pages
+// uploaded in parallel, are spread over time instead of being rejected by
+// Confluence with 429 Too Many Requests. Rejected requests are resent after
+// delay requested by Retry-After header or exponential backoff. Requests are
+// not delayed if rate is zero.
+type rateTransport struct {
+	rate  float64
+	burst float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+
+	retries int
+	backoff time.Duration
+
+	transport http.RoundTripper
+}
+
+func newRateTransport(
+	rate float64,
+	transport http.RoundTripper,
+) *rateTransport {
+	// bucket holds tokens for one second of requests, but at least for one
+	// request if rate is less than one request per second
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateTransport{
+		rate:      rate,
+		burst:     burst,
+		tokens:    burst,
+		last:      time.Now(),
+		retries:   DefaultRetries,
+		backoff:   time.Second,
+		transport: transport,
+	}
+}
+
+// reserve takes token from the bucket and returns how long to wait before
+// sending request. Tokens are taken in advance, so concurrent requests
+// are spread evenly instead of being sent at once when tokens are refilled.
+func (limiter *rateTransport) reserve() time.Duration {
+	if limiter.rate == 0 {
+		return 0
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+
+	limiter.tokens += now.Sub(limiter.last).Seconds() * limiter.rate
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+
+	limiter.last = now
+	limiter.tokens--
+
+	if limiter.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+}
+
+func (limiter *rateTransport) RoundTrip(
+	request *http.Request,
+) (*http.Response, error) {
+	backoff := limiter.backoff
+
+	for attempt := 0; ; attempt++ {
+		err := sleep(request.Context(), limiter.reserve())
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := limiter.transport.RoundTrip(request)
+		if err != nil ||
+			response.StatusCode != http.StatusTooManyRequests ||
+			attempt >= limiter.retries {
+			return response, err
+		}
+
+		retry, ok := rewindRequest(request)
+		if !ok {
+			return response, nil
+		}
+
+		delay, ok := getRetryAfter(
+			response.Header.Get("Retry-After"),
+			time.Now(),
+		)
+		if !ok {
+			delay = backoff
+			backoff *= 2
+		}
+
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+
+		response.Body.Close()
+
+		err = sleep(request.Context(), delay)
+		if err != nil {
+			return nil, err
+		}
+
+		request = retry
+	}
+}
+
+// rewindRequest returns copy of the request which can be sent again, false is
+// returned if body of the request can't be read again.
+func rewindRequest(request *http.Request) (*http.Request, bool) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return request, true
+	}
+
+	if request.GetBody == nil {
+		return nil, false
+	}
+
+	body, err := request.GetBody()
+	if err != nil {
+		return nil, false
+	}
+
+	request = request.Clone(request.Context())
+	request.Body = body
+
+	return request, true
+}
+
+// getRetryAfter returns delay specified by Retry-After header either as
+// number of seconds or as HTTP date, false is returned if it's not specified
+// or invalid.
+func getRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+
+	seconds, err := strconv.Atoi(header)
+	if err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+
+	if date.Before(now) {
+		return 0, true
+	}
+
+	return date.Sub(now), true
+}
+
+// sleep waits for given duration, error is returned if context is done
+// before that.
+func sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// gzipTransport compresses JSON bodies of requests which are larger than
+// threshold. If server responds to compressed request with 415 Unsupported
+// Media Type, request is resent uncompressed and compression is disabled for
+// following requests if uncompressed request succeeds. Other errors are
+// returned as is, so requests are never sent twice because of them.
+type gzipTransport struct {
+	threshold   int
+	unsupported int32
+	transport   http.RoundTripper
+}
+
+func (compressor *gzipTransport) RoundTrip(
+	request *http.Request,
+) (*http.Response, error) {
+	if request.Body == nil ||
+		atomic.LoadInt32(&compressor.unsupported) == 1 ||
+		request.Header.Get("Content-Encoding") != "" {
+		return compressor.transport.RoundTrip(request)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if contentType != "application/json" {
+		return compressor.transport.RoundTrip(request)
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	request.Body.Close()
+	if err != nil {
+		return nil, karma.Format(err, "unable to read request body")
+	}
+
+	// original body is restored, so request can be resent as is
+	plain := func() *http.Request {
+		request := request.Clone(request.Context())
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		request.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+
+		return request
+	}
+
+	if len(body) <= compressor.threshold {
+		return compressor.transport.RoundTrip(plain())
+	}
+
+	var buffer bytes.Buffer
+
+	writer := gzip.NewWriter(&buffer)
+
+	_, err = writer.Write(body)
+	if err == nil {
+		err = writer.Close()
+	}
+
+	if err != nil {
+		return nil, karma.Format(err, "unable to compress request body")
+	}
+
+	compressed := buffer.Bytes()
+
+	gzipped := request.Clone(request.Context())
+	gzipped.Header.Set("Content-Encoding", "gzip")
+	gzipped.ContentLength = int64(len(compressed))
+	gzipped.Body = ioutil.NopCloser(bytes.NewReader(compressed))
+	gzipped.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(compressed)), nil
+	}
+
+	response, err := compressor.transport.RoundTrip(gzipped)
+	if err != nil || response.StatusCode != http.StatusUnsupportedMediaType {
+		return response, err
+	}
+
+	response.Body.Close()
+
+	response, err = compressor.transport.RoundTrip(plain())
+	if err == nil && response.StatusCode < http.StatusBadRequest {
+		atomic.StoreInt32(&compressor.unsupported, 1)
+	}
+
+	return response, err
+}
+
+// loadCACerts returns system cert pool extended with certificates from given
+// files or nil if no files are given, so default pool is used.
+func loadCACerts(paths []string) (*x509.CertPool, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+
+	for _, path := range paths {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, karma.Format(
+				err,
+				"unable to read CA certificate file %q",
+				path,
+			)
+		}
+
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, karma.Format(
+				nil,
+				"unable to parse CA certificate file %q, "+
+					"expected PEM encoded certificates",
+				path,
+			)
+		}
+	}
+
+	return roots, nil
+}
+
+// withContext returns copy of the resource which requests are bound to
+// given context, so they are cancelled along with it.
+func withContext(
+	ctx context.Context,
+	resource *gopencils.Resource,
+) *gopencils.Resource {
+	api := *resource.Api
+	client := *api.Client
+
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	client.Transport = &contextTransport{
+		ctx:       ctx,
+		transport: transport,
+	}
+
+	api.Client = &client
+
+	bound := *resource
+	bound.Api = &api
+
+	return &bound
+}
+
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+func (transport *contextTransport) RoundTrip(
+	request *http.Request,
+) (*http.Response, error) {
+	return transport.transport.RoundTrip(request.WithContext(transport.ctx))
+}
@@ -0,0 +1,284 @@
+package confluence
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readBody returns body of the request decompressed if it's compressed.
+func readBody(request *http.Request) string {
+	reader := request.Body
+
+	if request.Header.Get("Content-Encoding") == "gzip" {
+		gzipped, err := gzip.NewReader(request.Body)
+		if err != nil {
+			panic(err)
+		}
+
+		reader = gzipped
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(body)
+}
+
+// postJSON sends JSON body and returns status code of the response.
+func postJSON(
+	test *assert.Assertions,
+	client *http.Client,
+	url string,
+	body string,
+) int {
+	response, err := client.Post(
+		url,
+		"application/json",
+		bytes.NewBufferString(body),
+	)
+	test.NoError(err)
+
+	response.Body.Close()
+
+	return response.StatusCode
+}
+
+func TestGzipTransport(t *testing.T) {
+	test := assert.New(t)
+
+	encodings := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			encoding := request.Header.Get("Content-Encoding")
+			encodings = append(encodings, encoding)
+
+			test.Equal(`{"value":"large"}`, readBody(request))
+		},
+	))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &gzipTransport{
+			threshold: 8,
+			transport: http.DefaultTransport,
+		},
+	}
+
+	test.Equal(200, postJSON(test, client, server.URL, `{"value":"large"}`))
+	test.Equal([]string{"gzip"}, encodings)
+}
+
+func TestGzipTransportFallback(t *testing.T) {
+	test := assert.New(t)
+
+	encodings := []string{}
+
+	// server which can't handle compressed requests rejects their encoding
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			encoding := request.Header.Get("Content-Encoding")
+			encodings = append(encodings, encoding)
+
+			if encoding == "gzip" {
+				writer.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+
+			test.Equal(`{"value":"large"}`, readBody(request))
+		},
+	))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &gzipTransport{
+			threshold: 8,
+			transport: http.DefaultTransport,
+		},
+	}
+
+	test.Equal(200, postJSON(test, client, server.URL, `{"value":"large"}`))
+	test.Equal(200, postJSON(test, client, server.URL, `{"value":"large"}`))
+
+	// compression is disabled once uncompressed request succeeds
+	test.Equal([]string{"gzip", "", ""}, encodings)
+}
+
+func TestGzipTransportServerError(t *testing.T) {
+	test := assert.New(t)
+
+	encodings := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			encoding := request.Header.Get("Content-Encoding")
+			encodings = append(encodings, encoding)
+
+			writer.WriteHeader(http.StatusInternalServerError)
+		},
+	))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &gzipTransport{
+			threshold: 8,
+			transport: http.DefaultTransport,
+		},
+	}
+
+	test.Equal(500, postJSON(test, client, server.URL, `{"value":"large"}`))
+	test.Equal(500, postJSON(test, client, server.URL, `{"value":"large"}`))
+
+	// server errors are not caused by compression, so request is not resent
+	// and compression is kept enabled
+	test.Equal([]string{"gzip", "gzip"}, encodings)
+}
+
+func TestNewClientCompressionOptIn(t *testing.T) {
+	test := assert.New(t)
+
+	encodings := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			encoding := request.Header.Get("Content-Encoding")
+			encodings = append(encodings, encoding)
+		},
+	))
+	defer server.Close()
+
+	body := `{"value":"` +
+		string(bytes.Repeat([]byte("a"), CompressionThreshold)) +
+		`"}`
+
+	client, err := NewClient(ClientOptions{})
+	test.NoError(err)
+	test.Equal(200, postJSON(test, client, server.URL, body))
+
+	client, err = NewClient(ClientOptions{CompressRequests: true})
+	test.NoError(err)
+	test.Equal(200, postJSON(test, client, server.URL, body))
+
+	test.Equal([]string{"", "gzip"}, encodings)
+}
+
+func TestRateTransportReserve(t *testing.T) {
+	test := assert.New(t)
+
+	// reservations are computed using current time
+	delta := float64(10 * time.Millisecond)
+
+	limiter := newRateTransport(10, http.DefaultTransport)
+
+	// bucket holds tokens for one second of requests
+	for i := 0; i < 10; i++ {
+		test.Zero(limiter.reserve())
+	}
+
+	// following requests are spread evenly
+	test.InDelta(100*time.Millisecond, limiter.reserve(), delta)
+	test.InDelta(200*time.Millisecond, limiter.reserve(), delta)
+
+	// tokens are refilled over time, tokens of delayed requests are taken
+	// in advance
+	limiter.last = limiter.last.Add(-300 * time.Millisecond)
+	test.Zero(limiter.reserve())
+	test.InDelta(100*time.Millisecond, limiter.reserve(), delta)
+
+	// at least one request is sent at once if rate is low
+	limiter = newRateTransport(0.5, http.DefaultTransport)
+	test.Zero(limiter.reserve())
+	test.InDelta(2*time.Second, limiter.reserve(), delta)
+
+	// requests are not delayed without limit
+	limiter = newRateTransport(0, http.DefaultTransport)
+	for i := 0; i < 100; i++ {
+		test.Zero(limiter.reserve())
+	}
+}
+
+func TestRateTransportRetry(t *testing.T) {
+	test := assert.New(t)
+
+	bodies := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			bodies = append(bodies, readBody(request))
+
+			switch len(bodies) {
+			case 1:
+				writer.Header().Set("Retry-After", "0")
+				writer.WriteHeader(http.StatusTooManyRequests)
+			case 2:
+				writer.WriteHeader(http.StatusTooManyRequests)
+			}
+		},
+	))
+	defer server.Close()
+
+	limiter := newRateTransport(0, http.DefaultTransport)
+	limiter.backoff = time.Millisecond
+
+	client := &http.Client{Transport: limiter}
+
+	test.Equal(200, postJSON(test, client, server.URL, `{"value":1}`))
+	test.Equal([]string{`{"value":1}`, `{"value":1}`, `{"value":1}`}, bodies)
+}
+
+func TestRateTransportRetryLimit(t *testing.T) {
+	test := assert.New(t)
+
+	var requests int
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			requests++
+
+			writer.WriteHeader(http.StatusTooManyRequests)
+		},
+	))
+	defer server.Close()
+
+	limiter := newRateTransport(0, http.DefaultTransport)
+	limiter.backoff = time.Millisecond
+	limiter.retries = 2
+
+	client := &http.Client{Transport: limiter}
+
+	test.Equal(429, postJSON(test, client, server.URL, `{}`))
+	test.Equal(3, requests)
+}
+
+func TestGetRetryAfter(t *testing.T) {
+	test := assert.New(t)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	delay, ok := getRetryAfter("3", now)
+	test.True(ok)
+	test.Equal(3*time.Second, delay)
+
+	delay, ok = getRetryAfter("Wed, 01 Jan 2020 00:00:05 GMT", now)
+	test.True(ok)
+	test.Equal(5*time.Second, delay)
+
+	delay, ok = getRetryAfter("Tue, 31 Dec 2019 23:59:00 GMT", now)
+	test.True(ok)
+	test.Zero(delay)
+
+	_, ok = getRetryAfter("", now)
+	test.False(ok)
+
+	_, ok = getRetryAfter("soon", now)
+	test.False(ok)
+}
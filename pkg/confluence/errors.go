@@ -0,0 +1,134 @@
+package confluence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/reconquest/karma-go"
+)
+
+// StatusError is returned if Confluence API responds with unexpected status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Output     []byte
+}
+
+func (err *StatusError) Error() string {
+	switch err.StatusCode {
+	case http.StatusUnauthorized, http.StatusNotFound:
+		return fmt.Sprintf(
+			"Confluence API returned unexpected status: %d (%s)",
+			err.StatusCode,
+			http.StatusText(err.StatusCode),
+		)
+	}
+
+	return fmt.Sprintf(
+		"Confluence API returned unexpected status: %v, "+
+			"output: %q",
+		err.Status, err.Output,
+	)
+}
+
+// IsAuthError reports whether error is caused by failed authentication or
+// lack of permissions.
+func IsAuthError(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized, http.StatusForbidden)
+}
+
+// IsNotFoundError reports whether error is caused by requesting entity which
+// doesn't exist.
+func IsNotFoundError(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsNetworkError reports whether error is caused by connection failure or
+// timeout, such errors are usually transient.
+func IsNetworkError(err error) bool {
+	return FindError(err, func(err error) bool {
+		if err == context.DeadlineExceeded {
+			return true
+		}
+
+		_, ok := err.(net.Error)
+
+		return ok
+	})
+}
+
+// IsTooLargeError reports whether error is caused by page body exceeding the
+// size limit of Confluence. Some versions respond with 413, others with 400
+// and the limit mentioned in the output.
+func IsTooLargeError(err error) bool {
+	return FindError(err, func(err error) bool {
+		status, ok := err.(*StatusError)
+		if !ok {
+			return false
+		}
+
+		switch status.StatusCode {
+		case http.StatusRequestEntityTooLarge:
+			return true
+		case http.StatusBadRequest:
+			output := strings.ToLower(string(status.Output))
+
+			return strings.Contains(output, "too large") ||
+				strings.Contains(output, "exceeds")
+		}
+
+		return false
+	})
+}
+
+func hasStatus(err error, codes ...int) bool {
+	return FindError(err, func(err error) bool {
+		status, ok := err.(*StatusError)
+		if !ok {
+			return false
+		}
+
+		for _, code := range codes {
+			if status.StatusCode == code {
+				return true
+			}
+		}
+
+		return false
+	})
+}
+
+// FindError returns true if match returns true for given error or for any
+// error it's caused by, including reasons of karma errors.
+func FindError(err error, match func(error) bool) bool {
+	if err == nil {
+		return false
+	}
+
+	if match(err) {
+		return true
+	}
+
+	var reasons []karma.Reason
+
+	switch typed := err.(type) {
+	case karma.Karma:
+		reasons = typed.GetReasons()
+	case *karma.Karma:
+		reasons = typed.GetReasons()
+	default:
+		return FindError(errors.Unwrap(err), match)
+	}
+
+	for _, reason := range reasons {
+		if nested, ok := reason.(error); ok && FindError(nested, match) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,26 +1,121 @@
 package mark
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/bonovoxly/mark/pkg/confluence"
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
 )
 
+// AncestryCache keeps parent pages which are found or created while
+// resolving ancestry of documents, so parents shared by several documents are
+// fetched only once per run. Parents are looked up by title, so listing
+// children of large pages is not required.
+type AncestryCache struct {
+	mutex sync.Mutex
+
+	// pages are found parent pages by space and title
+	pages map[string]*confluence.PageInfo
+
+	// roots are root pages by space
+	roots map[string]*confluence.PageInfo
+}
+
+// NewAncestryCache returns empty cache of parent pages.
+func NewAncestryCache() *AncestryCache {
+	return &AncestryCache{
+		pages: map[string]*confluence.PageInfo{},
+		roots: map[string]*confluence.PageInfo{},
+	}
+}
+
+// FindPage returns page with given title in given space, page is looked up
+// in Confluence if it's not cached yet. Nil is returned if there is no such
+// page, which is not cached, since the page may be created later.
+func (cache *AncestryCache) FindPage(
+	ctx context.Context,
+	api *confluence.API,
+	space string,
+	title string,
+) (*confluence.PageInfo, error) {
+	cache.mutex.Lock()
+	page, ok := cache.pages[space+"/"+title]
+	cache.mutex.Unlock()
+
+	if ok {
+		return page, nil
+	}
+
+	page, err := api.FindPage(ctx, space, title, "page")
+	if err != nil {
+		return nil, err
+	}
+
+	if page != nil {
+		cache.add(space, page)
+	}
+
+	return page, nil
+}
+
+// FindRootPage returns root page of given space, it's looked up in Confluence
+// if it's not cached yet.
+func (cache *AncestryCache) FindRootPage(
+	ctx context.Context,
+	api *confluence.API,
+	space string,
+) (*confluence.PageInfo, error) {
+	cache.mutex.Lock()
+	root, ok := cache.roots[space]
+	cache.mutex.Unlock()
+
+	if ok {
+		return root, nil
+	}
+
+	root, err := api.FindRootPage(ctx, space)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.mutex.Lock()
+	cache.roots[space] = root
+	cache.mutex.Unlock()
+
+	return root, nil
+}
+
+func (cache *AncestryCache) add(space string, page *confluence.PageInfo) {
+	cache.mutex.Lock()
+	cache.pages[space+"/"+page.Title] = page
+	cache.mutex.Unlock()
+}
+
+// EnsureAncestry returns the last page of ancestry, pages of ancestry which
+// don't exist are created unless dryRun is set. Found pages are kept in
+// given cache, they are fetched on every call if it's nil.
 func EnsureAncestry(
+	ctx context.Context,
 	dryRun bool,
 	api *confluence.API,
+	cache *AncestryCache,
 	space string,
 	ancestry []string,
 ) (*confluence.PageInfo, error) {
+	if cache == nil {
+		cache = NewAncestryCache()
+	}
+
 	var parent *confluence.PageInfo
 
 	rest := ancestry
 
 	for i, title := range ancestry {
-		page, err := api.FindPage(space, title, "page")
+		page, err := cache.FindPage(ctx, api, space, title)
 		if err != nil {
 			return nil, karma.Format(
 				err,
@@ -42,7 +137,7 @@ func EnsureAncestry(
 	if parent != nil {
 		rest = rest[1:]
 	} else {
-		page, err := api.FindRootPage(space)
+		page, err := cache.FindRootPage(ctx, api, space)
 		if err != nil {
 			return nil, karma.Format(
 				err,
@@ -66,7 +161,7 @@ func EnsureAncestry(
 
 	if !dryRun {
 		for _, title := range rest {
-			page, err := api.CreatePage(space, "page", parent, title, ``)
+			page, err := api.CreatePage(ctx, space, "page", parent, title, ``)
 			if err != nil {
 				return nil, karma.Format(
 					err,
@@ -75,6 +170,8 @@ func EnsureAncestry(
 				)
 			}
 
+			cache.add(space, page)
+
 			parent = page
 		}
 	} else {
@@ -91,11 +188,17 @@ func EnsureAncestry(
 }
 
 func ValidateAncestry(
+	ctx context.Context,
 	api *confluence.API,
+	cache *AncestryCache,
 	space string,
 	ancestry []string,
 ) (*confluence.PageInfo, error) {
-	page, err := api.FindPage(space, ancestry[len(ancestry)-1], "page")
+	if cache == nil {
+		cache = NewAncestryCache()
+	}
+
+	page, err := cache.FindPage(ctx, api, space, ancestry[len(ancestry)-1])
 	if err != nil {
 		return nil, err
 	}
@@ -105,7 +208,9 @@ func ValidateAncestry(
 	}
 
 	if len(page.Ancestors) < 1 {
-		return nil, fmt.Errorf(`page %q has no parents`, page.Title)
+		return nil, &ResolveError{
+			Err: fmt.Errorf(`page %q has no parents`, page.Title),
+		}
 	}
 
 	if len(page.Ancestors) < len(ancestry) {
@@ -114,10 +219,12 @@ func ValidateAncestry(
 			actual = append(actual, ancestor.Title)
 		}
 
-		return nil, karma.Describe("title", page.Title).
-			Describe("actual", strings.Join(actual, " > ")).
-			Describe("expected", strings.Join(ancestry, " > ")).
-			Format(nil, "the page has fewer parents than expected")
+		return nil, &ResolveError{
+			Err: karma.Describe("title", page.Title).
+				Describe("actual", strings.Join(actual, " > ")).
+				Describe("expected", strings.Join(ancestry, " > ")).
+				Format(nil, "the page has fewer parents than expected"),
+		}
 	}
 
 	for _, parent := range ancestry[:len(ancestry)-1] {
@@ -138,14 +245,108 @@ func ValidateAncestry(
 				list = append(list, ancestor.Title)
 			}
 
-			return nil, karma.Describe("expected parent", parent).
-				Describe("list", strings.Join(list, "; ")).
-				Format(
-					nil,
-					"unexpected ancestry tree, did not find expected parent page in the tree",
-				)
+			return nil, &ResolveError{
+				Err: karma.Describe("expected parent", parent).
+					Describe("list", strings.Join(list, "; ")).
+					Format(
+						nil,
+						"unexpected ancestry tree, did not find expected parent page in the tree",
+					),
+			}
 		}
 	}
 
 	return page, nil
 }
+
+// PageTree is a resolved location of the page in the space.
+type PageTree struct {
+	Space string
+
+	// Ancestors are parents of the page starting from the root page of the
+	// space, Id is empty for parents which don't exist yet.
+	Ancestors []confluence.PageAncestor
+
+	// Page is the page itself, Id is empty if the page will be created.
+	Page confluence.PageAncestor
+}
+
+// GetPageTree returns location of the page which is resolved by ResolvePage
+// into given parent and page. Parents which are not created in dry-run mode
+// are listed after the last existing parent.
+func GetPageTree(
+	meta *Meta,
+	parent *confluence.PageInfo,
+	page *confluence.PageInfo,
+) *PageTree {
+	tree := &PageTree{
+		Space:     meta.Space,
+		Ancestors: []confluence.PageAncestor{},
+		Page:      confluence.PageAncestor{Title: meta.Title},
+	}
+
+	if page != nil {
+		tree.Page.Id = page.ID
+	}
+
+	if parent == nil {
+		return tree
+	}
+
+	tree.Ancestors = append(tree.Ancestors, parent.Ancestors...)
+	tree.Ancestors = append(
+		tree.Ancestors,
+		confluence.PageAncestor{Id: parent.ID, Title: parent.Title},
+	)
+
+	// parent is either the last existing page of ancestry or the root page
+	// of the space if none of them exists
+	missing := meta.Parents
+	for i := len(meta.Parents) - 1; i >= 0; i-- {
+		if meta.Parents[i] == parent.Title {
+			missing = meta.Parents[i+1:]
+			break
+		}
+	}
+
+	for _, title := range missing {
+		tree.Ancestors = append(
+			tree.Ancestors,
+			confluence.PageAncestor{Title: title},
+		)
+	}
+
+	return tree
+}
+
+// String returns the tree as indented list of pages, e.g.:
+//
+//	space DOC
+//	└── Docs (id 1)
+//	    └── Guides (will be created)
+func (tree *PageTree) String() string {
+	var buffer strings.Builder
+
+	fmt.Fprintf(&buffer, "space %s", tree.Space)
+
+	pages := append(
+		append([]confluence.PageAncestor{}, tree.Ancestors...),
+		tree.Page,
+	)
+	for i, page := range pages {
+		state := "will be created"
+		if page.Id != "" {
+			state = "id " + page.Id
+		}
+
+		fmt.Fprintf(
+			&buffer,
+			"\n%s└── %s (%s)",
+			strings.Repeat("    ", i),
+			page.Title,
+			state,
+		)
+	}
+
+	return buffer.String()
+}
@@ -0,0 +1,216 @@
+package mark
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnsureAncestryCached(t *testing.T) {
+	test := assert.New(t)
+
+	requests := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			requests = append(requests, request.URL.Query().Get("title"))
+
+			switch request.URL.Query().Get("title") {
+			case "Docs":
+				writer.Write([]byte(`{"results":[{"id":"1","title":"Docs"}]}`))
+			case "Guides":
+				writer.Write([]byte(`{"results":[{"id":"2","title":"Guides"}]}`))
+			case "Reference":
+				writer.Write([]byte(`{"results":[{"id":"3","title":"Reference"}]}`))
+			default:
+				writer.Write([]byte(`{"results":[]}`))
+			}
+		},
+	))
+	defer server.Close()
+
+	var (
+		api   = confluence.NewAPI(server.URL, "", "", nil)
+		cache = NewAncestryCache()
+	)
+
+	parent, err := EnsureAncestry(
+		context.Background(),
+		false,
+		api,
+		cache,
+		"DOC",
+		[]string{"Docs", "Guides"},
+	)
+	test.NoError(err)
+	test.Equal("2", parent.ID)
+	test.Equal([]string{"Docs", "Guides"}, requests)
+
+	requests = []string{}
+
+	// shared parent is cached, only sibling is looked up by title
+	parent, err = EnsureAncestry(
+		context.Background(),
+		false,
+		api,
+		cache,
+		"DOC",
+		[]string{"Docs", "Reference"},
+	)
+	test.NoError(err)
+	test.Equal("3", parent.ID)
+	test.Equal([]string{"Reference"}, requests)
+}
+
+func TestResolvePageForeignParent(t *testing.T) {
+	test := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			query := request.URL.Query()
+
+			switch query.Get("spaceKey") + "/" + query.Get("title") {
+			case "DOC/Deploy":
+				writer.Write([]byte(
+					`{"results":[{"id":"3","title":"Deploy",` +
+						`"space":{"key":"DOC"},` +
+						`"ancestors":[{"id":"1","title":"Home"}]}]}`,
+				))
+			case "OPS/Runbooks":
+				writer.Write([]byte(
+					`{"results":[{"id":"7","title":"Runbooks",` +
+						`"space":{"key":"OPS"}}]}`,
+				))
+			default:
+				writer.Write([]byte(`{"results":[]}`))
+			}
+		},
+	))
+	defer server.Close()
+
+	api := confluence.NewAPI(server.URL, "", "", nil)
+
+	meta := &Meta{
+		Space:       "DOC",
+		Type:        "page",
+		Title:       "Deploy",
+		Parents:     []string{"Runbooks"},
+		ParentSpace: "OPS",
+	}
+
+	// existing page is not moved to another space
+	_, _, err := ResolvePage(context.Background(), false, api, nil, meta)
+	test.Error(err)
+	test.True(IsResolveError(err))
+	test.Contains(err.Error(), `unable to move page "Deploy" under "Runbooks"`)
+
+	// new page is not created under parent of another space
+	meta.Title = "Rollback"
+
+	_, _, err = ResolvePage(context.Background(), false, api, nil, meta)
+	test.Error(err)
+	test.True(IsResolveError(err))
+	test.Contains(err.Error(), `unable to create page "Rollback" under "Runbooks"`)
+
+	// parent is looked up in its own space
+	meta.Parents = []string{"Databases"}
+
+	_, _, err = ResolvePage(context.Background(), false, api, nil, meta)
+	test.EqualError(err, `parent page "Databases" is not found in space "OPS"`)
+}
+
+func TestGetPageTree(t *testing.T) {
+	test := assert.New(t)
+
+	meta := &Meta{
+		Space:   "DOC",
+		Title:   "Deploy",
+		Parents: []string{"Guides", "Runbooks"},
+	}
+
+	parent := &confluence.PageInfo{
+		ID:    "2",
+		Title: "Guides",
+		Ancestors: []confluence.PageAncestor{
+			{Id: "1", Title: "Home"},
+		},
+	}
+
+	tree := GetPageTree(meta, parent, nil)
+	test.Equal(
+		[]confluence.PageAncestor{
+			{Id: "1", Title: "Home"},
+			{Id: "2", Title: "Guides"},
+			{Title: "Runbooks"},
+		},
+		tree.Ancestors,
+	)
+	test.Equal(
+		"space DOC\n"+
+			"└── Home (id 1)\n"+
+			"    └── Guides (id 2)\n"+
+			"        └── Runbooks (will be created)\n"+
+			"            └── Deploy (will be created)",
+		tree.String(),
+	)
+
+	// none of parents exist, so they are created under the root page
+	tree = GetPageTree(
+		meta,
+		&confluence.PageInfo{ID: "1", Title: "Home"},
+		&confluence.PageInfo{ID: "3", Title: "Deploy"},
+	)
+	test.Equal(
+		"space DOC\n"+
+			"└── Home (id 1)\n"+
+			"    └── Guides (will be created)\n"+
+			"        └── Runbooks (will be created)\n"+
+			"            └── Deploy (id 3)",
+		tree.String(),
+	)
+
+	// blog posts have no parents
+	tree = GetPageTree(&Meta{Space: "DOC", Title: "News"}, nil, nil)
+	test.Equal("space DOC\n└── News (will be created)", tree.String())
+}
+
+func TestRefreshPageKeepsMove(t *testing.T) {
+	test := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte(`{"id":"10","title":"Page",` +
+				`"version":{"number":5},` +
+				`"ancestors":[{"id":"1","title":"Old"}]}`))
+		},
+	))
+	defer server.Close()
+
+	api := confluence.NewAPI(server.URL, "", "", nil)
+
+	page := &confluence.PageInfo{
+		ID:        "10",
+		Title:     "Page",
+		Ancestors: []confluence.PageAncestor{{Id: "2", Title: "New"}},
+	}
+
+	latest, err := RefreshPage(
+		context.Background(),
+		api,
+		&Meta{Parents: []string{"New"}},
+		page,
+	)
+	test.NoError(err)
+	test.Equal(int64(5), latest.Version.Number)
+	test.Equal([]confluence.PageAncestor{{Id: "2", Title: "New"}}, latest.Ancestors)
+
+	// page without parents is not moved, so its current location is kept
+	latest, err = RefreshPage(context.Background(), api, &Meta{}, page)
+	test.NoError(err)
+	test.Equal([]confluence.PageAncestor{{Id: "1", Title: "Old"}}, latest.Ancestors)
+}
@@ -0,0 +1,183 @@
+package mark
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	bf "github.com/russross/blackfriday/v2"
+)
+
+const (
+	AnchorStyleGitHub     = `github`
+	AnchorStyleConfluence = `confluence`
+	AnchorStyleASCII      = `ascii`
+)
+
+// Slugify converts heading text to anchor name using the given style:
+// github: lowercase, punctuation removed, spaces replaced with dashes;
+// confluence: all whitespace removed, case and punctuation preserved;
+// ascii: same as github, but non-ASCII letters are transliterated, e.g. ü
+// becomes ue, or encoded by code points if they can't be, e.g. 日 becomes
+// u65e5, so names are safe to use in links.
+func Slugify(text string, style string) (string, error) {
+	switch style {
+	case AnchorStyleGitHub:
+		return slugifyGitHub(text), nil
+	case AnchorStyleConfluence:
+		return slugifyConfluence(text), nil
+	case AnchorStyleASCII:
+		return slugifyASCII(text), nil
+	default:
+		return "", fmt.Errorf(
+			"unknown anchor style %q, expected %s, %s or %s",
+			style,
+			AnchorStyleGitHub,
+			AnchorStyleConfluence,
+			AnchorStyleASCII,
+		)
+	}
+}
+
+func slugifyGitHub(text string) string {
+	var slug strings.Builder
+
+	for _, symbol := range strings.ToLower(strings.TrimSpace(text)) {
+		switch {
+		// combining marks are kept, so decomposed letters like u followed
+		// by U+0308 aren't stripped of their diacritics
+		case unicode.IsLetter(symbol), unicode.IsDigit(symbol),
+			unicode.IsMark(symbol), symbol == '-', symbol == '_':
+			slug.WriteRune(symbol)
+		case unicode.IsSpace(symbol):
+			slug.WriteRune('-')
+		}
+	}
+
+	return slug.String()
+}
+
+// transliterations contains ASCII replacements of lowercase Latin letters
+// with diacritics, German umlauts are replaced the way they are spelled
+// without them.
+var transliterations = map[rune]string{
+	'ä': "ae", 'ö': "oe", 'ü': "ue", 'ß': "ss",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'å': "a", 'ā': "a", 'ă': "a",
+	'ą': "a", 'æ': "ae", 'ç': "c", 'ć': "c", 'ĉ': "c", 'ċ': "c", 'č': "c",
+	'ď': "d", 'đ': "d", 'ð': "d", 'è': "e", 'é': "e", 'ê': "e", 'ë': "e",
+	'ē': "e", 'ĕ': "e", 'ė': "e", 'ę': "e", 'ě': "e", 'ĝ': "g", 'ğ': "g",
+	'ġ': "g", 'ģ': "g", 'ĥ': "h", 'ħ': "h", 'ì': "i", 'í': "i", 'î': "i",
+	'ï': "i", 'ĩ': "i", 'ī': "i", 'ĭ': "i", 'į': "i", 'ı': "i", 'ĵ': "j",
+	'ķ': "k", 'ĺ': "l", 'ļ': "l", 'ľ': "l", 'ŀ': "l", 'ł': "l", 'ñ': "n",
+	'ń': "n", 'ņ': "n", 'ň': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o",
+	'ø': "o", 'ō': "o", 'ŏ': "o", 'ő': "o", 'œ': "oe", 'ŕ': "r", 'ŗ': "r",
+	'ř': "r", 'ś': "s", 'ŝ': "s", 'ş': "s", 'š': "s", 'ţ': "t", 'ť': "t",
+	'ŧ': "t", 'þ': "th", 'ù': "u", 'ú': "u", 'û': "u", 'ũ': "u", 'ū': "u",
+	'ŭ': "u", 'ů': "u", 'ű': "u", 'ų': "u", 'ŵ': "w", 'ý': "y", 'ÿ': "y",
+	'ŷ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// combiningDiaeresis is a mark which decomposed umlauts are spelled with.
+const combiningDiaeresis = '\u0308'
+
+func slugifyASCII(text string) string {
+	var (
+		slug     strings.Builder
+		previous rune
+	)
+
+	for _, symbol := range slugifyGitHub(text) {
+		switch {
+		case symbol <= unicode.MaxASCII:
+			slug.WriteRune(symbol)
+		case symbol == combiningDiaeresis &&
+			strings.ContainsRune("aou", previous):
+			slug.WriteRune('e')
+		case unicode.IsMark(symbol):
+			// other diacritics of decomposed letters are dropped
+		case transliterations[symbol] != "":
+			slug.WriteString(transliterations[symbol])
+		default:
+			fmt.Fprintf(&slug, "u%04x", symbol)
+		}
+
+		previous = symbol
+	}
+
+	return slug.String()
+}
+
+func slugifyConfluence(text string) string {
+	return strings.Join(strings.Fields(text), "")
+}
+
+// anchorNames keeps track of used anchor names, so duplicate names can be
+// disambiguated with numeric suffixes in document order like GitHub does:
+// the second "Usage" heading becomes usage-1, the third one becomes usage-2.
+type anchorNames map[string]bool
+
+func (names anchorNames) unique(name string) string {
+	candidate := name
+
+	for i := 1; names[candidate]; i++ {
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+
+	names[candidate] = true
+
+	return candidate
+}
+
+// HeadingAnchors returns names of anchors which are emitted for headings of
+// given markdown using given style by GitHub-style ids of the headings, so
+// links to sections written for GitHub, like #usage-1, can be resolved to
+// anchors of the Confluence page.
+func HeadingAnchors(markdown []byte, style string) (map[string]string, error) {
+	var (
+		anchors = map[string]string{}
+		ids     = anchorNames{}
+		names   = anchorNames{}
+		err     error
+	)
+
+	document := bf.New(bf.WithExtensions(markdownExtensions)).Parse(markdown)
+
+	document.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if node.Type != bf.Heading || !entering {
+			return bf.GoToNext
+		}
+
+		text := getHeadingText(node)
+
+		var name string
+
+		name, err = Slugify(text, style)
+		if err != nil {
+			return bf.Terminate
+		}
+
+		anchors[ids.unique(slugifyGitHub(text))] = names.unique(name)
+
+		return bf.SkipChildren
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return anchors, nil
+}
+
+// getHeadingText returns text of the heading without formatting.
+func getHeadingText(heading *bf.Node) string {
+	var text strings.Builder
+
+	heading.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+		if entering && (node.Type == bf.Text || node.Type == bf.Code) {
+			text.Write(node.Literal)
+		}
+
+		return bf.GoToNext
+	})
+
+	return text.String()
+}
@@ -2,8 +2,10 @@ package mark
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"net/url"
 	"os"
@@ -11,6 +13,7 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/bonovoxly/mark/pkg/confluence"
 	"github.com/reconquest/karma-go"
@@ -21,6 +24,10 @@ const (
 	AttachmentChecksumPrefix = `mark:checksum: `
 )
 
+// DefaultAttachmentJobs is a number of attachments which are uploaded
+// concurrently by default.
+const DefaultAttachmentJobs = 4
+
 type Attachment struct {
 	ID       string
 	Name     string
@@ -29,26 +36,150 @@ type Attachment struct {
 	Checksum string
 	Link     string
 	Replace  string
+
+	// Comment is sent along with checksum as attachment version comment.
+	Comment string
+}
+
+// FormatAttachmentComment returns attachment version comment which contains
+// checksum of the file, so unchanged files are not uploaded again.
+func FormatAttachmentComment(comment string, checksum string) string {
+	if comment == "" {
+		return AttachmentChecksumPrefix + checksum
+	}
+
+	return comment + " (" + AttachmentChecksumPrefix + checksum + ")"
 }
 
+// GetAttachmentChecksum returns checksum stored in attachment version comment
+// by FormatAttachmentComment or empty string if attachment is not uploaded by
+// mark.
+func GetAttachmentChecksum(comment string) string {
+	index := strings.LastIndex(comment, AttachmentChecksumPrefix)
+	if index < 0 {
+		return ""
+	}
+
+	checksum := comment[index+len(AttachmentChecksumPrefix):]
+
+	return strings.TrimSuffix(strings.TrimSpace(checksum), ")")
+}
+
+// IsAttachmentChanged returns true if local attachment differs from the
+// uploaded one. Only contents of the file are compared, so changing comment
+// of the attachment doesn't cause new version to be uploaded.
+func IsAttachmentChanged(
+	attach Attachment,
+	remote confluence.AttachmentInfo,
+) bool {
+	return attach.Checksum != GetAttachmentChecksum(remote.Metadata.Comment)
+}
+
+// ResolveAttachments uploads new and changed attachments of the page using up
+// to jobs concurrent uploads and returns all attachments with their links.
+// Every upload is attempted even if some of them failed, errors of all failed
+// uploads are returned together.
 func ResolveAttachments(
+	ctx context.Context,
 	api *confluence.API,
 	page *confluence.PageInfo,
 	base string,
 	replacements map[string]string,
+	comments map[string]string,
+	jobs int,
 ) ([]Attachment, error) {
+	existing, creating, updating, err := matchAttachments(
+		ctx,
+		api,
+		page,
+		base,
+		replacements,
+		comments,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attach := range existing {
+		log.Debugf(nil, "attachment %q is not changed, skipping", attach.Name)
+	}
+
+	// attachments are uploaded in place, so order of the result doesn't
+	// depend on order of finished uploads
+	uploading := []Attachment{}
+	uploading = append(uploading, creating...)
+	uploading = append(uploading, updating...)
+
+	err = uploadAttachments(ctx, api, page.ID, uploading, jobs)
+	if err != nil {
+		return nil, err
+	}
+
 	attaches := []Attachment{}
-	for replace, name := range replacements {
-		attach := Attachment{
-			Name:     name,
-			Filename: strings.ReplaceAll(name, "/", "_"),
-			Path:     filepath.Join(base, name),
-			Replace:  replace,
-		}
+	attaches = append(attaches, existing...)
+	attaches = append(attaches, uploading...)
+
+	return attaches, nil
+}
+
+// PreviewAttachments returns attachments of the page like ResolveAttachments
+// does, but nothing is uploaded. Links of attachments which are not uploaded
+// yet are left as they are specified in markdown. Page may be nil if it
+// doesn't exist yet.
+func PreviewAttachments(
+	ctx context.Context,
+	api *confluence.API,
+	page *confluence.PageInfo,
+	base string,
+	replacements map[string]string,
+	comments map[string]string,
+) ([]Attachment, error) {
+	existing, creating, updating, err := matchAttachments(
+		ctx,
+		api,
+		page,
+		base,
+		replacements,
+		comments,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range creating {
+		creating[i].Link = creating[i].Replace
+	}
+
+	attaches := []Attachment{}
+	attaches = append(attaches, existing...)
+	attaches = append(attaches, creating...)
+	attaches = append(attaches, updating...)
+
+	return attaches, nil
+}
+
+// matchAttachments matches local attachments against attachments of the page
+// and splits them into not changed, new and changed ones.
+func matchAttachments(
+	ctx context.Context,
+	api *confluence.API,
+	page *confluence.PageInfo,
+	base string,
+	replacements map[string]string,
+	comments map[string]string,
+) ([]Attachment, []Attachment, []Attachment, error) {
+	attaches, err := expandAttachments(base, replacements, comments)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for i, attach := range attaches {
+		attach.Filename = strings.ReplaceAll(attach.Name, "/", "_")
+		attach.Path = filepath.Join(base, attach.Name)
 
 		checksum, err := getChecksum(attach.Path)
 		if err != nil {
-			return nil, karma.Format(
+			return nil, nil, nil, karma.Format(
 				err,
 				"unable to get checksum for attachment: %q", attach.Name,
 			)
@@ -56,12 +187,19 @@ func ResolveAttachments(
 
 		attach.Checksum = checksum
 
-		attaches = append(attaches, attach)
+		attaches[i] = attach
 	}
 
-	remotes, err := api.GetAttachments(page.ID)
-	if err != nil {
-		panic(err)
+	// page which doesn't exist yet has no attachments
+	remotes := []confluence.AttachmentInfo{}
+	if page != nil {
+		remotes, err = api.GetAttachments(ctx, page.ID)
+		if err != nil {
+			return nil, nil, nil, karma.Format(
+				err,
+				"unable to retrieve page attachments",
+			)
+		}
 	}
 
 	existing := []Attachment{}
@@ -72,10 +210,7 @@ func ResolveAttachments(
 		var same bool
 		for _, remote := range remotes {
 			if remote.Filename == attach.Filename {
-				same = attach.Checksum == strings.TrimPrefix(
-					remote.Metadata.Comment,
-					AttachmentChecksumPrefix,
-				)
+				same = !IsAttachmentChanged(attach, remote)
 
 				attach.ID = remote.ID
 				attach.Link = path.Join(
@@ -100,17 +235,96 @@ func ResolveAttachments(
 		}
 	}
 
-	for i, attach := range creating {
-		log.Infof(nil, "creating attachment: %q", attach.Name)
+	return existing, creating, updating, nil
+}
+
+// uploadAttachments creates attachments which don't have ID yet and updates
+// others using up to jobs concurrent uploads.
+func uploadAttachments(
+	ctx context.Context,
+	api *confluence.API,
+	pageID string,
+	attaches []Attachment,
+	jobs int,
+) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	var (
+		wait  sync.WaitGroup
+		slots = make(chan struct{}, jobs)
+		errs  = make([]error, len(attaches))
+	)
+
+	for i := range attaches {
+		slots <- struct{}{}
+
+		// logger is not safe for concurrent use, so uploads are logged
+		// before they are started
+		if attaches[i].ID == "" {
+			log.Infof(nil, "creating attachment: %q", attaches[i].Name)
+		} else {
+			log.Infof(nil, "updating attachment: %q", attaches[i].Name)
+		}
 
-		info, err := api.CreateAttachment(
-			page.ID,
+		wait.Add(1)
+
+		go func(attach *Attachment, err *error) {
+			defer func() {
+				<-slots
+				wait.Done()
+			}()
+
+			*err = uploadAttachment(ctx, api, pageID, attach)
+		}(&attaches[i], &errs[i])
+	}
+
+	wait.Wait()
+
+	failed := []karma.Reason{}
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return karma.Push(
+		fmt.Sprintf(
+			"unable to upload %d of %d attachments",
+			len(failed),
+			len(attaches),
+		),
+		failed...,
+	)
+}
+
+func uploadAttachment(
+	ctx context.Context,
+	api *confluence.API,
+	pageID string,
+	attach *Attachment,
+) error {
+	var (
+		info    confluence.AttachmentInfo
+		err     error
+		comment = FormatAttachmentComment(attach.Comment, attach.Checksum)
+	)
+
+	if attach.ID == "" {
+		info, err = api.CreateAttachment(
+			ctx,
+			pageID,
 			attach.Filename,
-			AttachmentChecksumPrefix+attach.Checksum,
+			comment,
 			attach.Path,
 		)
 		if err != nil {
-			return nil, karma.Format(
+			return karma.Format(
 				err,
 				"unable to create attachment %q",
 				attach.Name,
@@ -118,48 +332,253 @@ func ResolveAttachments(
 		}
 
 		attach.ID = info.ID
-		attach.Link = path.Join(
-			info.Links.Context,
-			info.Links.Download,
-		)
-
-		creating[i] = attach
-	}
-
-	for i, attach := range updating {
-		log.Infof(nil, "updating attachment: %q", attach.Name)
-
-		info, err := api.UpdateAttachment(
-			page.ID,
+	} else {
+		info, err = api.UpdateAttachment(
+			ctx,
+			pageID,
 			attach.ID,
 			attach.Name,
-			AttachmentChecksumPrefix+attach.Checksum,
+			comment,
 			attach.Path,
 		)
 		if err != nil {
-			return nil, karma.Format(
+			return karma.Format(
 				err,
 				"unable to update attachment %q",
 				attach.Name,
 			)
 		}
+	}
 
-		attach.Link = path.Join(
-			info.Links.Context,
-			info.Links.Download,
+	attach.Link = path.Join(
+		info.Links.Context,
+		info.Links.Download,
+	)
+
+	return nil
+}
+
+// PruneAttachments deletes attachments of the page which were uploaded by mark
+// but are not in the given list anymore. Attachments uploaded manually or by
+// other tools don't have mark checksum in the comment, so they are kept.
+func PruneAttachments(
+	ctx context.Context,
+	api *confluence.API,
+	page *confluence.PageInfo,
+	attaches []Attachment,
+) error {
+	remotes, err := api.GetAttachments(ctx, page.ID)
+	if err != nil {
+		return karma.Format(err, "unable to retrieve page attachments")
+	}
+
+	current := map[string]bool{}
+	for _, attach := range attaches {
+		current[attach.Filename] = true
+	}
+
+	for _, remote := range remotes {
+		if current[remote.Filename] {
+			continue
+		}
+
+		if GetAttachmentChecksum(remote.Metadata.Comment) == "" {
+			log.Debugf(
+				nil,
+				"keeping attachment %q which is not uploaded by mark",
+				remote.Filename,
+			)
+
+			continue
+		}
+
+		log.Infof(nil, "deleting stale attachment: %q", remote.Filename)
+
+		err := api.DeleteAttachment(ctx, remote.ID)
+		if err != nil {
+			return karma.Format(
+				err,
+				"unable to delete attachment %q",
+				remote.Filename,
+			)
+		}
+	}
+
+	return nil
+}
+
+// CopyAttachments uploads every attachment of the source page to the target
+// page, e.g. to seed a new page from a template. Mark checksum is removed from
+// comments of copied attachments, so they are not considered uploaded by mark
+// and are not deleted by PruneAttachments.
+func CopyAttachments(
+	ctx context.Context,
+	api *confluence.API,
+	sourceID string,
+	targetID string,
+) ([]confluence.AttachmentInfo, error) {
+	attachments, err := api.GetAttachments(ctx, sourceID)
+	if err != nil {
+		return nil, karma.Format(
+			err,
+			"unable to retrieve attachments of page %q",
+			sourceID,
 		)
+	}
+
+	copied := []confluence.AttachmentInfo{}
+	for _, attachment := range attachments {
+		info, err := api.CopyAttachment(
+			ctx,
+			attachment,
+			targetID,
+			stripAttachmentChecksum(attachment.Metadata.Comment),
+		)
+		if err != nil {
+			return nil, karma.Format(
+				err,
+				"unable to copy attachment %q",
+				attachment.Filename,
+			)
+		}
 
-		updating[i] = attach
+		copied = append(copied, info)
 	}
 
-	attaches = []Attachment{}
-	attaches = append(attaches, existing...)
-	attaches = append(attaches, creating...)
-	attaches = append(attaches, updating...)
+	return copied, nil
+}
+
+// stripAttachmentChecksum returns attachment comment without checksum added
+// by FormatAttachmentComment.
+func stripAttachmentChecksum(comment string) string {
+	index := strings.LastIndex(comment, AttachmentChecksumPrefix)
+	if index < 0 {
+		return comment
+	}
+
+	comment = strings.TrimSpace(comment[:index])
+
+	return strings.TrimSpace(strings.TrimSuffix(comment, "("))
+}
+
+// expandAttachments returns attachments sorted by replacement with glob
+// patterns like images/*.png expanded into matching files relative to base
+// directory. Every matched file replaces its own path and gets comment of the
+// pattern.
+func expandAttachments(
+	base string,
+	replacements map[string]string,
+	comments map[string]string,
+) ([]Attachment, error) {
+	keys := []string{}
+	for replace := range replacements {
+		keys = append(keys, replace)
+	}
+
+	sort.Strings(keys)
+
+	var (
+		attaches = []Attachment{}
+		seen     = map[string]bool{}
+	)
+
+	for _, replace := range keys {
+		name := replacements[replace]
+
+		if !strings.ContainsAny(name, "*?[") {
+			if !seen[replace] {
+				seen[replace] = true
+
+				attaches = append(attaches, Attachment{
+					Name:    name,
+					Replace: replace,
+					Comment: comments[name],
+				})
+			}
+
+			continue
+		}
+
+		matches, err := filepath.Glob(
+			filepath.Join(base, filepath.FromSlash(name)),
+		)
+		if err != nil {
+			return nil, karma.Format(
+				err,
+				"invalid attachment pattern: %q",
+				name,
+			)
+		}
+
+		if len(matches) == 0 {
+			log.Warningf(nil, "attachment pattern %q matches no files", name)
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || info.IsDir() {
+				continue
+			}
+
+			relative, err := filepath.Rel(base, match)
+			if err != nil {
+				return nil, err
+			}
+
+			relative = filepath.ToSlash(relative)
+
+			if seen[relative] {
+				continue
+			}
+
+			seen[relative] = true
+
+			attaches = append(attaches, Attachment{
+				Name:    relative,
+				Replace: relative,
+				Comment: comments[name],
+			})
+		}
+	}
 
 	return attaches, nil
 }
 
+// ExtractAttachmentLinks returns paths of existing local files which are
+// linked from markdown and should be uploaded as attachments. Links to
+// markdown files, images and external resources are ignored.
+func ExtractAttachmentLinks(markdown []byte, base string) []string {
+	var (
+		links = []string{}
+		seen  = map[string]bool{}
+	)
+
+	for _, link := range parseLinks(string(markdown)) {
+		name := link.filename
+		if name == "" || seen[name] || strings.Contains(name, "://") {
+			continue
+		}
+
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".md", ".markdown",
+			".png", ".jpg", ".jpeg", ".gif", ".svg", ".bmp", ".webp":
+			continue
+		}
+
+		stat, err := os.Stat(filepath.Join(base, name))
+		if err != nil || !stat.Mode().IsRegular() {
+			continue
+		}
+
+		log.Debugf(nil, "found link to local file: %q", name)
+
+		seen[name] = true
+		links = append(links, name)
+	}
+
+	return links
+}
+
 func CompileAttachmentLinks(markdown []byte, attaches []Attachment) []byte {
 	links := map[string]string{}
 	replaces := []string{}
@@ -167,7 +586,7 @@ func CompileAttachmentLinks(markdown []byte, attaches []Attachment) []byte {
 	for _, attach := range attaches {
 		uri, err := url.ParseRequestURI(attach.Link)
 		if err != nil {
-			links[attach.Replace] = strings.ReplaceAll("&", "&amp;", attach.Link)
+			links[attach.Replace] = strings.ReplaceAll(attach.Link, "&", "&amp;")
 		} else {
 			links[attach.Replace] = uri.Path +
 				"?" + url.QueryEscape(uri.Query().Encode())
@@ -0,0 +1,372 @@
+package mark
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractAttachmentLinks(t *testing.T) {
+	base, err := ioutil.TempDir("", "mark")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(base)
+
+	for _, name := range []string{
+		"report.pdf",
+		"docs/spec.txt",
+		"image.png",
+		"page.md",
+	} {
+		err := os.MkdirAll(filepath.Join(base, filepath.Dir(name)), 0755)
+		if err != nil {
+			panic(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(base, name), []byte(name), 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	markdown := `
+	[report](report.pdf)
+	[report again](report.pdf)
+	[spec](./docs/spec.txt#section)
+	![image](image.png)
+	[page](page.md)
+	[missing](missing.pdf)
+	[directory](docs)
+	[external](https://example.com/file.pdf)
+	[heading](#heading)
+	`
+
+	assert.Equal(
+		t,
+		[]string{"report.pdf", "./docs/spec.txt"},
+		ExtractAttachmentLinks([]byte(markdown), base),
+	)
+}
+
+func TestExpandAttachments(t *testing.T) {
+	base, err := ioutil.TempDir("", "mark")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(base)
+
+	for _, name := range []string{
+		"images/b.png",
+		"images/a.png",
+		"images/c.jpg",
+		"report.pdf",
+	} {
+		err := os.MkdirAll(filepath.Join(base, filepath.Dir(name)), 0755)
+		if err != nil {
+			panic(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(base, name), []byte(name), 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	attaches, err := expandAttachments(
+		base,
+		map[string]string{
+			"report.pdf":    "report.pdf",
+			"images/*.png":  "images/*.png",
+			"images/a.png":  "images/a.png",
+			"images/*.gif":  "images/*.gif",
+			"images/[a-b]*": "images/[a-b]*",
+		},
+		map[string]string{
+			"images/*.png": "Diagrams",
+			"report.pdf":   "Quarterly report",
+		},
+	)
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		[]Attachment{
+			{Name: "images/a.png", Replace: "images/a.png", Comment: "Diagrams"},
+			{Name: "images/b.png", Replace: "images/b.png", Comment: "Diagrams"},
+			{
+				Name:    "report.pdf",
+				Replace: "report.pdf",
+				Comment: "Quarterly report",
+			},
+		},
+		attaches,
+	)
+}
+
+func TestAttachmentComment(t *testing.T) {
+	test := assert.New(t)
+
+	for _, comment := range []string{"", "Architecture (v2)"} {
+		formatted := FormatAttachmentComment(comment, "abc123")
+		test.Equal("abc123", GetAttachmentChecksum(formatted), formatted)
+	}
+
+	test.Equal(
+		"Architecture (v2) (mark:checksum: abc123)",
+		FormatAttachmentComment("Architecture (v2)", "abc123"),
+	)
+	test.Equal("", GetAttachmentChecksum("uploaded manually"))
+}
+
+func TestResolveAttachmentsConcurrently(t *testing.T) {
+	test := assert.New(t)
+
+	base, err := ioutil.TempDir("", "mark")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(base)
+
+	replacements := map[string]string{}
+
+	for _, name := range []string{"a.png", "b.png", "c.png", "d.png", "e.png"} {
+		err = ioutil.WriteFile(filepath.Join(base, name), []byte(name), 0644)
+		if err != nil {
+			panic(err)
+		}
+
+		replacements[name] = name
+	}
+
+	var running, peak, uploaded int32
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			if request.Method == http.MethodGet {
+				writer.Write([]byte(`{"results":[]}`))
+				return
+			}
+
+			current := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+
+			for {
+				max := atomic.LoadInt32(&peak)
+				if current <= max ||
+					atomic.CompareAndSwapInt32(&peak, max, current) {
+					break
+				}
+			}
+
+			time.Sleep(20 * time.Millisecond)
+
+			_, header, err := request.FormFile("file")
+			if err != nil {
+				panic(err)
+			}
+
+			if header.Filename == "c.png" {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			atomic.AddInt32(&uploaded, 1)
+
+			fmt.Fprintf(
+				writer,
+				`{"results":[{"id":"%[1]s","title":"%[1]s",`+
+					`"_links":{"download":"/download/%[1]s"}}]}`,
+				header.Filename,
+			)
+		},
+	))
+	defer server.Close()
+
+	api := confluence.NewAPI(server.URL, "", "", nil)
+	page := &confluence.PageInfo{ID: "1"}
+
+	_, err = ResolveAttachments(
+		context.Background(),
+		api,
+		page,
+		base,
+		replacements,
+		nil,
+		2,
+	)
+	test.Error(err)
+	test.Contains(err.Error(), `unable to create attachment "c.png"`)
+
+	// failed upload doesn't prevent uploading other attachments
+	test.Equal(int32(4), atomic.LoadInt32(&uploaded))
+	test.Equal(int32(2), atomic.LoadInt32(&peak))
+
+	delete(replacements, "c.png")
+
+	attaches, err := ResolveAttachments(
+		context.Background(),
+		api,
+		page,
+		base,
+		replacements,
+		nil,
+		3,
+	)
+	test.NoError(err)
+
+	links := []string{}
+	for _, attach := range attaches {
+		links = append(links, attach.Link)
+	}
+
+	test.Equal(
+		[]string{
+			"/download/a.png",
+			"/download/b.png",
+			"/download/d.png",
+			"/download/e.png",
+		},
+		links,
+	)
+}
+
+func TestPruneAttachments(t *testing.T) {
+	test := assert.New(t)
+
+	deleted := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			if request.Method == http.MethodDelete {
+				deleted = append(deleted, filepath.Base(request.URL.Path))
+				writer.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			writer.Write([]byte(`{"results":[` +
+				`{"id":"1","title":"kept.png",` +
+				`"metadata":{"comment":"mark:checksum: aaa"}},` +
+				`{"id":"2","title":"stale.png",` +
+				`"metadata":{"comment":"mark:checksum: bbb"}},` +
+				`{"id":"3","title":"manual.png",` +
+				`"metadata":{"comment":"uploaded manually"}},` +
+				`{"id":"4","title":"diagram.png",` +
+				`"metadata":{"comment":"Diagram (mark:checksum: ccc)"}}` +
+				`]}`))
+		},
+	))
+	defer server.Close()
+
+	api := confluence.NewAPI(server.URL, "", "", nil)
+
+	err := PruneAttachments(
+		context.Background(),
+		api,
+		&confluence.PageInfo{ID: "100"},
+		[]Attachment{{Filename: "kept.png"}},
+	)
+	test.NoError(err)
+
+	// attachments without mark checksum in comment are not uploaded by mark
+	test.Equal([]string{"2", "4"}, deleted)
+}
+
+func TestCopyAttachments(t *testing.T) {
+	test := assert.New(t)
+
+	copied := map[string]string{}
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			switch request.URL.Path {
+			case "/rest/api/content/1/child/attachment":
+				writer.Write([]byte(`{"results":[` +
+					`{"id":"10","title":"a.png",` +
+					`"metadata":{"comment":"mark:checksum: aaa"},` +
+					`"_links":{"download":"/download/a.png"}},` +
+					`{"id":"11","title":"b.png",` +
+					`"metadata":{"comment":"Diagram (mark:checksum: bbb)"},` +
+					`"_links":{"download":"/download/b.png"}}` +
+					`]}`))
+
+			case "/download/a.png", "/download/b.png":
+				writer.Write([]byte(filepath.Base(request.URL.Path)))
+
+			case "/rest/api/content/2/child/attachment":
+				file, header, err := request.FormFile("file")
+				test.NoError(err)
+
+				contents, err := ioutil.ReadAll(file)
+				test.NoError(err)
+				test.Equal(header.Filename, string(contents))
+
+				copied[header.Filename] = request.FormValue("comment")
+
+				writer.Write([]byte(`{"results":[{"id":"20"}]}`))
+
+			default:
+				t.Errorf("unexpected request: %s", request.URL.Path)
+			}
+		},
+	))
+	defer server.Close()
+
+	api := confluence.NewAPI(server.URL, "", "", nil)
+
+	attachments, err := CopyAttachments(context.Background(), api, "1", "2")
+	test.NoError(err)
+	test.Len(attachments, 2)
+
+	// copied attachments are not uploaded by mark, so they are not pruned
+	test.Equal(map[string]string{"a.png": "", "b.png": "Diagram"}, copied)
+}
+
+func TestPreviewAttachmentsNewLink(t *testing.T) {
+	test := assert.New(t)
+
+	base, err := ioutil.TempDir("", "mark")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(base)
+
+	err = os.MkdirAll(filepath.Join(base, "images"), 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(base, "images/a.png"), []byte("a"), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	// page doesn't exist yet, so attachment isn't uploaded yet
+	attaches, err := PreviewAttachments(
+		context.Background(),
+		nil,
+		nil,
+		base,
+		map[string]string{"images/a.png": "images/a.png"},
+		nil,
+	)
+	test.NoError(err)
+
+	test.Equal(
+		"![d](images/a.png)",
+		string(CompileAttachmentLinks([]byte("![d](images/a.png)"), attaches)),
+	)
+}
@@ -0,0 +1,228 @@
+package mark
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bonovoxly/mark/pkg/mark/fence"
+	"github.com/bonovoxly/mark/pkg/mark/includes"
+	"github.com/bonovoxly/mark/pkg/mark/stdlib"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+	"gopkg.in/yaml.v2"
+)
+
+// Block is marked by <!-- Block: <template> --> start marker, which may
+// contain YAML data with template parameters before -->, and <!-- /Block -->
+// end marker. Contents of the block are rendered as usual and passed to the
+// template as Body. TOC zone is a block of ac:toc:zone template, which is
+// marked by <!-- TOCZone --> and <!-- /TOCZone --> markers.
+var (
+	reBlockStart = regexp.MustCompile(
+		`^\s*<!--\s*(?:(TOCZone)\b|(Block):[ \t]*([^\s>]+))(.*)$`,
+	)
+	reBlockEnd = regexp.MustCompile(`^\s*<!--\s*/(TOCZone|Block)\s*-->\s*$`)
+)
+
+// blockTemplates maps kinds of blocks with predefined template to the
+// template name.
+var blockTemplates = map[string]string{
+	"TOCZone": "ac:toc:zone",
+}
+
+type block struct {
+	kind     string
+	template string
+	start    string
+	end      string
+	config   map[string]interface{}
+}
+
+// extractBlocks replaces start and end markers of blocks outside of code
+// with placeholder tokens, so contents of the block are rendered as usual.
+// Blocks can be nested, error is returned if markers are not balanced.
+func extractBlocks(markdown []byte) ([]byte, []block, error) {
+	var (
+		blocks []block
+		result []string
+		open   []int
+		fences fence.Scanner
+		spec   *strings.Builder
+		kind   string
+		name   string
+		lines  = strings.Split(string(markdown), "\n")
+	)
+
+	for number, line := range lines {
+		if spec != nil {
+			spec.WriteString("\n" + line)
+		} else {
+			if fences.Scan(line) {
+				result = append(result, line)
+				continue
+			}
+
+			if matches := reBlockEnd.FindStringSubmatch(line); matches != nil {
+				if len(open) == 0 {
+					return nil, nil, fmt.Errorf(
+						"%s end marker at line %d doesn't have "+
+							"matching start marker",
+						matches[1],
+						number+1,
+					)
+				}
+
+				block := blocks[open[len(open)-1]]
+				open = open[:len(open)-1]
+
+				if block.kind != matches[1] {
+					return nil, nil, fmt.Errorf(
+						"%s end marker at line %d doesn't match "+
+							"%s start marker",
+						matches[1],
+						number+1,
+						block.kind,
+					)
+				}
+
+				result = append(result, "", block.end, "")
+
+				continue
+			}
+
+			matches := reBlockStart.FindStringSubmatch(line)
+			if matches == nil {
+				result = append(result, line)
+				continue
+			}
+
+			kind = matches[1] + matches[2]
+			name = blockTemplates[kind]
+
+			if kind == "Block" {
+				name = matches[3]
+
+				// template name may be followed by --> without space
+				if strings.HasSuffix(name, "--") {
+					name = strings.TrimSuffix(name, "--")
+					matches[4] = "--" + matches[4]
+				}
+			}
+
+			spec = &strings.Builder{}
+			spec.WriteString(matches[4])
+		}
+
+		if !strings.Contains(spec.String(), "-->") {
+			continue
+		}
+
+		config := map[string]interface{}{}
+
+		data := strings.SplitN(spec.String(), "-->", 2)[0]
+
+		err := yaml.Unmarshal([]byte(data), &config)
+		if err != nil {
+			return nil, nil, karma.Format(
+				err,
+				"unable to unmarshal %s config at line %d",
+				kind,
+				number+1,
+			)
+		}
+
+		block := block{
+			kind:     kind,
+			template: name,
+			start:    fmt.Sprintf("MARKBLOCK%dSTART", len(blocks)),
+			end:      fmt.Sprintf("MARKBLOCK%dEND", len(blocks)),
+			config:   config,
+		}
+
+		open = append(open, len(blocks))
+		blocks = append(blocks, block)
+
+		result = append(result, "", block.start, "")
+
+		spec = nil
+	}
+
+	if spec != nil {
+		return nil, nil, fmt.Errorf("%s start marker is not terminated", kind)
+	}
+
+	if len(open) > 0 {
+		return nil, nil, fmt.Errorf(
+			"%d %s start markers don't have matching end marker",
+			len(open),
+			blocks[open[len(open)-1]].kind,
+		)
+	}
+
+	return []byte(strings.Join(result, "\n")), blocks, nil
+}
+
+// compileBlocks replaces contents of blocks in rendered html, which are
+// marked by placeholders, with output of block templates.
+func compileBlocks(
+	html []byte,
+	blocks []block,
+	lib *stdlib.Lib,
+) []byte {
+	// nested blocks are started later, so they are compiled first
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+
+		start := findPlaceholder(html, block.start)
+		end := findPlaceholder(html, block.end)
+
+		if start == nil || end == nil || end[0] < start[1] {
+			log.Errorf(nil, "unable to find contents of %s #%d", block.kind, i+1)
+			continue
+		}
+
+		data := map[string]interface{}{}
+		for key, value := range block.config {
+			data[key] = value
+		}
+
+		data["Body"] = string(html[start[1]:end[0]])
+
+		var buffer bytes.Buffer
+
+		template, err := includes.LoadTemplate(block.template, lib.Templates)
+		if err == nil {
+			err = template.Execute(&buffer, data)
+		}
+
+		if err != nil {
+			log.Errorf(err, "unable to render %s #%d", block.kind, i+1)
+			continue
+		}
+
+		html = append(
+			html[:start[0]:start[0]],
+			append(buffer.Bytes(), html[end[1]:]...)...,
+		)
+	}
+
+	return html
+}
+
+// findPlaceholder returns location of the placeholder along with paragraph
+// it's wrapped into by renderer.
+func findPlaceholder(html []byte, token string) []int {
+	for _, from := range []string{
+		"<p>" + token + "</p>\n",
+		"<p>" + token + "</p>",
+		token,
+	} {
+		if index := bytes.Index(html, []byte(from)); index >= 0 {
+			return []int{index, index + len(from)}
+		}
+	}
+
+	return nil
+}
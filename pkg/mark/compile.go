@@ -0,0 +1,304 @@
+package mark
+
+import (
+	"context"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/bonovoxly/mark/pkg/mark/includes"
+	"github.com/bonovoxly/mark/pkg/mark/macro"
+	"github.com/bonovoxly/mark/pkg/mark/multierr"
+	"github.com/bonovoxly/mark/pkg/mark/stdlib"
+	"github.com/reconquest/karma-go"
+)
+
+// Options controls how markdown document is compiled into Confluence storage
+// format.
+type Options struct {
+	CompileOptions
+
+	// API is used for resolving user mentions and relative links to other
+	// documents, relative links are kept as is if it's nil.
+	API *confluence.API
+
+	// Base is a directory which relative links are resolved against.
+	Base string
+
+	// File is a path of the document, it's used by functions of templated
+	// page title, see RenderTitle.
+	File string
+
+	// IndexFiles are names of files which links to directories are resolved
+	// to, DefaultIndexFiles are used if it's empty.
+	IndexFiles []string
+
+	// TitleFromH1 enables using leading H1 heading as page title if metadata
+	// doesn't specify one.
+	TitleFromH1 bool
+
+	// DropH1 enables removing leading H1 heading from the output, it's a
+	// shorthand for dropping LeadingHeading of level 1.
+	DropH1 bool
+
+	// LeadingHeading controls how heading which document starts with is
+	// transformed, it's kept as is by default.
+	LeadingHeading LeadingHeading
+
+	// TemplatesDir is a directory with custom templates and macros which are
+	// loaded in addition to the standard library.
+	TemplatesDir string
+
+	// EnvSubst enables substitution of ${VAR} placeholders with values of
+	// environment variables, see SubstituteEnv.
+	EnvSubst bool
+
+	// PageCache keeps bodies of pages included by Confluence-Include
+	// directives between documents, pages are fetched for every document if
+	// it's nil.
+	PageCache *PageCache
+
+	// StrictMacros enables failing on directives which look like macros, but
+	// aren't recognized, e.g. due to a typo. Such directives are passed
+	// through to the output and only logged as warnings otherwise. Unknown
+	// inline macro shorthands like {foo:bar} are logged as warnings only if
+	// it's set.
+	StrictMacros bool
+
+	// UserScheme is an attribute which mentioned users are linked by, it's
+	// chosen by flavor of Confluence or by found users if it's empty.
+	// UserScheme metadata field takes precedence.
+	UserScheme confluence.UserScheme
+
+	// CollectErrors enables processing of every include and macro even if
+	// some of them failed, so all errors are returned at once instead of
+	// stopping at the first one.
+	CollectErrors bool
+}
+
+// Document is a markdown document with metadata extracted, includes and
+// macros expanded and relative links resolved, which is ready for rendering.
+type Document struct {
+	Meta     *Meta
+	Markdown []byte
+	Stdlib   *stdlib.Lib
+
+	// Options are options of compiling the document with metadata
+	// overrides applied, see CompileOptions.WithMeta.
+	Options CompileOptions
+
+	// Source is the markdown source as is, see EmbedSource.
+	Source []byte
+
+	// Pages are bodies of pages included by Confluence-Include directives
+	// by their placeholder tokens, see SubstituteConfluenceIncludes.
+	Pages map[string]string
+}
+
+// Prepare extracts metadata from given markdown source, processes includes and
+// macros and resolves relative links.
+func Prepare(
+	ctx context.Context,
+	source []byte,
+	options Options,
+) (*Document, error) {
+	original := source
+
+	if options.EnvSubst {
+		var err error
+
+		source, err = SubstituteEnv(source)
+		if err != nil {
+			return nil, karma.Format(err, "unable to substitute variables")
+		}
+	}
+
+	meta, markdown, err := ExtractFileMeta(
+		source,
+		options.File,
+		options.TitleFromH1,
+	)
+	if err != nil {
+		return nil, karma.Format(err, "unable to extract metadata")
+	}
+
+	stdlib, err := stdlib.New(ctx, options.API)
+	if err != nil {
+		return nil, karma.Format(err, "unable to load stdlib")
+	}
+
+	stdlib.UserScheme = options.UserScheme
+	if meta != nil && meta.UserScheme != "" {
+		stdlib.UserScheme = confluence.UserScheme(meta.UserScheme)
+	}
+
+	if options.TemplatesDir != "" {
+		err = stdlib.Load(options.TemplatesDir)
+		if err != nil {
+			return nil, karma.Format(err, "unable to load custom templates")
+		}
+	}
+
+	templates := stdlib.Templates
+
+	var (
+		recurse bool
+		errs    []error
+	)
+
+	// fail returns true if preparation should be stopped due to the error
+	fail := func(err error, message string) bool {
+		errs = append(errs, karma.Format(err, message))
+
+		return !options.CollectErrors
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		templates, markdown, recurse, err = includes.ProcessIncludes(
+			markdown,
+			templates,
+		)
+		if err != nil && fail(err, "unable to process includes") {
+			return nil, errs[0]
+		}
+
+		if !recurse {
+			break
+		}
+	}
+
+	macros, markdown, err := macro.ExtractMacros(markdown, templates)
+	if err != nil && fail(err, "unable to extract macros") {
+		return nil, errs[0]
+	}
+
+	err = checkUnresolvedMacros(source, markdown, options.StrictMacros)
+	if err != nil && fail(err, "invalid macros") {
+		return nil, errs[0]
+	}
+
+	macros = append(macros, stdlib.Macros...)
+
+	for _, macro := range macros {
+		markdown, err = macro.Apply(markdown)
+		if err != nil && fail(err, "unable to apply macro") {
+			return nil, errs[0]
+		}
+	}
+
+	checkUnknownShorthands(source, markdown, options.StrictMacros)
+
+	_, blocks, err := extractBlocks(markdown)
+	if err != nil && fail(err, "invalid block markers") {
+		return nil, errs[0]
+	}
+
+	err = validatePanels(markdown)
+	if err != nil && fail(err, "invalid panels") {
+		return nil, errs[0]
+	}
+
+	for _, block := range blocks {
+		_, err := includes.LoadTemplate(block.template, templates)
+		if err != nil && fail(err, "unable to load "+block.kind+" template") {
+			return nil, errs[0]
+		}
+	}
+
+	pages := map[string]string{}
+
+	// pages can't be fetched without API, so directives are kept as is
+	if options.API != nil {
+		var included []confluenceInclude
+
+		markdown, included = extractConfluenceIncludes(markdown)
+
+		cache := options.PageCache
+		if cache == nil {
+			cache = NewPageCache()
+		}
+
+		space := ""
+		if meta != nil {
+			space = meta.Space
+		}
+
+		for _, page := range included {
+			body, err := cache.GetPageBody(ctx, options.API, space, page.page)
+			if err != nil && fail(err, "unable to include page "+page.page) {
+				return nil, errs[0]
+			}
+
+			pages[page.token] = body
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, multierr.Join(errs)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	options.CompileOptions = options.CompileOptions.WithMeta(meta)
+
+	if options.API != nil {
+		base := options.Base
+		if base == "" {
+			base = "."
+		}
+
+		links, err := ResolveRelativeLinks(
+			ctx,
+			options.API,
+			meta,
+			markdown,
+			base,
+			options.IndexFiles,
+			options.AnchorStyle,
+		)
+		if err != nil {
+			return nil, karma.Format(err, "unable to resolve relative links")
+		}
+
+		markdown = SubstituteLinks(markdown, links)
+	}
+
+	return &Document{
+		Meta:     meta,
+		Markdown: markdown,
+		Stdlib:   stdlib,
+		Options:  options.CompileOptions,
+		Source:   original,
+		Pages:    pages,
+	}, nil
+}
+
+// Compile compiles markdown source into Confluence storage format and returns
+// it along with the document metadata. Attachments are not uploaded, so links
+// to them are kept as is.
+func Compile(
+	ctx context.Context,
+	source []byte,
+	options Options,
+) (string, *Meta, error) {
+	document, err := Prepare(ctx, source, options)
+	if err != nil {
+		return "", nil, err
+	}
+
+	markdown := document.Markdown
+	if options.DropH1 {
+		markdown = DropDocumentLeadingH1(markdown)
+	} else {
+		markdown = TransformLeadingHeading(markdown, options.LeadingHeading)
+	}
+
+	html := CompileMarkdown(markdown, document.Stdlib, document.Options)
+	html = SubstituteConfluenceIncludes(html, document.Pages)
+
+	return html, document.Meta, nil
+}
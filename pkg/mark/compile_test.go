@@ -0,0 +1,988 @@
+package mark
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompile(t *testing.T) {
+	test := assert.New(t)
+
+	html, meta, err := Compile(
+		context.Background(),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: My Article -->",
+			"",
+			"# My Article",
+			"<!-- Macro: :done:",
+			"     Template: ac:status",
+			"     Title: DONE",
+			"     Color: Green -->",
+			"",
+			"Status: :done:",
+		)),
+		Options{DropH1: true},
+	)
+	test.NoError(err)
+	test.Equal("TEST", meta.Space)
+	test.Equal("My Article", meta.Title)
+	test.Equal(
+		text(
+			`<p>Status: <ac:structured-macro ac:name="status">`+
+				`<ac:parameter ac:name="colour">Green</ac:parameter>`+
+				`<ac:parameter ac:name="title">DONE</ac:parameter>`+
+				`<ac:parameter ac:name="subtle">false</ac:parameter>`+
+				`</ac:structured-macro></p>`,
+			"",
+		),
+		html,
+	)
+}
+
+func TestCompileMacroParams(t *testing.T) {
+	test := assert.New(t)
+
+	source := text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: Statuses -->",
+		"",
+		`<!-- Macro: :status\[(?P<params>[^\]]*)\]:`,
+		"     Template: ac:status",
+		"     Color: Grey -->",
+		"",
+		`* :status[title="In Progress" subtle=true]:`,
+		`* :status[color=Green title=Done]:`,
+	)
+
+	html, _, err := Compile(context.Background(), []byte(source), Options{})
+	test.NoError(err)
+	test.Equal(
+		text(
+			"<ul>",
+			`<li><ac:structured-macro ac:name="status">`+
+				`<ac:parameter ac:name="colour">Grey</ac:parameter>`+
+				`<ac:parameter ac:name="title">In Progress</ac:parameter>`+
+				`<ac:parameter ac:name="subtle">true</ac:parameter>`+
+				`</ac:structured-macro></li>`,
+			`<li><ac:structured-macro ac:name="status">`+
+				`<ac:parameter ac:name="colour">Green</ac:parameter>`+
+				`<ac:parameter ac:name="title">Done</ac:parameter>`+
+				`<ac:parameter ac:name="subtle">false</ac:parameter>`+
+				`</ac:structured-macro></li>`,
+			"</ul>",
+			"",
+		),
+		html,
+	)
+
+	_, _, err = Compile(
+		context.Background(),
+		[]byte(source+"\n:status[colour=Red]:\n"),
+		Options{},
+	)
+	if test.Error(err) {
+		test.Contains(
+			err.Error(),
+			`unknown parameter "colour" of template "ac:status", `+
+				"expected one of: Color, Subtle, Title",
+		)
+	}
+
+	_, _, err = Compile(
+		context.Background(),
+		[]byte(source+"\n:status[Done]:\n"),
+		Options{},
+	)
+	if test.Error(err) {
+		test.Contains(
+			err.Error(),
+			`invalid macro parameter "Done", expected key=value`,
+		)
+	}
+}
+
+func TestCompileMacroShorthand(t *testing.T) {
+	test := assert.New(t)
+
+	source := text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: Shorthands -->",
+		"",
+		`Status: {status:color=Green title="In Progress"}`,
+		"",
+		"Ticket: {jira:PROJ-123}",
+		"",
+		"Unknown: {todo:later}",
+	)
+
+	html, _, err := Compile(context.Background(), []byte(source), Options{})
+	test.NoError(err)
+	test.Equal(
+		text(
+			`<p>Status: <ac:structured-macro ac:name="status">`+
+				`<ac:parameter ac:name="colour">Green</ac:parameter>`+
+				`<ac:parameter ac:name="title">In Progress</ac:parameter>`+
+				`<ac:parameter ac:name="subtle">false</ac:parameter>`+
+				`</ac:structured-macro></p>`,
+			"",
+			`<p>Ticket: <ac:structured-macro ac:name="jira">`+
+				`<ac:parameter ac:name="key">PROJ-123</ac:parameter>`+
+				`</ac:structured-macro></p>`,
+			"",
+			"<p>Unknown: {todo:later}</p>",
+			"",
+		),
+		html,
+	)
+
+	document, err := Prepare(context.Background(), []byte(source), Options{})
+	test.NoError(err)
+	test.Equal(
+		[]UnresolvedMacro{{Line: 8, Text: "{todo:later}"}},
+		findUnknownShorthands([]byte(source), document.Markdown),
+	)
+
+	_, _, err = Compile(
+		context.Background(),
+		[]byte(source+"\n\n{status:colour=Red}\n"),
+		Options{},
+	)
+	if test.Error(err) {
+		test.Contains(
+			err.Error(),
+			`unknown parameter "colour" of template "ac:status"`,
+		)
+	}
+}
+
+func TestCompileCollapseCode(t *testing.T) {
+	test := assert.New(t)
+
+	source := []byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: Reference -->",
+		"<!-- CollapseCode: true -->",
+		"",
+		"```bash",
+		"collapsed by default",
+		"```",
+		"",
+		"```bash {collapse=false}",
+		"expanded explicitly",
+		"```",
+	))
+
+	html, meta, err := Compile(context.Background(), source, Options{})
+	test.NoError(err)
+	test.True(*meta.CollapseCode)
+
+	// collapsed code block is wrapped into expand macro
+	blocks := strings.Split(html, `<ac:structured-macro ac:name="code">`)
+	if test.Len(blocks, 3) {
+		test.Contains(blocks[0], `<ac:structured-macro ac:name="expand">`)
+		test.Contains(blocks[1], `<ac:parameter ac:name="collapse">true`)
+		test.Contains(blocks[1], "collapsed by default")
+		test.Contains(blocks[2], `<ac:parameter ac:name="collapse">false`)
+		test.Contains(blocks[2], "expanded explicitly")
+	}
+
+	// metadata takes precedence over the default of command line
+	html, _, err = Compile(
+		context.Background(),
+		bytes.Replace(source, []byte("true"), []byte("false"), 1),
+		Options{CompileOptions: CompileOptions{CollapseCode: true}},
+	)
+	test.NoError(err)
+	test.NotContains(html, `ac:name="expand"`)
+	test.NotContains(html, `<ac:parameter ac:name="collapse">true`)
+}
+
+func TestCompileCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := Compile(ctx, []byte("text"), Options{})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestPrepareCollectErrors(t *testing.T) {
+	test := assert.New(t)
+
+	source := []byte(text(
+		"# Heading",
+		"<!-- Include: testdata/missing-1.tmpl -->",
+		"<!-- Include: testdata/missing-2.tmpl -->",
+		"<!-- Macro: :broken:",
+		"     Template: testdata/missing-3 -->",
+		"",
+		"Text :broken:",
+	))
+
+	_, err := Prepare(context.Background(), source, Options{})
+	if test.Error(err) {
+		// macros are not processed after includes failed
+		test.Contains(err.Error(), "missing-1")
+		test.NotContains(err.Error(), "missing-3")
+	}
+
+	_, err = Prepare(
+		context.Background(),
+		source,
+		Options{CollectErrors: true},
+	)
+	if test.Error(err) {
+		test.Contains(err.Error(), "missing-1")
+		test.Contains(err.Error(), "missing-2")
+		test.Contains(err.Error(), "missing-3")
+	}
+}
+
+func TestPrepareStrictMacros(t *testing.T) {
+	test := assert.New(t)
+
+	source := []byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: Macros -->",
+		"",
+		"# Macros",
+		"<!-- Macro: :done:",
+		"     Template: ac:status",
+		"     Title: DONE -->",
+		"<!-- Macro: :todo:",
+		"     Tempalte: ac:status",
+		"     Title: TODO -->",
+		"",
+		"Status: :done: :todo:",
+	))
+
+	document, err := Prepare(context.Background(), source, Options{})
+	test.NoError(err)
+	test.Contains(string(document.Markdown), "<!-- Macro: :todo:")
+
+	test.Equal(
+		[]UnresolvedMacro{{Line: 8, Text: "<!-- Macro: :todo:"}},
+		findUnresolvedMacros(source, document.Markdown),
+	)
+
+	_, err = Prepare(
+		context.Background(),
+		source,
+		Options{StrictMacros: true},
+	)
+	if test.Error(err) {
+		test.Contains(err.Error(), "unresolved macro directives")
+		test.Contains(err.Error(), "line 8: <!-- Macro: :todo:")
+	}
+}
+
+func TestCompileUnresolvedMacrosInCode(t *testing.T) {
+	test := assert.New(t)
+
+	source := []byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: Macros -->",
+		"",
+		"<!-- Macros: examples below -->",
+		"",
+		"Directive starts with `<!-- Macro: <regexp>` line.",
+		"",
+		"```",
+		"<!-- Macro: :todo:",
+		"     Tempalte: ac:status -->",
+		"```",
+	))
+
+	document, err := Prepare(context.Background(), source, Options{})
+	test.NoError(err)
+	test.Empty(findUnresolvedMacros(source, document.Markdown))
+
+	_, err = Prepare(
+		context.Background(),
+		source,
+		Options{StrictMacros: true},
+	)
+	test.NoError(err)
+}
+
+func TestCompileMacroShorthandInCode(t *testing.T) {
+	test := assert.New(t)
+
+	source := []byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: Shorthands -->",
+		"",
+		"Response is `{status:200}`.",
+		"",
+		"```js",
+		"res.json({status:200})",
+		"```",
+		"",
+		"```json",
+		`{"response": {status: "ok"}}`,
+		"```",
+	))
+
+	html, _, err := Compile(
+		context.Background(),
+		source,
+		Options{StrictMacros: true},
+	)
+	test.NoError(err)
+	test.NotContains(html, `ac:name="status"`)
+	test.Contains(html, "<code>{status:200}</code>")
+	test.Contains(html, "res.json({status:200})")
+	test.Contains(html, `{"response": {status: "ok"}}`)
+
+	document, err := Prepare(context.Background(), source, Options{})
+	test.NoError(err)
+	test.Empty(findUnknownShorthands(source, document.Markdown))
+}
+
+func TestCompileInvalidPanel(t *testing.T) {
+	test := assert.New(t)
+
+	source := []byte(text(
+		"> [!PANEL bg=yellow]",
+		"> Panel with invalid color.",
+		"",
+		"> > [!PANEL emoji=unknown-emoji]",
+		"> > Nested panel.",
+		"",
+		"```",
+		"> [!PANEL bg=yellow]",
+		"```",
+	))
+
+	_, _, err := Compile(context.Background(), source, Options{})
+	if test.Error(err) {
+		test.Contains(err.Error(), "invalid panel marker at line 1")
+		test.Contains(err.Error(), `invalid color "yellow"`)
+		test.Contains(err.Error(), "invalid panel marker at line 4")
+		test.NotContains(err.Error(), "line 8")
+	}
+}
+
+func TestCompileTOCZone(t *testing.T) {
+	test := assert.New(t)
+
+	html, _, err := Compile(
+		context.Background(),
+		[]byte(text(
+			"# Top",
+			"",
+			"<!-- TOCZone",
+			"     MaxLevel: 3",
+			"     Location: both -->",
+			"## Inside",
+			"```",
+			"<!-- /TOCZone -->",
+			"```",
+			"<!-- /TOCZone -->",
+			"after",
+		)),
+		Options{},
+	)
+	test.NoError(err)
+	test.Contains(html, `<ac:structured-macro ac:name="toc-zone">`)
+	test.Contains(html, `<ac:parameter ac:name="maxLevel">3</ac:parameter>`)
+	test.Contains(html, `<ac:parameter ac:name="location">both</ac:parameter>`)
+	test.Regexp(
+		`(?s)<ac:rich-text-body>\s*<h2 id="inside">Inside</h2>.*`+
+			`<!\[CDATA\[<!-- /TOCZone -->\]\]>.*</ac:rich-text-body>\s*`+
+			`</ac:structured-macro>\s*<p>after</p>`,
+		html,
+	)
+
+	for _, markdown := range []string{
+		text("<!-- TOCZone -->", "text"),
+		text("text", "<!-- /TOCZone -->"),
+	} {
+		_, _, err = Compile(context.Background(), []byte(markdown), Options{})
+		test.Error(err, markdown)
+	}
+}
+
+func TestCompileBlock(t *testing.T) {
+	test := assert.New(t)
+
+	html, _, err := Compile(
+		context.Background(),
+		[]byte(text(
+			"<!-- Block: ac:box",
+			"     Name: info",
+			"     Title: Note -->",
+			"Some **text**.",
+			"",
+			"<!-- Block: ac:expand",
+			"     Title: Details -->",
+			"* item",
+			"<!-- /Block -->",
+			"<!-- /Block -->",
+			"after",
+		)),
+		Options{},
+	)
+	test.NoError(err)
+	test.Regexp(
+		`(?s)^<ac:structured-macro ac:name="info">\s*`+
+			`<ac:parameter ac:name="icon">false</ac:parameter>\s*`+
+			`<ac:parameter ac:name="title">Note</ac:parameter>\s*`+
+			`<ac:rich-text-body>\s*<p>Some <strong>text</strong>.</p>\s*`+
+			`<ac:structured-macro ac:name="expand">\s*`+
+			`<ac:parameter ac:name="title">Details</ac:parameter>\s*`+
+			`<ac:rich-text-body>\s*<ul>\s*<li>item</li>\s*</ul>\s*`+
+			`</ac:rich-text-body>\s*</ac:structured-macro>\s*`+
+			`</ac:rich-text-body>\s*</ac:structured-macro>\s*<p>after</p>`,
+		html,
+	)
+
+	for _, markdown := range []string{
+		text("<!-- Block: ac:box -->", "text", "<!-- /TOCZone -->"),
+		text("<!-- Block: ac:missing -->", "text", "<!-- /Block -->"),
+		text("<!-- Block: ac:box -->", "text"),
+	} {
+		_, _, err = Compile(context.Background(), []byte(markdown), Options{})
+		test.Error(err, markdown)
+	}
+}
+
+func TestCompileTemplatesDir(t *testing.T) {
+	test := assert.New(t)
+
+	html, _, err := Compile(
+		context.Background(),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: My Article -->",
+			"",
+			":disclaimer:",
+		)),
+		Options{TemplatesDir: "testdata/templates"},
+	)
+	test.NoError(err)
+	test.Equal(
+		text(
+			`<p><ac:structured-macro ac:name="info">`+
+				`<ac:rich-text-body><p>Internal use only</p></ac:rich-text-body>`+
+				`</ac:structured-macro></p>`,
+			"",
+		),
+		html,
+	)
+}
+
+func TestCompileTemplatesDirCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mark-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "ac:status.tmpl"),
+		[]byte("custom"),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = Compile(
+		context.Background(),
+		[]byte("text"),
+		Options{TemplatesDir: dir},
+	)
+	assert.Error(t, err)
+}
+
+func TestPrepareIncludeShift(t *testing.T) {
+	test := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "mark-includes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	fragment := filepath.Join(dir, "fragment.md")
+
+	err = ioutil.WriteFile(
+		fragment,
+		[]byte(text(
+			"## Section",
+			"```",
+			"## not a heading",
+			"```",
+			"##### Deep",
+			"",
+		)),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	document, err := Prepare(
+		context.Background(),
+		[]byte(text(
+			"# Page",
+			"<!-- Include: "+fragment+" shift=2 -->",
+		)),
+		Options{},
+	)
+	test.NoError(err)
+	test.Equal(
+		text(
+			"# Page",
+			"#### Section",
+			"```",
+			"## not a heading",
+			"```",
+			"###### Deep",
+			"",
+		),
+		string(document.Markdown),
+	)
+
+	_, err = Prepare(
+		context.Background(),
+		[]byte(text(
+			"# Page",
+			"<!-- Include: "+fragment+" level=2 -->",
+		)),
+		Options{},
+	)
+	test.Error(err)
+}
+
+func TestPrepareRelativeToBase(t *testing.T) {
+	test := assert.New(t)
+
+	// no pages exist, so links are built from space and title
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "mark")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = os.MkdirAll(filepath.Join(dir, "docs"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "docs", "other.md"),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: Other -->",
+			"",
+		)),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// document is processed from its parent directory, like
+	// mark -f docs/guide.md
+	document, err := Prepare(
+		context.Background(),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: Guide -->",
+			"",
+			"[other](other.md)",
+		)),
+		Options{
+			API:  confluence.NewAPI(server.URL, "", "", nil),
+			Base: filepath.Join(dir, "docs"),
+		},
+	)
+	test.NoError(err)
+	test.Equal(
+		"[other]("+server.URL+"/display/TEST/Other)",
+		strings.TrimSpace(string(document.Markdown)),
+	)
+}
+
+func TestCompileUserMentions(t *testing.T) {
+	test := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			switch request.URL.Query().Get("cql") {
+			case `user.fullname~"smith@example.com"`:
+				writer.Write([]byte(`{"results":[` +
+					`{"user":{"accountId":"41","email":"smith@example.org"}},` +
+					`{"user":{"accountId":"42","email":"Smith@example.com"}}` +
+					`]}`))
+			default:
+				writer.Write([]byte(`{"results":[]}`))
+			}
+		},
+	))
+	defer server.Close()
+
+	html, _, err := Compile(
+		context.Background(),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: Mentions -->",
+			"",
+			"@{id:557058:abc} @{email:smith@example.com} @{email:nobody@example.com}",
+		)),
+		Options{API: confluence.NewAPI(server.URL, "", "", nil)},
+	)
+	test.NoError(err)
+	test.Equal(
+		text(
+			`<p><ac:link><ri:user ri:account-id="557058:abc"/></ac:link>`+
+				` <ac:link><ri:user ri:account-id="42"/></ac:link>`+
+				` nobody@example.com</p>`,
+			"",
+		),
+		html,
+	)
+}
+
+func TestCompileUserMentionsCached(t *testing.T) {
+	test := assert.New(t)
+
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			requests++
+
+			switch request.URL.Query().Get("cql") {
+			case `user.fullname~"John Smith"`:
+				writer.Write([]byte(`{"results":[{"user":{"accountId":"42"}}]}`))
+			default:
+				writer.Write([]byte(`{"results":[]}`))
+			}
+		},
+	))
+	defer server.Close()
+
+	_, _, err := Compile(
+		context.Background(),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: Mentions -->",
+			"",
+			"@{John Smith} @{John Smith} @{Nobody} @{Nobody} @{John Smith}",
+		)),
+		Options{API: confluence.NewAPI(server.URL, "", "", nil)},
+	)
+	test.NoError(err)
+
+	// one lookup per user, including not found one
+	test.Equal(2, requests)
+}
+
+func TestCompileUserMentionsScheme(t *testing.T) {
+	test := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte(
+				`{"results":[{"user":{"username":"smith","userKey":"ff80"}}]}`,
+			))
+		},
+	))
+	defer server.Close()
+
+	api := confluence.NewAPI(server.URL, "", "", nil)
+
+	source := []byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: Mentions -->",
+		"",
+		"@{John Smith}",
+	))
+
+	// users found on Confluence Server/Data Center are linked by username
+	html, _, err := Compile(context.Background(), source, Options{API: api})
+	test.NoError(err)
+	test.Contains(html, `<ri:user ri:username="smith"/>`)
+
+	html, _, err = Compile(
+		context.Background(),
+		source,
+		Options{API: api, UserScheme: confluence.UserKey},
+	)
+	test.NoError(err)
+	test.Contains(html, `<ri:user ri:userkey="ff80"/>`)
+
+	// metadata takes precedence over the default of command line
+	html, meta, err := Compile(
+		context.Background(),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: Mentions -->",
+			"<!-- UserScheme: username -->",
+			"",
+			"@{id:jones}",
+		)),
+		Options{UserScheme: confluence.UserAccountID},
+	)
+	test.NoError(err)
+	test.Equal("username", meta.UserScheme)
+	test.Contains(html, `<ri:user ri:username="jones"/>`)
+
+	_, _, err = Compile(
+		context.Background(),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: Mentions -->",
+			"<!-- UserScheme: email -->",
+			"",
+		)),
+		Options{},
+	)
+	if test.Error(err) {
+		test.Contains(err.Error(), `unknown user scheme "email"`)
+	}
+}
+
+func TestCompileTaskAssignee(t *testing.T) {
+	test := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			switch request.URL.Query().Get("cql") {
+			case `user.fullname~"alice"`:
+				writer.Write([]byte(`{"results":[{"user":{"accountId":"42"}}]}`))
+			default:
+				writer.Write([]byte(`{"results":[]}`))
+			}
+		},
+	))
+	defer server.Close()
+
+	html, _, err := Compile(
+		context.Background(),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: Meeting -->",
+			"",
+			"- [ ] @alice do thing (2024-07-01)",
+			"- [x] @nobody done",
+		)),
+		Options{API: confluence.NewAPI(server.URL, "", "", nil)},
+	)
+	test.NoError(err)
+	test.Contains(
+		html,
+		`<ac:task-body><ac:link><ri:user ri:account-id="42"/></ac:link>`+
+			` do thing <time datetime="2024-07-01" /></ac:task-body>`,
+	)
+	test.Contains(html, `<ac:task-body>nobody done</ac:task-body>`)
+}
+
+func TestCompileProfile(t *testing.T) {
+	test := assert.New(t)
+
+	html, _, err := Compile(
+		context.Background(),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: Team -->",
+			"",
+			"<!-- Profile: id:557058:abc -->",
+			"",
+			"<!-- Profile: John Smith -->",
+		)),
+		Options{},
+	)
+	test.NoError(err)
+	test.Equal(
+		text(
+			`<p><ac:structured-macro ac:name="profile">`+
+				`<ac:parameter ac:name="user">`+
+				`<ri:user ri:account-id="557058:abc"/>`+
+				`</ac:parameter>`+
+				`</ac:structured-macro></p>`,
+			"",
+			"<p>John Smith</p>",
+			"",
+		),
+		html,
+	)
+}
+
+func TestCompileConfluenceInclude(t *testing.T) {
+	test := assert.New(t)
+
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			requests++
+
+			switch request.URL.Path {
+			case "/rest/api/content/":
+				if request.URL.Query().Get("title") == "Glossary" {
+					writer.Write([]byte(`{"results":[{"id":"2"}]}`))
+				} else {
+					writer.Write([]byte(`{"results":[]}`))
+				}
+			case "/rest/api/content/1":
+				writer.Write([]byte(
+					`{"body":{"storage":{"value":"<p>first</p>"}}}`,
+				))
+			case "/rest/api/content/2":
+				writer.Write([]byte(
+					`{"body":{"storage":{"value":"<p>glossary</p>"}}}`,
+				))
+			default:
+				writer.WriteHeader(http.StatusNotFound)
+			}
+		},
+	))
+	defer server.Close()
+
+	options := Options{
+		API:       confluence.NewAPI(server.URL, "", "", nil),
+		PageCache: NewPageCache(),
+	}
+
+	source := []byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: Composite -->",
+		"",
+		"<!-- Confluence-Include: 1 -->",
+		"",
+		"```",
+		"<!-- Confluence-Include: 3 -->",
+		"```",
+		"",
+		"<!-- Confluence-Include: Glossary -->",
+	))
+
+	html, _, err := Compile(context.Background(), source, options)
+	test.NoError(err)
+	test.Equal(
+		text(
+			"<p>first</p>",
+			`<ac:structured-macro ac:name="code">`,
+			`<ac:parameter ac:name="language"></ac:parameter>`,
+			`<ac:parameter ac:name="collapse">false</ac:parameter>`,
+			`<ac:plain-text-body><![CDATA[<!-- Confluence-Include: 3 -->]]>`+
+				`</ac:plain-text-body>`,
+			`</ac:structured-macro>`,
+			"",
+			"<p>glossary</p>",
+			"",
+		),
+		html,
+	)
+
+	requests = 0
+
+	_, _, err = Compile(context.Background(), source, options)
+	test.NoError(err)
+	test.Equal(0, requests)
+
+	_, _, err = Compile(
+		context.Background(),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: Composite -->",
+			"",
+			"<!-- Confluence-Include: 3 -->",
+		)),
+		options,
+	)
+	test.Error(err)
+	test.Contains(
+		err.Error(),
+		"page 3 is not found or you don't have permission to view it",
+	)
+
+	_, _, err = Compile(
+		context.Background(),
+		[]byte(text(
+			"<!-- Space: TEST -->",
+			"<!-- Title: Composite -->",
+			"",
+			"<!-- Confluence-Include: Missing -->",
+		)),
+		options,
+	)
+	test.Error(err)
+	test.Contains(err.Error(), `page "Missing" is not found in space TEST`)
+}
+
+func TestCompileBOMAndCRLF(t *testing.T) {
+	test := assert.New(t)
+
+	source, err := ioutil.ReadFile("testdata/source/bom-crlf.md")
+	if err != nil {
+		panic(err)
+	}
+
+	html, meta, err := Compile(
+		context.Background(),
+		NormalizeSource(source),
+		Options{DropH1: true},
+	)
+	test.NoError(err)
+	test.Equal("TEST", meta.Space)
+	test.Equal("Windows", meta.Title)
+	test.NotContains(html, "\r")
+	test.Contains(html, `<ac:structured-macro ac:name="status">`)
+
+	// metadata is detected even if source is not normalized beforehand
+	meta, _, err = ExtractMeta(source)
+	test.NoError(err)
+	test.Equal("TEST", meta.Space)
+	test.Equal("Windows", meta.Title)
+}
+
+func TestCompileTemplatesDirMacroCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mark-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "macros.md"),
+		[]byte(text(
+			`<!-- Macro: @\{([^}]+)\}`,
+			`     Template: ac:link:user`,
+			`     Name: ${1} -->`,
+		)),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = Compile(
+		context.Background(),
+		[]byte("text"),
+		Options{TemplatesDir: dir},
+	)
+	assert.Error(t, err)
+}
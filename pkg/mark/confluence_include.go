@@ -0,0 +1,190 @@
+package mark
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/bonovoxly/mark/pkg/mark/fence"
+	"github.com/reconquest/karma-go"
+)
+
+// Confluence-Include directive inlines body of another Confluence page in
+// storage format into the document, page is specified by id or by title in
+// the space of the document:
+// <!-- Confluence-Include: <page id or title> -->
+var (
+	reConfluenceInclude = regexp.MustCompile(
+		`^\s*<!--\s*Confluence-Include:\s*(.*?)\s*-->\s*$`,
+	)
+	rePageID = regexp.MustCompile(`^\d+$`)
+)
+
+// PageCache keeps bodies of pages fetched for Confluence-Include directives,
+// so every page is fetched only once per run.
+type PageCache struct {
+	mutex sync.Mutex
+	pages map[string]string
+}
+
+// NewPageCache returns empty cache of page bodies.
+func NewPageCache() *PageCache {
+	return &PageCache{pages: map[string]string{}}
+}
+
+// GetPageBody returns body of the page specified by id or by title in given
+// space, body is fetched from Confluence if it's not cached yet.
+func (cache *PageCache) GetPageBody(
+	ctx context.Context,
+	api *confluence.API,
+	space string,
+	page string,
+) (string, error) {
+	key := page
+	if !rePageID.MatchString(page) {
+		key = space + "/" + page
+	}
+
+	cache.mutex.Lock()
+	body, ok := cache.pages[key]
+	cache.mutex.Unlock()
+
+	if ok {
+		return body, nil
+	}
+
+	body, err := getPageBody(ctx, api, space, page)
+	if err != nil {
+		return "", err
+	}
+
+	cache.mutex.Lock()
+	cache.pages[key] = body
+	cache.mutex.Unlock()
+
+	return body, nil
+}
+
+func getPageBody(
+	ctx context.Context,
+	api *confluence.API,
+	space string,
+	page string,
+) (string, error) {
+	id := page
+
+	if !rePageID.MatchString(page) {
+		if space == "" {
+			return "", fmt.Errorf(
+				"page %q is specified by title, but space of the document "+
+					"is not known, specify page by id instead",
+				page,
+			)
+		}
+
+		info, err := api.FindPage(ctx, space, page, "page")
+		if err != nil {
+			return "", karma.Format(
+				err,
+				"unable to find page %q in space %s",
+				page,
+				space,
+			)
+		}
+
+		if info == nil {
+			return "", fmt.Errorf(
+				"page %q is not found in space %s",
+				page,
+				space,
+			)
+		}
+
+		id = info.ID
+	}
+
+	body, err := api.GetPageBody(ctx, id)
+	switch {
+	case confluence.IsNotFoundError(err):
+		return "", karma.Format(
+			err,
+			"page %s is not found or you don't have permission to view it",
+			id,
+		)
+
+	case confluence.IsAuthError(err):
+		return "", karma.Format(
+			err,
+			"you don't have permission to view page %s",
+			id,
+		)
+
+	case err != nil:
+		return "", karma.Format(err, "unable to get body of page %s", id)
+	}
+
+	return body, nil
+}
+
+type confluenceInclude struct {
+	token string
+	page  string
+}
+
+// extractConfluenceIncludes replaces Confluence-Include directives outside of
+// code with placeholder tokens, which are replaced with bodies of included
+// pages after rendering.
+func extractConfluenceIncludes(
+	markdown []byte,
+) ([]byte, []confluenceInclude) {
+	var (
+		pages  []confluenceInclude
+		result []string
+		fences fence.Scanner
+	)
+
+	for _, line := range strings.Split(string(markdown), "\n") {
+		fenced := fences.Scan(line)
+
+		matches := reConfluenceInclude.FindStringSubmatch(line)
+		if fenced || matches == nil {
+			result = append(result, line)
+			continue
+		}
+
+		page := confluenceInclude{
+			token: fmt.Sprintf("MARKINCLUDE%dEND", len(pages)),
+			page:  matches[1],
+		}
+
+		pages = append(pages, page)
+
+		result = append(result, "", page.token, "")
+	}
+
+	return []byte(strings.Join(result, "\n")), pages
+}
+
+// SubstituteConfluenceIncludes replaces placeholder tokens of
+// Confluence-Include directives in rendered document with bodies of included
+// pages.
+func SubstituteConfluenceIncludes(html string, pages map[string]string) string {
+	result := []byte(html)
+
+	for token, body := range pages {
+		location := findPlaceholder(result, token)
+		if location == nil {
+			continue
+		}
+
+		result = append(
+			result[:location[0]:location[0]],
+			append([]byte(body+"\n"), result[location[1]:]...)...,
+		)
+	}
+
+	return string(result)
+}
@@ -0,0 +1,371 @@
+package mark
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// DiffOp is a kind of change of the diff chunk.
+type DiffOp int
+
+const (
+	DiffEqual DiffOp = iota
+	DiffDelete
+	DiffInsert
+)
+
+// DiffChunk is a single token of the diff, every tag of storage format and
+// every word is a separate token along with whitespace following it.
+type DiffChunk struct {
+	Op   DiffOp
+	Text string
+}
+
+// Diff is a word-level difference between two versions of storage format.
+type Diff []DiffChunk
+
+// diffContext is a number of unchanged tokens shown around every change.
+const diffContext = 8
+
+var reDiffToken = regexp.MustCompile(`(<[^>]*>|[^\s<]+|<)\s*`)
+
+// DiffStorage returns word-level difference between storage format of the
+// live page and storage format compiled from the file. Whitespace is not
+// compared since Confluence reformats stored pages.
+func DiffStorage(old, new string) Diff {
+	return diffTokens(
+		reDiffToken.FindAllString(old, -1),
+		reDiffToken.FindAllString(new, -1),
+	)
+}
+
+// Changed returns true if there is at least one deleted or inserted token.
+func (diff Diff) Changed() bool {
+	for _, chunk := range diff {
+		if chunk.Op != DiffEqual {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Render returns changes surrounded by few unchanged tokens, deleted and
+// inserted text is highlighted using terminal colors if color is true or
+// marked as [-deleted-] and {+inserted+} otherwise.
+func (diff Diff) Render(color bool) string {
+	type hunk struct {
+		start, end int
+	}
+
+	hunks := []hunk{}
+	for i, chunk := range diff {
+		if chunk.Op == DiffEqual {
+			continue
+		}
+
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+
+		end := i + diffContext + 1
+		if end > len(diff) {
+			end = len(diff)
+		}
+
+		if len(hunks) > 0 && hunks[len(hunks)-1].end >= start {
+			hunks[len(hunks)-1].end = end
+		} else {
+			hunks = append(hunks, hunk{start: start, end: end})
+		}
+	}
+
+	blocks := []string{}
+	for _, hunk := range hunks {
+		var block strings.Builder
+
+		if hunk.start > 0 {
+			block.WriteString("...")
+		}
+
+		for i := hunk.start; i < hunk.end; {
+			op := diff[i].Op
+
+			var text strings.Builder
+			for ; i < hunk.end && diff[i].Op == op; i++ {
+				text.WriteString(diff[i].Text)
+			}
+
+			block.WriteString(renderDiffChunk(op, text.String(), color))
+		}
+
+		if hunk.end < len(diff) {
+			block.WriteString("...")
+		}
+
+		blocks = append(
+			blocks,
+			strings.TrimRightFunc(block.String(), unicode.IsSpace),
+		)
+	}
+
+	return strings.Join(blocks, "\n\n")
+}
+
+func renderDiffChunk(op DiffOp, text string, color bool) string {
+	if op == DiffEqual {
+		return text
+	}
+
+	// whitespace is left outside of markers, so it's not highlighted
+	space := text[len(strings.TrimRightFunc(text, unicode.IsSpace)):]
+	text = text[:len(text)-len(space)]
+
+	switch {
+	case op == DiffDelete && color:
+		return "\x1b[31m" + text + "\x1b[0m" + space
+	case op == DiffInsert && color:
+		return "\x1b[32m" + text + "\x1b[0m" + space
+	case op == DiffDelete:
+		return "[-" + text + "-]" + space
+	default:
+		return "{+" + text + "+}" + space
+	}
+}
+
+// diffTokens finds shortest edit script between tokens using linear space
+// variant of Myers algorithm, tokens of the new version are used for
+// unchanged text. Memory is proportional to number of tokens, so large pages
+// with many changes can be compared.
+func diffTokens(old, new []string) Diff {
+	differ := &tokenDiffer{
+		old:     old,
+		new:     new,
+		oldKeys: getDiffKeys(old),
+		newKeys: getDiffKeys(new),
+		diff:    Diff{},
+	}
+
+	differ.compare(0, len(old), 0, len(new))
+
+	return slideDiff(differ.diff)
+}
+
+// slideDiff moves runs of inserted or deleted tokens forward while the run is
+// followed by the same token, so changes are shown as whole tags, e.g.
+// "<p>over</p>" instead of "</p><p>over".
+func slideDiff(diff Diff) Diff {
+	for i := 0; i < len(diff); {
+		op := diff[i].Op
+		if op == DiffEqual {
+			i++
+			continue
+		}
+
+		end := i
+		for end < len(diff) && diff[end].Op == op {
+			end++
+		}
+
+		for end < len(diff) && diff[end].Op == DiffEqual &&
+			strings.TrimSpace(diff[i].Text) ==
+				strings.TrimSpace(diff[end].Text) {
+			// unchanged text is taken from the new version
+			first, next := diff[i].Text, diff[end].Text
+			if op == DiffDelete {
+				first, next = next, first
+			}
+
+			diff[i] = DiffChunk{DiffEqual, first}
+			diff[end] = DiffChunk{op, next}
+
+			i++
+			end++
+		}
+
+		i = end
+	}
+
+	return diff
+}
+
+// getDiffKeys returns tokens which are compared, whitespace following tokens
+// is not compared.
+func getDiffKeys(tokens []string) []string {
+	keys := make([]string, len(tokens))
+	for i, token := range tokens {
+		keys[i] = strings.TrimSpace(token)
+	}
+
+	return keys
+}
+
+// tokenDiffer collects diff of old and new tokens.
+type tokenDiffer struct {
+	old, new         []string
+	oldKeys, newKeys []string
+
+	diff Diff
+}
+
+// compare appends diff of old[x0:x1] and new[y0:y1] tokens. Common prefix and
+// suffix are trimmed first, so only the changed part is searched, and the
+// search is split into halves at the middle of the edit script.
+func (differ *tokenDiffer) compare(x0, x1, y0, y1 int) {
+	for x0 < x1 && y0 < y1 && differ.oldKeys[x0] == differ.newKeys[y0] {
+		differ.append(DiffEqual, differ.new[y0])
+		x0++
+		y0++
+	}
+
+	suffix := 0
+	for x1 > x0 && y1 > y0 &&
+		differ.oldKeys[x1-1] == differ.newKeys[y1-1] {
+		x1--
+		y1--
+		suffix++
+	}
+
+	switch {
+	case x0 == x1:
+		for y := y0; y < y1; y++ {
+			differ.append(DiffInsert, differ.new[y])
+		}
+
+	case y0 == y1:
+		for x := x0; x < x1; x++ {
+			differ.append(DiffDelete, differ.old[x])
+		}
+
+	default:
+		x, y, ok := differ.bisect(x0, x1, y0, y1)
+		if ok {
+			differ.compare(x0, x, y0, y)
+			differ.compare(x, x1, y, y1)
+		} else {
+			for x := x0; x < x1; x++ {
+				differ.append(DiffDelete, differ.old[x])
+			}
+
+			for y := y0; y < y1; y++ {
+				differ.append(DiffInsert, differ.new[y])
+			}
+		}
+	}
+
+	for i := 0; i < suffix; i++ {
+		differ.append(DiffEqual, differ.new[y1+i])
+	}
+}
+
+func (differ *tokenDiffer) append(op DiffOp, text string) {
+	differ.diff = append(differ.diff, DiffChunk{op, text})
+}
+
+// bisect finds point which the shortest edit script of old[x0:x1] and
+// new[y0:y1] passes through by searching from both ends at once until
+// searches overlap, only furthest reaching points of the current step are
+// kept. False is returned if there is no common token.
+func (differ *tokenDiffer) bisect(x0, x1, y0, y1 int) (int, int, bool) {
+	var (
+		old = differ.oldKeys[x0:x1]
+		new = differ.newKeys[y0:y1]
+
+		n, m   = len(old), len(new)
+		max    = (n + m + 1) / 2
+		offset = max
+		length = 2*max + 1
+
+		forward  = make([]int, length)
+		backward = make([]int, length)
+
+		delta = n - m
+
+		// searches overlap in forward step if delta is odd and in backward
+		// step otherwise
+		front = delta%2 != 0
+
+		// bounds of diagonals which didn't go out of the grid yet
+		fstart, fend, bstart, bend int
+	)
+
+	for i := range forward {
+		forward[i] = -1
+		backward[i] = -1
+	}
+
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+
+	for d := 0; d < max; d++ {
+		for k := -d + fstart; k <= d-fend; k += 2 {
+			var x int
+			if k == -d ||
+				(k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && old[x] == new[y] {
+				x++
+				y++
+			}
+
+			forward[offset+k] = x
+
+			switch {
+			case x > n:
+				fend += 2
+			case y > m:
+				fstart += 2
+			case front:
+				index := offset + delta - k
+				if index >= 0 && index < length && backward[index] != -1 {
+					if x >= n-backward[index] {
+						return x0 + x, y0 + y, true
+					}
+				}
+			}
+		}
+
+		for k := -d + bstart; k <= d-bend; k += 2 {
+			var x int
+			if k == -d ||
+				(k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && old[n-x-1] == new[m-y-1] {
+				x++
+				y++
+			}
+
+			backward[offset+k] = x
+
+			switch {
+			case x > n:
+				bend += 2
+			case y > m:
+				bstart += 2
+			case !front:
+				index := offset + delta - k
+				if index >= 0 && index < length && forward[index] != -1 {
+					fx := forward[index]
+					fy := offset + fx - index
+					if fx >= n-x {
+						return x0 + fx, y0 + fy, true
+					}
+				}
+			}
+		}
+	}
+
+	return 0, 0, false
+}
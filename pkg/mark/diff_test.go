@@ -0,0 +1,120 @@
+package mark
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffStorage(t *testing.T) {
+	test := assert.New(t)
+
+	diff := DiffStorage(
+		"<p>The quick brown fox</p>\n<p>jumps</p>",
+		"<p>The quick red fox</p><p>jumps</p>\n<p>over</p>",
+	)
+	test.True(diff.Changed())
+	test.Equal(
+		"<p>The quick [-brown-] {+red+} fox</p><p>jumps</p>\n{+<p>over</p>+}",
+		diff.Render(false),
+	)
+	test.Equal(
+		"<p>The quick \x1b[31mbrown\x1b[0m \x1b[32mred\x1b[0m fox</p>"+
+			"<p>jumps</p>\n\x1b[32m<p>over</p>\x1b[0m",
+		diff.Render(true),
+	)
+
+	// confluence reformats whitespace of stored pages
+	diff = DiffStorage("<p>a\nb</p>", "<p>a b</p>")
+	test.False(diff.Changed())
+	test.Equal("", diff.Render(false))
+
+	diff = DiffStorage("", "")
+	test.False(diff.Changed())
+}
+
+func TestDiffStorageContext(t *testing.T) {
+	test := assert.New(t)
+
+	words := "1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20"
+
+	diff := DiffStorage(
+		"0 "+words+" 21",
+		"x "+words+" y",
+	)
+	test.Equal(
+		"[-0-] {+x+} 1 2 3 4 5 6 7 8 ...\n\n...13 14 15 16 17 18 19 20 [-21-]{+y+}",
+		diff.Render(false),
+	)
+}
+
+func TestDiffStorageEmpty(t *testing.T) {
+	test := assert.New(t)
+
+	test.Equal(
+		Diff{{DiffInsert, "<p>"}, {DiffInsert, "a"}, {DiffInsert, "</p>"}},
+		DiffStorage("", "<p>a</p>"),
+	)
+	test.Equal(
+		Diff{{DiffDelete, "<p>"}, {DiffDelete, "a"}, {DiffDelete, "</p>"}},
+		DiffStorage("<p>a</p>", ""),
+	)
+}
+
+func TestDiffStorageLarge(t *testing.T) {
+	test := assert.New(t)
+
+	old := []string{}
+	new := []string{}
+	for i := 0; i < 20000; i++ {
+		old = append(old, fmt.Sprintf("<p>%d</p>", i))
+		new = append(new, fmt.Sprintf("<p>%d</p>", i))
+	}
+
+	new[10000] = "<p>changed</p>"
+
+	diff := DiffStorage(strings.Join(old, ""), strings.Join(new, ""))
+	test.Equal(
+		"...</p><p>9998</p><p>9999</p><p>[-10000-]{+changed+}"+
+			"</p><p>10001</p><p>10002</p><p>...",
+		diff.Render(false),
+	)
+}
+
+func TestDiffStorageSides(t *testing.T) {
+	test := assert.New(t)
+
+	random := rand.New(rand.NewSource(1))
+
+	words := func() []string {
+		result := []string{}
+		for i := random.Intn(30); i > 0; i-- {
+			result = append(result, string(rune('a'+random.Intn(4))))
+		}
+
+		return result
+	}
+
+	for i := 0; i < 1000; i++ {
+		old, new := words(), words()
+
+		diff := diffTokens(old, new)
+		test.Equal(old, getDiffSide(diff, DiffInsert), "%q %q", old, new)
+		test.Equal(new, getDiffSide(diff, DiffDelete), "%q %q", old, new)
+	}
+}
+
+// getDiffSide returns tokens of the diff without chunks of given operation.
+func getDiffSide(diff Diff, skip DiffOp) []string {
+	result := []string{}
+	for _, chunk := range diff {
+		if chunk.Op != skip {
+			result = append(result, chunk.Text)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,92 @@
+package mark
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PageEmojiProperty is a content property which holds emoji shown next to
+// the page title and in the page tree.
+const PageEmojiProperty = "emoji-title-published"
+
+// Emojis maps known emoji shortnames to their code points in the form
+// Confluence stores them in PageEmojiProperty.
+var Emojis = map[string]string{
+	"+1":                       "1f44d",
+	"-1":                       "1f44e",
+	"100":                      "1f4af",
+	"alarm_clock":              "23f0",
+	"art":                      "1f3a8",
+	"bar_chart":                "1f4ca",
+	"bell":                     "1f514",
+	"book":                     "1f4d6",
+	"books":                    "1f4da",
+	"bookmark":                 "1f516",
+	"bug":                      "1f41b",
+	"bulb":                     "1f4a1",
+	"calendar":                 "1f4c6",
+	"chart_with_upwards_trend": "1f4c8",
+	"clipboard":                "1f4cb",
+	"closed_lock_with_key":     "1f510",
+	"cloud":                    "2601",
+	"computer":                 "1f4bb",
+	"construction":             "1f6a7",
+	"dart":                     "1f3af",
+	"desktop_computer":         "1f5a5",
+	"email":                    "1f4e7",
+	"exclamation":              "2757",
+	"eyes":                     "1f440",
+	"file_folder":              "1f4c1",
+	"fire":                     "1f525",
+	"gear":                     "2699",
+	"globe_with_meridians":     "1f310",
+	"hammer":                   "1f528",
+	"hammer_and_wrench":        "1f6e0",
+	"heart":                    "2764",
+	"hourglass":                "231b",
+	"house":                    "1f3e0",
+	"information_source":       "2139",
+	"key":                      "1f511",
+	"label":                    "1f3f7",
+	"link":                     "1f517",
+	"lock":                     "1f512",
+	"loudspeaker":              "1f4e2",
+	"mag":                      "1f50d",
+	"memo":                     "1f4dd",
+	"microscope":               "1f52c",
+	"money_with_wings":         "1f4b8",
+	"mortar_board":             "1f393",
+	"package":                  "1f4e6",
+	"page_facing_up":           "1f4c4",
+	"pencil2":                  "270f",
+	"people_holding_hands":     "1f9d1-200d-1f91d-200d-1f9d1",
+	"pushpin":                  "1f4cc",
+	"question":                 "2753",
+	"rocket":                   "1f680",
+	"rotating_light":           "1f6a8",
+	"scroll":                   "1f4dc",
+	"shield":                   "1f6e1",
+	"sparkles":                 "2728",
+	"speech_balloon":           "1f4ac",
+	"star":                     "2b50",
+	"straight_ruler":           "1f4cf",
+	"tada":                     "1f389",
+	"test_tube":                "1f9ea",
+	"trophy":                   "1f3c6",
+	"warning":                  "26a0",
+	"white_check_mark":         "2705",
+	"wrench":                   "1f527",
+	"x":                        "274c",
+	"zap":                      "26a1",
+}
+
+// GetEmojiCode returns code point of the emoji with given shortname, which
+// may be wrapped into colons, e.g. :rocket:.
+func GetEmojiCode(name string) (string, error) {
+	code, ok := Emojis[strings.Trim(name, ":")]
+	if !ok {
+		return "", fmt.Errorf("unknown emoji shortname %q", name)
+	}
+
+	return code, nil
+}
@@ -0,0 +1,67 @@
+package mark
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/bonovoxly/mark/pkg/mark/fence"
+)
+
+var (
+	reEnvVariable = regexp.MustCompile(
+		`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`,
+	)
+)
+
+// SubstituteEnv replaces ${VAR} placeholders outside of code fences with
+// values of environment variables. Default value can be specified as
+// ${VAR:-default}, otherwise undefined variable is an error. $$ is an escape
+// for literal $.
+func SubstituteEnv(markdown []byte) ([]byte, error) {
+	var (
+		lines     = strings.Split(string(markdown), "\n")
+		fences    fence.Scanner
+		undefined []string
+	)
+
+	for i, line := range lines {
+		if fences.Scan(line) {
+			continue
+		}
+
+		lines[i] = reEnvVariable.ReplaceAllStringFunc(
+			line,
+			func(match string) string {
+				if match == "$$" {
+					return "$"
+				}
+
+				groups := reEnvVariable.FindStringSubmatch(match)
+
+				value, ok := os.LookupEnv(groups[1])
+				if ok {
+					return value
+				}
+
+				if groups[2] != "" {
+					return groups[3]
+				}
+
+				undefined = append(undefined, groups[1])
+
+				return match
+			},
+		)
+	}
+
+	if len(undefined) > 0 {
+		return nil, fmt.Errorf(
+			"undefined environment variables: %s",
+			strings.Join(undefined, ", "),
+		)
+	}
+
+	return []byte(strings.Join(lines, "\n")), nil
+}
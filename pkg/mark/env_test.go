@@ -0,0 +1,39 @@
+package mark
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubstituteEnv(t *testing.T) {
+	test := assert.New(t)
+
+	os.Setenv("MARK_TEST_HOST", "db.local")
+	defer os.Unsetenv("MARK_TEST_HOST")
+
+	os.Unsetenv("MARK_TEST_PORT")
+
+	markdown, err := SubstituteEnv([]byte(text(
+		"<!-- Title: Runbook for ${MARK_TEST_HOST} -->",
+		"Connect to ${MARK_TEST_HOST}:${MARK_TEST_PORT:-5432} for $$5.",
+		"```",
+		"echo ${MARK_TEST_UNDEFINED} $$",
+		"```",
+	)))
+	test.NoError(err)
+	test.Equal(
+		text(
+			"<!-- Title: Runbook for db.local -->",
+			"Connect to db.local:5432 for $5.",
+			"```",
+			"echo ${MARK_TEST_UNDEFINED} $$",
+			"```",
+		),
+		string(markdown),
+	)
+
+	_, err = SubstituteEnv([]byte("${MARK_TEST_UNDEFINED}"))
+	test.EqualError(err, "undefined environment variables: MARK_TEST_UNDEFINED")
+}
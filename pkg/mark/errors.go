@@ -0,0 +1,31 @@
+package mark
+
+import "github.com/bonovoxly/mark/pkg/confluence"
+
+// ResolveError is returned if page location can't be resolved, e.g. page is
+// located under unexpected parents.
+type ResolveError struct {
+	Err error
+}
+
+func (err *ResolveError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *ResolveError) Unwrap() error {
+	return err.Err
+}
+
+// IsResolveError reports whether error is caused by page which can't be
+// resolved or by entity which is not found in Confluence.
+func IsResolveError(err error) bool {
+	if confluence.IsNotFoundError(err) {
+		return true
+	}
+
+	return confluence.FindError(err, func(err error) bool {
+		_, ok := err.(*ResolveError)
+
+		return ok
+	})
+}
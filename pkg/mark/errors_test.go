@@ -0,0 +1,28 @@
+package mark
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/reconquest/karma-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsResolveError(t *testing.T) {
+	test := assert.New(t)
+
+	test.True(IsResolveError(karma.Format(
+		&ResolveError{Err: errors.New("unexpected parent")},
+		"unable to resolve page",
+	)))
+	test.True(IsResolveError(karma.Format(
+		&confluence.StatusError{StatusCode: 404},
+		"unable to retrieve page by id",
+	)))
+	test.False(IsResolveError(karma.Format(
+		&confluence.StatusError{StatusCode: 401},
+		"unable to retrieve page by id",
+	)))
+	test.False(IsResolveError(errors.New("generic")))
+}
@@ -0,0 +1,82 @@
+// Package fence finds fenced code blocks of markdown, so directives, macros
+// and other syntax extensions are not processed inside of them.
+package fence
+
+import (
+	"bytes"
+	"regexp"
+)
+
+var reFence = regexp.MustCompile("^\\s*(```|~~~)")
+
+// Scanner tracks whether lines of markdown which are passed to it one by one
+// belong to fenced code block.
+type Scanner struct {
+	fenced bool
+}
+
+// Scan returns true if line belongs to fenced code block, opening and closing
+// fences are a part of the block.
+func (scanner *Scanner) Scan(line string) bool {
+	if reFence.MatchString(line) {
+		scanner.fenced = !scanner.fenced
+
+		return true
+	}
+
+	return scanner.fenced
+}
+
+// Marker returns marker of the fence, ``` or ~~~, if line opens or closes
+// fenced code block, empty string is returned otherwise.
+func Marker(line string) string {
+	if groups := reFence.FindStringSubmatch(line); groups != nil {
+		return groups[1]
+	}
+
+	return ""
+}
+
+// Mask returns copy of markdown with fenced code blocks and inline code spans
+// replaced by spaces, line breaks are kept, so locations of matches found in
+// the masked markdown point to the same text in the original one.
+func Mask(markdown []byte) []byte {
+	var (
+		masked = make([]byte, 0, len(markdown))
+		fences Scanner
+	)
+
+	for _, line := range bytes.SplitAfter(markdown, []byte("\n")) {
+		if fences.Scan(string(line)) {
+			masked = append(masked, blank(line)...)
+			continue
+		}
+
+		parts := bytes.Split(line, []byte("`"))
+		for i, part := range parts {
+			if i > 0 {
+				masked = append(masked, '`')
+			}
+
+			// unterminated code span is not a code span
+			if i%2 == 1 && i < len(parts)-1 {
+				part = blank(part)
+			}
+
+			masked = append(masked, part...)
+		}
+	}
+
+	return masked
+}
+
+// blank returns copy of text with every character except line break replaced
+// by space.
+func blank(text []byte) []byte {
+	result := bytes.Repeat([]byte(" "), len(text))
+	if bytes.HasSuffix(text, []byte("\n")) {
+		result[len(result)-1] = '\n'
+	}
+
+	return result
+}
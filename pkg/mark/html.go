@@ -0,0 +1,110 @@
+package mark
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/reconquest/pkg/log"
+)
+
+// Policies of handling raw HTML tags which are not valid in Confluence
+// storage format.
+const (
+	HTMLKeep  = "keep"
+	HTMLWarn  = "warn"
+	HTMLStrip = "strip"
+)
+
+var reHTMLTag = regexp.MustCompile(`<(/?)([a-zA-Z][a-zA-Z0-9:-]*)[^>]*>`)
+
+// htmlAllowed are tags which are valid in Confluence storage format and are
+// passed through as is.
+var htmlAllowed = map[string]bool{
+	"a": true, "abbr": true, "b": true, "big": true, "blockquote": true,
+	"br": true, "cite": true, "code": true, "col": true, "colgroup": true,
+	"dd": true, "del": true, "div": true, "dl": true, "dt": true, "em": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"hr": true, "i": true, "img": true, "li": true, "ol": true, "p": true,
+	"pre": true, "s": true, "small": true, "span": true, "strong": true,
+	"sub": true, "sup": true, "table": true, "tbody": true, "td": true,
+	"tfoot": true, "th": true, "thead": true, "tr": true, "u": true, "ul": true,
+}
+
+// htmlReplaced maps tags which are not supported by Confluence to their
+// valid equivalents, attributes of such tags are dropped.
+var htmlReplaced = map[string]string{
+	"kbd":    "code",
+	"samp":   "code",
+	"tt":     "code",
+	"var":    "em",
+	"ins":    "u",
+	"strike": "s",
+}
+
+// ValidateHTML checks that given raw HTML policy is supported.
+func ValidateHTML(policy string) error {
+	switch policy {
+	case "", HTMLKeep, HTMLWarn, HTMLStrip:
+		return nil
+	default:
+		return fmt.Errorf(
+			"unknown HTML policy %q, expected %s, %s or %s",
+			policy,
+			HTMLKeep,
+			HTMLWarn,
+			HTMLStrip,
+		)
+	}
+}
+
+// sanitizeHTML applies policy to tags of raw HTML: known tags are passed
+// through or replaced with valid equivalents, while others are kept with
+// warning or removed along with their attributes, but contents are kept.
+// Namespaced tags, like ac:structured-macro, are always kept. Warnings are
+// reported once per tag, warned keeps track of reported ones.
+func sanitizeHTML(
+	literal []byte,
+	policy string,
+	warned map[string]bool,
+) []byte {
+	if policy == "" || policy == HTMLKeep {
+		return literal
+	}
+
+	return reHTMLTag.ReplaceAllFunc(literal, func(tag []byte) []byte {
+		matches := reHTMLTag.FindSubmatch(tag)
+
+		var (
+			closing = string(matches[1])
+			name    = strings.ToLower(string(matches[2]))
+		)
+
+		if strings.Contains(name, ":") ||
+			strings.Contains(name, "---bf-colon---") ||
+			htmlAllowed[name] {
+			return tag
+		}
+
+		if replacement, ok := htmlReplaced[name]; ok {
+			return []byte("<" + closing + replacement + ">")
+		}
+
+		if policy == HTMLStrip {
+			return nil
+		}
+
+		if !warned[name] {
+			warned[name] = true
+
+			log.Warningf(
+				nil,
+				"HTML tag <%s> is not supported by Confluence storage format "+
+					"and may break the page, use --html strip to remove it",
+				name,
+			)
+		}
+
+		return tag
+	})
+}
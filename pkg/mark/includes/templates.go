@@ -6,19 +6,105 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
 
+	"github.com/bonovoxly/mark/pkg/mark/fence"
+	"github.com/bonovoxly/mark/pkg/mark/multierr"
 	"gopkg.in/yaml.v2"
 
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
 )
 
-// <!-- Include: <template path>
+// <!-- Include: <template path> <optional key=value options>
 //      <optional yaml data> -->
 var reIncludeDirective = regexp.MustCompile(
-	`(?s)<!--\s*Include:\s*(?P<template>\S+)\s*(\n(?P<config>.*?))?-->`)
+	`(?s)<!--\s*Include:\s*(?P<template>\S+)(?P<options>[ \t]+[^\n]*?)?` +
+		`\s*(\n(?P<config>.*?))?-->`)
+
+var reHeading = regexp.MustCompile(`^(\s{0,3})(#{1,6})([ \t]|$)`)
+
+// maxHeadingLevel is the deepest heading level supported by markdown.
+const maxHeadingLevel = 6
+
+// includeOptions are options which can be specified after template path of
+// include directive as key=value pairs.
+type includeOptions struct {
+	// Shift is added to level of every heading of included content.
+	Shift int
+}
+
+func parseIncludeOptions(spec string) (includeOptions, error) {
+	var options includeOptions
+
+	for _, field := range strings.Fields(spec) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return options, fmt.Errorf(
+				"invalid option %q, expected key=value",
+				field,
+			)
+		}
+
+		switch key, value := parts[0], parts[1]; key {
+		case "shift":
+			shift, err := strconv.Atoi(value)
+			if err != nil {
+				return options, fmt.Errorf(
+					"invalid shift %q, expected integer",
+					value,
+				)
+			}
+
+			options.Shift = shift
+
+		default:
+			return options, fmt.Errorf("unknown option %q", key)
+		}
+	}
+
+	return options, nil
+}
+
+// shiftHeadings changes level of every ATX heading outside of code fences by
+// specified shift, resulting level is clamped between H1 and H6.
+func shiftHeadings(markdown []byte, shift int) []byte {
+	if shift == 0 {
+		return markdown
+	}
+
+	var (
+		lines  = strings.SplitAfter(string(markdown), "\n")
+		fences fence.Scanner
+	)
+
+	for i, line := range lines {
+		if fences.Scan(line) {
+			continue
+		}
+
+		groups := reHeading.FindStringSubmatch(line)
+		if groups == nil {
+			continue
+		}
+
+		level := len(groups[2]) + shift
+		if level < 1 {
+			level = 1
+		}
+
+		if level > maxHeadingLevel {
+			level = maxHeadingLevel
+		}
+
+		lines[i] = groups[1] + strings.Repeat("#", level) +
+			line[len(groups[1])+len(groups[2]):]
+	}
+
+	return []byte(strings.Join(lines, ""))
+}
 
 func LoadTemplate(
 	path string,
@@ -83,25 +169,38 @@ func ProcessIncludes(
 
 	var (
 		recurse bool
-		err     error
+		errs    []error
 	)
 
+	// every directive is processed even if some of them failed, so all
+	// errors are reported at once
 	contents = reIncludeDirective.ReplaceAllFunc(
 		contents,
 		func(spec []byte) []byte {
-			if err != nil {
-				return nil
-			}
+			var err error
+
+			defer func() {
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}()
 
 			groups := reIncludeDirective.FindSubmatch(spec)
 
 			var (
-				path, config = string(groups[1]), groups[2]
+				path, config = string(groups[1]), groups[3]
 				data         = map[string]interface{}{}
 
 				facts = karma.Describe("path", path)
 			)
 
+			options, err := parseIncludeOptions(string(groups[2]))
+			if err != nil {
+				err = facts.Format(err, "unable to parse include options")
+
+				return nil
+			}
+
 			err = yaml.Unmarshal(config, &data)
 			if err != nil {
 				err = facts.
@@ -116,13 +215,15 @@ func ProcessIncludes(
 
 			log.Tracef(vardump(facts, data), "including template %q", path)
 
-			templates, err = LoadTemplate(path, templates)
+			loaded, err := LoadTemplate(path, templates)
 			if err != nil {
 				err = facts.Format(err, "unable to load template")
 
 				return nil
 			}
 
+			templates = loaded
+
 			var buffer bytes.Buffer
 
 			err = templates.Execute(&buffer, data)
@@ -137,9 +238,9 @@ func ProcessIncludes(
 
 			recurse = true
 
-			return buffer.Bytes()
+			return shiftHeadings(buffer.Bytes(), options.Shift)
 		},
 	)
 
-	return templates, contents, recurse, err
+	return templates, contents, recurse, multierr.Join(errs)
 }
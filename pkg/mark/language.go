@@ -0,0 +1,155 @@
+package mark
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// languageRule is a pattern which is typical for a language, the more rules
+// match code the more likely code is written in that language.
+type languageRule struct {
+	language string
+	pattern  *regexp.Regexp
+	weight   int
+}
+
+// languageThreshold is a minimal score which language should have to be
+// detected, so a single accidental match doesn't count.
+const languageThreshold = 3
+
+var languageRules = []languageRule{
+	{"bash", regexp.MustCompile(`(?m)^#!.*\b(ba|z)?sh\b`), 5},
+	{"bash", regexp.MustCompile(`(?m)^\s*(sudo|echo|export|cd|apt-get|apt|yum|curl|wget|chmod|mkdir)\s`), 2},
+	{"bash", regexp.MustCompile(`(?m)^\s*(if \[|fi$|then$|done$|esac$)`), 2},
+	{"bash", regexp.MustCompile(`\$\{?[A-Z_][A-Z0-9_]*\}?`), 1},
+
+	{"go", regexp.MustCompile(`(?m)^package \w+$`), 5},
+	{"go", regexp.MustCompile(`(?m)^func (\(\w+ \*?\w+\) )?\w+\(`), 3},
+	{"go", regexp.MustCompile(`\w+ := `), 2},
+	{"go", regexp.MustCompile(`\bif err != nil\b`), 3},
+	{"go", regexp.MustCompile(`\bfmt\.\w+\(`), 2},
+
+	{"python", regexp.MustCompile(`(?m)^#!.*\bpython`), 5},
+	{"python", regexp.MustCompile(`(?m)^\s*def \w+\(.*\):\s*$`), 3},
+	{"python", regexp.MustCompile(`(?m)^\s*class \w+(\(.*\))?:\s*$`), 3},
+	{"python", regexp.MustCompile(`(?m)^(from [\w.]+ )?import [\w.]+( as \w+)?$`), 2},
+	{"python", regexp.MustCompile(`\bself\.\w+`), 2},
+	{"python", regexp.MustCompile(`\bprint\(`), 1},
+
+	{"javascript", regexp.MustCompile(`\bfunction\s*\w*\s*\(`), 2},
+	{"javascript", regexp.MustCompile(`(?m)^\s*(const|let|var) \w+ = `), 2},
+	{"javascript", regexp.MustCompile(`=>\s*[{(]`), 2},
+	{"javascript", regexp.MustCompile(`\bconsole\.log\(`), 3},
+	{"javascript", regexp.MustCompile(`\brequire\(['"]`), 3},
+
+	{"java", regexp.MustCompile(`\b(public|private|protected) (static )?(class|void|interface)\b`), 3},
+	{"java", regexp.MustCompile(`\bSystem\.out\.print`), 3},
+
+	{"cpp", regexp.MustCompile(`(?m)^#include\s*[<"]`), 5},
+	{"cpp", regexp.MustCompile(`\bstd::\w+`), 2},
+
+	{"sql", regexp.MustCompile(`(?i)\bselect\b[\s\S]+\bfrom\b`), 3},
+	{"sql", regexp.MustCompile(`(?i)\b(insert into|update \w+ set|delete from|create table)\b`), 3},
+
+	{"xml", regexp.MustCompile(`^\s*<(\?xml|!DOCTYPE|html)\b`), 5},
+	{"xml", regexp.MustCompile(`</\w+>`), 2},
+
+	{"yaml", regexp.MustCompile(`(?m)^---\s*$`), 1},
+	{"yaml", regexp.MustCompile(`(?m)^[\w-]+:(\s+\S.*)?$`), 1},
+	{"yaml", regexp.MustCompile(`(?m)^\s+- [\w-]+:?`), 1},
+}
+
+// languageAliases are names of languages which are known to Confluence code
+// macro under another name.
+var languageAliases = map[string]string{
+	"patch": "diff",
+	"udiff": "diff",
+}
+
+// reDiffShebang matches first line of the code which marks it as diff, e.g.
+// #!diff, when code block has no language specified.
+var reDiffShebang = regexp.MustCompile(`^#!(diff|patch)[ \t]*(\n|$)`)
+
+// reYAMLLine matches lines which YAML document usually consists of: keys,
+// list items and comments.
+var reYAMLLine = regexp.MustCompile(`^\s*(#.*|- .*|[\w.-]+:(\s.*)?|---)?$`)
+
+// DetectLanguage guesses language of the code using simple heuristics. It
+// returns empty string if no language is likely enough.
+func DetectLanguage(code string) string {
+	trimmed := strings.TrimSpace(code)
+	if trimmed == "" {
+		return ""
+	}
+
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) &&
+		json.Valid([]byte(trimmed)) {
+		return "json"
+	}
+
+	scores := map[string]int{}
+	for _, rule := range languageRules {
+		if rule.pattern.MatchString(code) {
+			scores[rule.language] += rule.weight
+		}
+	}
+
+	yaml := true
+	for _, line := range strings.Split(trimmed, "\n") {
+		if !reYAMLLine.MatchString(line) {
+			yaml = false
+
+			break
+		}
+	}
+
+	if yaml {
+		scores["yaml"] += languageThreshold
+	}
+
+	var (
+		best   string
+		top    int
+		second int
+	)
+
+	for language, score := range scores {
+		switch {
+		case score > top:
+			best, top, second = language, score, top
+		case score == top:
+			// ambiguous, e.g. languages with similar syntax
+			best, second = "", score
+		case score > second:
+			second = score
+		}
+	}
+
+	if top < languageThreshold || top == second {
+		return ""
+	}
+
+	return best
+}
+
+// NormalizeLanguage returns name of the language which is used by Confluence
+// code macro, e.g. diff for patch.
+func NormalizeLanguage(language string) string {
+	if alias, ok := languageAliases[strings.ToLower(language)]; ok {
+		return alias
+	}
+
+	return language
+}
+
+// stripDiffShebang removes leading #!diff line from the code, it returns
+// false if there is no such line.
+func stripDiffShebang(code string) (string, bool) {
+	match := reDiffShebang.FindString(code)
+	if match == "" {
+		return code, false
+	}
+
+	return code[len(match):], true
+}
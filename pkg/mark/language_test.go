@@ -0,0 +1,27 @@
+package mark
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	for code, language := range map[string]string{
+		"#!/bin/bash\necho hello\n":                             "bash",
+		"sudo apt-get install -y mark\nexport PATH=$HOME/bin\n": "bash",
+		"package main\n\nfunc main() {\n\tfmt.Println(1)\n}\n":  "go",
+		"def main():\n    print('hi')\n":                        "python",
+		"const x = require('x');\nconsole.log(x);\n":            "javascript",
+		"#include <stdio.h>\nint main() {}\n":                   "cpp",
+		"SELECT id FROM users WHERE id = 1;\n":                  "sql",
+		`{"key": ["value"]}`:                                    "json",
+		"name: mark\nitems:\n  - key: value\n":                  "yaml",
+		"<?xml version=\"1.0\"?>\n<a></a>\n":                    "xml",
+		"some plain text\n":                                     "",
+		"x = 1\n":                                               "",
+		"":                                                      "",
+	} {
+		assert.Equal(t, language, DetectLanguage(code), code)
+	}
+}
@@ -2,14 +2,18 @@ package mark
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 
 	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/bonovoxly/mark/pkg/mark/fence"
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
 )
@@ -17,6 +21,21 @@ import (
 type LinkSubstitution struct {
 	From string
 	To   string
+
+	// Wiki is set for [[Page]] links, which are replaced as a whole, while
+	// only target of regular links is replaced.
+	Wiki bool
+}
+
+var (
+	reWikiLink      = regexp.MustCompile(`\[\[([^\s\[\]][^\[\]\n]*?)\]\]`)
+	reWikiLinkSpace = regexp.MustCompile(`^(~?[A-Z0-9]+):(.+)$`)
+)
+
+type wikiLink struct {
+	full  string
+	space string
+	title string
 }
 
 type markdownLink struct {
@@ -25,12 +44,45 @@ type markdownLink struct {
 	hash     string
 }
 
+// DefaultIndexFiles are names of files which links to directories are
+// resolved to if other names are not specified.
+var DefaultIndexFiles = []string{"README.md", "index.md"}
+
+// ResolveRelativeLinks returns substitutions for relative links to other
+// documents and wiki-style links. Links to directories are resolved to the
+// first existing file from indexes in the directory, DefaultIndexFiles are
+// used if indexes are empty. Fragments of links are resolved to names of
+// heading anchors of given style, see HeadingAnchors, they are kept as is if
+// style is empty.
 func ResolveRelativeLinks(
+	ctx context.Context,
 	api *confluence.API,
 	meta *Meta,
 	markdown []byte,
 	base string,
+	indexes []string,
+	style string,
 ) ([]LinkSubstitution, error) {
+	if len(indexes) == 0 {
+		indexes = DefaultIndexFiles
+	}
+
+	resolver := linkResolver{
+		api:     api,
+		base:    base,
+		indexes: indexes,
+		style:   style,
+	}
+
+	if style != "" {
+		var err error
+
+		resolver.anchors, err = HeadingAnchors(markdown, style)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	matches := parseLinks(string(markdown))
 
 	links := []LinkSubstitution{}
@@ -43,7 +95,7 @@ func ResolveRelativeLinks(
 			match.hash,
 		)
 
-		resolved, err := resolveLink(api, base, match)
+		resolved, err := resolver.resolve(ctx, match)
 		if err != nil {
 			return nil, karma.Format(err, "resolve link: %q", match.full)
 		}
@@ -58,19 +110,92 @@ func ResolveRelativeLinks(
 		})
 	}
 
+	for _, link := range parseWikiLinks(string(markdown)) {
+		if link.space == "" && meta != nil {
+			link.space = meta.Space
+		}
+
+		resolved, err := resolveWikiLink(ctx, api, link)
+		if err != nil {
+			return nil, karma.Format(err, "resolve link: %q", link.full)
+		}
+
+		links = append(links, LinkSubstitution{
+			From: link.full,
+			To:   resolved,
+			Wiki: true,
+		})
+	}
+
 	return links, nil
 }
 
-func resolveLink(
+// resolveWikiLink returns Confluence link to the page, link is returned
+// even if the page doesn't exist, since it may be created later.
+func resolveWikiLink(
+	ctx context.Context,
 	api *confluence.API,
-	base string,
+	link wikiLink,
+) (string, error) {
+	if api != nil && link.space != "" {
+		page, err := api.FindPage(ctx, link.space, link.title, "page")
+		if err != nil {
+			return "", karma.Format(err, "api: find page")
+		}
+
+		if page == nil {
+			log.Warningf(
+				nil,
+				"page %q linked as %s is not found in space %q",
+				link.title,
+				link.full,
+				link.space,
+			)
+		}
+	}
+
+	var space string
+	if link.space != "" {
+		space = fmt.Sprintf(` ri:space-key="%s"`, html.EscapeString(link.space))
+	}
+
+	return fmt.Sprintf(
+		`<ac:link><ri:page ri:content-title="%s"%s/></ac:link>`,
+		html.EscapeString(link.title),
+		space,
+	), nil
+}
+
+// linkResolver resolves relative links of the document.
+type linkResolver struct {
+	api     *confluence.API
+	base    string
+	indexes []string
+
+	// style is a style of heading anchors, fragments of links are kept as is
+	// if it's empty.
+	style string
+
+	// anchors are heading anchors of the document itself.
+	anchors map[string]string
+}
+
+func (resolver linkResolver) resolve(
+	ctx context.Context,
 	link markdownLink,
 ) (string, error) {
-	var result string
+	var (
+		result  string
+		anchors = resolver.anchors
+		api     = resolver.api
+	)
 
 	if len(link.filename) > 0 {
-		filepath := filepath.Join(base, link.filename)
-		if _, err := os.Stat(filepath); err != nil {
+		filepath, ok := findIndexFile(
+			filepath.Join(resolver.base, link.filename),
+			resolver.indexes,
+		)
+		if !ok {
 			return "", nil
 		}
 
@@ -81,7 +206,11 @@ func resolveLink(
 
 		// This helps to determine if found link points to file that's
 		// not markdown or have mark required metadata
-		linkMeta, _, err := ExtractMeta(linkContents)
+		linkMeta, linkMarkdown, err := ExtractFileMeta(
+			linkContents,
+			filepath,
+			false,
+		)
 		if err != nil {
 			log.Errorf(
 				err,
@@ -96,7 +225,7 @@ func resolveLink(
 			return "", nil
 		}
 
-		result, err = getConfluenceLink(api, linkMeta.Space, linkMeta.Title)
+		result, err = getConfluenceLink(ctx, api, linkMeta.Space, linkMeta.Title)
 		if err != nil {
 			return "", karma.Format(
 				err,
@@ -110,21 +239,66 @@ func resolveLink(
 		if result == "" {
 			return "", nil
 		}
+
+		anchors = nil
+
+		if resolver.style != "" {
+			anchors, err = HeadingAnchors(linkMarkdown, resolver.style)
+			if err != nil {
+				return "", err
+			}
+		}
 	}
 
 	if len(link.hash) > 0 {
-		result = result + "#" + link.hash
+		hash := link.hash
+		if name, ok := anchors[hash]; ok {
+			hash = name
+		}
+
+		result = result + "#" + hash
 	}
 
 	return result, nil
 }
 
+// findIndexFile returns path to the first existing index file if path is a
+// directory, or path itself if it's a file. False is returned if path doesn't
+// exist or directory doesn't contain any of index files.
+func findIndexFile(path string, indexes []string) (string, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", false
+	}
+
+	if !info.IsDir() {
+		return path, true
+	}
+
+	for _, name := range indexes {
+		index := filepath.Join(path, name)
+
+		info, err := os.Stat(index)
+		if err == nil && !info.IsDir() {
+			return index, true
+		}
+	}
+
+	return "", false
+}
+
 func SubstituteLinks(markdown []byte, links []LinkSubstitution) []byte {
 	for _, link := range links {
 		if link.From == link.To {
 			continue
 		}
 
+		if link.Wiki {
+			markdown = substituteWikiLink(markdown, link)
+
+			continue
+		}
+
 		log.Tracef(nil, "substitute link: %q -> %q", link.From, link.To)
 
 		markdown = bytes.ReplaceAll(
@@ -137,6 +311,71 @@ func SubstituteLinks(markdown []byte, links []LinkSubstitution) []byte {
 	return markdown
 }
 
+// substituteWikiLink replaces wiki link everywhere except code.
+func substituteWikiLink(markdown []byte, link LinkSubstitution) []byte {
+	lines := strings.Split(string(markdown), "\n")
+
+	var fences fence.Scanner
+
+	for i, line := range lines {
+		if fences.Scan(line) {
+			continue
+		}
+
+		// inline code spans are kept as is
+		parts := strings.Split(line, "`")
+		for j := 0; j < len(parts); j += 2 {
+			parts[j] = strings.ReplaceAll(parts[j], link.From, link.To)
+		}
+
+		lines[i] = strings.Join(parts, "`")
+	}
+
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// parseWikiLinks returns unique [[Page]] and [[SPACE:Page]] links outside of
+// code.
+func parseWikiLinks(markdown string) []wikiLink {
+	var (
+		links  []wikiLink
+		seen   = map[string]bool{}
+		fences fence.Scanner
+	)
+
+	for _, line := range strings.Split(markdown, "\n") {
+		if fences.Scan(line) {
+			continue
+		}
+
+		parts := strings.Split(line, "`")
+		for i := 0; i < len(parts); i += 2 {
+			for _, match := range reWikiLink.FindAllStringSubmatch(parts[i], -1) {
+				if seen[match[0]] {
+					continue
+				}
+
+				seen[match[0]] = true
+
+				link := wikiLink{
+					full:  match[0],
+					title: strings.TrimSpace(match[1]),
+				}
+
+				groups := reWikiLinkSpace.FindStringSubmatch(link.title)
+				if groups != nil {
+					link.space = groups[1]
+					link.title = strings.TrimSpace(groups[2])
+				}
+
+				links = append(links, link)
+			}
+		}
+	}
+
+	return links
+}
+
 func parseLinks(markdown string) []markdownLink {
 	re := regexp.MustCompile("\\[[^\\]]+\\]\\((([^\\)#]+)?#?([^\\)]+)?)\\)")
 	matches := re.FindAllStringSubmatch(markdown, -1)
@@ -155,7 +394,11 @@ func parseLinks(markdown string) []markdownLink {
 
 // getConfluenceLink build (to be) link for Conflunce, and tries to verify from
 // API if there's real link available
-func getConfluenceLink(api *confluence.API, space, title string) (string, error) {
+func getConfluenceLink(
+	ctx context.Context,
+	api *confluence.API,
+	space, title string,
+) (string, error) {
 	link := fmt.Sprintf(
 		"%s/display/%s/%s",
 		api.BaseURL,
@@ -163,7 +406,7 @@ func getConfluenceLink(api *confluence.API, space, title string) (string, error)
 		url.QueryEscape(title),
 	)
 
-	page, err := api.FindPage(space, title, "page")
+	page, err := api.FindPage(ctx, space, title, "page")
 	if err != nil {
 		return "", karma.Format(err, "api: find page")
 	}
@@ -1,6 +1,10 @@
 package mark
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -49,3 +53,149 @@ func TestParseLinks(t *testing.T) {
 
 	assert.Equal(t, len(links), 7)
 }
+
+func TestWikiLinks(t *testing.T) {
+	test := assert.New(t)
+
+	markdown := []byte(text(
+		"See [[Other Page]] and [[OPS:Runbook]], [[Other Page]] again.",
+		"Title with colon: [[Release: v1]].",
+		"Code `[[Other Page]]` is kept.",
+		"```bash",
+		"[[ -f file ]] && [[Other Page]]",
+		"```",
+	))
+
+	links, err := ResolveRelativeLinks(
+		context.Background(),
+		nil,
+		&Meta{Space: "DOC"},
+		markdown,
+		".",
+		nil,
+		"",
+	)
+	test.NoError(err)
+	test.Equal(
+		text(
+			`See <ac:link><ri:page ri:content-title="Other Page" ri:space-key="DOC"/></ac:link>`+
+				` and <ac:link><ri:page ri:content-title="Runbook" ri:space-key="OPS"/></ac:link>,`+
+				` <ac:link><ri:page ri:content-title="Other Page" ri:space-key="DOC"/></ac:link> again.`,
+			`Title with colon: <ac:link><ri:page ri:content-title="Release: v1" ri:space-key="DOC"/></ac:link>.`,
+			"Code `[[Other Page]]` is kept.",
+			"```bash",
+			"[[ -f file ]] && [[Other Page]]",
+			"```",
+		),
+		string(SubstituteLinks(markdown, links)),
+	)
+}
+
+func TestResolveRelativeLinksFragments(t *testing.T) {
+	test := assert.New(t)
+
+	markdown := []byte(text(
+		"# Usage",
+		"",
+		"See [second](#usage-1), [third](#usage-2) and [first](#usage).",
+		"",
+		"## Usage",
+		"",
+		"Unknown [section](#missing) is kept.",
+		"",
+		"## Usage",
+	))
+
+	anchors, err := HeadingAnchors(markdown, AnchorStyleConfluence)
+	test.NoError(err)
+	test.Equal(
+		map[string]string{
+			"usage":   "Usage",
+			"usage-1": "Usage-1",
+			"usage-2": "Usage-2",
+		},
+		anchors,
+	)
+
+	links, err := ResolveRelativeLinks(
+		context.Background(),
+		nil,
+		nil,
+		markdown,
+		".",
+		nil,
+		AnchorStyleConfluence,
+	)
+	test.NoError(err)
+	test.Equal(
+		text(
+			"# Usage",
+			"",
+			"See [second](#Usage-1), [third](#Usage-2) and [first](#Usage).",
+			"",
+			"## Usage",
+			"",
+			"Unknown [section](#missing) is kept.",
+			"",
+			"## Usage",
+		),
+		string(SubstituteLinks(markdown, links)),
+	)
+}
+
+func TestFindIndexFile(t *testing.T) {
+	test := assert.New(t)
+
+	base, err := ioutil.TempDir("", "mark")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(base)
+
+	for _, name := range []string{
+		"page.md",
+		"readme/README.md",
+		"readme/index.md",
+		"index/index.md",
+		"empty/other.md",
+	} {
+		err := os.MkdirAll(filepath.Join(base, filepath.Dir(name)), 0755)
+		if err != nil {
+			panic(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(base, name), []byte(name), 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	for link, expected := range map[string]string{
+		"page.md":  "page.md",
+		"readme/":  "readme/README.md",
+		"./index/": "index/index.md",
+		"index":    "index/index.md",
+		"empty/":   "",
+		"missing/": "",
+	} {
+		path, ok := findIndexFile(
+			filepath.Join(base, link),
+			DefaultIndexFiles,
+		)
+		if expected == "" {
+			test.False(ok, link)
+			continue
+		}
+
+		test.True(ok, link)
+		test.Equal(filepath.Join(base, expected), path, link)
+	}
+
+	path, ok := findIndexFile(
+		filepath.Join(base, "readme"),
+		[]string{"index.md", "README.md"},
+	)
+	test.True(ok)
+	test.Equal(filepath.Join(base, "readme/index.md"), path)
+}
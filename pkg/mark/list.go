@@ -0,0 +1,235 @@
+package mark
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bonovoxly/mark/pkg/mark/fence"
+)
+
+var (
+	reListItem = regexp.MustCompile(`^([-*+]|\d+\.)([ \t]+|$)`)
+	reListRule = regexp.MustCompile(`^([-*_])([ \t]*[-*_])*[ \t]*$`)
+)
+
+// listLevel is an item of the list which following lines may belong to.
+type listLevel struct {
+	// marker is a column of the item marker
+	marker int
+
+	// content is a column of the item text
+	content int
+}
+
+// listCode is a fenced code block of the list item, which is replaced with
+// placeholder token, since markdown parser doesn't recognize fences with
+// language inside of lists and swallows the rest of the list into the code.
+type listCode struct {
+	token  string
+	source []string
+}
+
+// normalizeLists re-indents nested lists, so every level of nesting is
+// indented by four spaces as markdown parser expects. Otherwise items of
+// lists which are indented by width of the parent marker, like three spaces
+// for 1., are nested incorrectly and paragraphs of such items fall out of the
+// list. Fenced code blocks of list items are replaced with placeholder tokens.
+// Lists inside of blockquotes, including admonitions, are normalized as well.
+func normalizeLists(markdown []byte) ([]byte, []listCode) {
+	var codes []listCode
+
+	lines := normalizeListLines(strings.Split(string(markdown), "\n"), &codes)
+
+	return []byte(strings.Join(lines, "\n")), codes
+}
+
+// normalizeListLines normalizes lists of given lines, extracted code blocks
+// are appended to codes, so their tokens are unique across nested quotes.
+func normalizeListLines(lines []string, codes *[]listCode) []string {
+	var (
+		levels []listLevel
+		result []string
+		blank  bool
+		marker string
+		code   *listCode
+		margin int
+	)
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		indent, text := getIndent(line)
+
+		if marker != "" {
+			if strings.HasPrefix(text, marker) {
+				marker = ""
+			}
+
+			if code == nil {
+				result = append(result, line)
+				continue
+			}
+
+			code.source = append(code.source, indentLine(indent-margin, text))
+
+			if marker == "" {
+				*codes = append(*codes, *code)
+				code = nil
+			}
+
+			continue
+		}
+
+		if text == "" {
+			blank = len(levels) > 0
+
+			result = append(result, line)
+			continue
+		}
+
+		// line indented by four spaces outside of list is a code block
+		isItem := reListItem.MatchString(text) &&
+			!reListRule.MatchString(text) &&
+			(len(levels) > 0 || indent < 4)
+
+		switch {
+		case isItem:
+			for len(levels) > 0 && indent <= levels[len(levels)-1].marker {
+				levels = levels[:len(levels)-1]
+			}
+
+		case blank:
+			for len(levels) > 0 && indent < levels[len(levels)-1].content {
+				levels = levels[:len(levels)-1]
+			}
+		}
+
+		blank = false
+
+		// blockquote which is not a part of list item is normalized
+		// separately, since its lines are prefixed by quote markers
+		if len(levels) == 0 && !isItem && indent < 4 &&
+			strings.HasPrefix(text, ">") {
+			quote := []string{}
+			for ; i < len(lines); i++ {
+				indent, text := getIndent(lines[i])
+				if indent >= 4 || !strings.HasPrefix(text, ">") {
+					break
+				}
+
+				text = strings.TrimPrefix(text[1:], " ")
+
+				quote = append(quote, text)
+			}
+
+			i--
+
+			for _, text := range normalizeListLines(quote, codes) {
+				result = append(result, strings.TrimRight("> "+text, " "))
+			}
+
+			continue
+		}
+
+		if len(levels) == 0 && !isItem {
+			marker = fence.Marker(text)
+
+			result = append(result, line)
+			continue
+		}
+
+		depth := len(levels)
+
+		if isItem {
+			matches := reListItem.FindStringSubmatch(text)
+
+			levels = append(levels, listLevel{
+				marker:  indent,
+				content: indent + len(matches[0]),
+			})
+
+			result = append(result, indentLine(depth*4, text))
+			continue
+		}
+
+		// text which is indented by four spaces more than content of the
+		// item is a code block, it keeps its relative indentation
+		extra := indent - levels[depth-1].content
+		if extra < 4 {
+			extra = 0
+		}
+
+		if marker = fence.Marker(text); marker != "" {
+			code = &listCode{
+				token:  fmt.Sprintf("MARKLISTCODE%dEND", len(*codes)),
+				source: []string{text},
+			}
+
+			margin = indent
+
+			result = append(result, "", indentLine(depth*4, code.token), "")
+			continue
+		}
+
+		result = append(result, indentLine(depth*4+extra, text))
+	}
+
+	// code block which is not closed lasts until the end of document
+	if code != nil {
+		*codes = append(*codes, *code)
+	}
+
+	return result
+}
+
+// compileListCodes replaces placeholder tokens of code blocks extracted from
+// lists with the code blocks rendered by given function.
+func compileListCodes(
+	html []byte,
+	codes []listCode,
+	render func([]byte) []byte,
+) []byte {
+	for _, code := range codes {
+		location := findPlaceholder(html, code.token)
+		if location == nil {
+			continue
+		}
+
+		body := render([]byte(strings.Join(code.source, "\n") + "\n"))
+
+		html = append(
+			html[:location[0]:location[0]],
+			append(body, html[location[1]:]...)...,
+		)
+	}
+
+	return html
+}
+
+// getIndent returns width of the leading whitespace of the line, tabs are
+// expanded to four spaces, along with the rest of the line.
+func getIndent(line string) (int, string) {
+	indent := 0
+
+	for i, char := range line {
+		switch char {
+		case ' ':
+			indent++
+		case '\t':
+			indent += 4 - indent%4
+		default:
+			return indent, line[i:]
+		}
+	}
+
+	return indent, ""
+}
+
+func indentLine(indent int, text string) string {
+	if indent < 0 {
+		indent = 0
+	}
+
+	return strings.Repeat(" ", indent) + text
+}
@@ -7,7 +7,9 @@ import (
 	"strings"
 	"text/template"
 
+	"github.com/bonovoxly/mark/pkg/mark/fence"
 	"github.com/bonovoxly/mark/pkg/mark/includes"
+	"github.com/bonovoxly/mark/pkg/mark/multierr"
 	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
 	"github.com/reconquest/regexputil-go"
@@ -25,6 +27,10 @@ var reMacroDirective = regexp.MustCompile(
 		/*   */ `(?P<config>\n.*?)?-->`,
 )
 
+// reMacroLike matches beginning of anything which looks like macro directive,
+// it's used to find directives which are not recognized due to typos.
+var reMacroLike = regexp.MustCompile(`(?i)<!--\s*macro\s*:[^\n]*`)
+
 type Macro struct {
 	Regexp   *regexp.Regexp
 	Template *template.Template
@@ -34,39 +40,59 @@ type Macro struct {
 func (macro *Macro) Apply(
 	content []byte,
 ) ([]byte, error) {
-	var err error
+	var errs []error
 
 	content = macro.Regexp.ReplaceAllFunc(
 		content,
 		func(match []byte) []byte {
 			config := map[string]interface{}{}
 
-			err = yaml.Unmarshal([]byte(macro.Config), &config)
+			err := yaml.Unmarshal([]byte(macro.Config), &config)
 			if err != nil {
-				err = karma.Format(
+				errs = append(errs, karma.Format(
 					err,
 					"unable to unmarshal macros config template",
-				)
+				))
+			}
+
+			groups := macro.Regexp.FindSubmatch(match)
+
+			// config is a map, so values are replaced in place
+			macro.configure(config, groups)
+
+			// parameters are applied after substitution, so they are
+			// passed to the template as is
+			for i, name := range macro.Regexp.SubexpNames() {
+				if name != ParamsGroup {
+					continue
+				}
+
+				err := applyParams(config, string(groups[i]), macro.Template)
+				if err != nil {
+					errs = append(errs, karma.Describe("match", string(match)).Format(
+						err,
+						"unable to parse macro parameters",
+					))
+
+					return match
+				}
 			}
 
 			var buffer bytes.Buffer
 
-			err = macro.Template.Execute(&buffer, macro.configure(
-				config,
-				macro.Regexp.FindSubmatch(match),
-			))
+			err = macro.Template.Execute(&buffer, config)
 			if err != nil {
-				err = karma.Format(
+				errs = append(errs, karma.Describe("match", string(match)).Format(
 					err,
 					"unable to execute macros template",
-				)
+				))
 			}
 
 			return buffer.Bytes()
 		},
 	)
 
-	return content, err
+	return content, multierr.Join(errs)
 }
 
 func (macro *Macro) configure(node interface{}, groups [][]byte) interface{} {
@@ -108,16 +134,23 @@ func ExtractMacros(
 	contents []byte,
 	templates *template.Template,
 ) ([]Macro, []byte, error) {
-	var err error
-
-	var macros []Macro
+	var (
+		macros []Macro
+		errs   []error
+	)
 
+	// every directive is processed even if some of them failed, so all
+	// errors are reported at once
 	contents = reMacroDirective.ReplaceAllFunc(
 		contents,
 		func(spec []byte) []byte {
-			if err != nil {
-				return spec
-			}
+			var err error
+
+			defer func() {
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}()
 
 			groups := reMacroDirective.FindStringSubmatch(string(spec))
 
@@ -169,5 +202,13 @@ func ExtractMacros(
 		},
 	)
 
-	return macros, contents, err
+	return macros, contents, multierr.Join(errs)
+}
+
+// FindUnresolved returns locations of directives which look like macro
+// directives, but are left in given contents after ExtractMacros, e.g. due to
+// misspelled Template field. Location spans the first line of directive.
+// Directives inside of code are examples, so they are not reported.
+func FindUnresolved(contents []byte) [][]int {
+	return reMacroLike.FindAllIndex(fence.Mask(contents), -1)
 }
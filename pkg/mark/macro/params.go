@@ -0,0 +1,203 @@
+package macro
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/reconquest/karma-go"
+	"gopkg.in/yaml.v2"
+)
+
+// ParamsGroup is a name of capture group of macro regexp which contains
+// parameters of the macro, e.g. :status[color=Green title="In Progress"]:
+// for regexp :status\[(?P<params>[^\]]*)\]:
+const ParamsGroup = "params"
+
+// reMacroParam matches single key=value parameter, value can be quoted to
+// contain whitespace.
+var reMacroParam = regexp.MustCompile(`^(\w+)=("(?:[^"\\]|\\.)*"|\S*)`)
+
+// ParseParams parses whitespace separated key=value parameters. Unquoted
+// values are typed like YAML scalars, e.g. true is a boolean and 3 is an
+// integer, quoted values are always strings.
+func ParseParams(text string) (map[string]interface{}, error) {
+	params := map[string]interface{}{}
+
+	for text = strings.TrimSpace(text); text != ""; {
+		match := reMacroParam.FindStringSubmatch(text)
+		if match == nil {
+			return nil, fmt.Errorf(
+				"invalid macro parameter %q, expected key=value",
+				strings.Fields(text)[0],
+			)
+		}
+
+		key, raw := match[1], match[2]
+
+		var value interface{}
+		if strings.HasPrefix(raw, `"`) {
+			unquoted, err := strconv.Unquote(raw)
+			if err != nil {
+				return nil, karma.Format(
+					err,
+					"invalid value of macro parameter %q: %s",
+					key,
+					raw,
+				)
+			}
+
+			value = unquoted
+		} else {
+			err := yaml.Unmarshal([]byte(raw), &value)
+			if err != nil {
+				value = raw
+			}
+
+			// only scalars are typed, e.g. [a] is left as is
+			switch value.(type) {
+			case nil, []interface{}, map[interface{}]interface{}:
+				value = raw
+			}
+		}
+
+		if _, ok := params[key]; ok {
+			return nil, fmt.Errorf("duplicate macro parameter %q", key)
+		}
+
+		params[key] = value
+
+		text = strings.TrimSpace(text[len(match[0]):])
+	}
+
+	return params, nil
+}
+
+// applyParams sets parameters parsed from the match to the template data.
+// Keys are matched against fields of the template case-insensitively, so
+// color=Green sets .Color, unknown keys are reported as error.
+func applyParams(
+	data map[string]interface{},
+	text string,
+	tmpl *template.Template,
+) error {
+	params, err := ParseParams(text)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]string{}
+	for _, field := range templateFields(tmpl) {
+		fields[strings.ToLower(field)] = field
+	}
+
+	for key, value := range params {
+		field, ok := fields[strings.ToLower(key)]
+		if !ok {
+			expected := []string{}
+			for _, field := range fields {
+				expected = append(expected, field)
+			}
+
+			sort.Strings(expected)
+
+			return fmt.Errorf(
+				"unknown parameter %q of template %q, expected one of: %s",
+				key,
+				tmpl.Name(),
+				strings.Join(expected, ", "),
+			)
+		}
+
+		data[field] = value
+	}
+
+	return nil
+}
+
+// templateFields returns names of fields of the template data which are
+// referenced by the template and templates invoked by it, e.g. Title for
+// {{ .Title }}. Fields referenced inside of with and range are not
+// included since dot is changed there.
+func templateFields(tmpl *template.Template) []string {
+	var (
+		fields  = map[string]bool{}
+		visited = map[string]bool{}
+		walk    func(node parse.Node)
+	)
+
+	walk = func(node parse.Node) {
+		switch node := node.(type) {
+		case *parse.ListNode:
+			if node == nil {
+				return
+			}
+
+			for _, child := range node.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(node.Pipe)
+		case *parse.PipeNode:
+			if node == nil {
+				return
+			}
+
+			for _, command := range node.Cmds {
+				walk(command)
+			}
+		case *parse.CommandNode:
+			for _, arg := range node.Args {
+				walk(arg)
+			}
+		case *parse.ChainNode:
+			walk(node.Node)
+		case *parse.FieldNode:
+			fields[node.Ident[0]] = true
+		case *parse.VariableNode:
+			if node.Ident[0] == "$" && len(node.Ident) > 1 {
+				fields[node.Ident[1]] = true
+			}
+		case *parse.IfNode:
+			walk(node.Pipe)
+			walk(node.List)
+			walk(node.ElseList)
+		case *parse.WithNode:
+			walk(node.Pipe)
+			walk(node.ElseList)
+		case *parse.RangeNode:
+			walk(node.Pipe)
+			walk(node.ElseList)
+		case *parse.TemplateNode:
+			if visited[node.Name] {
+				return
+			}
+
+			visited[node.Name] = true
+
+			walk(node.Pipe)
+
+			if invoked := tmpl.Lookup(node.Name); invoked != nil &&
+				invoked.Tree != nil {
+				walk(invoked.Tree.Root)
+			}
+		}
+	}
+
+	if tmpl.Tree != nil {
+		walk(tmpl.Tree.Root)
+	}
+
+	result := []string{}
+	for field := range fields {
+		result = append(result, field)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
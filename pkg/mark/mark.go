@@ -1,6 +1,11 @@
 package mark
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/bonovoxly/mark/pkg/confluence"
@@ -8,12 +13,146 @@ import (
 	"github.com/reconquest/pkg/log"
 )
 
+const (
+	PageChecksumProperty = `mark-checksum`
+
+	// PageRestrictionsProperty lists operations restricted by mark, so the
+	// restrictions are cleared once they are removed from metadata.
+	PageRestrictionsProperty = `mark-restrictions`
+
+	// PageVersionProperty is a version of the page published by mark last
+	// time, see CheckMinVersion.
+	PageVersionProperty = `mark-version`
+)
+
+// GetPageChecksum returns checksum of the page contents, labels, parent and
+// content properties set along with the contents, which is used to detect if
+// page update is required.
+func GetPageChecksum(
+	page *confluence.PageInfo,
+	body string,
+	labels []string,
+	properties map[string]string,
+) string {
+	labels = append([]string{}, labels...)
+	sort.Strings(labels)
+
+	keys := []string{}
+	for key := range properties {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var parent string
+	if len(page.Ancestors) > 0 {
+		parent = page.Ancestors[len(page.Ancestors)-1].Id
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(page.Title + "\n"))
+	hash.Write([]byte(parent + "\n"))
+	hash.Write([]byte(strings.Join(labels, ",") + "\n"))
+
+	for _, key := range keys {
+		hash.Write([]byte(key + "=" + properties[key] + "\n"))
+	}
+
+	hash.Write([]byte(body))
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// NormalizeLabels merges labels from several sources, e.g. metadata and
+// command line, into a sorted list without duplicates. Labels are lowercased
+// like Confluence does, so the same labels are always sent in the same order
+// and page versions don't differ by order of labels.
+func NormalizeLabels(sources ...[]string) []string {
+	result := []string{}
+	seen := map[string]bool{}
+
+	for _, labels := range sources {
+		for _, label := range labels {
+			label = strings.ToLower(strings.TrimSpace(label))
+			if label == "" || seen[label] {
+				continue
+			}
+
+			seen[label] = true
+			result = append(result, label)
+		}
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// ExcludeLabels returns labels without the removed ones, removed labels are
+// normalized the same way as by NormalizeLabels.
+func ExcludeLabels(labels []string, removed []string) []string {
+	excluded := map[string]bool{}
+	for _, label := range NormalizeLabels(removed) {
+		excluded[label] = true
+	}
+
+	result := []string{}
+	for _, label := range labels {
+		if !excluded[label] {
+			result = append(result, label)
+		}
+	}
+
+	return result
+}
+
+// CheckMinVersion returns error if the page has a newer version than the
+// version specified by MinVersion metadata field or the version published by
+// mark last time, whichever is newer, so changes made by others aren't
+// overwritten by a stale file while versions created by mark itself don't
+// make the page newer than the file.
+func CheckMinVersion(
+	meta *Meta,
+	page *confluence.PageInfo,
+	published int64,
+) error {
+	if meta == nil || meta.MinVersion == 0 {
+		return nil
+	}
+
+	expected := meta.MinVersion
+	if published > expected {
+		expected = published
+	}
+
+	if page.Version.Number <= expected {
+		return nil
+	}
+
+	return karma.
+		Describe("live version", page.Version.Number).
+		Describe("expected version", expected).
+		Format(
+			nil,
+			"page %q has a newer version than specified by %s header "+
+				"or published by mark",
+			page.Title,
+			HeaderMinVersion,
+		)
+}
+
+// ResolvePage returns parent page of the page described by metadata, which
+// is created along with its own parents if it doesn't exist, and the page
+// itself if it exists. Parent pages are kept in given cache, see
+// AncestryCache.
 func ResolvePage(
+	ctx context.Context,
 	dryRun bool,
 	api *confluence.API,
+	cache *AncestryCache,
 	meta *Meta,
 ) (*confluence.PageInfo, *confluence.PageInfo, error) {
-	page, err := api.FindPage(meta.Space, meta.Title, meta.Type)
+	page, err := api.FindPage(ctx, meta.Space, meta.Title, meta.Type)
 	if err != nil {
 		return nil, nil, karma.Format(
 			err,
@@ -32,14 +171,21 @@ func ResolvePage(
 		return nil, page, nil
 	}
 
-	ancestry := meta.Parents
-	if page != nil {
-		ancestry = append(ancestry, page.Title)
+	// parent is looked up in its own space, pages can't be placed under
+	// parents of another space, so it's reported instead of creating parents
+	if meta.ParentSpace != "" && len(meta.Parents) > 0 {
+		return nil, nil, resolveForeignParent(ctx, api, cache, meta, page)
 	}
 
+	// page itself is not validated since it will be moved under specified
+	// parents if its current location differs
+	ancestry := meta.Parents
+
 	if len(ancestry) > 0 {
 		page, err := ValidateAncestry(
+			ctx,
 			api,
+			cache,
 			meta.Space,
 			ancestry,
 		)
@@ -66,8 +212,10 @@ func ResolvePage(
 	}
 
 	parent, err := EnsureAncestry(
+		ctx,
 		dryRun,
 		api,
+		cache,
 		meta.Space,
 		meta.Parents,
 	)
@@ -79,6 +227,13 @@ func ResolvePage(
 		)
 	}
 
+	if page != nil && len(meta.Parents) > 0 {
+		err := movePage(page, parent)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	titles := []string{}
 	for _, page := range parent.Ancestors {
 		titles = append(titles, page.Title)
@@ -95,3 +250,194 @@ func ResolvePage(
 
 	return parent, page, nil
 }
+
+// RefreshPage retrieves the latest version of the page, e.g. after version
+// conflict. Ancestors of the page are kept if metadata specifies parents, so
+// the move of the page set by ResolvePage is not lost.
+func RefreshPage(
+	ctx context.Context,
+	api *confluence.API,
+	meta *Meta,
+	page *confluence.PageInfo,
+) (*confluence.PageInfo, error) {
+	latest, err := api.GetPageByID(ctx, page.ID)
+	if err != nil {
+		return nil, karma.Format(err, "unable to retrieve page by id")
+	}
+
+	if meta != nil && len(meta.Parents) > 0 {
+		latest.Ancestors = page.Ancestors
+	}
+
+	return latest, nil
+}
+
+// GetRestrictions converts restrictions from metadata into page restrictions,
+// operations without any users or groups are not restricted.
+func GetRestrictions(restrictions Restrictions) []confluence.Restriction {
+	result := []confluence.Restriction{}
+
+	for _, operation := range []struct {
+		name    string
+		entries []string
+	}{
+		{"read", restrictions.View},
+		{"update", restrictions.Edit},
+	} {
+		if len(operation.entries) == 0 {
+			continue
+		}
+
+		restriction := confluence.Restriction{Operation: operation.name}
+
+		for _, entry := range operation.entries {
+			if strings.HasPrefix(entry, RestrictionGroupPrefix) {
+				restriction.Groups = append(
+					restriction.Groups,
+					strings.TrimPrefix(entry, RestrictionGroupPrefix),
+				)
+			} else {
+				restriction.Users = append(restriction.Users, entry)
+			}
+		}
+
+		result = append(result, restriction)
+	}
+
+	return result
+}
+
+// LockRestrictions returns restrictions with the user added to the users
+// allowed to edit the page, other users and groups keep their access.
+func LockRestrictions(
+	restrictions []confluence.Restriction,
+	user string,
+) []confluence.Restriction {
+	result := []confluence.Restriction{}
+	locked := false
+
+	for _, restriction := range restrictions {
+		if restriction.Operation == "update" {
+			restriction.Users = append(
+				append([]string{}, restriction.Users...),
+				user,
+			)
+
+			locked = true
+		}
+
+		result = append(result, restriction)
+	}
+
+	if !locked {
+		result = append(result, confluence.Restriction{
+			Operation: "update",
+			Users:     []string{user},
+		})
+	}
+
+	return result
+}
+
+// resolveForeignParent returns error describing why the page can't be placed
+// under the parent which is in another space than the page itself.
+func resolveForeignParent(
+	ctx context.Context,
+	api *confluence.API,
+	cache *AncestryCache,
+	meta *Meta,
+	page *confluence.PageInfo,
+) error {
+	if cache == nil {
+		cache = NewAncestryCache()
+	}
+
+	title := meta.Parents[len(meta.Parents)-1]
+
+	parent, err := cache.FindPage(ctx, api, meta.ParentSpace, title)
+	if err != nil {
+		return karma.Format(
+			err,
+			`error during finding parent page with title %q`,
+			title,
+		)
+	}
+
+	if parent == nil {
+		return &ResolveError{
+			Err: fmt.Errorf(
+				"parent page %q is not found in space %q",
+				title,
+				meta.ParentSpace,
+			),
+		}
+	}
+
+	if parent.Space.Key == "" {
+		parent.Space.Key = meta.ParentSpace
+	}
+
+	action := "create"
+	if page != nil {
+		action = "move"
+	}
+
+	return &ResolveError{
+		Err: karma.
+			Describe("page space", meta.Space).
+			Describe("parent space", parent.Space.Key).
+			Format(
+				nil,
+				"unable to %s %s %q under %q: pages are in different spaces",
+				action,
+				meta.Type,
+				meta.Title,
+				parent.Title,
+			),
+	}
+}
+
+// movePage updates page ancestors to point to the given parent if the page is
+// currently located somewhere else, so next page update will move it.
+func movePage(page *confluence.PageInfo, parent *confluence.PageInfo) error {
+	if len(page.Ancestors) > 0 &&
+		page.Ancestors[len(page.Ancestors)-1].Id == parent.ID {
+		return nil
+	}
+
+	if page.Space.Key != "" && parent.Space.Key != "" &&
+		page.Space.Key != parent.Space.Key {
+		return karma.
+			Describe("page space", page.Space.Key).
+			Describe("parent space", parent.Space.Key).
+			Format(
+				nil,
+				"unable to move page %q under %q: pages are in different spaces",
+				page.Title,
+				parent.Title,
+			)
+	}
+
+	current := "<none>"
+	if len(page.Ancestors) > 0 {
+		current = page.Ancestors[len(page.Ancestors)-1].Title
+	}
+
+	log.Infof(
+		nil,
+		"page %q will be moved from %q to %q",
+		page.Title,
+		current,
+		parent.Title,
+	)
+
+	page.Ancestors = append(
+		append([]confluence.PageAncestor{}, parent.Ancestors...),
+		confluence.PageAncestor{
+			Id:    parent.ID,
+			Title: parent.Title,
+		},
+	)
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package mark
+
+import (
+	"testing"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeLabels(t *testing.T) {
+	test := assert.New(t)
+
+	test.Equal(
+		[]string{"api", "docs", "release"},
+		NormalizeLabels(
+			[]string{"release", "Docs", "", " api "},
+			[]string{"docs", "API", "release"},
+		),
+	)
+
+	test.Equal([]string{}, NormalizeLabels(nil, nil))
+}
+
+func TestExcludeLabels(t *testing.T) {
+	test := assert.New(t)
+
+	test.Equal(
+		[]string{"api", "release"},
+		ExcludeLabels(
+			[]string{"api", "docs", "release"},
+			[]string{" Docs ", "draft"},
+		),
+	)
+
+	test.Equal(
+		[]string{"api"},
+		ExcludeLabels([]string{"api"}, nil),
+	)
+}
+
+func TestGetPageChecksumProperties(t *testing.T) {
+	test := assert.New(t)
+
+	page := &confluence.PageInfo{Title: "Page"}
+
+	checksum := GetPageChecksum(page, "body", nil, map[string]string{})
+
+	test.NotEqual(
+		checksum,
+		GetPageChecksum(page, "body", nil, map[string]string{"editor": "v2"}),
+	)
+
+	test.Equal(
+		GetPageChecksum(page, "body", nil, map[string]string{
+			"editor": "v2",
+			"other":  "value",
+		}),
+		GetPageChecksum(page, "body", nil, map[string]string{
+			"other":  "value",
+			"editor": "v2",
+		}),
+	)
+}
+
+func TestGetPageChecksumEmoji(t *testing.T) {
+	test := assert.New(t)
+
+	page := &confluence.PageInfo{Title: "Page"}
+
+	rocket, _ := GetEmojiCode("rocket")
+	fire, _ := GetEmojiCode("fire")
+
+	test.NotEqual(
+		GetPageChecksum(page, "body", nil, map[string]string{
+			PageEmojiProperty: rocket,
+		}),
+		GetPageChecksum(page, "body", nil, map[string]string{
+			PageEmojiProperty: fire,
+		}),
+	)
+}
+
+func TestLockRestrictions(t *testing.T) {
+	test := assert.New(t)
+
+	test.Equal(
+		[]confluence.Restriction{
+			{Operation: "read", Users: []string{"smith"}},
+			{Operation: "update", Users: []string{"smith", "bot"}},
+		},
+		LockRestrictions(
+			[]confluence.Restriction{
+				{Operation: "read", Users: []string{"smith"}},
+				{Operation: "update", Users: []string{"smith"}},
+			},
+			"bot",
+		),
+	)
+
+	test.Equal(
+		[]confluence.Restriction{
+			{Operation: "read", Groups: []string{"team"}},
+			{Operation: "update", Users: []string{"bot"}},
+		},
+		LockRestrictions(
+			[]confluence.Restriction{
+				{Operation: "read", Groups: []string{"team"}},
+			},
+			"bot",
+		),
+	)
+}
@@ -1,8 +1,12 @@
 package mark
 
 import (
+	"bytes"
+	"fmt"
+	"html"
 	"io"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/bonovoxly/mark/pkg/mark/stdlib"
@@ -10,10 +14,156 @@ import (
 	bf "github.com/russross/blackfriday/v2"
 )
 
+var reLeadingH1 = regexp.MustCompile(`^#([^#].*)\n`)
+
+var reCodeParameters = regexp.MustCompile(`\{([^}]*)\}`)
+
+var reAdmonition = regexp.MustCompile(
+	`^\[!(NOTE|TIP|IMPORTANT|WARNING|CAUTION)\][ \t]*(\n|$)`,
+)
+
+// admonitions maps GitHub-style alert types to Confluence box macro names.
+var admonitions = map[string]string{
+	"NOTE":      "info",
+	"TIP":       "tip",
+	"IMPORTANT": "note",
+	"WARNING":   "warning",
+	"CAUTION":   "warning",
+}
+
+// markdownExtensions are extensions of markdown parser which are used for
+// rendering documents.
+const markdownExtensions = bf.NoIntraEmphasis |
+	bf.Tables |
+	bf.FencedCode |
+	bf.Autolink |
+	bf.LaxHTMLBlocks |
+	bf.Strikethrough |
+	bf.SpaceHeadings |
+	bf.HeadingIDs |
+	bf.AutoHeadingIDs |
+	bf.Titleblock |
+	bf.BackslashLineBreak |
+	bf.DefinitionLists |
+	bf.NoEmptyLineBeforeBlock
+
 type ConfluenceRenderer struct {
 	bf.Renderer
 
 	Stdlib *stdlib.Lib
+
+	// AnchorStyle is a style of anchor names which are emitted for every
+	// heading, anchors are not emitted if it's empty.
+	AnchorStyle string
+
+	// DetectLanguage enables guessing language of code blocks which don't
+	// specify it.
+	DetectLanguage bool
+
+	// HTML is a policy of handling raw HTML tags, see sanitizeHTML.
+	HTML string
+
+	// SoftBreaks controls how line breaks inside of paragraphs are rendered.
+	SoftBreaks string
+
+	// RawStorage enables passing through contents of code blocks of
+	// RawStorageLanguage as is.
+	RawStorage bool
+
+	// CollapseCode enables collapsing of code blocks which don't specify it.
+	CollapseCode bool
+
+	// warned contains HTML tags which have been already reported.
+	warned map[string]bool
+
+	// anchors contains names of anchors which have been already emitted.
+	anchors anchorNames
+}
+
+// CompileOptions controls how markdown is rendered into Confluence storage
+// format.
+type CompileOptions struct {
+	// AnchorStyle is one of AnchorStyleGitHub or AnchorStyleConfluence,
+	// anchor macros are not emitted for headings if it's empty.
+	AnchorStyle string
+
+	// Math is one of MathMacro or MathImage, math spans are rendered as
+	// plain text if it's empty.
+	Math string
+
+	// MathImageURL is a URL of service rendering math into images for
+	// MathImage, formula is appended to it escaped as query value, e.g.
+	// https://latex.codecogs.com/png.latex?
+	MathImageURL string
+
+	// DetectLanguage enables guessing language of code blocks which don't
+	// specify it, see DetectLanguage function.
+	DetectLanguage bool
+
+	// HTML is one of HTMLKeep, HTMLWarn or HTMLStrip, it controls how raw
+	// HTML tags which are not valid in Confluence storage format are
+	// handled. Raw HTML is kept as is if it's empty.
+	HTML string
+
+	// SoftBreaks is one of SoftBreaksKeep, SoftBreaksSpace or
+	// SoftBreaksBreak, it controls how single line breaks inside of
+	// paragraphs are rendered. Line breaks are kept as is if it's empty.
+	// Hard breaks, like trailing two spaces, are always rendered as <br />.
+	SoftBreaks string
+
+	// RawStorage enables passing through contents of code blocks with
+	// RawStorageLanguage language as is, so any Confluence macro can be
+	// embedded in storage format. Such code blocks are rendered as usual if
+	// it's disabled.
+	RawStorage bool
+
+	// CollapseCode enables collapsing of code blocks which don't specify it
+	// in info string, like ```go {collapse=false}. It's set by CollapseCode
+	// metadata field.
+	CollapseCode bool
+}
+
+// WithMeta returns options with fields overridden by metadata of the page,
+// metadata takes precedence over command line.
+func (options CompileOptions) WithMeta(meta *Meta) CompileOptions {
+	if meta == nil {
+		return options
+	}
+
+	if meta.CollapseCode != nil {
+		options.CollapseCode = *meta.CollapseCode
+	}
+
+	if meta.HeadingAnchors != "" {
+		options.AnchorStyle = meta.HeadingAnchors
+	}
+
+	return options
+}
+
+// Modes of rendering soft line breaks.
+const (
+	SoftBreaksKeep  = "keep"
+	SoftBreaksSpace = "space"
+	SoftBreaksBreak = "break"
+)
+
+var reSoftBreak = regexp.MustCompile(`[ \t]*\n[ \t]*`)
+
+// ValidateSoftBreaks checks that given soft breaks mode is supported.
+func ValidateSoftBreaks(mode string) error {
+	switch mode {
+	case "", SoftBreaksKeep, SoftBreaksSpace, SoftBreaksBreak:
+		return nil
+	default:
+		return fmt.Errorf(
+			"unknown soft breaks mode %q, expected %s, %s or %s",
+			mode,
+			SoftBreaksKeep,
+			SoftBreaksSpace,
+			SoftBreaksBreak,
+		)
+	}
 }
 
 func ParseLanguage(lang string) string {
@@ -47,44 +197,479 @@ func ParseTitle(lang string) string {
 	return ""
 }
 
+// CodeParameters holds optional code macro parameters which can be specified
+// in code fence info string, e.g.: ```go {linenumbers=true theme=Midnight}.
+type CodeParameters struct {
+	LineNumbers string
+	Theme       string
+
+	// Collapse overrides collapsing of the code block which is set for the
+	// whole document, it's either true, false or empty.
+	Collapse string
+}
+
+// ParseCodeParameters extracts parameters block from code fence info string
+// and returns info string without it. Unknown parameters are ignored.
+func ParseCodeParameters(lang string) (string, CodeParameters) {
+	var parameters CodeParameters
+
+	matches := reCodeParameters.FindStringSubmatch(lang)
+	if matches == nil {
+		return lang, parameters
+	}
+
+	for _, field := range strings.Fields(matches[1]) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			log.Warningf(nil, "invalid code block parameter: %q", field)
+
+			continue
+		}
+
+		switch strings.ToLower(parts[0]) {
+		case "linenumbers":
+			parameters.LineNumbers = parts[1]
+		case "theme":
+			parameters.Theme = parts[1]
+		case "collapse":
+			parameters.Collapse = parts[1]
+		default:
+			log.Warningf(nil, "unknown code block parameter: %q", parts[0])
+		}
+	}
+
+	lang = strings.Join(
+		strings.Fields(reCodeParameters.ReplaceAllString(lang, "")),
+		" ",
+	)
+
+	return lang, parameters
+}
+
+// ImageAttributes holds Confluence image attributes which can be specified
+// in markdown image title, e.g.: ![alt](image.png "width=400 align=center").
+type ImageAttributes struct {
+	Width  string
+	Height string
+	Align  string
+}
+
+// ParseImageAttributes parses image title as a list of key=value pairs.
+// It returns false if title contains anything except known attributes, so
+// such title will be rendered as regular image title.
+func ParseImageAttributes(title string) (ImageAttributes, bool) {
+	var attributes ImageAttributes
+
+	fields := strings.Fields(title)
+	if len(fields) == 0 {
+		return attributes, false
+	}
+
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return ImageAttributes{}, false
+		}
+
+		switch strings.ToLower(parts[0]) {
+		case "width":
+			attributes.Width = parts[1]
+		case "height":
+			attributes.Height = parts[1]
+		case "align":
+			attributes.Align = parts[1]
+		default:
+			return ImageAttributes{}, false
+		}
+	}
+
+	return attributes, true
+}
+
 func (renderer ConfluenceRenderer) RenderNode(
 	writer io.Writer,
 	node *bf.Node,
 	entering bool,
 ) bf.WalkStatus {
 	if node.Type == bf.CodeBlock {
-		lang := string(node.Info)
+		lang, parameters := ParseCodeParameters(string(node.Info))
+
+		language := ParseLanguage(lang)
+		if renderer.RawStorage && language == RawStorageLanguage {
+			return renderer.renderRawStorage(writer, node)
+		}
+
+		language = NormalizeLanguage(language)
+
+		code := string(node.Literal)
+
+		if language == "" || language == "diff" {
+			if stripped, ok := stripDiffShebang(code); ok {
+				code = stripped
+				language = "diff"
+			}
+		}
+
+		if language == "" && renderer.DetectLanguage {
+			language = DetectLanguage(code)
+		}
+
+		collapse := renderer.CollapseCode || strings.Contains(lang, "collapse")
+
+		if parameters.Collapse != "" {
+			value, err := strconv.ParseBool(parameters.Collapse)
+			if err != nil {
+				log.Warningf(
+					nil,
+					"invalid code block parameter: collapse=%q",
+					parameters.Collapse,
+				)
+			} else {
+				collapse = value
+			}
+		}
 
 		renderer.Stdlib.Templates.ExecuteTemplate(
 			writer,
 			"ac:code",
 			struct {
-				Language string
-				Collapse bool
-				Title    string
-				Text     string
+				Language    string
+				Collapse    bool
+				Title       string
+				LineNumbers string
+				Theme       string
+				Text        string
 			}{
-				ParseLanguage(lang),
-				strings.Contains(lang, "collapse"),
+				language,
+				collapse,
 				ParseTitle(lang),
-				strings.TrimSuffix(string(node.Literal), "\n"),
+				parameters.LineNumbers,
+				parameters.Theme,
+				strings.TrimSuffix(code, "\n"),
 			},
 		)
 
 		return bf.GoToNext
 	}
+
+	if node.Type == bf.Heading && entering && renderer.AnchorStyle != "" {
+		status := renderer.Renderer.RenderNode(writer, node, entering)
+
+		name, err := Slugify(getHeadingText(node), renderer.AnchorStyle)
+		if err != nil {
+			log.Error(err)
+
+			return status
+		}
+
+		name = renderer.anchors.unique(name)
+
+		renderer.Stdlib.Templates.ExecuteTemplate(
+			writer,
+			"ac:anchor",
+			struct {
+				Name string
+			}{
+				html.EscapeString(name),
+			},
+		)
+
+		return status
+	}
+
+	if node.Type == bf.Text && bytes.Contains(node.Literal, []byte("\n")) {
+		switch renderer.SoftBreaks {
+		case SoftBreaksSpace:
+			node.Literal = reSoftBreak.ReplaceAll(node.Literal, []byte(" "))
+
+		case SoftBreaksBreak:
+			return renderer.renderSoftBreaks(writer, node)
+		}
+	}
+
+	if node.Type == bf.HTMLBlock || node.Type == bf.HTMLSpan {
+		node.Literal = sanitizeHTML(node.Literal, renderer.HTML, renderer.warned)
+	}
+
+	if node.Type == bf.TableCell && entering && node.Align != 0 {
+		return renderer.renderTableCell(writer, node, entering)
+	}
+
+	if node.Type == bf.List && entering && isTaskList(node) {
+		return renderer.renderTaskList(writer, node)
+	}
+
+	if node.Type == bf.BlockQuote && entering {
+		if renderer.renderAdmonitions(writer, node) {
+			return bf.SkipChildren
+		}
+	}
+
+	if node.Type == bf.Image && entering {
+		attributes, ok := ParseImageAttributes(string(node.LinkData.Title))
+		if ok {
+			var alt bytes.Buffer
+
+			node.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+				if entering {
+					alt.Write(node.Literal)
+				}
+
+				return bf.GoToNext
+			})
+
+			renderer.Stdlib.Templates.ExecuteTemplate(
+				writer,
+				"ac:image",
+				struct {
+					Width  string
+					Height string
+					Align  string
+					Alt    string
+					URL    string
+				}{
+					html.EscapeString(attributes.Width),
+					html.EscapeString(attributes.Height),
+					html.EscapeString(attributes.Align),
+					html.EscapeString(alt.String()),
+					html.EscapeString(string(node.LinkData.Destination)),
+				},
+			)
+
+			return bf.SkipChildren
+		}
+	}
+
 	return renderer.Renderer.RenderNode(writer, node, entering)
 }
 
+// renderSoftBreaks renders text with every line break replaced with <br />,
+// lines are rendered as usual text.
+func (renderer ConfluenceRenderer) renderSoftBreaks(
+	writer io.Writer,
+	node *bf.Node,
+) bf.WalkStatus {
+	literal := node.Literal
+
+	for i, line := range reSoftBreak.Split(string(literal), -1) {
+		if i > 0 {
+			io.WriteString(writer, "<br />\n")
+		}
+
+		node.Literal = []byte(line)
+
+		renderer.Renderer.RenderNode(writer, node, true)
+	}
+
+	node.Literal = literal
+
+	return bf.GoToNext
+}
+
+// renderTableCell renders table cell with column alignment specified as
+// text-align style, because Confluence ignores align attribute.
+func (renderer ConfluenceRenderer) renderTableCell(
+	writer io.Writer,
+	node *bf.Node,
+	entering bool,
+) bf.WalkStatus {
+	var align string
+
+	switch node.Align {
+	case bf.TableAlignmentLeft:
+		align = "left"
+	case bf.TableAlignmentRight:
+		align = "right"
+	case bf.TableAlignmentCenter:
+		align = "center"
+	}
+
+	tag := "td"
+	if node.IsHeader {
+		tag = "th"
+	}
+
+	flags := node.Align
+	node.Align = 0
+
+	var buffer bytes.Buffer
+
+	status := renderer.Renderer.RenderNode(&buffer, node, entering)
+
+	node.Align = flags
+
+	writer.Write(
+		bytes.Replace(
+			buffer.Bytes(),
+			[]byte("<"+tag+">"),
+			[]byte("<"+tag+` style="text-align: `+align+`;">`),
+			1,
+		),
+	)
+
+	return status
+}
+
+// renderAdmonitions renders blockquote which contains GitHub-style alert
+// markers like [!NOTE] as Confluence boxes and [!PANEL] markers as panels.
+// Since consecutive blockquotes are merged by the markdown parser, every
+// paragraph starting with the marker begins a new box. It returns false if
+// blockquote contains no markers.
+func (renderer ConfluenceRenderer) renderAdmonitions(
+	writer io.Writer,
+	node *bf.Node,
+) bool {
+	type admonition struct {
+		name   string
+		params string
+		nodes  []*bf.Node
+	}
+
+	var (
+		groups = []admonition{{}}
+		found  bool
+	)
+
+	for child := node.FirstChild; child != nil; child = child.Next {
+		name, params, ok := parseAdmonition(child)
+		if ok {
+			found = true
+			groups = append(
+				groups,
+				admonition{name: name, params: params},
+			)
+		}
+
+		// paragraph which contains only the marker is skipped
+		if child.Type == bf.Paragraph && child.FirstChild == nil {
+			continue
+		}
+
+		groups[len(groups)-1].nodes = append(
+			groups[len(groups)-1].nodes,
+			child,
+		)
+	}
+
+	if !found {
+		return false
+	}
+
+	for _, group := range groups {
+		var body bytes.Buffer
+
+		for _, child := range group.nodes {
+			child.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+				return renderer.RenderNode(&body, node, entering)
+			})
+		}
+
+		if group.name == "" {
+			if len(group.nodes) > 0 {
+				io.WriteString(
+					writer,
+					"<blockquote>\n"+
+						strings.Trim(body.String(), "\n")+
+						"\n</blockquote>\n",
+				)
+			}
+
+			continue
+		}
+
+		if group.name == panelName {
+			panel, err := parsePanel(group.params)
+			if err != nil {
+				log.Errorf(
+					err,
+					"unable to parse panel parameters: %s",
+					group.params,
+				)
+			}
+
+			panel.Body = strings.Trim(body.String(), "\n")
+
+			renderer.Stdlib.Templates.ExecuteTemplate(writer, "ac:panel", panel)
+
+			continue
+		}
+
+		renderer.Stdlib.Templates.ExecuteTemplate(
+			writer,
+			"ac:box",
+			struct {
+				Name  string
+				Icon  string
+				Title string
+				Body  string
+			}{
+				group.name,
+				"true",
+				"",
+				strings.Trim(body.String(), "\n"),
+			},
+		)
+	}
+
+	return true
+}
+
+// parseAdmonition checks if paragraph starts with GitHub-style alert marker
+// like [!NOTE] and returns corresponding Confluence box macro name, or with
+// panel marker like [!PANEL bg=#fef3c7] and returns panelName along with its
+// parameters. The marker is removed from the paragraph contents.
+func parseAdmonition(paragraph *bf.Node) (string, string, bool) {
+	if paragraph.Type != bf.Paragraph {
+		return "", "", false
+	}
+
+	text := paragraph.FirstChild
+	if text == nil || text.Type != bf.Text {
+		return "", "", false
+	}
+
+	var name, params string
+
+	if matches := reAdmonition.FindSubmatch(text.Literal); matches != nil {
+		name = admonitions[string(matches[1])]
+
+		text.Literal = text.Literal[len(matches[0]):]
+	} else if matches := rePanel.FindSubmatch(text.Literal); matches != nil {
+		name = panelName
+		params = string(matches[1])
+
+		text.Literal = text.Literal[len(matches[0]):]
+	} else {
+		return "", "", false
+	}
+
+	if len(text.Literal) == 0 {
+		text.Unlink()
+	}
+
+	return name, params, true
+}
+
 // compileMarkdown will replace tags like <ac:rich-tech-body> with escaped
 // equivalent, because bf markdown parser replaces that tags with
 // <a href="ac:rich-text-body">ac:rich-text-body</a> for whatever reason.
 func CompileMarkdown(
 	markdown []byte,
 	stdlib *stdlib.Lib,
+	options CompileOptions,
 ) string {
 	log.Tracef(nil, "rendering markdown:\n%s", string(markdown))
 
+	// markers are extracted before tags are escaped, since template name
+	// contains colon; unbalanced markers are reported by Prepare, they are
+	// kept as is here
+	var blocks []block
+	if extracted, found, err := extractBlocks(markdown); err == nil {
+		markdown, blocks = extracted, found
+	}
+
+	markdown, codes := normalizeLists(markdown)
+
 	colon := regexp.MustCompile(`---bf-COLON---`)
 
 	tags := regexp.MustCompile(`<(/?\S+?):(\S+?)>`)
@@ -94,6 +679,11 @@ func CompileMarkdown(
 		[]byte(`<$1`+colon.String()+`$2>`),
 	)
 
+	var math []mathSpan
+	if options.Math != "" {
+		markdown, math = extractMath(markdown)
+	}
+
 	renderer := ConfluenceRenderer{
 		Renderer: bf.NewHTMLRenderer(
 			bf.HTMLRendererParameters{
@@ -105,31 +695,47 @@ func CompileMarkdown(
 			},
 		),
 
-		Stdlib: stdlib,
+		Stdlib:         stdlib,
+		AnchorStyle:    options.AnchorStyle,
+		DetectLanguage: options.DetectLanguage,
+		HTML:           options.HTML,
+		SoftBreaks:     options.SoftBreaks,
+		RawStorage:     options.RawStorage,
+		CollapseCode:   options.CollapseCode,
+		warned:         map[string]bool{},
+		anchors:        anchorNames{},
 	}
 
-	html := bf.Run(
-		markdown,
-		bf.WithRenderer(renderer),
-		bf.WithExtensions(
-			bf.NoIntraEmphasis|
-				bf.Tables|
-				bf.FencedCode|
-				bf.Autolink|
-				bf.LaxHTMLBlocks|
-				bf.Strikethrough|
-				bf.SpaceHeadings|
-				bf.HeadingIDs|
-				bf.AutoHeadingIDs|
-				bf.Titleblock|
-				bf.BackslashLineBreak|
-				bf.DefinitionLists|
-				bf.NoEmptyLineBeforeBlock,
-		),
-	)
+	render := func(markdown []byte) []byte {
+		return bf.Run(
+			markdown,
+			bf.WithRenderer(renderer),
+			bf.WithExtensions(markdownExtensions),
+		)
+	}
+
+	html := render(markdown)
+
+	if len(codes) > 0 {
+		html = compileListCodes(html, codes, render)
+	}
 
 	html = colon.ReplaceAll(html, []byte(`:`))
 
+	if len(math) > 0 {
+		html = compileMath(
+			html,
+			math,
+			options.Math,
+			options.MathImageURL,
+			stdlib,
+		)
+	}
+
+	if len(blocks) > 0 {
+		html = compileBlocks(html, blocks, stdlib)
+	}
+
 	log.Tracef(nil, "rendered markdown to html:\n%s", string(html))
 
 	return string(html)
@@ -142,7 +748,111 @@ func CompileMarkdown(
 func DropDocumentLeadingH1(
 	markdown []byte,
 ) []byte {
-	h1 := regexp.MustCompile(`^#[^#].*\n`)
-	markdown = h1.ReplaceAll(markdown, []byte(""))
+	return TransformLeadingHeading(markdown, LeadingHeading{
+		Action: LeadingHeadingDrop,
+		Level:  1,
+	})
+}
+
+// ExtractDocumentLeadingH1 returns text of the leading H1 heading or empty
+// string if document doesn't start with H1 heading.
+func ExtractDocumentLeadingH1(
+	markdown []byte,
+) string {
+	return ExtractLeadingHeading(markdown, 1)
+}
+
+const (
+	// LeadingHeadingKeep keeps leading heading as is.
+	LeadingHeadingKeep = `keep`
+
+	// LeadingHeadingDrop removes leading heading from the document.
+	LeadingHeadingDrop = `drop`
+
+	// LeadingHeadingDemote increases level of leading heading by one, e.g.
+	// H1 becomes H2.
+	LeadingHeadingDemote = `demote`
+)
+
+// LeadingHeading describes how heading which document starts with is
+// transformed. Only heading of specified level is transformed.
+type LeadingHeading struct {
+	Action string
+	Level  int
+}
+
+// ValidateLeadingHeading checks that action is known and level is between 1
+// and 6.
+func ValidateLeadingHeading(heading LeadingHeading) error {
+	switch heading.Action {
+	case LeadingHeadingKeep, LeadingHeadingDrop, LeadingHeadingDemote:
+	default:
+		return fmt.Errorf(
+			"unknown leading heading action %q, expected %s, %s or %s",
+			heading.Action,
+			LeadingHeadingKeep,
+			LeadingHeadingDrop,
+			LeadingHeadingDemote,
+		)
+	}
+
+	if heading.Level < 1 || heading.Level > 6 {
+		return fmt.Errorf(
+			"invalid heading level %d, expected 1 to 6",
+			heading.Level,
+		)
+	}
+
+	return nil
+}
+
+func getLeadingHeadingRegexp(level int) *regexp.Regexp {
+	if level == 1 {
+		return reLeadingH1
+	}
+
+	return regexp.MustCompile(fmt.Sprintf(`^#{%d}([^#].*)\n`, level))
+}
+
+// TransformLeadingHeading applies given transformation to the heading which
+// document starts with, document is returned as is if it starts with heading
+// of other level or doesn't start with heading at all.
+func TransformLeadingHeading(
+	markdown []byte,
+	heading LeadingHeading,
+) []byte {
+	switch heading.Action {
+	case LeadingHeadingDrop:
+		return getLeadingHeadingRegexp(heading.Level).ReplaceAll(
+			markdown,
+			[]byte(""),
+		)
+
+	case LeadingHeadingDemote:
+		// there is no level deeper than H6
+		if heading.Level >= 6 {
+			return markdown
+		}
+
+		return getLeadingHeadingRegexp(heading.Level).ReplaceAll(
+			markdown,
+			[]byte(strings.Repeat("#", heading.Level+1)+"$1\n"),
+		)
+	}
+
 	return markdown
 }
+
+// ExtractLeadingHeading returns text of the leading heading of specified level
+// or empty string if document doesn't start with such heading.
+func ExtractLeadingHeading(
+	markdown []byte,
+	level int,
+) string {
+	matches := getLeadingHeadingRegexp(level).FindSubmatch(markdown)
+	if matches == nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(matches[1]))
+}
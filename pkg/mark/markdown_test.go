@@ -1,6 +1,7 @@
 package mark
 
 import (
+	"context"
 	"io/ioutil"
 	"path/filepath"
 	"strings"
@@ -19,9 +20,196 @@ func text(lines ...string) string {
 }
 
 func TestCompileMarkdown(t *testing.T) {
+	testCompileMarkdown(t, "testdata/*.md", "", CompileOptions{})
+}
+
+func TestCompileMarkdownAnchors(t *testing.T) {
+	testCompileMarkdown(
+		t,
+		"testdata/anchors/*.md",
+		".github",
+		CompileOptions{AnchorStyle: AnchorStyleGitHub},
+	)
+
+	testCompileMarkdown(
+		t,
+		"testdata/anchors/*.md",
+		".confluence",
+		CompileOptions{AnchorStyle: AnchorStyleConfluence},
+	)
+
+	testCompileMarkdown(
+		t,
+		"testdata/anchors/*.md",
+		".ascii",
+		CompileOptions{AnchorStyle: AnchorStyleASCII},
+	)
+}
+
+func TestCompileMarkdownMath(t *testing.T) {
+	testCompileMarkdown(
+		t,
+		"testdata/math/*.md",
+		".macro",
+		CompileOptions{Math: MathMacro},
+	)
+
+	testCompileMarkdown(
+		t,
+		"testdata/math/*.md",
+		".image",
+		CompileOptions{
+			Math:         MathImage,
+			MathImageURL: "https://latex.codecogs.com/png.latex?",
+		},
+	)
+}
+
+func TestCompileMarkdownHTML(t *testing.T) {
+	testCompileMarkdown(
+		t,
+		"testdata/html/*.md",
+		".warn",
+		CompileOptions{HTML: HTMLWarn},
+	)
+
+	testCompileMarkdown(
+		t,
+		"testdata/html/*.md",
+		".strip",
+		CompileOptions{HTML: HTMLStrip},
+	)
+}
+
+func TestCompileMarkdownSoftBreaks(t *testing.T) {
+	testCompileMarkdown(
+		t,
+		"testdata/breaks/*.md",
+		".keep",
+		CompileOptions{SoftBreaks: SoftBreaksKeep},
+	)
+
+	testCompileMarkdown(
+		t,
+		"testdata/breaks/*.md",
+		".space",
+		CompileOptions{SoftBreaks: SoftBreaksSpace},
+	)
+
+	testCompileMarkdown(
+		t,
+		"testdata/breaks/*.md",
+		".break",
+		CompileOptions{SoftBreaks: SoftBreaksBreak},
+	)
+}
+
+func TestCompileMarkdownRawStorage(t *testing.T) {
+	testCompileMarkdown(
+		t,
+		"testdata/storage/*.md",
+		".code",
+		CompileOptions{},
+	)
+
+	testCompileMarkdown(
+		t,
+		"testdata/storage/*.md",
+		".raw",
+		CompileOptions{RawStorage: true},
+	)
+}
+
+func TestCompileMarkdownBlockquotes(t *testing.T) {
+	testCompileMarkdown(t, "testdata/quotes/*.md", "", CompileOptions{})
+
+	goldens, err := filepath.Glob("testdata/quotes/*.html")
+	if err != nil {
+		panic(err)
+	}
+
+	// quotes nested into lists and boxes are well-formed storage format
+	for _, golden := range goldens {
+		html, err := ioutil.ReadFile(golden)
+		if err != nil {
+			panic(err)
+		}
+
+		assert.NoError(t, validateStorage(html), golden)
+	}
+}
+
+func TestCompileMarkdownDiff(t *testing.T) {
+	testCompileMarkdown(t, "testdata/diff/*.md", "", CompileOptions{})
+}
+
+func TestCompileMarkdownTasks(t *testing.T) {
+	testCompileMarkdown(t, "testdata/tasks/*.md", "", CompileOptions{})
+
+	html, err := ioutil.ReadFile("testdata/tasks/tasks.html")
+	if err != nil {
+		panic(err)
+	}
+
+	assert.NoError(t, validateStorage(html))
+}
+
+func TestCompileMarkdownPanels(t *testing.T) {
+	testCompileMarkdown(t, "testdata/panels/*.md", "", CompileOptions{})
+
+	html, err := ioutil.ReadFile("testdata/panels/panels.html")
+	if err != nil {
+		panic(err)
+	}
+
+	assert.NoError(t, validateStorage(html))
+}
+
+func TestParsePanel(t *testing.T) {
 	test := assert.New(t)
 
-	testcases, err := filepath.Glob("testdata/*.md")
+	panel, err := parsePanel(`BG=#FFF borderColor=#f59e0b emoji=:rocket:`)
+	test.NoError(err)
+	test.Equal("#FFF", panel.BgColor)
+	test.Equal("#f59e0b", panel.BorderColor)
+	test.Equal("rocket", panel.Emoji)
+	test.Equal("1f680", panel.EmojiID)
+	test.Equal("🚀", panel.EmojiText)
+
+	_, err = parsePanel(`bg=red`)
+	if test.Error(err) {
+		test.Contains(err.Error(), `invalid color "red"`)
+	}
+
+	_, err = parsePanel(`emoji=unicorn_face`)
+	if test.Error(err) {
+		test.Contains(err.Error(), `unknown emoji shortname "unicorn_face"`)
+	}
+
+	_, err = parsePanel(`color=#fff`)
+	if test.Error(err) {
+		test.Contains(err.Error(), `unknown panel parameter "color"`)
+	}
+}
+
+func TestValidateStorage(t *testing.T) {
+	test := assert.New(t)
+
+	test.NoError(validateStorage([]byte(
+		`<ac:structured-macro ac:name="toc" /><p>a&nbsp;b</p>`,
+	)))
+	test.Error(validateStorage([]byte(`<p>unclosed <b>paragraph</p>`)))
+}
+
+func testCompileMarkdown(
+	t *testing.T,
+	pattern string,
+	suffix string,
+	options CompileOptions,
+) {
+	test := assert.New(t)
+
+	testcases, err := filepath.Glob(pattern)
 	if err != nil {
 		panic(err)
 	}
@@ -29,7 +217,10 @@ func TestCompileMarkdown(t *testing.T) {
 	for _, filename := range testcases {
 		basename := filepath.Base(filename)
 		testname := strings.TrimSuffix(basename, ".md")
-		htmlname := filepath.Join(filepath.Dir(filename), testname+".html")
+		htmlname := filepath.Join(
+			filepath.Dir(filename),
+			testname+suffix+".html",
+		)
 
 		markdown, err := ioutil.ReadFile(filename)
 		if err != nil {
@@ -40,11 +231,129 @@ func TestCompileMarkdown(t *testing.T) {
 			panic(err)
 		}
 
-		lib, err := stdlib.New(nil)
+		lib, err := stdlib.New(context.Background(), nil)
 		if err != nil {
 			panic(err)
 		}
-		actual := CompileMarkdown(markdown, lib)
+		actual := CompileMarkdown(markdown, lib, options)
 		test.EqualValues(string(html), actual, filename+" vs "+htmlname)
 	}
 }
+
+func TestSlugify(t *testing.T) {
+	test := assert.New(t)
+
+	slug, err := Slugify("Hello, World!", AnchorStyleGitHub)
+	test.NoError(err)
+	test.Equal("hello-world", slug)
+
+	slug, err = Slugify("Release v7.1 (22 Feb 2018)", AnchorStyleGitHub)
+	test.NoError(err)
+	test.Equal("release-v71-22-feb-2018", slug)
+
+	slug, err = Slugify("snake_case and-dashes", AnchorStyleGitHub)
+	test.NoError(err)
+	test.Equal("snake_case-and-dashes", slug)
+
+	slug, err = Slugify("Hello, World!", AnchorStyleConfluence)
+	test.NoError(err)
+	test.Equal("Hello,World!", slug)
+
+	// decomposed letters keep their diacritics
+	slug, err = Slugify("Mu\u0308ller", AnchorStyleGitHub)
+	test.NoError(err)
+	test.Equal("mu\u0308ller", slug)
+
+	slug, err = Slugify("Mu\u0308ller und Gau\u00dfe", AnchorStyleASCII)
+	test.NoError(err)
+	test.Equal("mueller-und-gausse", slug)
+
+	slug, err = Slugify("Crème brûlée", AnchorStyleASCII)
+	test.NoError(err)
+	test.Equal("creme-brulee", slug)
+
+	slug, err = Slugify("日本語 FAQ", AnchorStyleASCII)
+	test.NoError(err)
+	test.Equal("u65e5u672cu8a9e-faq", slug)
+
+	_, err = Slugify("Hello", "unknown")
+	test.Error(err)
+}
+
+func TestParseImageAttributes(t *testing.T) {
+	test := assert.New(t)
+
+	attributes, ok := ParseImageAttributes("width=400 align=center")
+	test.True(ok)
+	test.Equal(ImageAttributes{Width: "400", Align: "center"}, attributes)
+
+	attributes, ok = ParseImageAttributes("height=200 width=100 align=right")
+	test.True(ok)
+	test.Equal(
+		ImageAttributes{Width: "100", Height: "200", Align: "right"},
+		attributes,
+	)
+
+	_, ok = ParseImageAttributes("")
+	test.False(ok)
+
+	_, ok = ParseImageAttributes("Just a title")
+	test.False(ok)
+
+	_, ok = ParseImageAttributes("width=400 border=1")
+	test.False(ok)
+
+	_, ok = ParseImageAttributes("width=")
+	test.False(ok)
+}
+
+func TestTransformLeadingHeading(t *testing.T) {
+	test := assert.New(t)
+
+	markdown := []byte(text("## Overview", "Text", "## Details", ""))
+
+	testcases := []struct {
+		heading  LeadingHeading
+		expected string
+	}{
+		{
+			heading:  LeadingHeading{Action: LeadingHeadingKeep, Level: 2},
+			expected: text("## Overview", "Text", "## Details", ""),
+		},
+		{
+			heading:  LeadingHeading{Action: LeadingHeadingDrop, Level: 2},
+			expected: text("Text", "## Details", ""),
+		},
+		{
+			heading:  LeadingHeading{Action: LeadingHeadingDemote, Level: 2},
+			expected: text("### Overview", "Text", "## Details", ""),
+		},
+		{
+			heading:  LeadingHeading{Action: LeadingHeadingDrop, Level: 1},
+			expected: text("## Overview", "Text", "## Details", ""),
+		},
+	}
+
+	for _, testcase := range testcases {
+		test.Equal(
+			testcase.expected,
+			string(TransformLeadingHeading(markdown, testcase.heading)),
+			"%+v",
+			testcase.heading,
+		)
+	}
+
+	test.Equal(
+		"###### Deep\n",
+		string(TransformLeadingHeading(
+			[]byte("###### Deep\n"),
+			LeadingHeading{Action: LeadingHeadingDemote, Level: 6},
+		)),
+	)
+
+	test.Equal("Overview", ExtractLeadingHeading(markdown, 2))
+	test.Equal("", ExtractLeadingHeading(markdown, 1))
+
+	test.Error(ValidateLeadingHeading(LeadingHeading{Action: "drop", Level: 7}))
+	test.Error(ValidateLeadingHeading(LeadingHeading{Action: "move", Level: 1}))
+}
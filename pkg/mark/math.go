@@ -0,0 +1,189 @@
+package mark
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bonovoxly/mark/pkg/mark/fence"
+	"github.com/bonovoxly/mark/pkg/mark/stdlib"
+	"github.com/reconquest/pkg/log"
+)
+
+const (
+	// MathMacro renders math using LaTeX macros of Confluence math plugin.
+	MathMacro = `macro`
+
+	// MathImage renders math as images generated by external service, which
+	// URL is specified explicitly, since formulas are sent to it.
+	MathImage = `image`
+)
+
+type mathSpan struct {
+	token string
+	tex   string
+	block bool
+}
+
+var (
+	reMathInline = regexp.MustCompile(`(^|[^\\$])\$([^\s$](?:[^$\n]*[^\s\\$])?)\$([^0-9$]|$)`)
+	reMathBlock  = regexp.MustCompile(`^\s*\$\$(.*?)\$\$\s*$`)
+)
+
+// ValidateMath checks that given math strategy is supported and that URL of
+// the image renderer is specified for MathImage.
+func ValidateMath(strategy string, imageURL string) error {
+	switch strategy {
+	case "", MathMacro:
+		return nil
+	case MathImage:
+		if imageURL == "" {
+			return fmt.Errorf(
+				"URL of service rendering math into images is not "+
+					"specified, it's required for %s math strategy",
+				MathImage,
+			)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf(
+			"unknown math strategy %q, expected %s or %s",
+			strategy,
+			MathMacro,
+			MathImage,
+		)
+	}
+}
+
+// extractMath replaces $...$ and $$...$$ math spans outside of code with
+// placeholder tokens, so markdown renderer doesn't mangle them.
+func extractMath(markdown []byte) ([]byte, []mathSpan) {
+	var (
+		spans  []mathSpan
+		result []string
+		fences fence.Scanner
+		block  *mathSpan
+		lines  = strings.Split(string(markdown), "\n")
+	)
+
+	token := func() string {
+		return fmt.Sprintf("MARKMATHSPAN%dEND", len(spans))
+	}
+
+	for _, line := range lines {
+		if block != nil {
+			trimmed := strings.TrimSpace(line)
+			if strings.HasSuffix(trimmed, "$$") {
+				block.tex += "\n" + strings.TrimSuffix(trimmed, "$$")
+				block.tex = strings.TrimSpace(block.tex)
+				spans = append(spans, *block)
+				result = append(result, block.token)
+				block = nil
+			} else {
+				block.tex += "\n" + line
+			}
+
+			continue
+		}
+
+		if fences.Scan(line) {
+			result = append(result, line)
+			continue
+		}
+
+		if matches := reMathBlock.FindStringSubmatch(line); matches != nil {
+			spans = append(spans, mathSpan{
+				token: token(),
+				tex:   strings.TrimSpace(matches[1]),
+				block: true,
+			})
+			result = append(result, spans[len(spans)-1].token)
+
+			continue
+		}
+
+		if strings.TrimSpace(line) == "$$" {
+			block = &mathSpan{token: token(), block: true}
+			continue
+		}
+
+		// inline code spans are kept as is
+		parts := strings.Split(line, "`")
+		for i := 0; i < len(parts); i += 2 {
+			parts[i] = reMathInline.ReplaceAllStringFunc(
+				parts[i],
+				func(match string) string {
+					groups := reMathInline.FindStringSubmatch(match)
+
+					span := mathSpan{token: token(), tex: groups[2]}
+					spans = append(spans, span)
+
+					return groups[1] + span.token + groups[3]
+				},
+			)
+		}
+
+		result = append(result, strings.Join(parts, "`"))
+	}
+
+	if block != nil {
+		// unterminated block is kept as is
+		result = append(result, "$$"+block.tex)
+	}
+
+	return []byte(strings.Join(result, "\n")), spans
+}
+
+// compileMath replaces math placeholders in rendered html with Confluence
+// storage format according to given strategy.
+func compileMath(
+	html []byte,
+	spans []mathSpan,
+	strategy string,
+	imageURL string,
+	lib *stdlib.Lib,
+) []byte {
+	for _, span := range spans {
+		name := "ac:math:inline"
+		from := []byte(span.token)
+
+		if span.block {
+			name = "ac:math:block"
+
+			paragraph := []byte("<p>" + span.token + "</p>")
+			if bytes.Contains(html, paragraph) {
+				from = paragraph
+			}
+		}
+
+		if strategy == MathImage {
+			name = "ac:math:image"
+		}
+
+		var buffer bytes.Buffer
+
+		err := lib.Templates.ExecuteTemplate(
+			&buffer,
+			name,
+			struct {
+				Body  string
+				Block bool
+				URL   string
+			}{
+				Body:  span.tex,
+				Block: span.block,
+				URL:   imageURL,
+			},
+		)
+		if err != nil {
+			log.Errorf(err, "unable to render math: %s", span.tex)
+			continue
+		}
+
+		html = bytes.Replace(html, from, buffer.Bytes(), 1)
+	}
+
+	return html
+}
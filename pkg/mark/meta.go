@@ -5,9 +5,13 @@ import (
 	"bytes"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 
+	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/reconquest/karma-go"
 	"github.com/reconquest/pkg/log"
+	"gopkg.in/yaml.v2"
 )
 
 const (
@@ -19,24 +23,307 @@ const (
 	HeaderAttachment = `Attachment`
 	HeaderLabel      = `Label`
 	HeaderInclude    = `Include`
+	HeaderBlock      = `Block`
+	HeaderMinorEdit  = `MinorEdit`
+	HeaderMessage    = `Message`
+	HeaderMirror     = `Mirror`
+	HeaderEditor     = `Editor`
+	HeaderEmoji      = `Emoji`
+
+	HeaderCollapseCode   = `CollapseCode`
+	HeaderUserScheme     = `UserScheme`
+	HeaderMinVersion     = `MinVersion`
+	HeaderHeadingAnchors = `HeadingAnchors`
+	HeaderParentSpace    = `ParentSpace`
+
+	HeaderRestrictView = `RestrictView`
+	HeaderRestrictEdit = `RestrictEdit`
 )
 
+// RestrictionGroupPrefix marks restriction entries which are group names
+// rather than user names.
+const RestrictionGroupPrefix = `group:`
+
+// AttachmentCommentSeparator separates attachment path from its comment in
+// Attachment header, e.g. "images/arch.png | Architecture overview".
+const AttachmentCommentSeparator = `|`
+
+// Editors lists values of the editor content property which are accepted by
+// Confluence: v2 is the new editor and v1 is the legacy one.
+var Editors = []string{"v2", "v1"}
+
+// ValidateEditor returns error if given editor version is not known.
+func ValidateEditor(editor string) error {
+	for _, known := range Editors {
+		if editor == known {
+			return nil
+		}
+	}
+
+	return fmt.Errorf(
+		"unknown editor %q, expected one of: %s",
+		editor,
+		strings.Join(Editors, ", "),
+	)
+}
+
+// UserSchemes lists attributes which users can be linked by: account ids are
+// used by Confluence Cloud, usernames and user keys by Confluence Server/Data
+// Center.
+var UserSchemes = []string{
+	string(confluence.UserAccountID),
+	string(confluence.UserName),
+	string(confluence.UserKey),
+}
+
+// ValidateUserScheme returns error if given user scheme is not known.
+func ValidateUserScheme(scheme string) error {
+	for _, known := range UserSchemes {
+		if scheme == known {
+			return nil
+		}
+	}
+
+	return fmt.Errorf(
+		"unknown user scheme %q, expected one of: %s",
+		scheme,
+		strings.Join(UserSchemes, ", "),
+	)
+}
+
+// Layouts are layouts of the page which are supported by ac:layout template.
+var Layouts = []string{
+	"article",
+	"plain",
+	"single",
+	"two_equal",
+	"two_left_sidebar",
+	"two_right_sidebar",
+	"three_equal",
+	"three_with_sidebars",
+}
+
+// ValidateLayout returns error if given layout is not known.
+func ValidateLayout(layout string) error {
+	for _, known := range Layouts {
+		if layout == known {
+			return nil
+		}
+	}
+
+	return fmt.Errorf(
+		"unknown layout %q, expected one of: %s",
+		layout,
+		strings.Join(Layouts, ", "),
+	)
+}
+
 type Meta struct {
-	Parents     []string
-	Space       string
-	Type        string
-	Title       string
-	Layout      string
-	Attachments map[string]string
-	Labels      []string
+	Parents     []string          `json:"parents"`
+	Space       string            `json:"space"`
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	Layout      string            `json:"layout"`
+	Attachments map[string]string `json:"attachments"`
+	Labels      []string          `json:"labels"`
+	MinorEdit   *bool             `json:"minor_edit"`
+	Message     string            `json:"message"`
+
+	// AttachmentComments maps attachment path to the comment which is sent
+	// as attachment version comment.
+	AttachmentComments map[string]string `json:"attachment_comments,omitempty"`
+
+	// ParentSpace is a space key of the parents if it's specified and
+	// differs from the Space, it's empty if parents are in the Space.
+	ParentSpace string `json:"parent_space,omitempty"`
+
+	// Mirrors is a list of additional space keys where the page is published
+	// along with the Space.
+	Mirrors []string `json:"mirrors"`
+
+	// Restrictions lists users and groups which are allowed to view and edit
+	// the page, page is not restricted if they are empty.
+	Restrictions Restrictions `json:"restrictions"`
+
+	// Editor is the editor version page should be opened in, editor of
+	// the page is left unchanged if it is empty.
+	Editor string `json:"editor"`
+
+	// Emoji is a shortname of the emoji shown next to the page title, see
+	// Emojis, emoji of the page is left unchanged if it is empty.
+	Emoji string `json:"emoji"`
+
+	// CollapseCode sets whether code blocks which don't specify it are
+	// collapsed, default of command line is used if it's nil.
+	CollapseCode *bool `json:"collapse_code"`
+
+	// UserScheme is an attribute which mentioned users are linked by, see
+	// UserSchemes, default of command line is used if it's empty.
+	UserScheme string `json:"user_scheme"`
+
+	// MinVersion is the version of the page which file is based on, page
+	// isn't updated if it has a newer version than this one and the version
+	// published by mark last time. It's not checked if it's zero.
+	MinVersion int64 `json:"min_version,omitempty"`
+
+	// HeadingAnchors is a style of anchor names emitted for headings, see
+	// Slugify, default of command line is used if it's empty.
+	HeadingAnchors string `json:"heading_anchors,omitempty"`
+}
+
+// Restrictions lists users and groups which are allowed to view and edit the
+// page. Groups are prefixed with RestrictionGroupPrefix.
+type Restrictions struct {
+	View []string `json:"view" yaml:"view"`
+	Edit []string `json:"edit" yaml:"edit"`
+}
+
+// frontMatter describes YAML front-matter which can be used instead of
+// comment-based headers.
+type frontMatter struct {
+	Space       string   `yaml:"space"`
+	Type        string   `yaml:"type"`
+	Title       string   `yaml:"title"`
+	Layout      string   `yaml:"layout"`
+	Parents     []string `yaml:"parents"`
+	ParentSpace string   `yaml:"parent_space"`
+	Attachments []string `yaml:"attachments"`
+	Labels      []string `yaml:"labels"`
+	MinorEdit   *bool    `yaml:"minor_edit"`
+	Message     string   `yaml:"message"`
+	Mirrors     []string `yaml:"mirrors"`
+
+	Restrictions Restrictions `yaml:"restrictions"`
+	Editor       string       `yaml:"editor"`
+	Emoji        string       `yaml:"emoji"`
+	CollapseCode *bool        `yaml:"collapse_code"`
+	UserScheme   string       `yaml:"user_scheme"`
+	MinVersion   int64        `yaml:"min_version"`
+
+	HeadingAnchors string `yaml:"heading_anchors"`
 }
 
 var (
+	reFrontMatter = regexp.MustCompile(`(?s)\A---[ \t]*\r?\n(.*?\r?\n)?---[ \t]*(\r?\n|\z)`)
+
 	reHeaderPatternV1 = regexp.MustCompile(`\[\]:\s*#\s*\(([^:]+):\s*(.*)\)`)
 	reHeaderPatternV2 = regexp.MustCompile(`<!--\s*([^:]+):\s*(.*)\s*-->`)
 )
 
+// ExtractMeta parses metadata from the front-matter or headers and returns it
+// along with the rest of the document.
 func ExtractMeta(data []byte) (*Meta, []byte, error) {
+	return extractMeta(data, false)
+}
+
+// ExtractMetaTitleFromH1 parses metadata like ExtractMeta does, but uses the
+// leading H1 heading as the title when metadata doesn't specify one.
+func ExtractMetaTitleFromH1(data []byte) (*Meta, []byte, error) {
+	return extractMeta(data, true)
+}
+
+func extractMeta(data []byte, titleFromH1 bool) (*Meta, []byte, error) {
+	meta, data, err := extractFrontMatter(NormalizeSource(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if meta == nil {
+		meta, data, err = extractHeaders(data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if meta == nil {
+		return nil, data, nil
+	}
+
+	// parents in the page space are resolved as usual
+	if meta.ParentSpace == meta.Space {
+		meta.ParentSpace = ""
+	}
+
+	if meta.Title == "" && titleFromH1 {
+		meta.Title = ExtractDocumentLeadingH1(data)
+		if meta.Title == "" {
+			return nil, nil, fmt.Errorf(
+				"page title is not set (%s header is not set "+
+					"and document doesn't start with H1 heading)",
+				HeaderTitle,
+			)
+		}
+	}
+
+	err = validateMeta(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return meta, data, nil
+}
+
+// extractFrontMatter parses YAML front-matter fenced by --- lines. Front-matter
+// which doesn't contain space is considered to belong to other tools, e.g.
+// Jekyll or Hugo which use title as well, so it's stripped from the document,
+// but nil meta is returned.
+func extractFrontMatter(data []byte) (*Meta, []byte, error) {
+	matches := reFrontMatter.FindSubmatch(data)
+	if matches == nil {
+		return nil, data, nil
+	}
+
+	var matter frontMatter
+
+	err := yaml.Unmarshal(matches[1], &matter)
+	if err != nil {
+		return nil, nil, karma.Format(
+			err,
+			"unable to unmarshal front-matter",
+		)
+	}
+
+	data = data[len(matches[0]):]
+
+	if strings.TrimSpace(matter.Space) == "" {
+		return nil, data, nil
+	}
+
+	meta := &Meta{
+		Parents:     matter.Parents,
+		ParentSpace: strings.TrimSpace(matter.ParentSpace),
+		Space:       strings.TrimSpace(matter.Space),
+		Type:        strings.TrimSpace(matter.Type),
+		Title:       strings.TrimSpace(matter.Title),
+		Layout:      strings.TrimSpace(matter.Layout),
+		Attachments: make(map[string]string),
+		Labels:      matter.Labels,
+		MinorEdit:   matter.MinorEdit,
+		Message:     matter.Message,
+		Mirrors:     matter.Mirrors,
+
+		Restrictions: matter.Restrictions,
+		Editor:       strings.TrimSpace(matter.Editor),
+		Emoji:        strings.TrimSpace(matter.Emoji),
+		CollapseCode: matter.CollapseCode,
+		UserScheme:   strings.TrimSpace(matter.UserScheme),
+		MinVersion:   matter.MinVersion,
+
+		HeadingAnchors: strings.TrimSpace(matter.HeadingAnchors),
+	}
+
+	if meta.Type == "" {
+		meta.Type = "page"
+	}
+
+	for _, attachment := range matter.Attachments {
+		meta.addAttachment(attachment)
+	}
+
+	return meta, data, nil
+}
+
+func extractHeaders(data []byte) (*Meta, []byte, error) {
 	var (
 		meta   *Meta
 		offset int
@@ -67,6 +354,14 @@ func ExtractMeta(data []byte) (*Meta, []byte, error) {
 			)
 		}
 
+		// block start marker is a part of the document, so headers end
+		// before it
+		if strings.Title(strings.TrimSpace(matches[1])) == HeaderBlock {
+			offset -= len(line) + 1
+
+			break
+		}
+
 		if meta == nil {
 			meta = &Meta{}
 			meta.Type = "page" //Default if not specified
@@ -84,6 +379,9 @@ func ExtractMeta(data []byte) (*Meta, []byte, error) {
 		case HeaderParent:
 			meta.Parents = append(meta.Parents, value)
 
+		case HeaderParentSpace:
+			meta.ParentSpace = strings.TrimSpace(value)
+
 		case HeaderSpace:
 			meta.Space = strings.TrimSpace(value)
 
@@ -97,11 +395,71 @@ func ExtractMeta(data []byte) (*Meta, []byte, error) {
 			meta.Layout = strings.TrimSpace(value)
 
 		case HeaderAttachment:
-			meta.Attachments[value] = value
+			meta.addAttachment(value)
 
 		case HeaderLabel:
 			meta.Labels = append(meta.Labels, value)
 
+		case HeaderMinorEdit:
+			minorEdit, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf(
+					"invalid %s header value %q, expected true or false",
+					HeaderMinorEdit,
+					value,
+				)
+			}
+
+			meta.MinorEdit = &minorEdit
+
+		case HeaderMessage:
+			meta.Message = value
+
+		case HeaderMirror:
+			meta.Mirrors = append(meta.Mirrors, value)
+
+		case HeaderEditor:
+			meta.Editor = strings.TrimSpace(value)
+
+		case HeaderEmoji:
+			meta.Emoji = strings.TrimSpace(value)
+
+		case HeaderCollapseCode:
+			collapse, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, nil, fmt.Errorf(
+					"invalid %s header value %q, expected true or false",
+					HeaderCollapseCode,
+					value,
+				)
+			}
+
+			meta.CollapseCode = &collapse
+
+		case HeaderUserScheme:
+			meta.UserScheme = strings.TrimSpace(value)
+
+		case HeaderMinVersion:
+			version, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf(
+					"invalid %s header value %q, expected page version",
+					HeaderMinVersion,
+					value,
+				)
+			}
+
+			meta.MinVersion = version
+
+		case HeaderHeadingAnchors:
+			meta.HeadingAnchors = strings.TrimSpace(value)
+
+		case HeaderRestrictView:
+			meta.Restrictions.View = append(meta.Restrictions.View, value)
+
+		case HeaderRestrictEdit:
+			meta.Restrictions.Edit = append(meta.Restrictions.Edit, value)
+
 		case HeaderInclude:
 			// Includes are parsed by a different func
 			continue
@@ -122,19 +480,81 @@ func ExtractMeta(data []byte) (*Meta, []byte, error) {
 		return nil, data, nil
 	}
 
+	return meta, data[offset:], nil
+}
+
+// addAttachment adds attachment specified as path optionally followed by
+// AttachmentCommentSeparator and comment.
+func (meta *Meta) addAttachment(spec string) {
+	path, comment := spec, ""
+
+	parts := strings.SplitN(spec, AttachmentCommentSeparator, 2)
+	if len(parts) == 2 {
+		path = strings.TrimSpace(parts[0])
+		comment = strings.TrimSpace(parts[1])
+	}
+
+	meta.Attachments[path] = path
+
+	if comment != "" {
+		if meta.AttachmentComments == nil {
+			meta.AttachmentComments = map[string]string{}
+		}
+
+		meta.AttachmentComments[path] = comment
+	}
+}
+
+func validateMeta(meta *Meta) error {
 	if meta.Space == "" {
-		return nil, nil, fmt.Errorf(
+		return fmt.Errorf(
 			"space key is not set (%s header is not set)",
 			HeaderSpace,
 		)
 	}
 
 	if meta.Title == "" {
-		return nil, nil, fmt.Errorf(
+		return fmt.Errorf(
 			"page title is not set (%s header is not set)",
 			HeaderTitle,
 		)
 	}
 
-	return meta, data[offset:], nil
+	if meta.Editor != "" {
+		err := ValidateEditor(meta.Editor)
+		if err != nil {
+			return karma.Format(err, "invalid %s header", HeaderEditor)
+		}
+	}
+
+	if meta.Emoji != "" {
+		_, err := GetEmojiCode(meta.Emoji)
+		if err != nil {
+			return karma.Format(err, "invalid %s header", HeaderEmoji)
+		}
+	}
+
+	if meta.UserScheme != "" {
+		err := ValidateUserScheme(meta.UserScheme)
+		if err != nil {
+			return karma.Format(err, "invalid %s header", HeaderUserScheme)
+		}
+	}
+
+	if meta.HeadingAnchors != "" {
+		_, err := Slugify("", meta.HeadingAnchors)
+		if err != nil {
+			return karma.Format(err, "invalid %s header", HeaderHeadingAnchors)
+		}
+	}
+
+	if meta.MinVersion < 0 {
+		return fmt.Errorf(
+			"invalid %s header value %d, expected positive page version",
+			HeaderMinVersion,
+			meta.MinVersion,
+		)
+	}
+
+	return nil
 }
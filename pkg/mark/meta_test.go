@@ -0,0 +1,372 @@
+package mark
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractMetaFrontMatter(t *testing.T) {
+	test := assert.New(t)
+
+	meta, body, err := ExtractMeta([]byte(text(
+		"---",
+		"space: TEST",
+		"title: My Article",
+		"parents:",
+		"  - Parent 1",
+		"  - Parent 2",
+		"labels: [a, b]",
+		"layout: plain",
+		"attachments:",
+		"  - images/a.png",
+		"minor_edit: true",
+		"---",
+		"# Heading",
+	)))
+	test.NoError(err)
+	test.Equal("TEST", meta.Space)
+	test.Equal("My Article", meta.Title)
+	test.Equal("page", meta.Type)
+	test.Equal("plain", meta.Layout)
+	test.Equal([]string{"Parent 1", "Parent 2"}, meta.Parents)
+	test.Equal([]string{"a", "b"}, meta.Labels)
+	test.Equal(map[string]string{"images/a.png": "images/a.png"}, meta.Attachments)
+	test.True(*meta.MinorEdit)
+	test.Equal("# Heading", string(body))
+}
+
+func TestExtractMetaForeignFrontMatter(t *testing.T) {
+	test := assert.New(t)
+
+	meta, body, err := ExtractMeta([]byte(text(
+		"---",
+		"date: 2020-01-01",
+		"---",
+		"<!-- Space: TEST -->",
+		"<!-- Title: My Article -->",
+		"",
+		"# Heading",
+	)))
+	test.NoError(err)
+	test.Equal("TEST", meta.Space)
+	test.Equal("My Article", meta.Title)
+	test.Equal("# Heading", string(body))
+}
+
+func TestExtractMetaJekyllFrontMatter(t *testing.T) {
+	test := assert.New(t)
+
+	meta, body, err := ExtractMeta([]byte(text(
+		"---",
+		"title: Jekyll Title",
+		"layout: post",
+		"---",
+		"<!-- Space: TEST -->",
+		"<!-- Title: My Article -->",
+		"",
+		"# Heading",
+	)))
+	test.NoError(err)
+	test.Equal("TEST", meta.Space)
+	test.Equal("My Article", meta.Title)
+	test.Equal("", meta.Layout)
+	test.Equal("# Heading", string(body))
+
+	// front-matter with title only is not metadata of mark
+	meta, body, err = ExtractMeta([]byte(text(
+		"---",
+		"title: Jekyll Title",
+		"---",
+		"# Heading",
+	)))
+	test.NoError(err)
+	test.Nil(meta)
+	test.Equal("# Heading", string(body))
+}
+
+func TestExtractMetaFrontMatterWithoutTitle(t *testing.T) {
+	_, _, err := ExtractMeta([]byte(text(
+		"---",
+		"space: TEST",
+		"---",
+		"# Heading",
+	)))
+	assert.Error(t, err)
+}
+
+func TestExtractMetaHeaders(t *testing.T) {
+	test := assert.New(t)
+
+	meta, body, err := ExtractMeta([]byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: My Article -->",
+		"<!-- Parent: Parent 1 -->",
+		"",
+		"# Heading",
+	)))
+	test.NoError(err)
+	test.Equal("TEST", meta.Space)
+	test.Equal("My Article", meta.Title)
+	test.Equal([]string{"Parent 1"}, meta.Parents)
+	test.Equal("# Heading", string(body))
+}
+
+func TestExtractMetaParentSpace(t *testing.T) {
+	test := assert.New(t)
+
+	meta, _, err := ExtractMeta([]byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: My Article -->",
+		"<!-- ParentSpace: OPS -->",
+		"<!-- Parent: Runbooks -->",
+		"<!-- Parent: Databases -->",
+		"",
+		"# Heading",
+	)))
+	test.NoError(err)
+	test.Equal("OPS", meta.ParentSpace)
+	test.Equal([]string{"Runbooks", "Databases"}, meta.Parents)
+
+	// parent space equal to the page space is dropped
+	meta, _, err = ExtractMeta([]byte(text(
+		"---",
+		"space: TEST",
+		"title: My Article",
+		"parent_space: TEST",
+		"parents:",
+		"  - Runbooks",
+		"---",
+		"",
+	)))
+	test.NoError(err)
+	test.Equal("", meta.ParentSpace)
+	test.Equal([]string{"Runbooks"}, meta.Parents)
+
+	// colon in the title doesn't qualify parent with space
+	meta, _, err = ExtractMeta([]byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: My Article -->",
+		"<!-- Parent: API:Reference -->",
+		"",
+	)))
+	test.NoError(err)
+	test.Equal("", meta.ParentSpace)
+	test.Equal([]string{"API:Reference"}, meta.Parents)
+}
+
+func TestExtractMetaTitleFromH1(t *testing.T) {
+	test := assert.New(t)
+
+	meta, body, err := ExtractMetaTitleFromH1([]byte(text(
+		"<!-- Space: TEST -->",
+		"",
+		"# My Article",
+		"Text",
+	)))
+	test.NoError(err)
+	test.Equal("My Article", meta.Title)
+	test.Equal("Text", string(DropDocumentLeadingH1(body)))
+
+	meta, _, err = ExtractMetaTitleFromH1([]byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: Explicit -->",
+		"",
+		"# My Article",
+		"Text",
+	)))
+	test.NoError(err)
+	test.Equal("Explicit", meta.Title)
+
+	_, _, err = ExtractMetaTitleFromH1([]byte(text(
+		"<!-- Space: TEST -->",
+		"",
+		"Text",
+	)))
+	test.Error(err)
+
+	// heading isn't used as the title by ExtractMeta
+	_, _, err = ExtractMeta([]byte(text(
+		"<!-- Space: TEST -->",
+		"",
+		"# My Article",
+		"Text",
+	)))
+	test.EqualError(err, "page title is not set (Title header is not set)")
+}
+
+func TestExtractMetaRestrictions(t *testing.T) {
+	test := assert.New(t)
+
+	meta, _, err := ExtractMeta([]byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: My Article -->",
+		"<!-- RestrictView: group:secret-team -->",
+		"<!-- RestrictView: smith -->",
+		"<!-- RestrictEdit: smith -->",
+		"",
+		"# Heading",
+	)))
+	test.NoError(err)
+	test.Equal(
+		[]confluence.Restriction{
+			{
+				Operation: "read",
+				Users:     []string{"smith"},
+				Groups:    []string{"secret-team"},
+			},
+			{
+				Operation: "update",
+				Users:     []string{"smith"},
+			},
+		},
+		GetRestrictions(meta.Restrictions),
+	)
+
+	meta, _, err = ExtractMeta([]byte(text(
+		"---",
+		"space: TEST",
+		"title: My Article",
+		"restrictions:",
+		"  edit: [group:editors]",
+		"---",
+	)))
+	test.NoError(err)
+	test.Equal(Restrictions{Edit: []string{"group:editors"}}, meta.Restrictions)
+}
+
+func TestExtractMetaEditor(t *testing.T) {
+	test := assert.New(t)
+
+	meta, _, err := ExtractMeta([]byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: My Article -->",
+		"<!-- Editor: v2 -->",
+		"",
+		"# Heading",
+	)))
+	test.NoError(err)
+	test.Equal("v2", meta.Editor)
+
+	_, _, err = ExtractMeta([]byte(text(
+		"---",
+		"space: TEST",
+		"title: My Article",
+		"editor: v3",
+		"---",
+	)))
+	test.Error(err)
+}
+
+func TestExtractMetaEmoji(t *testing.T) {
+	test := assert.New(t)
+
+	meta, _, err := ExtractMeta([]byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: My Article -->",
+		"<!-- Emoji: :rocket: -->",
+		"",
+	)))
+	test.NoError(err)
+	test.Equal(":rocket:", meta.Emoji)
+
+	code, err := GetEmojiCode(meta.Emoji)
+	test.NoError(err)
+	test.Equal("1f680", code)
+
+	_, _, err = ExtractMeta([]byte(text(
+		"---",
+		"space: TEST",
+		"title: My Article",
+		"emoji: not-an-emoji",
+		"---",
+	)))
+	test.Contains(err.Error(), `unknown emoji shortname "not-an-emoji"`)
+}
+
+func TestExtractMetaMinVersion(t *testing.T) {
+	test := assert.New(t)
+
+	meta, _, err := ExtractMeta([]byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: My Article -->",
+		"<!-- MinVersion: 7 -->",
+		"",
+	)))
+	test.NoError(err)
+	test.EqualValues(7, meta.MinVersion)
+
+	page := &confluence.PageInfo{Title: "My Article"}
+
+	page.Version.Number = 7
+	test.NoError(CheckMinVersion(meta, page, 0))
+
+	page.Version.Number = 8
+	err = CheckMinVersion(meta, page, 0)
+	if test.Error(err) {
+		test.Contains(err.Error(), "live version: 8")
+		test.Contains(err.Error(), "expected version: 7")
+	}
+
+	// versions published by mark itself don't make the page newer
+	test.NoError(CheckMinVersion(meta, page, 8))
+
+	page.Version.Number = 9
+	err = CheckMinVersion(meta, page, 8)
+	if test.Error(err) {
+		test.Contains(err.Error(), "live version: 9")
+		test.Contains(err.Error(), "expected version: 8")
+	}
+
+	// version isn't checked if it's not specified
+	test.NoError(CheckMinVersion(&Meta{}, page, 0))
+
+	_, _, err = ExtractMeta([]byte(text(
+		"---",
+		"space: TEST",
+		"title: My Article",
+		"min_version: -1",
+		"---",
+	)))
+	test.Error(err)
+}
+
+func TestExtractMetaHeadingAnchors(t *testing.T) {
+	test := assert.New(t)
+
+	source := []byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: Übersicht -->",
+		"<!-- HeadingAnchors: ascii -->",
+		"",
+		"## Größen",
+	))
+
+	meta, _, err := ExtractMeta(source)
+	test.NoError(err)
+	test.Equal(AnchorStyleASCII, meta.HeadingAnchors)
+
+	// header takes precedence over options
+	html, _, err := Compile(
+		context.Background(),
+		source,
+		Options{
+			CompileOptions: CompileOptions{AnchorStyle: AnchorStyleGitHub},
+		},
+	)
+	test.NoError(err)
+	test.Contains(html, `<ac:parameter ac:name="">groessen</ac:parameter>`)
+
+	_, _, err = ExtractMeta([]byte(text(
+		"---",
+		"space: TEST",
+		"title: My Article",
+		"heading_anchors: slug",
+		"---",
+	)))
+	if test.Error(err) {
+		test.Contains(err.Error(), `unknown anchor style "slug"`)
+	}
+}
@@ -0,0 +1,27 @@
+// Package multierr combines errors collected while processing the document,
+// so all of them are reported at once instead of only the first one.
+package multierr
+
+import (
+	"fmt"
+
+	"github.com/reconquest/karma-go"
+)
+
+// Join returns nil if there are no errors, the error itself if there is only
+// one and error listing all of them otherwise.
+func Join(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	reasons := []karma.Reason{}
+	for _, err := range errs {
+		reasons = append(reasons, err)
+	}
+
+	return karma.Push(fmt.Sprintf("%d errors occurred", len(errs)), reasons...)
+}
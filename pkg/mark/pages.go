@@ -0,0 +1,54 @@
+package mark
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/bonovoxly/mark/pkg/mark/fence"
+)
+
+// PageSeparator is a line which separates pages when several pages are kept
+// in one markdown file, every page has its own metadata.
+const PageSeparator = `<!-- Page -->`
+
+var (
+	rePageSeparator = regexp.MustCompile(`^\s*<!--\s*Page\s*-->\s*$`)
+)
+
+// SplitPages splits markdown source into pages separated by PageSeparator
+// lines. Separators inside of code fences are ignored. Source without
+// separators is returned as a single page.
+func SplitPages(source []byte) [][]byte {
+	var (
+		pages  [][]byte
+		page   []byte
+		fences fence.Scanner
+	)
+
+	for _, line := range bytes.SplitAfter(source, []byte("\n")) {
+		if !fences.Scan(string(line)) && rePageSeparator.Match(line) {
+			pages = append(pages, page)
+			page = nil
+
+			continue
+		}
+
+		page = append(page, line...)
+	}
+
+	pages = append(pages, page)
+
+	// separator may be put before the first page or after the last one
+	result := [][]byte{}
+	for _, page := range pages {
+		if len(bytes.TrimSpace(page)) > 0 {
+			result = append(result, page)
+		}
+	}
+
+	if len(result) == 0 {
+		return [][]byte{source}
+	}
+
+	return result
+}
@@ -0,0 +1,57 @@
+package mark
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitPages(t *testing.T) {
+	test := assert.New(t)
+
+	pages := SplitPages([]byte(text(
+		"<!-- Space: TEST -->",
+		"<!-- Title: First -->",
+		"",
+		"See [[Second]].",
+		"```",
+		"<!-- Page -->",
+		"```",
+		"<!-- Page -->",
+		"<!-- Space: TEST -->",
+		"<!-- Title: Second -->",
+		"",
+		"Text",
+		"<!-- Page -->",
+		"",
+	)))
+
+	if test.Len(pages, 2) {
+		test.Equal(
+			text(
+				"<!-- Space: TEST -->",
+				"<!-- Title: First -->",
+				"",
+				"See [[Second]].",
+				"```",
+				"<!-- Page -->",
+				"```",
+				"",
+			),
+			string(pages[0]),
+		)
+		test.Equal(
+			text(
+				"<!-- Space: TEST -->",
+				"<!-- Title: Second -->",
+				"",
+				"Text",
+				"",
+			),
+			string(pages[1]),
+		)
+	}
+
+	pages = SplitPages([]byte("# Heading\n"))
+	test.Equal([][]byte{[]byte("# Heading\n")}, pages)
+}
@@ -0,0 +1,174 @@
+package mark
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bonovoxly/mark/pkg/mark/fence"
+	"github.com/bonovoxly/mark/pkg/mark/macro"
+	"github.com/bonovoxly/mark/pkg/mark/multierr"
+	"github.com/reconquest/karma-go"
+)
+
+// rePanel matches alert-like marker of the panel with optional parameters,
+// e.g. [!PANEL bg=#fef3c7 border=#f59e0b emoji=bulb title="Heads up"].
+var rePanel = regexp.MustCompile(
+	`^\[!PANEL(?:[ \t]+([^\]\n]*))?\][ \t]*(\n|$)`,
+)
+
+// rePanelLine matches panel marker at the start of a blockquote line, e.g.
+// > [!PANEL bg=#fef3c7], including markers of nested blockquotes.
+var rePanelLine = regexp.MustCompile(
+	`^\s*(?:>[ \t]*)+\[!PANEL(?:[ \t]+([^\]\n]*))?\][ \t]*$`,
+)
+
+var reColor = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// panelName is a name of the admonition which is rendered as panel.
+const panelName = "panel"
+
+// Panel is a Confluence panel with custom colors and emoji, which is rendered
+// using ac:panel template.
+type Panel struct {
+	Title       string
+	BgColor     string
+	BorderColor string
+	Collapse    bool
+
+	// Emoji is a shortname of the emoji shown in the panel, EmojiID and
+	// EmojiText are its code point and the emoji itself.
+	Emoji     string
+	EmojiID   string
+	EmojiText string
+
+	Body string
+}
+
+// ValidateColor returns error if given color is not a hex color like #fff or
+// #fef3c7.
+func ValidateColor(color string) error {
+	if !reColor.MatchString(color) {
+		return fmt.Errorf(
+			"invalid color %q, expected hex color like #fef3c7",
+			color,
+		)
+	}
+
+	return nil
+}
+
+// parsePanel parses parameters of the panel marker: title, bg, border, emoji
+// and collapse. Keys are case-insensitive, bgColor and borderColor are
+// accepted as well.
+func parsePanel(params string) (Panel, error) {
+	var panel Panel
+
+	values, err := macro.ParseParams(params)
+	if err != nil {
+		return panel, err
+	}
+
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	// errors are reported in the same order every time
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := fmt.Sprint(values[key])
+
+		switch strings.ToLower(key) {
+		case "title":
+			panel.Title = html.EscapeString(value)
+
+		case "bg", "bgcolor":
+			err := ValidateColor(value)
+			if err != nil {
+				return panel, karma.Format(err, "invalid panel %q", key)
+			}
+
+			panel.BgColor = value
+
+		case "border", "bordercolor":
+			err := ValidateColor(value)
+			if err != nil {
+				return panel, karma.Format(err, "invalid panel %q", key)
+			}
+
+			panel.BorderColor = value
+
+		case "emoji":
+			code, err := GetEmojiCode(value)
+			if err != nil {
+				return panel, karma.Format(err, "invalid panel %q", key)
+			}
+
+			point, err := strconv.ParseUint(code, 16, 32)
+			if err != nil {
+				return panel, karma.Format(err, "invalid emoji code %q", code)
+			}
+
+			panel.Emoji = strings.Trim(value, ":")
+			panel.EmojiID = code
+			panel.EmojiText = string(rune(point))
+
+		case "collapse":
+			collapse, err := strconv.ParseBool(value)
+			if err != nil {
+				return panel, fmt.Errorf(
+					"invalid panel %q value %q, expected true or false",
+					key,
+					value,
+				)
+			}
+
+			panel.Collapse = collapse
+
+		default:
+			return panel, fmt.Errorf(
+				"unknown panel parameter %q, expected one of: "+
+					"title, bg, border, emoji, collapse",
+				key,
+			)
+		}
+	}
+
+	return panel, nil
+}
+
+// validatePanels returns error if parameters of panel markers outside of code
+// are invalid, so such panels are reported before the page is rendered
+// instead of being rendered without parameters.
+func validatePanels(markdown []byte) error {
+	var (
+		errs   []error
+		fences fence.Scanner
+	)
+
+	for number, line := range strings.Split(string(markdown), "\n") {
+		if fences.Scan(line) {
+			continue
+		}
+
+		matches := rePanelLine.FindStringSubmatch(line)
+		if matches == nil {
+			continue
+		}
+
+		_, err := parsePanel(matches[1])
+		if err != nil {
+			errs = append(
+				errs,
+				karma.Format(err, "invalid panel marker at line %d", number+1),
+			)
+		}
+	}
+
+	return multierr.Join(errs)
+}
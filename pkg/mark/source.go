@@ -0,0 +1,52 @@
+package mark
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// MaxStorageSize is a size of storage format in bytes which Confluence
+// accepts by default, larger pages are rejected.
+const MaxStorageSize = 5 * 1024 * 1024
+
+// DefaultStorageSizeWarning is a size of storage format in bytes which pages
+// are reported to approach MaxStorageSize at by default.
+const DefaultStorageSizeWarning = 4 * 1024 * 1024
+
+// PageSourceProperty is a content property which source markdown of the page
+// is stored in, see EmbedSource.
+const PageSourceProperty = `mark-source`
+
+// MaxSourceSize is a size of the content property value in bytes which
+// Confluence accepts, larger sources are not embedded.
+const MaxSourceSize = 32 * 1024
+
+// NormalizeSource strips leading UTF-8 byte order mark and converts CRLF line
+// endings into LF, which are left by some editors, mostly on Windows, and
+// break detection of metadata and macros.
+func NormalizeSource(source []byte) []byte {
+	source = bytes.TrimPrefix(source, utf8BOM)
+
+	if !bytes.Contains(source, []byte("\r\n")) {
+		return source
+	}
+
+	return bytes.ReplaceAll(source, []byte("\r\n"), []byte("\n"))
+}
+
+// EmbedSource adds source markdown to the content properties which are set
+// along with the page, so it's stored apart from the page body which
+// Confluence may reformat. It returns false and properties as is if the
+// source exceeds MaxSourceSize.
+func EmbedSource(properties map[string]string, source []byte) bool {
+	value, err := json.Marshal(string(source))
+	if err != nil || len(value) > MaxSourceSize {
+		return false
+	}
+
+	properties[PageSourceProperty] = string(source)
+
+	return true
+}
@@ -0,0 +1,32 @@
+package mark
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbedSource(t *testing.T) {
+	test := assert.New(t)
+
+	source := []byte("<!-- Title: Page -->\n\n# Heading -->\n")
+
+	properties := map[string]string{"editor": "v2"}
+
+	test.True(EmbedSource(properties, source))
+	test.Equal(
+		map[string]string{
+			"editor":           "v2",
+			PageSourceProperty: string(source),
+		},
+		properties,
+	)
+
+	// source isn't embedded if it's too large for content property
+	properties = map[string]string{}
+	source = bytes.Repeat([]byte("x"), MaxSourceSize)
+
+	test.False(EmbedSource(properties, source))
+	test.Empty(properties)
+}
@@ -1,6 +1,13 @@
 package stdlib
 
 import (
+	"context"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"text/template"
 
@@ -14,15 +21,19 @@ import (
 type Lib struct {
 	Macros    []macro.Macro
 	Templates *template.Template
+
+	// UserScheme is an attribute which mentioned users are linked by, it's
+	// chosen by flavor of Confluence or by found users if it's empty.
+	UserScheme confluence.UserScheme
 }
 
-func New(api *confluence.API) (*Lib, error) {
+func New(ctx context.Context, api *confluence.API) (*Lib, error) {
 	var (
 		lib Lib
 		err error
 	)
 
-	lib.Templates, err = templates(api)
+	lib.Templates, err = templates(ctx, api, &lib)
 	if err != nil {
 		return nil, err
 	}
@@ -35,6 +46,102 @@ func New(api *confluence.API) (*Lib, error) {
 	return &lib, nil
 }
 
+// Load loads custom templates and macros from given directory. Every *.tmpl
+// file is loaded as template named after its path relative to the directory
+// without extension, e.g. org/warning.tmpl becomes org/warning. Macro
+// directives are loaded from *.md files after all templates are loaded, so
+// they can refer to both built-in and custom templates.
+func (lib *Lib) Load(dir string) error {
+	var templates, macros []string
+
+	err := filepath.Walk(
+		dir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() {
+				return nil
+			}
+
+			switch filepath.Ext(path) {
+			case ".tmpl":
+				templates = append(templates, path)
+			case ".md":
+				macros = append(macros, path)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return karma.Format(err, "unable to list templates directory %q", dir)
+	}
+
+	for _, path := range templates {
+		relative, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(
+			strings.TrimSuffix(relative, filepath.Ext(relative)),
+		)
+
+		facts := karma.Describe("path", path).Describe("template", name)
+
+		if lib.Templates.Lookup(name) != nil {
+			return facts.Format(nil, "template is already defined")
+		}
+
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return facts.Format(err, "unable to read template file")
+		}
+
+		_, err = lib.Templates.New(name).Parse(string(body))
+		if err != nil {
+			return facts.Format(err, "unable to parse template")
+		}
+	}
+
+	// macros with the same pattern would be applied in order, so custom macro
+	// would silently override or be overridden by built-in one
+	patterns := map[string]bool{}
+	for _, macro := range lib.Macros {
+		patterns[macro.Regexp.String()] = true
+	}
+
+	for _, path := range macros {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return karma.Format(err, "unable to read macros file %q", path)
+		}
+
+		extracted, _, err := macro.ExtractMacros(contents, lib.Templates)
+		if err != nil {
+			return karma.Format(err, "unable to extract macros from %q", path)
+		}
+
+		for _, macro := range extracted {
+			pattern := macro.Regexp.String()
+			if patterns[pattern] {
+				return karma.
+					Describe("path", path).
+					Describe("pattern", pattern).
+					Format(nil, "macro is already defined")
+			}
+
+			patterns[pattern] = true
+		}
+
+		lib.Macros = append(lib.Macros, extracted...)
+	}
+
+	return nil
+}
+
 func macros(templates *template.Template) ([]macro.Macro, error) {
 	text := func(line ...string) []byte {
 		return []byte(strings.Join(line, "\n"))
@@ -46,6 +153,19 @@ func macros(templates *template.Template) ([]macro.Macro, error) {
 			`     Template: ac:link:user`,
 			`     Name: ${1} -->`,
 
+			`<!-- Macro: <!--\s*Profile:\s*(.+?)\s*-->`,
+			`     Template: ac:profile`,
+			`     Name: ${1} -->`,
+
+			// at least one parameter is required, so objects like
+			// {status:200} in code examples are not taken for the macro
+			`<!-- Macro: \{status:(?P<params>\s*\w+\s*=[^{}\n]*)\}`,
+			`     Template: ac:status -->`,
+
+			`<!-- Macro: \{jira:\s*([A-Z][A-Z0-9_]*-[0-9]+)\s*\}`,
+			`     Template: ac:jira:ticket`,
+			`     Ticket: ${1} -->`,
+
 			// TODO(seletskiy): more macros here
 		)),
 
@@ -58,22 +178,117 @@ func macros(templates *template.Template) ([]macro.Macro, error) {
 	return macros, nil
 }
 
-func templates(api *confluence.API) (*template.Template, error) {
+// getUser finds user mentioned by full name, by email if mention is prefixed
+// with "email:" or by account id if it's prefixed with "id:". Nil is returned
+// if user is not found.
+func getUser(
+	ctx context.Context,
+	api *confluence.API,
+	name string,
+) *confluence.User {
+	// identifier is used as is whatever scheme users are linked by
+	if strings.HasPrefix(name, "id:") {
+		id := strings.TrimPrefix(name, "id:")
+
+		return &confluence.User{AccountID: id, Username: id, UserKey: id}
+	}
+
+	// user is mentioned as plain text without API
+	if api == nil {
+		return nil
+	}
+
+	var (
+		user *confluence.User
+		err  error
+	)
+
+	if strings.HasPrefix(name, "email:") {
+		user, err = api.GetUserByEmail(ctx, strings.TrimPrefix(name, "email:"))
+	} else {
+		user, err = api.GetUserByName(ctx, name)
+	}
+
+	if err != nil {
+		log.Error(err)
+	}
+
+	return user
+}
+
+// userScheme returns scheme which given user is linked by: UserScheme of the
+// lib, scheme supported by Confluence if its flavor is already detected or
+// scheme guessed by identifiers of the found user.
+func (lib *Lib) userScheme(
+	api *confluence.API,
+	user *confluence.User,
+) confluence.UserScheme {
+	if lib.UserScheme != "" {
+		return lib.UserScheme
+	}
+
+	if api != nil {
+		if server := api.Server(); server != nil {
+			return server.UserScheme()
+		}
+	}
+
+	// users found on Confluence Server/Data Center have no account id
+	if user.AccountID == "" && user.Username != "" {
+		return confluence.UserName
+	}
+
+	return confluence.UserAccountID
+}
+
+func templates(
+	ctx context.Context,
+	api *confluence.API,
+	lib *Lib,
+) (*template.Template, error) {
 	text := func(line ...string) string {
 		return strings.Join(line, ``)
 	}
 
+	// users are cached by mention, including not found ones
+	users := map[string]*confluence.User{}
+
 	templates := template.New(`stdlib`).Funcs(
 		template.FuncMap{
 			"user": func(name string) *confluence.User {
-				user, err := api.GetUserByName(name)
-				if err != nil {
-					log.Error(err)
+				if user, ok := users[name]; ok {
+					return user
 				}
 
+				user := getUser(ctx, api, name)
+
+				users[name] = user
+
 				return user
 			},
 
+			// userref returns attribute of <ri:user/> which identifies
+			// the user, e.g. ri:account-id="..."
+			"userref": func(user *confluence.User) string {
+				scheme := lib.userScheme(api, user)
+
+				return fmt.Sprintf(
+					`ri:%s="%s"`,
+					scheme,
+					html.EscapeString(user.Identifier(scheme)),
+				)
+			},
+
+			// mention returns text of mention of the user which is not
+			// found, e.g. email without email: prefix
+			"mention": func(name string) string {
+				return strings.TrimPrefix(name, "email:")
+			},
+
+			// queryescape escapes value of query parameter, so + of formulas
+			// isn't taken for space
+			"queryescape": url.QueryEscape,
+
 			// The only way to escape CDATA end marker ']]>' is to split it
 			// into two CDATA sections.
 			"cdata": func(data string) string {
@@ -91,13 +306,49 @@ func templates(api *confluence.API) (*template.Template, error) {
 	for name, body := range map[string]string{
 		// This template is used to select whole article layout
 		`ac:layout`: text(
-			`{{ if eq .Layout "article" }}`,
+			`{{ if or (eq .Layout "article") (eq .Layout "two_right_sidebar") }}`,
 			/**/ `<ac:layout>`,
 			/**/ `<ac:layout-section ac:type="two_right_sidebar">`,
 			/**/ `<ac:layout-cell>{{ .Body }}</ac:layout-cell>`,
 			/**/ `<ac:layout-cell></ac:layout-cell>`,
 			/**/ `</ac:layout-section>`,
 			/**/ `</ac:layout>`,
+			`{{ else if eq .Layout "single" }}`,
+			/**/ `<ac:layout>`,
+			/**/ `<ac:layout-section ac:type="single">`,
+			/**/ `<ac:layout-cell>{{ .Body }}</ac:layout-cell>`,
+			/**/ `</ac:layout-section>`,
+			/**/ `</ac:layout>`,
+			`{{ else if eq .Layout "two_equal" }}`,
+			/**/ `<ac:layout>`,
+			/**/ `<ac:layout-section ac:type="two_equal">`,
+			/**/ `<ac:layout-cell>{{ .Body }}</ac:layout-cell>`,
+			/**/ `<ac:layout-cell></ac:layout-cell>`,
+			/**/ `</ac:layout-section>`,
+			/**/ `</ac:layout>`,
+			`{{ else if eq .Layout "two_left_sidebar" }}`,
+			/**/ `<ac:layout>`,
+			/**/ `<ac:layout-section ac:type="two_left_sidebar">`,
+			/**/ `<ac:layout-cell></ac:layout-cell>`,
+			/**/ `<ac:layout-cell>{{ .Body }}</ac:layout-cell>`,
+			/**/ `</ac:layout-section>`,
+			/**/ `</ac:layout>`,
+			`{{ else if eq .Layout "three_equal" }}`,
+			/**/ `<ac:layout>`,
+			/**/ `<ac:layout-section ac:type="three_equal">`,
+			/**/ `<ac:layout-cell>{{ .Body }}</ac:layout-cell>`,
+			/**/ `<ac:layout-cell></ac:layout-cell>`,
+			/**/ `<ac:layout-cell></ac:layout-cell>`,
+			/**/ `</ac:layout-section>`,
+			/**/ `</ac:layout>`,
+			`{{ else if eq .Layout "three_with_sidebars" }}`,
+			/**/ `<ac:layout>`,
+			/**/ `<ac:layout-section ac:type="three_with_sidebars">`,
+			/**/ `<ac:layout-cell></ac:layout-cell>`,
+			/**/ `<ac:layout-cell>{{ .Body }}</ac:layout-cell>`,
+			/**/ `<ac:layout-cell></ac:layout-cell>`,
+			/**/ `</ac:layout-section>`,
+			/**/ `</ac:layout>`,
 			`{{ else }}`,
 			/**/ `{{ .Body }}`,
 			`{{ end }}`,
@@ -113,6 +364,8 @@ func templates(api *confluence.API) (*template.Template, error) {
 			/**/ `<ac:parameter ac:name="language">{{ .Language }}</ac:parameter>{{printf "\n"}}`,
 			/**/ `<ac:parameter ac:name="collapse">{{ .Collapse }}</ac:parameter>{{printf "\n"}}`,
 			/**/ `{{ if .Title }}<ac:parameter ac:name="title">{{ .Title }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			/**/ `{{ if .LineNumbers }}<ac:parameter ac:name="linenumbers">{{ .LineNumbers }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			/**/ `{{ if .Theme }}<ac:parameter ac:name="theme">{{ .Theme }}</ac:parameter>{{printf "\n"}}{{ end }}`,
 			/**/ `<ac:plain-text-body><![CDATA[{{ .Text | cdata }}]]></ac:plain-text-body>{{printf "\n"}}`,
 			`</ac:structured-macro>{{printf "\n"}}`,
 
@@ -120,6 +373,25 @@ func templates(api *confluence.API) (*template.Template, error) {
 			`</ac:structured-macro>{{printf "\n"}}{{ end }}`,
 		),
 
+		// This template is used for rendering images with attributes
+		`ac:image`: text(
+			`<ac:image`,
+			/**/ `{{ if .Width }} ac:width="{{ .Width }}"{{ end }}`,
+			/**/ `{{ if .Height }} ac:height="{{ .Height }}"{{ end }}`,
+			/**/ `{{ if .Align }} ac:align="{{ .Align }}"{{ end }}`,
+			/**/ `{{ if .Alt }} ac:alt="{{ .Alt }}"{{ end }}>`,
+			`<ri:url ri:value="{{ .URL }}"/>`,
+			`</ac:image>`,
+		),
+
+		/* https://confluence.atlassian.com/doc/anchor-macro-182682085.html */
+
+		`ac:anchor`: text(
+			`<ac:structured-macro ac:name="anchor">`,
+			`<ac:parameter ac:name="">{{ .Name }}</ac:parameter>`,
+			`</ac:structured-macro>`,
+		),
+
 		`ac:status`: text(
 			`<ac:structured-macro ac:name="status">`,
 			`<ac:parameter ac:name="colour">{{ or .Color "Grey" }}</ac:parameter>`,
@@ -128,13 +400,32 @@ func templates(api *confluence.API) (*template.Template, error) {
 			`</ac:structured-macro>`,
 		),
 
+		`ac:task`: text(
+			`<ac:task>{{printf "\n"}}`,
+			`<ac:task-status>{{ if .Complete }}complete{{ else }}incomplete{{ end }}</ac:task-status>{{printf "\n"}}`,
+			`<ac:task-body>{{ .Body }}</ac:task-body>{{printf "\n"}}`,
+			`</ac:task>{{printf "\n"}}`,
+		),
+
 		`ac:link:user`: text(
 			`{{ with .Name | user }}`,
 			/**/ `<ac:link>`,
-			/**/ `<ri:user ri:account-id="{{ .AccountID }}"/>`,
+			/**/ `<ri:user {{ userref . }}/>`,
 			/**/ `</ac:link>`,
 			`{{ else }}`,
-			/**/ `{{ .Name }}`,
+			/**/ `{{ .Name | mention }}`,
+			`{{ end }}`,
+		),
+
+		`ac:profile`: text(
+			`{{ with .Name | user }}`,
+			/**/ `<ac:structured-macro ac:name="profile">`,
+			/**/ `<ac:parameter ac:name="user">`,
+			/**/ `<ri:user {{ userref . }}/>`,
+			/**/ `</ac:parameter>`,
+			/**/ `</ac:structured-macro>`,
+			`{{ else }}`,
+			/**/ `{{ .Name | mention }}`,
 			`{{ end }}`,
 		),
 
@@ -156,6 +447,29 @@ func templates(api *confluence.API) (*template.Template, error) {
 			`</ac:structured-macro>{{printf "\n"}}`,
 		),
 
+		/* https://confluence.atlassian.com/doc/panel-macro-51872380.html */
+
+		`ac:panel`: text(
+			`{{ if .Collapse }}<ac:structured-macro ac:name="expand">{{printf "\n"}}`,
+			`{{ if .Title }}<ac:parameter ac:name="title">{{ .Title }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			`<ac:rich-text-body>{{printf "\n"}}{{ end }}`,
+
+			`<ac:structured-macro ac:name="panel">{{printf "\n"}}`,
+			/**/ `{{ if .Title }}<ac:parameter ac:name="title">{{ .Title }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			/**/ `{{ if .BgColor }}<ac:parameter ac:name="bgColor">{{ .BgColor }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			/**/ `{{ if .BorderColor }}<ac:parameter ac:name="borderColor">{{ .BorderColor }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			/**/ `{{ if .EmojiID }}<ac:parameter ac:name="panelIcon">:{{ .Emoji }}:</ac:parameter>{{printf "\n"}}`,
+			/**/ `<ac:parameter ac:name="panelIconId">{{ .EmojiID }}</ac:parameter>{{printf "\n"}}`,
+			/**/ `<ac:parameter ac:name="panelIconText">{{ .EmojiText }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			/**/ `<ac:rich-text-body>{{printf "\n"}}`,
+			/**/ `{{ .Body }}{{printf "\n"}}`,
+			/**/ `</ac:rich-text-body>{{printf "\n"}}`,
+			`</ac:structured-macro>{{printf "\n"}}`,
+
+			`{{ if .Collapse }}</ac:rich-text-body>{{printf "\n"}}`,
+			`</ac:structured-macro>{{printf "\n"}}{{ end }}`,
+		),
+
 		/* https://confluence.atlassian.com/conf59/table-of-contents-macro-792499210.html */
 
 		`ac:toc`: text(
@@ -172,6 +486,88 @@ func templates(api *confluence.API) (*template.Template, error) {
 			`</ac:structured-macro>{{printf "\n"}}`,
 		),
 
+		/* Expand macro, body is hidden until title is clicked */
+
+		`ac:expand`: text(
+			`<ac:structured-macro ac:name="expand">{{printf "\n"}}`,
+			`{{ if .Title }}<ac:parameter ac:name="title">{{ .Title }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			`<ac:rich-text-body>{{printf "\n"}}`,
+			`{{ .Body }}`,
+			`</ac:rich-text-body>{{printf "\n"}}`,
+			`</ac:structured-macro>{{printf "\n"}}`,
+		),
+
+		/* Table of Contents Zone macro, parameters are the same as of ac:toc */
+
+		`ac:toc:zone`: text(
+			`<ac:structured-macro ac:name="toc-zone">{{printf "\n"}}`,
+			`<ac:parameter ac:name="printable">{{ or .Printable "true" }}</ac:parameter>{{printf "\n"}}`,
+			`<ac:parameter ac:name="style">{{ or .Style "disc" }}</ac:parameter>{{printf "\n"}}`,
+			`<ac:parameter ac:name="maxLevel">{{ or .MaxLevel "7" }}</ac:parameter>{{printf "\n"}}`,
+			`<ac:parameter ac:name="indent">{{ or .Indent "" }}</ac:parameter>{{printf "\n"}}`,
+			`<ac:parameter ac:name="minLevel">{{ or .MinLevel "1" }}</ac:parameter>{{printf "\n"}}`,
+			`<ac:parameter ac:name="exclude">{{ or .Exclude "" }}</ac:parameter>{{printf "\n"}}`,
+			`<ac:parameter ac:name="type">{{ or .Type "list" }}</ac:parameter>{{printf "\n"}}`,
+			`<ac:parameter ac:name="outline">{{ or .Outline "clear" }}</ac:parameter>{{printf "\n"}}`,
+			`<ac:parameter ac:name="include">{{ or .Include "" }}</ac:parameter>{{printf "\n"}}`,
+			`<ac:parameter ac:name="location">{{ or .Location "top" }}</ac:parameter>{{printf "\n"}}`,
+			`<ac:rich-text-body>{{printf "\n"}}`,
+			`{{ .Body }}`,
+			`</ac:rich-text-body>{{printf "\n"}}`,
+			`</ac:structured-macro>{{printf "\n"}}`,
+		),
+
+		/* https://confluence.atlassian.com/doc/children-display-macro-139501.html */
+
+		`ac:children`: text(
+			`<ac:structured-macro ac:name="children">{{printf "\n"}}`,
+			`{{ if .Reverse }}<ac:parameter ac:name="reverse">{{ .Reverse }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			`{{ if .Sort }}<ac:parameter ac:name="sort">{{ .Sort }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			`{{ if .Style }}<ac:parameter ac:name="style">{{ .Style }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			`{{ if .Page }}`,
+			/**/ `<ac:parameter ac:name="page">`,
+			/**/ `<ac:link><ri:page ri:content-title="{{ .Page }}"{{ if .Space }} ri:space-key="{{ .Space }}"{{ end }}/></ac:link>`,
+			/**/ `</ac:parameter>{{printf "\n"}}`,
+			`{{ end }}`,
+			`{{ if .Excerpt }}<ac:parameter ac:name="excerptType">{{ .Excerpt }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			`{{ if .First }}<ac:parameter ac:name="first">{{ .First }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			`{{ if .Depth }}<ac:parameter ac:name="depth">{{ .Depth }}</ac:parameter>{{printf "\n"}}{{ end }}`,
+			`<ac:parameter ac:name="all">{{ or .All false }}</ac:parameter>{{printf "\n"}}`,
+			`</ac:structured-macro>{{printf "\n"}}`,
+		),
+
+		/* https://confluence.atlassian.com/doc/include-page-macro-139514.html */
+
+		`ac:include`: text(
+			`<ac:structured-macro ac:name="include">{{printf "\n"}}`,
+			`<ac:parameter ac:name="">`,
+			`<ac:link><ri:page ri:content-title="{{ .Page }}"{{ if .Space }} ri:space-key="{{ .Space }}"{{ end }}/></ac:link>`,
+			`</ac:parameter>{{printf "\n"}}`,
+			`</ac:structured-macro>{{printf "\n"}}`,
+		),
+
+		/* https://marketplace.atlassian.com/apps/1210882/latex-math-for-confluence */
+
+		`ac:math:inline`: text(
+			`<ac:structured-macro ac:name="mathinline">`,
+			`<ac:parameter ac:name="body">{{ .Body | html }}</ac:parameter>`,
+			`</ac:structured-macro>`,
+		),
+
+		`ac:math:block`: text(
+			`<ac:structured-macro ac:name="mathblock">{{printf "\n"}}`,
+			`<ac:plain-text-body><![CDATA[{{ .Body | cdata }}]]></ac:plain-text-body>{{printf "\n"}}`,
+			`</ac:structured-macro>`,
+		),
+
+		`ac:math:image`: text(
+			`{{ if .Block }}<p style="text-align: center;">{{ end }}`,
+			`<ac:image ac:alt="{{ .Body | html }}">`,
+			`<ri:url ri:value="{{ .URL | html }}{{ .Body | queryescape | html }}"/>`,
+			`</ac:image>`,
+			`{{ if .Block }}</p>{{ end }}`,
+		),
+
 		/* https://confluence.atlassian.com/doc/confluence-storage-format-790796544.html */
 
 		`ac:emoticon`: text(
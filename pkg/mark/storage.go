@@ -0,0 +1,62 @@
+package mark
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/reconquest/pkg/log"
+	bf "github.com/russross/blackfriday/v2"
+)
+
+// RawStorageLanguage is a language of code blocks which contents are passed
+// through to the output as is if raw storage format is enabled.
+const RawStorageLanguage = "confluence"
+
+// renderRawStorage writes contents of the code block as is, contents are
+// expected to be in Confluence storage format, so warning is logged if they
+// are not well-formed XML.
+func (renderer ConfluenceRenderer) renderRawStorage(
+	writer io.Writer,
+	node *bf.Node,
+) bf.WalkStatus {
+	err := validateStorage(
+		bytes.ReplaceAll(node.Literal, []byte("---bf-COLON---"), []byte(":")),
+	)
+	if err != nil {
+		log.Warningf(
+			err,
+			"%s code block is not well-formed XML and may break the page",
+			RawStorageLanguage,
+		)
+	}
+
+	writer.Write(node.Literal)
+
+	return bf.GoToNext
+}
+
+// validateStorage checks that given storage format fragment is well-formed
+// XML. Fragment may contain several top-level elements, namespace prefixes
+// like ac: are not required to be declared and HTML entities are allowed.
+func validateStorage(storage []byte) error {
+	decoder := xml.NewDecoder(io.MultiReader(
+		strings.NewReader("<storage>"),
+		bytes.NewReader(storage),
+		strings.NewReader("</storage>"),
+	))
+
+	decoder.Entity = xml.HTMLEntity
+
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package mark
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/reconquest/pkg/log"
+	bf "github.com/russross/blackfriday/v2"
+)
+
+// reTask matches checkbox which task list item starts with, e.g. [ ] or [x],
+// optionally followed by assignee, e.g. [ ] @alice.
+var reTask = regexp.MustCompile(
+	`^\[([ xX])\](?:[ \t]+|$)(?:@([\w.-]+)(?:[ \t]+|$))?`,
+)
+
+// reTaskDue matches due date which task list item text ends with, e.g.
+// (2024-07-01).
+var reTaskDue = regexp.MustCompile(`[ \t]*\((\d{4}-\d{2}-\d{2})\)[ \t]*$`)
+
+// task is a task list item with its checkbox, assignee and due date removed.
+type task struct {
+	complete bool
+	assignee string
+	due      string
+}
+
+// isTaskList returns true if every item of the list starts with checkbox.
+func isTaskList(list *bf.Node) bool {
+	for item := list.FirstChild; item != nil; item = item.Next {
+		text := getTaskText(item)
+		if text == nil || !reTask.Match(text.Literal) {
+			return false
+		}
+	}
+
+	return list.FirstChild != nil
+}
+
+// getTaskText returns text node which list item starts with or nil if item
+// doesn't start with text.
+func getTaskText(item *bf.Node) *bf.Node {
+	paragraph := item.FirstChild
+	if paragraph == nil || paragraph.Type != bf.Paragraph {
+		return nil
+	}
+
+	text := paragraph.FirstChild
+	if text == nil || text.Type != bf.Text {
+		return nil
+	}
+
+	return text
+}
+
+// parseTask removes checkbox, assignee and due date from the task list item.
+func parseTask(item *bf.Node) task {
+	var (
+		result  task
+		text    = getTaskText(item)
+		matches = reTask.FindSubmatch(text.Literal)
+	)
+
+	result.complete = !bytes.Equal(matches[1], []byte(" "))
+	result.assignee = string(matches[2])
+
+	text.Literal = text.Literal[len(matches[0]):]
+
+	last := item.FirstChild.LastChild
+	if last.Type != bf.Text {
+		return result
+	}
+
+	due := reTaskDue.FindSubmatch(last.Literal)
+	if due == nil {
+		return result
+	}
+
+	_, err := time.Parse("2006-01-02", string(due[1]))
+	if err != nil {
+		log.Warningf(err, "invalid due date of task: %s", due[1])
+
+		return result
+	}
+
+	result.due = string(due[1])
+
+	last.Literal = last.Literal[:len(last.Literal)-len(due[0])]
+
+	return result
+}
+
+// renderTaskList renders list which items start with [ ] or [x] checkboxes as
+// Confluence task list. Assignee which task starts with, e.g. @alice, is
+// rendered as user link and due date which task ends with, e.g.
+// (2024-07-01), is rendered as date.
+func (renderer ConfluenceRenderer) renderTaskList(
+	writer io.Writer,
+	list *bf.Node,
+) bf.WalkStatus {
+	io.WriteString(writer, "<ac:task-list>\n")
+
+	for item := list.FirstChild; item != nil; item = item.Next {
+		task := parseTask(item)
+
+		var body bytes.Buffer
+
+		if task.assignee != "" {
+			renderer.Stdlib.Templates.ExecuteTemplate(
+				&body,
+				"ac:link:user",
+				struct {
+					Name string
+				}{
+					task.assignee,
+				},
+			)
+
+			body.WriteString(" ")
+		}
+
+		for child := item.FirstChild; child != nil; child = child.Next {
+			// first paragraph is the task itself, so it's not wrapped into
+			// <p>, nested blocks are rendered as usual
+			if child == item.FirstChild {
+				renderer.renderInlines(&body, child)
+
+				if task.due != "" {
+					body.WriteString(
+						` <time datetime="` + html.EscapeString(task.due) + `" />`,
+					)
+				}
+
+				continue
+			}
+
+			child.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+				return renderer.RenderNode(&body, node, entering)
+			})
+		}
+
+		renderer.Stdlib.Templates.ExecuteTemplate(
+			writer,
+			"ac:task",
+			struct {
+				Complete bool
+				Body     string
+			}{
+				task.complete,
+				strings.TrimSpace(body.String()),
+			},
+		)
+	}
+
+	io.WriteString(writer, "</ac:task-list>\n")
+
+	return bf.SkipChildren
+}
+
+// renderInlines renders contents of the block without the block itself.
+func (renderer ConfluenceRenderer) renderInlines(
+	writer io.Writer,
+	block *bf.Node,
+) {
+	for child := block.FirstChild; child != nil; child = child.Next {
+		child.Walk(func(node *bf.Node, entering bool) bf.WalkStatus {
+			return renderer.RenderNode(writer, node, entering)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package mark
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/reconquest/karma-go"
+)
+
+// DefaultTitleDateLayout is a layout of {{date}} in page titles if it's not
+// specified, like {{date "January 2006"}}.
+const DefaultTitleDateLayout = "2006-01-02"
+
+// RenderTitle executes title of the page as a template if it contains {{,
+// file is a path of the document which title belongs to. Following functions
+// are available in the template:
+//
+//   - date returns current date, optionally formatted using given layout;
+//   - filename returns name of the file without extension;
+//   - gitref returns current git branch, or commit if HEAD is detached, of
+//     repository containing the file.
+//
+// Literal braces are written as {{"{{"}}.
+func RenderTitle(meta *Meta, file string) error {
+	if meta == nil || !strings.Contains(meta.Title, "{{") {
+		return nil
+	}
+
+	title, err := template.New("title").
+		Funcs(getTitleFuncs(file)).
+		Parse(meta.Title)
+	if err != nil {
+		return karma.Format(err, "unable to parse title %q", meta.Title)
+	}
+
+	var buffer bytes.Buffer
+
+	err = title.Execute(&buffer, nil)
+	if err != nil {
+		return karma.Format(err, "unable to execute title %q", meta.Title)
+	}
+
+	meta.Title = strings.TrimSpace(buffer.String())
+
+	return nil
+}
+
+// ExtractFileMeta extracts metadata of the page kept in given file like
+// ExtractMeta or ExtractMetaTitleFromH1 do and renders its title, see
+// RenderTitle.
+func ExtractFileMeta(
+	data []byte,
+	file string,
+	titleFromH1 bool,
+) (*Meta, []byte, error) {
+	extract := ExtractMeta
+	if titleFromH1 {
+		extract = ExtractMetaTitleFromH1
+	}
+
+	meta, markdown, err := extract(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = RenderTitle(meta, file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return meta, markdown, nil
+}
+
+func getTitleFuncs(file string) template.FuncMap {
+	return template.FuncMap{
+		"date": func(layout ...string) string {
+			if len(layout) == 0 {
+				return time.Now().Format(DefaultTitleDateLayout)
+			}
+
+			return time.Now().Format(strings.Join(layout, " "))
+		},
+
+		"filename": func() string {
+			if file == "" || file == "-" {
+				return ""
+			}
+
+			name := filepath.Base(file)
+
+			return strings.TrimSuffix(name, filepath.Ext(name))
+		},
+
+		"gitref": func() (string, error) {
+			return getGitRef(filepath.Dir(file))
+		},
+	}
+}
+
+// getGitRef returns current branch of git repository containing given
+// directory, or short hash of the current commit if HEAD is detached.
+func getGitRef(dir string) (string, error) {
+	for _, args := range [][]string{
+		{"rev-parse", "--abbrev-ref", "HEAD"},
+		{"rev-parse", "--short", "HEAD"},
+	} {
+		var stderr bytes.Buffer
+
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Stderr = &stderr
+
+		output, err := cmd.Output()
+		if err != nil {
+			return "", karma.
+				Describe("stderr", strings.TrimSpace(stderr.String())).
+				Format(
+					err,
+					"unable to get git ref: git %s",
+					strings.Join(args, " "),
+				)
+		}
+
+		ref := strings.TrimSpace(string(output))
+		if ref != "HEAD" {
+			return ref, nil
+		}
+	}
+
+	return "", nil
+}
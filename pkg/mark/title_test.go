@@ -0,0 +1,48 @@
+package mark
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderTitle(t *testing.T) {
+	test := assert.New(t)
+
+	render := func(title string) (string, error) {
+		meta := &Meta{Title: title}
+
+		err := RenderTitle(meta, "docs/reports/weekly.md")
+
+		return meta.Title, err
+	}
+
+	title, err := render("Weekly Report")
+	test.NoError(err)
+	test.Equal("Weekly Report", title)
+
+	title, err = render("Weekly Report - {{date}}")
+	test.NoError(err)
+	test.Equal(
+		"Weekly Report - "+time.Now().Format(DefaultTitleDateLayout),
+		title,
+	)
+
+	title, err = render(`Report of {{date "January 2006"}}`)
+	test.NoError(err)
+	test.Equal("Report of "+time.Now().Format("January 2006"), title)
+
+	title, err = render("{{filename}}")
+	test.NoError(err)
+	test.Equal("weekly", title)
+
+	title, err = render(`{{"{{"}}literal{{"}}"}} {{filename}}`)
+	test.NoError(err)
+	test.Equal("{{literal}} weekly", title)
+
+	_, err = render("Report {{unknown}}")
+	test.Error(err)
+
+	test.NoError(RenderTitle(nil, "weekly.md"))
+}
@@ -0,0 +1,105 @@
+package mark
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/reconquest/karma-go"
+)
+
+// MirrorTree returns ancestry of the page stored in given file which mirrors
+// directory structure below root: every directory becomes a parent page and
+// every file becomes a child of the page of its directory. Index file of the
+// directory, see ResolveRelativeLinks, is the page of the directory itself,
+// so it becomes a child of the parent directory. Root directory doesn't have
+// a page, files in it are published as top-level pages.
+func MirrorTree(root, file string, indexes []string) ([]string, error) {
+	if len(indexes) == 0 {
+		indexes = DefaultIndexFiles
+	}
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, karma.Format(err, "unable to get absolute path: %s", root)
+	}
+
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return nil, karma.Format(err, "unable to get absolute path: %s", file)
+	}
+
+	relative, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf(
+			"file %q is outside of mirrored directory %q",
+			file,
+			root,
+		)
+	}
+
+	dirs := strings.Split(filepath.Dir(relative), string(filepath.Separator))
+	if dirs[0] == "." {
+		dirs = nil
+	}
+
+	// index file is the page of its directory
+	if len(dirs) > 0 {
+		index, ok := findIndexFile(filepath.Dir(path), indexes)
+		if ok && index == path {
+			dirs = dirs[:len(dirs)-1]
+		}
+	}
+
+	parents := []string{}
+
+	for i := range dirs {
+		dir := filepath.Join(append([]string{root}, dirs[:i+1]...)...)
+
+		title, err := getDirectoryTitle(dir, indexes)
+		if err != nil {
+			return nil, err
+		}
+
+		parents = append(parents, title)
+	}
+
+	return parents, nil
+}
+
+// getDirectoryTitle returns title of the page of the directory, which is
+// taken from metadata or leading H1 heading of the index file if there is
+// one, or directory name otherwise.
+func getDirectoryTitle(dir string, indexes []string) (string, error) {
+	index, ok := findIndexFile(dir, indexes)
+	if ok {
+		contents, err := ioutil.ReadFile(index)
+		if err != nil {
+			return "", karma.Format(err, "read file: %s", index)
+		}
+
+		meta, markdown, err := ExtractFileMeta(
+			SplitPages(contents)[0],
+			index,
+			false,
+		)
+		if err != nil {
+			return "", karma.Format(
+				err,
+				"unable to extract metadata from %q",
+				index,
+			)
+		}
+
+		if meta != nil && meta.Title != "" {
+			return meta.Title, nil
+		}
+
+		if heading := ExtractDocumentLeadingH1(markdown); heading != "" {
+			return heading, nil
+		}
+	}
+
+	return filepath.Base(dir), nil
+}
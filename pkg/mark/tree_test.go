@@ -0,0 +1,58 @@
+package mark
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirrorTree(t *testing.T) {
+	test := assert.New(t)
+
+	base, err := ioutil.TempDir("", "mark")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(base)
+
+	for name, contents := range map[string]string{
+		"README.md":                 "# Docs\n",
+		"intro.md":                  "Intro\n",
+		"guide/README.md":           "<!-- Space: DOC -->\n<!-- Title: User Guide -->\n",
+		"guide/install.md":          "Install\n",
+		"guide/advanced/index.md":   "# Advanced Topics\n",
+		"guide/advanced/tuning.md":  "Tuning\n",
+		"guide/advanced/plain/a.md": "A\n",
+	} {
+		err := os.MkdirAll(filepath.Join(base, filepath.Dir(name)), 0755)
+		if err != nil {
+			panic(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(base, name), []byte(contents), 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	for file, expected := range map[string][]string{
+		"README.md":                 {},
+		"intro.md":                  {},
+		"guide/README.md":           {},
+		"guide/install.md":          {"User Guide"},
+		"guide/advanced/index.md":   {"User Guide"},
+		"guide/advanced/tuning.md":  {"User Guide", "Advanced Topics"},
+		"guide/advanced/plain/a.md": {"User Guide", "Advanced Topics", "plain"},
+	} {
+		parents, err := MirrorTree(base, filepath.Join(base, file), nil)
+		test.NoError(err, file)
+		test.Equal(expected, parents, file)
+	}
+
+	_, err = MirrorTree(filepath.Join(base, "guide"), filepath.Join(base, "intro.md"), nil)
+	test.Error(err)
+}
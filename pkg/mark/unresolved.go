@@ -0,0 +1,126 @@
+package mark
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/bonovoxly/mark/pkg/mark/fence"
+	"github.com/bonovoxly/mark/pkg/mark/macro"
+	"github.com/reconquest/karma-go"
+	"github.com/reconquest/pkg/log"
+)
+
+// reMacroShorthand matches inline macro shorthand like {status:color=Green},
+// known shorthands are replaced by stdlib macros before it's used.
+var reMacroShorthand = regexp.MustCompile(`\{([a-z][a-z0-9-]*):[^{}\n]*\}`)
+
+// UnresolvedMacro is a directive which looks like macro directive, but is not
+// recognized as one and is passed through to the output as is.
+type UnresolvedMacro struct {
+	// Line is a number of the line in the source where directive starts, it's
+	// zero if directive comes from included template.
+	Line int
+
+	// Text is the first line of the directive.
+	Text string
+}
+
+func (unresolved UnresolvedMacro) String() string {
+	if unresolved.Line == 0 {
+		return fmt.Sprintf("included: %s", unresolved.Text)
+	}
+
+	return fmt.Sprintf("line %d: %s", unresolved.Line, unresolved.Text)
+}
+
+// findUnresolvedMacros returns macro-like directives which are left in the
+// markdown after macros are extracted. Markdown doesn't contain metadata and
+// contains expanded includes, so directives are looked up in the source to
+// report their line numbers.
+func findUnresolvedMacros(source, markdown []byte) []UnresolvedMacro {
+	return locateUnresolved(source, markdown, macro.FindUnresolved(markdown))
+}
+
+// findUnknownShorthands returns inline macro shorthands which are left in the
+// markdown after all macros are applied, e.g. {stauts:color=Green}. Code is
+// not searched since objects like {status:200} are common there.
+func findUnknownShorthands(source, markdown []byte) []UnresolvedMacro {
+	return locateUnresolved(
+		source,
+		markdown,
+		reMacroShorthand.FindAllIndex(fence.Mask(markdown), -1),
+	)
+}
+
+// locateUnresolved returns text of the markdown at given locations along with
+// numbers of lines of the source it's found at.
+func locateUnresolved(
+	source []byte,
+	markdown []byte,
+	locations [][]int,
+) []UnresolvedMacro {
+	var (
+		unresolved []UnresolvedMacro
+		offset     int
+	)
+
+	for _, location := range locations {
+		text := bytes.TrimSpace(markdown[location[0]:location[1]])
+
+		directive := UnresolvedMacro{Text: string(text)}
+
+		index := bytes.Index(source[offset:], text)
+		if index >= 0 {
+			offset += index
+
+			directive.Line = bytes.Count(source[:offset], []byte("\n")) + 1
+
+			offset += len(text)
+		}
+
+		unresolved = append(unresolved, directive)
+	}
+
+	return unresolved
+}
+
+// checkUnresolvedMacros logs warning about every unresolved macro directive,
+// or returns them as error if strict is set.
+func checkUnresolvedMacros(source, markdown []byte, strict bool) error {
+	unresolved := findUnresolvedMacros(source, markdown)
+	if len(unresolved) == 0 {
+		return nil
+	}
+
+	if !strict {
+		for _, directive := range unresolved {
+			log.Warningf(nil, "unresolved macro directive at %s", directive)
+		}
+
+		return nil
+	}
+
+	reasons := []karma.Reason{}
+	for _, directive := range unresolved {
+		reasons = append(reasons, directive.String())
+	}
+
+	return karma.Push(
+		fmt.Sprintf("found %d unresolved macro directives", len(unresolved)),
+		reasons...,
+	)
+}
+
+// checkUnknownShorthands logs warning about every unknown inline macro
+// shorthand if strict is set, otherwise they are left as is silently since
+// braces are common in regular text.
+func checkUnknownShorthands(source, markdown []byte, strict bool) {
+	if !strict {
+		return
+	}
+
+	for _, shorthand := range findUnknownShorthands(source, markdown) {
+		log.Warningf(nil, "unknown macro shorthand at %s", shorthand)
+	}
+}
@@ -0,0 +1,105 @@
+package mark
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/reconquest/karma-go"
+)
+
+// Strategies of handling several pages found by FindPageByCQL.
+const (
+	MultipleMatchesError  = "error"
+	MultipleMatchesNewest = "newest"
+)
+
+// ValidateMultipleMatches checks that given strategy of handling several
+// found pages is supported.
+func ValidateMultipleMatches(strategy string) error {
+	switch strategy {
+	case MultipleMatchesError, MultipleMatchesNewest:
+		return nil
+	default:
+		return fmt.Errorf(
+			"unknown multiple matches strategy %q, expected %s or %s",
+			strategy,
+			MultipleMatchesError,
+			MultipleMatchesNewest,
+		)
+	}
+}
+
+// FindPageByCQL looks up page with given title in given space using CQL
+// search. Nil is returned if there is no such page. If several pages are
+// found, either error is returned or the most recently updated page is
+// picked, depending on strategy.
+func FindPageByCQL(
+	ctx context.Context,
+	api *confluence.API,
+	space string,
+	title string,
+	strategy string,
+) (*confluence.PageInfo, error) {
+	cql := fmt.Sprintf("space=%q AND type=page AND title=%q", space, title)
+
+	pages, err := api.SearchByCQL(ctx, cql)
+	if err != nil {
+		return nil, karma.Format(err, "unable to search pages: %s", cql)
+	}
+
+	return selectPage(pages, strategy)
+}
+
+// selectPage returns the only page of given ones or handles several pages
+// according to strategy.
+func selectPage(
+	pages []confluence.PageInfo,
+	strategy string,
+) (*confluence.PageInfo, error) {
+	switch len(pages) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &pages[0], nil
+	}
+
+	if strategy != MultipleMatchesNewest {
+		ids := []string{}
+		for _, page := range pages {
+			ids = append(ids, page.ID)
+		}
+
+		return nil, fmt.Errorf(
+			"%d pages titled %q are found (ids: %v), "+
+				"use page id to specify which one to update",
+			len(pages),
+			pages[0].Title,
+			ids,
+		)
+	}
+
+	var (
+		newest *confluence.PageInfo
+		latest time.Time
+	)
+
+	for i, page := range pages {
+		when, err := time.Parse(time.RFC3339, page.Version.When)
+		if err != nil {
+			return nil, karma.Format(
+				err,
+				"unable to parse update time of page %s: %q",
+				page.ID,
+				page.Version.When,
+			)
+		}
+
+		if newest == nil || when.After(latest) {
+			newest, latest = &pages[i], when
+		}
+	}
+
+	return newest, nil
+}
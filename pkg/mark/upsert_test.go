@@ -0,0 +1,56 @@
+package mark
+
+import (
+	"testing"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectPage(t *testing.T) {
+	test := assert.New(t)
+
+	page := func(id, when string) confluence.PageInfo {
+		var page confluence.PageInfo
+
+		page.ID = id
+		page.Title = "Report"
+		page.Version.When = when
+
+		return page
+	}
+
+	found, err := selectPage(nil, MultipleMatchesError)
+	test.NoError(err)
+	test.Nil(found)
+
+	found, err = selectPage(
+		[]confluence.PageInfo{page("1", "")},
+		MultipleMatchesError,
+	)
+	test.NoError(err)
+	test.Equal("1", found.ID)
+
+	pages := []confluence.PageInfo{
+		page("1", "2021-06-01T10:00:00.000Z"),
+		page("2", "2021-06-03T10:00:00.000+02:00"),
+		page("3", "2021-06-02T10:00:00.000Z"),
+	}
+
+	_, err = selectPage(pages, MultipleMatchesError)
+	test.EqualError(
+		err,
+		`3 pages titled "Report" are found (ids: [1 2 3]), `+
+			`use page id to specify which one to update`,
+	)
+
+	found, err = selectPage(pages, MultipleMatchesNewest)
+	test.NoError(err)
+	test.Equal("2", found.ID)
+
+	_, err = selectPage(
+		[]confluence.PageInfo{page("1", "yesterday"), page("2", "")},
+		MultipleMatchesNewest,
+	)
+	test.Error(err)
+}
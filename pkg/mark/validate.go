@@ -0,0 +1,152 @@
+package mark
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bonovoxly/mark/pkg/confluence"
+	"github.com/reconquest/karma-go"
+)
+
+// Validate checks that relative links of given markdown point to existing
+// files and Confluence pages and that attachment files exist. Confluence is
+// only queried, nothing is changed. Every problem found is returned, error is
+// returned only if check itself has failed. Links to directories are checked
+// against index files, see ResolveRelativeLinks.
+func Validate(
+	ctx context.Context,
+	api *confluence.API,
+	meta *Meta,
+	markdown []byte,
+	base string,
+	indexes []string,
+) ([]error, error) {
+	if len(indexes) == 0 {
+		indexes = DefaultIndexFiles
+	}
+
+	problems := []error{}
+
+	checked := map[string]bool{}
+
+	for _, link := range parseLinks(string(markdown)) {
+		if link.filename == "" || checked[link.filename] {
+			continue
+		}
+
+		checked[link.filename] = true
+
+		problem, err := validateLink(ctx, api, base, indexes, link.filename)
+		if err != nil {
+			return nil, err
+		}
+
+		if problem != "" {
+			problems = append(problems, errors.New(problem))
+		}
+	}
+
+	if meta != nil {
+		names := []string{}
+		for _, name := range meta.Attachments {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			if !strings.ContainsAny(name, "*?[") {
+				_, err := os.Stat(filepath.Join(base, name))
+				if err != nil {
+					problems = append(problems, fmt.Errorf(
+						"attachment %q is not found",
+						name,
+					))
+				}
+
+				continue
+			}
+
+			matches, err := filepath.Glob(
+				filepath.Join(base, filepath.FromSlash(name)),
+			)
+			if err != nil || len(matches) == 0 {
+				problems = append(problems, fmt.Errorf(
+					"attachment pattern %q matches no files",
+					name,
+				))
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// validateLink returns description of the problem if link is broken.
+func validateLink(
+	ctx context.Context,
+	api *confluence.API,
+	base string,
+	indexes []string,
+	filename string,
+) (string, error) {
+	// links to other sites and absolute links to Confluence itself can't be
+	// checked locally
+	target, err := url.Parse(filename)
+	if err != nil || target.Scheme != "" || strings.HasPrefix(filename, "/") {
+		return "", nil
+	}
+
+	path := filepath.Join(base, filename)
+
+	// directories without index file are linked as is
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		index, ok := findIndexFile(path, indexes)
+		if !ok {
+			return "", nil
+		}
+
+		path = index
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Sprintf("link target %q is not found", filename), nil
+		}
+
+		return "", karma.Format(err, "read file: %s", path)
+	}
+
+	if api == nil {
+		return "", nil
+	}
+
+	linkMeta, _, err := ExtractFileMeta(contents, path, false)
+	if err != nil || linkMeta == nil {
+		return "", nil
+	}
+
+	page, err := api.FindPage(ctx, linkMeta.Space, linkMeta.Title, "page")
+	if err != nil {
+		return "", karma.Format(err, "api: find page")
+	}
+
+	if page == nil {
+		return fmt.Sprintf(
+			"page %q linked as %q is not found in space %q",
+			linkMeta.Title,
+			filename,
+			linkMeta.Space,
+		), nil
+	}
+
+	return "", nil
+}
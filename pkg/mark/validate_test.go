@@ -0,0 +1,73 @@
+package mark
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	test := assert.New(t)
+
+	base, err := ioutil.TempDir("", "mark")
+	if err != nil {
+		panic(err)
+	}
+
+	defer os.RemoveAll(base)
+
+	for _, name := range []string{"other.md", "images/a.png", "report.pdf"} {
+		err := os.MkdirAll(filepath.Join(base, filepath.Dir(name)), 0755)
+		if err != nil {
+			panic(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(base, name), []byte(name), 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	problems, err := Validate(
+		context.Background(),
+		nil,
+		&Meta{
+			Attachments: map[string]string{
+				"report.pdf":   "report.pdf",
+				"missing.pdf":  "missing.pdf",
+				"images/*.png": "images/*.png",
+				"images/*.gif": "images/*.gif",
+			},
+		},
+		[]byte(text(
+			"[other](other.md#heading)",
+			"[missing](missing.md)",
+			"[missing again](missing.md)",
+			"[directory](images)",
+			"[external](https://example.com/page.md)",
+			"[absolute](/display/TEST/Page)",
+			"[heading](#heading)",
+		)),
+		base,
+		nil,
+	)
+	test.NoError(err)
+
+	messages := []string{}
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+
+	test.Equal(
+		[]string{
+			`link target "missing.md" is not found`,
+			`attachment pattern "images/*.gif" matches no files`,
+			`attachment "missing.pdf" is not found`,
+		},
+		messages,
+	)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/reconquest/karma-go"
+)
+
+// Statuses of pages in the report.
+const (
+	StatusCreated = "created"
+	StatusUpdated = "updated"
+	StatusSkipped = "skipped"
+	StatusFailed  = "failed"
+)
+
+// PageResult describes outcome of publishing a single page, results of all
+// pages are written to the file specified by --report.
+type PageResult struct {
+	File    string `json:"file"`
+	Space   string `json:"space"`
+	Title   string `json:"title"`
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Version int64  `json:"version"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// writeReport writes results to the file as CSV if it has .csv extension or
+// as JSON otherwise.
+func writeReport(path string, results []PageResult) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return karma.Format(err, "unable to create report file")
+	}
+
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		writer := csv.NewWriter(file)
+
+		err = writer.Write([]string{
+			"file", "space", "title", "id", "url", "version", "status", "error",
+		})
+		if err != nil {
+			return karma.Format(err, "unable to write report")
+		}
+
+		for _, result := range results {
+			err = writer.Write([]string{
+				result.File,
+				result.Space,
+				result.Title,
+				result.ID,
+				result.URL,
+				strconv.FormatInt(result.Version, 10),
+				result.Status,
+				result.Error,
+			})
+			if err != nil {
+				return karma.Format(err, "unable to write report")
+			}
+		}
+
+		writer.Flush()
+
+		err = writer.Error()
+	} else {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+
+		err = encoder.Encode(results)
+	}
+
+	if err != nil {
+		return karma.Format(err, "unable to write report")
+	}
+
+	return file.Close()
+}
+
+// saveReport writes report to the file specified by --report, nothing is
+// done if it's not specified.
+func saveReport(flags Flags, results []PageResult) error {
+	if flags.Report == "" {
+		return nil
+	}
+
+	return writeReport(flags.Report, results)
+}
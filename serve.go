@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bonovoxly/mark/pkg/mark"
+	"github.com/reconquest/pkg/log"
+)
+
+var reCDATA = regexp.MustCompile(`(?s)<!\[CDATA\[(.*?)\]\]>`)
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Roboto, sans-serif; max-width: 960px; margin: 2em auto; padding: 0 1em; color: #172b4d; line-height: 1.5; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #c1c7d0; padding: 4px 8px; }
+pre { background: #f4f5f7; padding: 8px; overflow: auto; }
+ac\:structured-macro { display: block; border-left: 3px solid #0052cc; margin: 8px 0; padding: 4px 8px; background: #f4f5f7; }
+ac\:parameter { display: none; }
+.files a { display: block; }
+</style>
+</head>
+<body>
+{{ if .Files }}
+<div class="files">
+{{ range .Files }}<a href="/?file={{ . }}">{{ . }}</a>
+{{ end }}
+</div>
+{{ else }}
+<h1>{{ .Title }}</h1>
+{{ .Body }}
+<script>
+// reload page when file is changed
+var version = "{{ .Version }}";
+setInterval(function() {
+	fetch("/version?file=" + encodeURIComponent("{{ .File }}"))
+		.then(function(response) { return response.text(); })
+		.then(function(current) {
+			if (current !== version) {
+				location.reload();
+			}
+		});
+}, 1000);
+</script>
+{{ end }}
+</body>
+</html>
+`))
+
+// serve starts HTTP server which renders preview of given files without
+// calling Confluence API, every file is compiled on each request, so changes
+// are always shown.
+func serve(ctx context.Context, files []string, flags Flags) {
+	allowed := map[string]bool{}
+	for _, file := range files {
+		allowed[file] = true
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/version", func(
+		writer http.ResponseWriter,
+		request *http.Request,
+	) {
+		file := request.URL.Query().Get("file")
+		if !allowed[file] {
+			http.NotFound(writer, request)
+
+			return
+		}
+
+		fmt.Fprint(writer, getFileVersion(file))
+	})
+
+	mux.HandleFunc("/", func(
+		writer http.ResponseWriter,
+		request *http.Request,
+	) {
+		file := request.URL.Query().Get("file")
+		if file == "" && len(files) == 1 {
+			file = files[0]
+		}
+
+		if file == "" {
+			err := previewTemplate.Execute(writer, struct {
+				Title string
+				Files []string
+			}{
+				Title: "mark preview",
+				Files: files,
+			})
+			if err != nil {
+				log.Error(err)
+			}
+
+			return
+		}
+
+		if !allowed[file] {
+			http.NotFound(writer, request)
+
+			return
+		}
+
+		version := getFileVersion(file)
+
+		body, title, err := renderPreview(request.Context(), file, flags)
+		if err != nil {
+			log.Errorf(err, "unable to render preview of %q", file)
+
+			body = "<pre>" + html.EscapeString(err.Error()) + "</pre>"
+		}
+
+		err = previewTemplate.Execute(writer, struct {
+			Title   string
+			File    string
+			Files   []string
+			Version string
+			Body    template.HTML
+		}{
+			Title:   title,
+			File:    file,
+			Version: version,
+			Body:    template.HTML(body),
+		})
+		if err != nil {
+			log.Error(err)
+		}
+	})
+
+	server := &http.Server{
+		Addr:    flags.Listen,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		server.Close()
+	}()
+
+	log.Infof(nil, "serving preview at http://%s/", flags.Listen)
+
+	err := server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// renderPreview compiles given file and returns resulting HTML which code
+// blocks are made visible in browser, along with the page title.
+func renderPreview(
+	ctx context.Context,
+	file string,
+	flags Flags,
+) (string, string, error) {
+	source, err := readFile(file)
+	if err != nil {
+		return "", "", err
+	}
+
+	var (
+		bodies []string
+		title  = file
+	)
+
+	leading, err := getLeadingHeading(flags)
+	if err != nil {
+		return "", "", err
+	}
+
+	// pages of multi-page file are shown one after another
+	for i, section := range mark.SplitPages(source) {
+		body, meta, err := mark.Compile(
+			ctx,
+			section,
+			mark.Options{
+				CompileOptions: mark.CompileOptions{
+					AnchorStyle:    flags.HeadingAnchors,
+					Math:           flags.Math,
+					MathImageURL:   flags.MathImageURL,
+					DetectLanguage: flags.DetectLanguage,
+					HTML:           flags.HTML,
+					SoftBreaks:     flags.SoftBreaks,
+					RawStorage:     flags.RawStorage,
+					CollapseCode:   flags.CollapseCode,
+				},
+				File:           file,
+				TitleFromH1:    flags.TitleFromH1,
+				LeadingHeading: leading,
+				TemplatesDir:   flags.TemplatesDir,
+				EnvSubst:       flags.EnvSubst,
+				StrictMacros:   flags.StrictMacros,
+			},
+		)
+		if err != nil {
+			return "", "", err
+		}
+
+		if meta != nil {
+			if i == 0 {
+				title = meta.Title
+			} else {
+				body = "<h1>" + html.EscapeString(meta.Title) + "</h1>\n" + body
+			}
+		}
+
+		bodies = append(bodies, body)
+	}
+
+	body := strings.Join(bodies, "<hr>\n")
+
+	// CDATA sections are not displayed by browsers
+	body = reCDATA.ReplaceAllStringFunc(body, func(match string) string {
+		text := reCDATA.FindStringSubmatch(match)[1]
+
+		return "<pre>" + html.EscapeString(text) + "</pre>"
+	})
+
+	return body, title, nil
+}
+
+// getFileVersion returns modification time of the file which is used to
+// detect changes.
+func getFileVersion(file string) string {
+	info, err := os.Stat(file)
+	if err != nil {
+		return ""
+	}
+
+	return strconv.FormatInt(info.ModTime().UnixNano(), 10)
+}